@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/horazont/dragonstash/internal/cache"
+	"github.com/horazont/dragonstash/internal/control"
+)
+
+func ctlUsage(flags *flag.FlagSet) {
+	fmt.Printf("usage: %s ctl [options] SOCKET COMMAND [ARGS...]\n", path.Base(os.Args[0]))
+	fmt.Printf("\nSOCKET is the control socket of a mount or the CACHE directory\n")
+	fmt.Printf("of a mount which uses the default socket.\n")
+	fmt.Printf("\ncommands:\n")
+	fmt.Printf("  status                    show the state of source and cache\n")
+	fmt.Printf("  quota                     show the limits and usage of the cache\n")
+	fmt.Printf("  set-quota                 change the limits given by -quota and -inode-quota\n")
+	fmt.Printf("  fetch PATH                fetch PATH and everything below it into the cache\n")
+	fmt.Printf("  prefetch PATH             fetch PATH and everything below it in the background\n")
+	fmt.Printf("  prefetch-cancel PATH      stop the background prefetch of PATH\n")
+	fmt.Printf("  prefetch-status           show the progress of background prefetches\n")
+	fmt.Printf("  evict PATH                drop the cached data below PATH\n")
+	fmt.Printf("  pin PATH                  never evict PATH and everything below it\n")
+	fmt.Printf("  unpin PATH                allow PATH and everything below it to be evicted\n")
+	fmt.Printf("  source online|offline|auto  force the state of the source or lift the override\n")
+	fmt.Printf("\noptions:\n")
+	flags.PrintDefaults()
+	os.Exit(2)
+}
+
+func ctl(args []string) {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	quota := sizeValue(0)
+	flags.Var(&quota, "quota", "new maximum size of cached file contents for set-quota (0 means unlimited)")
+	inodeQuota := flags.Uint64("inode-quota", 0, "new maximum number of cached inodes for set-quota (0 means unlimited)")
+	flags.Usage = func() {
+		ctlUsage(flags)
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+	}
+
+	socket_path := flags.Arg(0)
+	if info, err := os.Stat(socket_path); err == nil && info.IsDir() {
+		socket_path = path.Join(socket_path, "control.sock")
+	}
+	command := flags.Arg(1)
+	command_args := flags.Args()[2:]
+
+	needArgs := func(n int) {
+		if len(command_args) != n {
+			flags.Usage()
+		}
+	}
+
+	client, err := control.Dial(socket_path)
+	if err != nil {
+		fmt.Printf("Cannot connect to %s: %s\n", socket_path, err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	switch command {
+	case "status":
+		needArgs(0)
+		var status *control.StatusReply
+		status, err = client.Status()
+		if err == nil {
+			forced := ""
+			if status.SourceForced {
+				forced = " (forced)"
+			}
+			fmt.Printf("source:     %s%s\n", status.SourceState, forced)
+			fmt.Printf("blocks:     %d / %d\n", status.BlocksUsed, status.BlocksTotal)
+			fmt.Printf("inodes:     %d / %d\n", status.InodesUsed, status.InodesTotal)
+			fmt.Printf("open files: %d\n", status.OpenFiles)
+		}
+	case "quota":
+		needArgs(0)
+		var quota *control.QuotaReply
+		quota, err = client.GetQuota()
+		if err == nil {
+			fmt.Printf("block size: %d\n", quota.BlockSize)
+			fmt.Printf("blocks:     %d / %d (%d pinned)\n", quota.BlocksUsed, quota.BlocksTotal, quota.BlocksPinned)
+			fmt.Printf("inodes:     %d / %d (%d pinned)\n", quota.InodesUsed, quota.InodesTotal, quota.InodesPinned)
+		}
+	case "set-quota":
+		needArgs(0)
+		quota_args := &control.SetQuotaArgs{}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "quota":
+				var block_size int64 = 1
+				var reply *control.QuotaReply
+				reply, err = client.GetQuota()
+				if err == nil {
+					block_size = reply.BlockSize
+				}
+				blocks := (uint64(quota) + uint64(block_size) - 1) / uint64(block_size)
+				quota_args.Blocks = &blocks
+			case "inode-quota":
+				quota_args.Inodes = inodeQuota
+			}
+		})
+		if err == nil {
+			err = client.SetQuota(quota_args)
+		}
+	case "fetch":
+		needArgs(1)
+		var reply *control.FetchReply
+		reply, err = client.Fetch(command_args[0])
+		if err == nil {
+			fmt.Printf("fetched %d files (%d bytes), %d failed\n", reply.Files, reply.Bytes, reply.Failed)
+		}
+	case "prefetch":
+		needArgs(1)
+		err = client.Prefetch(command_args[0])
+	case "prefetch-cancel":
+		needArgs(1)
+		err = client.CancelPrefetch(command_args[0])
+	case "prefetch-status":
+		needArgs(0)
+		var prefetches []cache.PrefetchProgress
+		prefetches, err = client.PrefetchProgress()
+		for _, progress := range prefetches {
+			state := "done"
+			switch {
+			case progress.Cancelled:
+				state = "cancelled"
+			case progress.Scanning:
+				state = "scanning"
+			case progress.Running:
+				state = "running"
+			}
+			fmt.Printf("%s: %s, %d/%d files, %d/%d bytes, %d failed\n",
+				progress.Path, state,
+				progress.FilesDone, progress.FilesTotal,
+				progress.BytesDone, progress.BytesTotal,
+				progress.Failed)
+		}
+	case "evict":
+		needArgs(1)
+		var reply *control.EvictReply
+		reply, err = client.Evict(command_args[0])
+		if err == nil {
+			fmt.Printf("evicted %d blocks\n", reply.Blocks)
+		}
+	case "pin":
+		needArgs(1)
+		err = client.Pin(command_args[0])
+	case "unpin":
+		needArgs(1)
+		err = client.Unpin(command_args[0])
+	case "source":
+		needArgs(1)
+		err = client.SetSourceState(command_args[0])
+	default:
+		flags.Usage()
+	}
+
+	if err != nil {
+		fmt.Printf("%s: %s\n", command, err)
+		os.Exit(1)
+	}
+}
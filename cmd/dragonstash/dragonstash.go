@@ -8,6 +8,8 @@ import (
 	"os/signal"
 	"path"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,9 +17,13 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/horazont/dragonstash/internal/cache"
+	"github.com/horazont/dragonstash/internal/control"
+	"github.com/horazont/dragonstash/internal/failover"
 	"github.com/horazont/dragonstash/internal/filecache"
 	"github.com/horazont/dragonstash/internal/frontend"
+	"github.com/horazont/dragonstash/internal/health"
 	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/horazont/dragonstash/internal/s3fs"
 )
 
 func writeMemProfile(fn string, sigs <-chan os.Signal) {
@@ -39,14 +45,103 @@ func writeMemProfile(fn string, sigs <-chan os.Signal) {
 	}
 }
 
+type sizeValue uint64
+
+func (m *sizeValue) String() string {
+	return fmt.Sprintf("%d", uint64(*m))
+}
+
+// Parse a size in bytes with an optional K, M, G or T (binary) suffix
+func (m *sizeValue) Set(value string) error {
+	multiplier := uint64(1)
+	if len(value) > 0 {
+		switch strings.ToUpper(value[len(value)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	*m = sizeValue(parsed * multiplier)
+	return nil
+}
+
+func usage() {
+	fmt.Printf("usage: %s COMMAND [options] ARGS...\n", path.Base(os.Args[0]))
+	fmt.Printf("\ncommands:\n")
+	fmt.Printf("  mount    mount SOURCE at MOUNTPOINT, caching in CACHE\n")
+	fmt.Printf("  ctl      control a running mount through its control socket\n")
+	os.Exit(2)
+}
+
 func main() {
-	cpuprofile := flag.String("profile", "", "record cpu profile.")
-	memprofile := flag.String("mem-profile", "", "record memory profile.")
-	flag.Parse()
-	if flag.NArg() < 3 {
-		fmt.Printf("usage: %s SOURCE CACHE MOUNTPOINT\n", path.Base(os.Args[0]))
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "mount":
+		mount(os.Args[2:])
+	case "ctl":
+		ctl(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func mount(args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	cpuprofile := flags.String("profile", "", "record cpu profile.")
+	memprofile := flags.String("mem-profile", "", "record memory profile.")
+	quota := sizeValue(0)
+	flags.Var(&quota, "quota", "maximum size of cached file contents, with optional K/M/G/T suffix (0 means unlimited)")
+	inodeQuota := flags.Uint64("inode-quota", 0, "maximum number of cached files, directories and links (0 means unlimited)")
+	agingInterval := flags.Duration("aging-interval", time.Hour, "interval at which the access counters of cached blocks are halved (0 disables aging)")
+	attrTimeout := flags.Duration("attr-timeout", time.Second, "time for which the kernel caches attributes")
+	entryTimeout := flags.Duration("entry-timeout", time.Second, "time for which the kernel caches directory entries")
+	negativeTimeout := flags.Duration("negative-timeout", time.Second, "time for which the kernel caches failed lookups")
+	allowOther := flags.Bool("allow-other", false, "allow other users to access the mount")
+	fsName := flags.String("fsname", "", "file system name shown in mtab (defaults to SOURCE)")
+	debug := flags.Bool("debug", false, "print FUSE debug output")
+	readOnly := flags.Bool("read-only", false, "mount read-only")
+	conflictPolicy := flags.String("conflict-policy", cache.CONFLICT_KEEP_BOTH.String(), "how to handle offline modifications of files which changed on the source: keep-both, cache-wins, source-wins or refuse")
+	readAhead := flags.String("read-ahead", cache.READAHEAD_DOUBLING, "how far to read ahead of sequential reads: off, fixed, doubling or whole-file")
+	readAheadSize := sizeValue(4 << 20)
+	flags.Var(&readAheadSize, "read-ahead-size", "window of fixed read-ahead, maximum window of doubling read-ahead or maximum file size of whole-file read-ahead, with optional K/M/G/T suffix")
+	prefetchConcurrency := flags.Int("prefetch-concurrency", 4, "number of files fetched at the same time by background prefetches")
+	controlSocket := flags.String("control-socket", "", "path of the control socket (defaults to control.sock in CACHE)")
+	offlineLocks := flags.Bool("offline-locks", false, "emulate locks while the source is unavailable (unsafe: other clients of the source do not see them)")
+	srcOpts := &sourceOptions{}
+	flags.Var(&srcOpts.identityFiles, "identity", "private key file for sftp sources (may be given multiple times)")
+	flags.BoolVar(&srcOpts.useAgent, "ssh-agent", true, "use the SSH agent for sftp sources")
+	flags.StringVar(&srcOpts.knownHostsFile, "known-hosts", "", "known_hosts file for sftp sources (defaults to ~/.ssh/known_hosts)")
+	flags.StringVar(&srcOpts.s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "service URL for s3 sources")
+	flags.StringVar(&srcOpts.s3Region, "s3-region", s3fs.DEFAULT_REGION, "region used to sign requests for s3 sources")
+	flags.Usage = func() {
+		fmt.Printf("usage: %s mount [options] SOURCE... CACHE MOUNTPOINT\n", path.Base(os.Args[0]))
+		fmt.Printf("\nSOURCE is a URL: file:///path, sftp://[user@]host[:port]/path,\n")
+		fmt.Printf("http(s)://[user:password@]host[:port]/path or s3://bucket/prefix;\n")
+		fmt.Printf("prefix it with archive+ to use a tar or zip file at the URL\n")
+		fmt.Printf("If multiple sources are given, they must provide the same tree;\n")
+		fmt.Printf("the first available one is used.\n")
 		fmt.Printf("\noptions:\n")
-		flag.PrintDefaults()
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 3 {
+		flags.Usage()
 		os.Exit(2)
 	}
 	if *cpuprofile != "" {
@@ -72,23 +167,116 @@ func main() {
 		)
 	}
 
-	cachedir := flag.Arg(1)
-	mountpoint := flag.Arg(2)
+	policy, err := cache.ParseConflictPolicy(*conflictPolicy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	read_ahead, err := cache.NewReadAheadStrategy(*readAhead, int64(readAheadSize))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
 
-	filecache := filecache.NewFileCache(cachedir)
-	filecache.SetBlocksTotal(16)
+	sources := flags.Args()[:flags.NArg()-2]
+	cachedir := flags.Arg(flags.NArg() - 2)
+	mountpoint := flags.Arg(flags.NArg() - 1)
+
+	var back_fs layer.FileSystem
+	if len(sources) == 1 {
+		fs, err := openSource(sources[0], srcOpts)
+		if err != nil {
+			fmt.Printf("Cannot open source %s: %s\n", sources[0], err)
+			os.Exit(1)
+		}
+		back_fs = fs
+	} else {
+		monitored := make([]layer.FileSystem, len(sources))
+		for i, source := range sources {
+			fs, err := openSource(source, srcOpts)
+			if err != nil {
+				fmt.Printf("Cannot open source %s: %s\n", source, err)
+				os.Exit(1)
+			}
+			source_monitor := health.NewMonitor(fs, health.DefaultConfig())
+			source_monitor.Start()
+			defer source_monitor.Stop()
+			monitored[i] = source_monitor
+		}
+		back_fs = failover.NewFailoverFileSystem(monitored...)
+	}
+
+	quota_blocks := (uint64(quota) + filecache.BLOCK_SIZE - 1) / filecache.BLOCK_SIZE
+	filecache, err := filecache.NewFileCache(cachedir)
+	if err != nil {
+		fmt.Printf("Cannot open cache %s: %s\n", cachedir, err)
+		os.Exit(1)
+	}
+	filecache.SetBlocksTotal(quota_blocks)
+	filecache.SetInodesTotal(*inodeQuota)
+	if *agingInterval > 0 {
+		filecache.StartAging(*agingInterval)
+		defer filecache.StopAging()
+	}
+
+	monitor := health.NewMonitor(back_fs, health.DefaultConfig())
+	monitor.Start()
+	defer monitor.Stop()
+
+	cache_layer := cache.NewCacheLayer(filecache, monitor)
+	cache_layer.SetReadAhead(read_ahead)
+	if !*readOnly {
+		journal, err := cache.OpenJournal(path.Join(cachedir, "journal"))
+		if err != nil {
+			fmt.Printf("Cannot open journal: %s\n", err)
+			os.Exit(1)
+		}
+		defer journal.Close()
+		cache_layer.SetJournal(journal)
+		cache_layer.SetConflictPolicy(policy)
+		cache_layer.SetOfflineLocking(*offlineLocks)
+
+		// write back offline modifications as soon as the source is back
+		events := monitor.Subscribe()
+		go func() {
+			for event := range events {
+				if event.State == health.STATE_ONLINE {
+					cache_layer.Replay()
+				}
+			}
+		}()
+	}
+
+	prefetcher := cache.NewPrefetcher(
+		cache_layer,
+		path.Join(cachedir, "prefetch"),
+		*prefetchConcurrency,
+	)
+	if err := prefetcher.Resume(); err != nil {
+		fmt.Printf("Cannot resume prefetches: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *controlSocket == "" {
+		*controlSocket = path.Join(cachedir, "control.sock")
+	}
+	control_server, err := control.Listen(
+		*controlSocket,
+		control.NewControlV1(filecache, monitor, cache_layer, prefetcher),
+	)
+	if err != nil {
+		fmt.Printf("Cannot create control socket: %s\n", err)
+		os.Exit(1)
+	}
+	defer control_server.Close()
 
-	// back_fs := localfs.NewLocalFileSystem(flag.Arg(0))
-	back_fs := layer.NewDefaultFileSystem()
-	cache_layer := cache.NewCacheLayer(filecache, back_fs)
 	front_fs := frontend.NewDragonStashFS(cache_layer)
+	front_fs.SetControl(control.NewLocal(filecache, monitor, cache_layer))
 
 	opts := &nodefs.Options{
-		// These options are to be compatible with libfuse defaults,
-		// making benchmarking easier.
-		NegativeTimeout: time.Second,
-		AttrTimeout:     time.Second,
-		EntryTimeout:    time.Second,
+		NegativeTimeout: *negativeTimeout,
+		AttrTimeout:     *attrTimeout,
+		EntryTimeout:    *entryTimeout,
 	}
 	// Enable ClientInodes so hard links work
 	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
@@ -96,11 +284,17 @@ func main() {
 
 	conn := nodefs.NewFileSystemConnector(pathFs.Root(), opts)
 
+	if *fsName == "" {
+		*fsName = sources[0]
+	}
 	mOpts := &fuse.MountOptions{
-		AllowOther: false,
-		Name:       "test",
-		FsName:     "test",
-		Debug:      true,
+		AllowOther: *allowOther,
+		Name:       "dragonstash",
+		FsName:     *fsName,
+		Debug:      *debug,
+	}
+	if *readOnly {
+		mOpts.Options = append(mOpts.Options, "ro")
 	}
 	state, err := fuse.NewServer(conn.RawFS(), mountpoint, mOpts)
 	if err != nil {
@@ -111,5 +305,6 @@ func main() {
 	fmt.Println("Mounted!")
 	state.Serve()
 
+	prefetcher.Close()
 	filecache.Close()
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/horazont/dragonstash/internal/archivefs"
+	"github.com/horazont/dragonstash/internal/httpfs"
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/horazont/dragonstash/internal/localfs"
+	"github.com/horazont/dragonstash/internal/s3fs"
+	"github.com/horazont/dragonstash/internal/sftp"
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported source URL scheme")
+)
+
+type sourceOptions struct {
+	identityFiles  stringList
+	useAgent       bool
+	knownHostsFile string
+	s3Endpoint     string
+	s3Region       string
+}
+
+// A flag.Value which collects all occurences of a flag
+type stringList []string
+
+func (m *stringList) String() string {
+	return fmt.Sprintf("%v", *m)
+}
+
+func (m *stringList) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+// Create the source file system described by a URL
+//
+// Supported are file:///path (a path without scheme is treated the same),
+// sftp://[user@]host[:port]/path, http(s)://[user:password@]host[:port]/path
+// and s3://[access_key:secret_key@]bucket/prefix.
+//
+// Prefixing any of these with archive+ (e.g. archive+file:///path/to/a.zip)
+// uses the tar or zip archive at the URL as source.
+func openSource(source string, opts *sourceOptions) (layer.FileSystem, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(u.Scheme, "archive+") {
+		return openArchiveSource(strings.TrimPrefix(source, "archive+"), opts)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("file URL must not have a host: %s", source)
+		}
+		return localfs.NewLocalFileSystem(u.Path), nil
+	case "sftp":
+		return openSFTPSource(u, opts)
+	case "http", "https":
+		return httpfs.NewHTTPFileSystem(u, nil), nil
+	case "s3":
+		return openS3Source(u, opts)
+	}
+
+	return nil, ErrUnsupportedScheme
+}
+
+func openSFTPSource(u *url.URL, opts *sourceOptions) (layer.FileSystem, error) {
+	config := &sftp.Config{
+		Host:           u.Hostname(),
+		Root:           u.Path,
+		IdentityFiles:  opts.identityFiles,
+		UseAgent:       opts.useAgent,
+		KnownHostsFile: opts.knownHostsFile,
+	}
+
+	if u.User != nil {
+		config.User = u.User.Username()
+	} else {
+		config.User = os.Getenv("USER")
+	}
+
+	if port := u.Port(); port != "" {
+		parsed, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", port)
+		}
+		config.Port = int(parsed)
+	}
+
+	return sftp.NewSFTPFileSystem(config)
+}
+
+func openS3Source(u *url.URL, opts *sourceOptions) (layer.FileSystem, error) {
+	config := &s3fs.Config{
+		Endpoint:  opts.s3Endpoint,
+		Region:    opts.s3Region,
+		Bucket:    u.Host,
+		Prefix:    u.Path,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+
+	if u.User != nil {
+		config.AccessKey = u.User.Username()
+		config.SecretKey, _ = u.User.Password()
+	}
+
+	return s3fs.NewS3FileSystem(config)
+}
+
+func openArchiveSource(source string, opts *sourceOptions) (layer.FileSystem, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// open the directory containing the archive as source
+	name := path.Base(u.Path)
+	u.Path = path.Dir(u.Path)
+	u.RawPath = ""
+	container, err := openSource(u.String(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return archivefs.NewArchiveFileSystem(container, "/"+name)
+}
@@ -0,0 +1,495 @@
+package archivefs
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// ArchiveFileSystem is a read-only source whose tree is the contents of a tar
+// or zip archive.
+//
+// The archive itself is read through another layer.FileSystem. An index of
+// all entries is built when the ArchiveFileSystem is created, or on first use
+// if the source is unavailable at that time; metadata operations are served
+// from that index without accessing the archive.
+//
+// File contents are read on demand. Tar entries and zip entries which are
+// stored uncompressed are read directly from their offset in the archive.
+// Compressed zip entries are decompressed sequentially; seeking backwards
+// restarts decompression at the beginning of the entry.
+//
+// The archive is reopened if reading it fails because the source became
+// unavailable, as the handle may not survive e.g. a reconnect of the source.
+//
+// Only regular files, directories and symlinks are supported; other entries
+// are skipped. Directories which are not in the archive, but which are needed
+// to reach an entry, are created with the attributes of the root.
+type ArchiveFileSystem struct {
+	layer.ReadOnlyFileSystem
+	src    layer.FileSystem
+	path   string
+	reader *archiveReaderAt
+
+	// protects archive; held for reading while the archive is read
+	lock    sync.RWMutex
+	archive layer.File
+
+	index_lock sync.Mutex
+	index      *index
+}
+
+// Open the archive at path in src and build its index.
+//
+// If the source is unavailable, the index is built once it is needed and
+// the source is back. The archive is kept open until Close is called.
+func NewArchiveFileSystem(src layer.FileSystem, path string) (*ArchiveFileSystem, error) {
+	result := &ArchiveFileSystem{
+		src:  src,
+		path: path,
+	}
+	result.reader = &archiveReaderAt{result}
+
+	if _, err := result.loadIndex(); err != nil {
+		if lerr, ok := err.(layer.Error); !ok || !layer.IsUnavailableError(lerr) {
+			result.Close()
+			return nil, err
+		}
+		log.Printf("archive %s is unavailable, indexing it later: %s", path, err)
+	}
+	return result, nil
+}
+
+// Return the index, building it first if needed.
+func (m *ArchiveFileSystem) loadIndex() (*index, error) {
+	m.index_lock.Lock()
+	defer m.index_lock.Unlock()
+
+	if m.index != nil {
+		return m.index, nil
+	}
+
+	stat, err := m.src.Lstat(m.path)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &ArchiveFileStat{
+		mode:  syscall.S_IFDIR | 0555,
+		mtime: time.Unix(int64(stat.Mtime()), int64(stat.MtimeNsec())),
+		atime: time.Unix(int64(stat.Atime()), int64(stat.AtimeNsec())),
+		ctime: time.Unix(int64(stat.Ctime()), int64(stat.CtimeNsec())),
+		uid:   stat.OwnerUID(),
+		gid:   stat.OwnerGID(),
+	}
+
+	index, indexerr := buildIndex(m.reader, int64(stat.Size()), root)
+	if indexerr != nil {
+		return nil, indexerr
+	}
+	m.index = index
+	return index, nil
+}
+
+// Like loadIndex, for operations which have to return a layer.Error.
+func (m *ArchiveFileSystem) getIndex() (*index, layer.Error) {
+	index, err := m.loadIndex()
+	if err != nil {
+		if lerr, ok := err.(layer.Error); ok {
+			return nil, lerr
+		}
+		log.Printf("cannot index archive %s: %s", m.path, err)
+		return nil, layer.WrapError(syscall.EIO)
+	}
+	return index, nil
+}
+
+// Read from the archive, opening it first if needed.
+//
+// If the read fails because the source is unavailable, the handle is dropped
+// and the read is tried once more with a new handle: the source may be back,
+// but not the handle.
+func (m *ArchiveFileSystem) readArchive(dest []byte, position int64) (int, layer.Error) {
+	n, err := m.tryReadArchive(dest, position)
+	if err != nil && layer.IsUnavailableError(err) {
+		n, err = m.tryReadArchive(dest, position)
+	}
+	return n, err
+}
+
+func (m *ArchiveFileSystem) tryReadArchive(dest []byte, position int64) (int, layer.Error) {
+	if err := m.openArchive(); err != nil {
+		return 0, err
+	}
+
+	m.lock.RLock()
+	archive := m.archive
+	if archive == nil {
+		// dropped by a concurrent read in the meantime
+		m.lock.RUnlock()
+		return 0, layer.WrapError(syscall.ENOTCONN)
+	}
+	n, err := archive.Read(dest, position)
+	m.lock.RUnlock()
+
+	if err != nil && layer.IsUnavailableError(err) {
+		m.dropArchive(archive)
+	}
+	return n, err
+}
+
+func (m *ArchiveFileSystem) openArchive() layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.archive != nil {
+		return nil
+	}
+	archive, err := m.src.OpenFile(m.path, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	m.archive = archive
+	return nil
+}
+
+// Release the handle, unless it has been replaced already.
+func (m *ArchiveFileSystem) dropArchive(archive layer.File) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.archive == archive {
+		m.archive.Release()
+		m.archive = nil
+	}
+}
+
+// Release the archive file.
+func (m *ArchiveFileSystem) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.archive != nil {
+		m.archive.Release()
+		m.archive = nil
+	}
+}
+
+// Return whether the archive can be read.
+//
+// The file system holding the archive being ready is not enough: the handle
+// may have been lost with the connection, or the archive may not have been
+// indexed yet.
+func (m *ArchiveFileSystem) IsReady() bool {
+	if !m.src.IsReady() {
+		return false
+	}
+	if _, err := m.getIndex(); err != nil {
+		return false
+	}
+	buf := make([]byte, 1)
+	_, err := m.readArchive(buf, 0)
+	return err == nil
+}
+
+func (m *ArchiveFileSystem) Join(elems ...string) string {
+	return path.Join(elems...)
+}
+
+func (m *ArchiveFileSystem) Lstat(p string) (layer.FileStat, layer.Error) {
+	index, err := m.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	e, err := index.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return &e.stat, nil
+}
+
+func (m *ArchiveFileSystem) OpenDir(p string) ([]layer.DirEntry, layer.Error) {
+	index, err := m.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	e, err := index.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.stat.mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, layer.WrapError(syscall.ENOTDIR)
+	}
+
+	name := cleanName(p)
+	entries := make([]layer.DirEntry, len(e.children))
+	for i, child_name := range e.children {
+		child := index.entries[name+"/"+child_name]
+		entries[i] = &ArchiveDirEntry{
+			name: child_name,
+			stat: &child.stat,
+		}
+	}
+	return entries, nil
+}
+
+func (m *ArchiveFileSystem) Readlink(p string) (string, layer.Error) {
+	index, err := m.getIndex()
+	if err != nil {
+		return "", err
+	}
+	e, err := index.lookup(p)
+	if err != nil {
+		return "", err
+	}
+	if !isSymlink(e) {
+		return "", layer.WrapError(syscall.EINVAL)
+	}
+	if e.linkname != "" {
+		return e.linkname, nil
+	}
+
+	// zip stores the target of a symlink as its contents
+	f := m.openEntry(e)
+	defer f.Release()
+	buf := make([]byte, e.stat.size)
+	n, err := f.Read(buf, 0)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func (m *ArchiveFileSystem) OpenFile(p string, flags int) (layer.File, layer.Error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, layer.WrapError(syscall.EROFS)
+	}
+
+	index, err := m.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	e, err := index.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	switch e.stat.mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+	case syscall.S_IFDIR:
+		return nil, layer.WrapError(syscall.EISDIR)
+	default:
+		return nil, layer.WrapError(syscall.EINVAL)
+	}
+
+	return m.openEntry(e), nil
+}
+
+func (m *ArchiveFileSystem) openEntry(e *entry) layer.File {
+	if e.zipfile != nil {
+		return &compressedFile{
+			entry: e,
+			lock:  &sync.Mutex{},
+		}
+	}
+	return &storedFile{
+		reader: m.reader,
+		offset: e.offset,
+		size:   int64(e.stat.size),
+	}
+}
+
+type ArchiveDirEntry struct {
+	name string
+	stat *ArchiveFileStat
+}
+
+func (m *ArchiveDirEntry) Name() string {
+	return m.name
+}
+
+func (m *ArchiveDirEntry) Mode() uint32 {
+	return m.stat.Mode()
+}
+
+func (m *ArchiveDirEntry) Stat() layer.FileStat {
+	return m.stat
+}
+
+// Zip does not store owners; files in zip archives are owned by the owner of
+// the archive.
+type ArchiveFileStat struct {
+	mode  uint32
+	size  uint64
+	mtime time.Time
+	atime time.Time
+	ctime time.Time
+	uid   uint32
+	gid   uint32
+}
+
+func (m *ArchiveFileStat) Mtime() uint64 {
+	return uint64(m.mtime.Unix())
+}
+
+func (m *ArchiveFileStat) Atime() uint64 {
+	return uint64(orMtime(m.atime, m.mtime).Unix())
+}
+
+func (m *ArchiveFileStat) Ctime() uint64 {
+	return uint64(orMtime(m.ctime, m.mtime).Unix())
+}
+
+func (m *ArchiveFileStat) MtimeNsec() uint32 {
+	return uint32(m.mtime.Nanosecond())
+}
+
+func (m *ArchiveFileStat) AtimeNsec() uint32 {
+	return uint32(orMtime(m.atime, m.mtime).Nanosecond())
+}
+
+func (m *ArchiveFileStat) CtimeNsec() uint32 {
+	return uint32(orMtime(m.ctime, m.mtime).Nanosecond())
+}
+
+func (m *ArchiveFileStat) Ino() uint64 {
+	return 0
+}
+
+func (m *ArchiveFileStat) Nlink() uint32 {
+	return 1
+}
+
+func (m *ArchiveFileStat) Rdev() uint64 {
+	return 0
+}
+
+func (m *ArchiveFileStat) Blocks() uint64 {
+	return (m.size + 511) / 512
+}
+
+func (m *ArchiveFileStat) Mode() uint32 {
+	return m.mode
+}
+
+func (m *ArchiveFileStat) OwnerGID() uint32 {
+	return m.gid
+}
+
+func (m *ArchiveFileStat) OwnerUID() uint32 {
+	return m.uid
+}
+
+func (m *ArchiveFileStat) Size() uint64 {
+	return m.size
+}
+
+// An entry which is stored uncompressed at a fixed offset in the archive.
+type storedFile struct {
+	layer.ReadOnlyFile
+	reader *archiveReaderAt
+	offset int64
+	size   int64
+}
+
+func (m *storedFile) Read(dest []byte, position int64) (int, layer.Error) {
+	if position >= m.size {
+		return 0, nil
+	}
+	if remaining := m.size - position; int64(len(dest)) > remaining {
+		dest = dest[:remaining]
+	}
+
+	n, err := m.reader.ReadAt(dest, m.offset+position)
+	if err == io.EOF {
+		// the archive is shorter than its index claims
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		log.Printf("Read(): %s\n", err)
+	}
+	return n, layer.WrapError(err)
+}
+
+func (m *storedFile) Release() {
+}
+
+// A compressed zip entry.
+//
+// The decompressor is kept between reads, so that sequential reads do not
+// need to decompress the data again.
+type compressedFile struct {
+	layer.ReadOnlyFile
+	entry    *entry
+	lock     *sync.Mutex
+	stream   io.ReadCloser
+	position int64
+}
+
+// Position the decompressor at position.
+//
+// Must be called with the lock held.
+func (m *compressedFile) seek(position int64) error {
+	if m.stream != nil && position < m.position {
+		m.stream.Close()
+		m.stream = nil
+	}
+
+	if m.stream == nil {
+		stream, err := m.entry.zipfile.Open()
+		if err != nil {
+			return err
+		}
+		m.stream = stream
+		m.position = 0
+	}
+
+	if position > m.position {
+		n, err := io.CopyN(ioutil.Discard, m.stream, position-m.position)
+		m.position += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *compressedFile) Read(dest []byte, position int64) (int, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if position >= int64(m.entry.stat.size) {
+		return 0, nil
+	}
+
+	if err := m.seek(position); err != nil {
+		log.Printf("Read(): %s\n", err)
+		return 0, layer.WrapError(err)
+	}
+
+	n, err := io.ReadFull(m.stream, dest)
+	m.position += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("Read(): %s\n", err)
+	}
+	return n, layer.WrapError(err)
+}
+
+func (m *compressedFile) Release() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stream != nil {
+		m.stream.Close()
+		m.stream = nil
+	}
+}
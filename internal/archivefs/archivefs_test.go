@@ -0,0 +1,438 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/horazont/dragonstash/internal/localfs"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMtime = time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// Large enough to need several reads from the decompressor
+var testLarge = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+func writeArchive(t *testing.T, name string, data []byte) (string, *localfs.LocalFileSystem) {
+	dir, err := ioutil.TempDir("", "dragonstash-archivefs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, localfs.NewLocalFileSystem(dir)
+}
+
+func makeTar(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+
+	add := func(hdr *tar.Header, data []byte) {
+		hdr.ModTime = testMtime
+		hdr.Size = int64(len(data))
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+
+	add(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750}, nil)
+	add(&tar.Header{Name: "dir/a", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 100}, []byte("a"))
+	add(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}, []byte("0123456789"))
+	add(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644}, testLarge)
+	add(&tar.Header{Name: "implicit/sub/b", Typeflag: tar.TypeReg, Mode: 0644}, []byte("b"))
+	add(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/a", Mode: 0777}, nil)
+	add(&tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "file", Mode: 0644}, nil)
+	add(&tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}, nil)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+
+	add := func(name string, method uint16, mode os.FileMode, data []byte) {
+		hdr := &zip.FileHeader{
+			Name:     name,
+			Method:   method,
+			Modified: testMtime,
+		}
+		hdr.SetMode(mode)
+		f, err := w.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+
+	add("dir/", zip.Store, os.ModeDir|0750, nil)
+	add("dir/a", zip.Store, 0640, []byte("a"))
+	add("file", zip.Store, 0644, []byte("0123456789"))
+	add("large", zip.Deflate, 0644, testLarge)
+	add("implicit/sub/b", zip.Deflate, 0644, []byte("b"))
+	add("link", zip.Store, os.ModeSymlink|0777, []byte("dir/a"))
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func prepArchive(t *testing.T, name string, data []byte) (string, *ArchiveFileSystem) {
+	dir, src := writeArchive(t, name, data)
+	fs, err := NewArchiveFileSystem(src, "/"+name)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, fs
+}
+
+type archiveTest func(t *testing.T, fs *ArchiveFileSystem)
+
+func runForFormats(t *testing.T, test archiveTest) {
+	formats := map[string]func(t *testing.T) []byte{
+		"test.tar": makeTar,
+		"test.zip": makeZip,
+	}
+	for name, make := range formats {
+		t.Run(name, func(t *testing.T) {
+			dir, fs := prepArchive(t, name, make(t))
+			defer os.RemoveAll(dir)
+			defer fs.Close()
+			test(t, fs)
+		})
+	}
+}
+
+// A source which can go offline. Handles opened before a reconnect stay
+// unusable, like those of an SFTP session which has been replaced.
+type flakySource struct {
+	*localfs.LocalFileSystem
+	lock       sync.Mutex
+	offline    bool
+	generation int
+}
+
+func (m *flakySource) unavailable() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.offline
+}
+
+func (m *flakySource) setOffline(offline bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.offline && !offline {
+		m.generation += 1
+	}
+	m.offline = offline
+}
+
+func (m *flakySource) IsReady() bool {
+	return !m.unavailable()
+}
+
+func (m *flakySource) Lstat(path string) (layer.FileStat, layer.Error) {
+	if m.unavailable() {
+		return nil, layer.WrapError(syscall.ENOTCONN)
+	}
+	return m.LocalFileSystem.Lstat(path)
+}
+
+func (m *flakySource) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	if m.unavailable() {
+		return nil, layer.WrapError(syscall.ENOTCONN)
+	}
+	f, err := m.LocalFileSystem.OpenFile(path, flags)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return &flakyFile{File: f, src: m, generation: m.generation}, nil
+}
+
+type flakyFile struct {
+	layer.File
+	src        *flakySource
+	generation int
+}
+
+func (m *flakyFile) Read(dest []byte, position int64) (int, layer.Error) {
+	m.src.lock.Lock()
+	broken := m.src.offline || m.src.generation != m.generation
+	m.src.lock.Unlock()
+	if broken {
+		return 0, layer.WrapError(syscall.ENOTCONN)
+	}
+	return m.File.Read(dest, position)
+}
+
+func readAll(t *testing.T, f layer.File, position int64, length int) []byte {
+	buf := make([]byte, length)
+	n, err := f.Read(buf, position)
+	assert.Nil(t, err)
+	return buf[:n]
+}
+
+func TestUnknownFormat(t *testing.T) {
+	dir, src := writeArchive(t, "test.txt", []byte("not an archive"))
+	defer os.RemoveAll(dir)
+
+	_, err := NewArchiveFileSystem(src, "/test.txt")
+	assert.Equal(t, ErrUnknownFormat, err)
+}
+
+func TestMissingArchive(t *testing.T) {
+	dir, src := writeArchive(t, "test.txt", nil)
+	defer os.RemoveAll(dir)
+
+	_, err := NewArchiveFileSystem(src, "/nonexistant.zip")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.(layer.Error).Errno())
+}
+
+func TestLstat(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		stat, err := fs.Lstat("/file")
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(syscall.S_IFREG|0644), stat.Mode())
+		assert.Equal(t, uint64(10), stat.Size())
+		assert.Equal(t, uint64(testMtime.Unix()), stat.Mtime())
+		assert.Equal(t, uint64(testMtime.Unix()), stat.Ctime())
+
+		stat, err = fs.Lstat("/dir")
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(syscall.S_IFDIR|0750), stat.Mode())
+
+		stat, err = fs.Lstat("/link")
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(syscall.S_IFLNK), stat.Mode()&syscall.S_IFMT)
+
+		stat, err = fs.Lstat("/")
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+
+		_, err = fs.Lstat("/nonexistant")
+		assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+	})
+}
+
+func TestTarOwners(t *testing.T) {
+	dir, fs := prepArchive(t, "test.tar", makeTar(t))
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	stat, err := fs.Lstat("/dir/a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1000), stat.OwnerUID())
+	assert.Equal(t, uint32(100), stat.OwnerGID())
+}
+
+func TestZipOwnersAreArchiveOwner(t *testing.T) {
+	dir, fs := prepArchive(t, "test.zip", makeZip(t))
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	stat, err := fs.Lstat("/dir/a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(os.Getuid()), stat.OwnerUID())
+	assert.Equal(t, uint32(os.Getgid()), stat.OwnerGID())
+}
+
+func TestOpenDir(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		entries, err := fs.OpenDir("/dir")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "a", entries[0].Name())
+		assert.Equal(t, uint32(syscall.S_IFREG|0640), entries[0].Mode())
+		assert.Equal(t, uint64(1), entries[0].Stat().Size())
+
+		_, err = fs.OpenDir("/file")
+		assert.Equal(t, uintptr(syscall.ENOTDIR), err.Errno())
+
+		_, err = fs.OpenDir("/nonexistant")
+		assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+	})
+}
+
+func TestOpenDirRoot(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		entries, err := fs.OpenDir("/")
+		assert.Nil(t, err)
+
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		expected := []string{"dir", "file", "implicit", "large", "link"}
+		if _, ok := fs.index.entries["/hardlink"]; ok {
+			// only in the tar archive
+			expected = []string{"dir", "file", "hardlink", "implicit", "large", "link"}
+		}
+		assert.Equal(t, expected, names)
+	})
+}
+
+func TestImplicitDirectories(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		stat, err := fs.Lstat("/implicit/sub")
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+
+		entries, err := fs.OpenDir("/implicit/sub")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "b", entries[0].Name())
+	})
+}
+
+func TestReadlink(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		dest, err := fs.Readlink("/link")
+		assert.Nil(t, err)
+		assert.Equal(t, "dir/a", dest)
+
+		_, err = fs.Readlink("/file")
+		assert.Equal(t, uintptr(syscall.EINVAL), err.Errno())
+	})
+}
+
+func TestReadRandomAccess(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		f, err := fs.OpenFile("/file", os.O_RDONLY)
+		assert.Nil(t, err)
+		defer f.Release()
+
+		assert.Equal(t, []byte("4567"), readAll(t, f, 4, 4))
+		assert.Equal(t, []byte("0123"), readAll(t, f, 0, 4))
+		assert.Equal(t, []byte("89"), readAll(t, f, 8, 4))
+		assert.Equal(t, []byte{}, readAll(t, f, 10, 4))
+	})
+}
+
+func TestReadLargeEntry(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		f, err := fs.OpenFile("/large", os.O_RDONLY)
+		assert.Nil(t, err)
+		defer f.Release()
+
+		// forwards, backwards and across the end
+		assert.Equal(t, testLarge[4096:8192], readAll(t, f, 4096, 4096))
+		assert.Equal(t, testLarge[8192:12288], readAll(t, f, 8192, 4096))
+		assert.Equal(t, testLarge[100:4196], readAll(t, f, 100, 4096))
+		assert.Equal(t, testLarge[len(testLarge)-10:], readAll(t, f, int64(len(testLarge)-10), 4096))
+	})
+}
+
+func TestTarHardLink(t *testing.T) {
+	dir, fs := prepArchive(t, "test.tar", makeTar(t))
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	stat, err := fs.Lstat("/hardlink")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0644), stat.Mode())
+	assert.Equal(t, uint64(10), stat.Size())
+
+	f, err := fs.OpenFile("/hardlink", os.O_RDONLY)
+	assert.Nil(t, err)
+	defer f.Release()
+	assert.Equal(t, []byte("0123456789"), readAll(t, f, 0, 16))
+}
+
+func TestTarSkipsUnsupportedTypes(t *testing.T) {
+	dir, fs := prepArchive(t, "test.tar", makeTar(t))
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	_, err := fs.Lstat("/fifo")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestOpenFile(t *testing.T) {
+	runForFormats(t, func(t *testing.T, fs *ArchiveFileSystem) {
+		_, err := fs.OpenFile("/file", os.O_RDWR)
+		assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+
+		_, err = fs.OpenFile("/dir", os.O_RDONLY)
+		assert.Equal(t, uintptr(syscall.EISDIR), err.Errno())
+
+		_, err = fs.OpenFile("/nonexistant", os.O_RDONLY)
+		assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+	})
+}
+
+func TestReadAfterSourceReconnected(t *testing.T) {
+	formats := map[string]func(t *testing.T) []byte{
+		"test.tar": makeTar,
+		"test.zip": makeZip,
+	}
+	for name, makeArchive := range formats {
+		t.Run(name, func(t *testing.T) {
+			dir, local := writeArchive(t, name, makeArchive(t))
+			defer os.RemoveAll(dir)
+			src := &flakySource{LocalFileSystem: local}
+
+			fs, err := NewArchiveFileSystem(src, "/"+name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+
+			f, lerr := fs.OpenFile("/large", os.O_RDONLY)
+			assert.Nil(t, lerr)
+			defer f.Release()
+			assert.Equal(t, testLarge[:4096], readAll(t, f, 0, 4096))
+
+			src.setOffline(true)
+			assert.False(t, fs.IsReady())
+			_, lerr = f.Read(make([]byte, 4096), 0)
+			assert.Equal(t, uintptr(syscall.ENOTCONN), lerr.Errno())
+
+			src.setOffline(false)
+			assert.True(t, fs.IsReady())
+			assert.Equal(t, testLarge[:4096], readAll(t, f, 0, 4096))
+
+			g, lerr := fs.OpenFile("/file", os.O_RDONLY)
+			assert.Nil(t, lerr)
+			defer g.Release()
+			assert.Equal(t, []byte("0123456789"), readAll(t, g, 0, 16))
+		})
+	}
+}
+
+func TestMountWhileSourceIsOffline(t *testing.T) {
+	dir, local := writeArchive(t, "test.tar", makeTar(t))
+	defer os.RemoveAll(dir)
+	src := &flakySource{LocalFileSystem: local, offline: true}
+
+	fs, err := NewArchiveFileSystem(src, "/test.tar")
+	assert.Nil(t, err)
+	defer fs.Close()
+
+	assert.False(t, fs.IsReady())
+	_, lerr := fs.Lstat("/file")
+	assert.Equal(t, uintptr(syscall.ENOTCONN), lerr.Errno())
+
+	src.setOffline(false)
+	assert.True(t, fs.IsReady())
+	stat, lerr := fs.Lstat("/file")
+	assert.Nil(t, lerr)
+	assert.Equal(t, uint64(10), stat.Size())
+}
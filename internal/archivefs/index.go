@@ -0,0 +1,326 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+var (
+	ErrUnknownFormat = errors.New("archivefs: unknown archive format")
+)
+
+type archiveFormat int
+
+const (
+	format_UNKNOWN archiveFormat = iota
+	format_TAR
+	format_ZIP
+)
+
+// A node in the archive index.
+type entry struct {
+	stat ArchiveFileStat
+
+	// Names of the children of a directory, sorted
+	children []string
+
+	// Target of a symlink
+	linkname string
+
+	// Offset of the data in the archive file, if it is stored uncompressed
+	offset int64
+
+	// The zip entry, if the data has to be decompressed
+	zipfile *zip.File
+}
+
+type index struct {
+	entries map[string]*entry
+}
+
+// Read exactly len(p) bytes from an archive, unless the end is hit.
+//
+// This adapts the archive of an ArchiveFileSystem to io.ReaderAt, which is
+// what the archive readers need. The archive is read through the file system,
+// so that the index and the zip entries never hold on to a handle which
+// became unusable.
+type archiveReaderAt struct {
+	fs *ArchiveFileSystem
+}
+
+func (m *archiveReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		n, err := m.fs.readArchive(p[total:], off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+	}
+	return total, nil
+}
+
+// Detect the format from the header of the archive. Archives shorter than a
+// header are fine, other read errors are returned.
+func detectFormat(r io.ReaderAt) (archiveFormat, error) {
+	header := make([]byte, 512)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return format_UNKNOWN, err
+	}
+	header = header[:n]
+
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) ||
+		bytes.HasPrefix(header, []byte("PK\x05\x06")) {
+		return format_ZIP, nil
+	}
+	if n == 512 && bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return format_TAR, nil
+	}
+	return format_UNKNOWN, nil
+}
+
+func fromFileMode(mode os.FileMode) uint32 {
+	result := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		result |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		result |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		result |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		result |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		result |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		result |= syscall.S_IFBLK
+	default:
+		result |= syscall.S_IFREG
+	}
+	return result
+}
+
+// Normalise a path inside the archive; returns "" for the root and for paths
+// which escape the archive.
+func cleanName(name string) string {
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		return ""
+	}
+	return cleaned
+}
+
+func newIndex(root *ArchiveFileStat) *index {
+	return &index{
+		entries: map[string]*entry{
+			"/": &entry{stat: *root},
+		},
+	}
+}
+
+// Add an entry, creating missing parent directories with the attributes of
+// the root.
+func (m *index) add(name string, e *entry) {
+	if old, ok := m.entries[name]; ok {
+		// later entries win, but keep the children of directories
+		// which are replaced by directories
+		if old.stat.mode&syscall.S_IFMT == syscall.S_IFDIR &&
+			e.stat.mode&syscall.S_IFMT == syscall.S_IFDIR {
+			e.children = old.children
+		}
+		m.entries[name] = e
+		return
+	}
+
+	m.entries[name] = e
+	parent_name := path.Dir(name)
+	parent, ok := m.entries[parent_name]
+	if !ok {
+		parent = &entry{stat: m.entries["/"].stat}
+		m.add(parent_name, parent)
+	}
+	parent.children = append(parent.children, path.Base(name))
+}
+
+func (m *index) finish() {
+	for _, e := range m.entries {
+		sort.Strings(e.children)
+	}
+}
+
+// Build the index of a tar archive in a single pass.
+//
+// Only the headers are read; the data is skipped by seeking. Since tar stores
+// data uncompressed and contiguously, the data offset recorded for each entry
+// is all that is needed for random access.
+func indexTar(r io.ReaderAt, size int64, root *ArchiveFileStat) (*index, error) {
+	result := newIndex(root)
+	section := io.NewSectionReader(r, 0, size)
+	reader := tar.NewReader(section)
+
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		offset, _ := section.Seek(0, io.SeekCurrent)
+		name := cleanName(hdr.Name)
+		if name == "" {
+			continue
+		}
+
+		e := &entry{
+			stat: ArchiveFileStat{
+				mode:  fromFileMode(hdr.FileInfo().Mode()),
+				size:  uint64(hdr.Size),
+				mtime: hdr.ModTime,
+				atime: hdr.AccessTime,
+				ctime: hdr.ChangeTime,
+				uid:   uint32(hdr.Uid),
+				gid:   uint32(hdr.Gid),
+			},
+			offset: offset,
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+		case tar.TypeSymlink:
+			e.linkname = hdr.Linkname
+			e.stat.size = uint64(len(hdr.Linkname))
+		case tar.TypeLink:
+			target, ok := result.entries[cleanName(hdr.Linkname)]
+			if !ok || target.stat.mode&syscall.S_IFMT != syscall.S_IFREG {
+				log.Printf("archivefs: skipping hard link %s to unknown file %s",
+					hdr.Name, hdr.Linkname)
+				continue
+			}
+			e.offset = target.offset
+			e.stat.mode = target.stat.mode
+			e.stat.size = target.stat.size
+		default:
+			log.Printf("archivefs: skipping %s of unsupported type %q",
+				hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		result.add(name, e)
+	}
+
+	result.finish()
+	return result, nil
+}
+
+// Build the index of a zip archive from its central directory.
+//
+// Stored entries are read directly from the archive; compressed entries need
+// to be decompressed from the start.
+func indexZip(r io.ReaderAt, size int64, root *ArchiveFileStat) (*index, error) {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	result := newIndex(root)
+	for _, f := range reader.File {
+		name := cleanName(f.Name)
+		if name == "" {
+			continue
+		}
+
+		mode := fromFileMode(f.Mode())
+		e := &entry{
+			stat: ArchiveFileStat{
+				mode:  mode,
+				size:  f.UncompressedSize64,
+				mtime: f.Modified,
+				uid:   root.uid,
+				gid:   root.gid,
+			},
+			offset: -1,
+		}
+		if f.Modified.IsZero() {
+			e.stat.mtime = f.ModTime()
+		}
+
+		switch mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+		case syscall.S_IFREG, syscall.S_IFLNK:
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				e.offset = offset
+			} else {
+				e.zipfile = f
+			}
+		default:
+			log.Printf("archivefs: skipping %s of unsupported type %o",
+				f.Name, mode&syscall.S_IFMT)
+			continue
+		}
+
+		result.add(name, e)
+	}
+
+	result.finish()
+	return result, nil
+}
+
+func buildIndex(r io.ReaderAt, size int64, root *ArchiveFileStat) (*index, error) {
+	format, err := detectFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case format_TAR:
+		return indexTar(r, size, root)
+	case format_ZIP:
+		return indexZip(r, size, root)
+	}
+	return nil, ErrUnknownFormat
+}
+
+func (m *index) lookup(p string) (*entry, layer.Error) {
+	name := cleanName(p)
+	if name == "" {
+		name = "/"
+	}
+	e, ok := m.entries[name]
+	if !ok {
+		return nil, layer.WrapError(syscall.ENOENT)
+	}
+	return e, nil
+}
+
+// Tar stores the access and change times only in some formats; fall back
+// to the modification time.
+func orMtime(t time.Time, mtime time.Time) time.Time {
+	if t.IsZero() {
+		return mtime
+	}
+	return t
+}
+
+func isSymlink(e *entry) bool {
+	return e.stat.mode&syscall.S_IFMT == syscall.S_IFLNK
+}
@@ -10,6 +10,7 @@ import (
 
 var (
 	ErrMustBeAligned = errors.New("This operation must be aligned.")
+	ErrCacheFull     = errors.New("The cache quota is exhausted.")
 )
 
 // Notes about put operations:
@@ -24,6 +25,10 @@ var (
 // the attributes of the object as stale (unless the changing operation was a
 // PutAttr).
 //
+// If the parent directory of the path is in the cache, its listing is kept in
+// sync: PutAttr, PutLink and PutDir add the name of the object to it and
+// PutNonExistant removes it.
+//
 // Common error conditions:
 //
 // ENOENT is returned if the path of a fetch operation is not in the cache, and
@@ -67,6 +72,12 @@ type Cache interface {
 	// This negative caching is useful in certain situations.
 	PutNonExistant(path string)
 
+	// Move a path, including all cached children and data, to a new path
+	//
+	// Anything cached at newpath is replaced. Returns the usual fetch
+	// errors if oldpath is not in the cache.
+	Move(oldpath string, newpath string) layer.Error
+
 	// Retrieve a link from the cache
 	//
 	// Returns EINVAL if the path is something other than a link.
@@ -82,6 +93,17 @@ type Cache interface {
 	// Retrieve the attributes of a path.
 	FetchAttr(path string) (layer.FileStat, layer.Error)
 
+	// Replace the extended attributes cached for a path
+	//
+	// This is ignored if the path is not in the cache.
+	PutXattrs(path string, xattrs map[string][]byte)
+
+	// Retrieve the extended attributes cached for a path
+	//
+	// Returns an empty map if none are cached. The usual error conditions
+	// apply.
+	FetchXattrs(path string) (map[string][]byte, layer.Error)
+
 	// The block size of the cache
 	BlockSize() int64
 
@@ -101,9 +123,43 @@ type CachedFile interface {
 	// The indicator whether data was written or read may be used by
 	// eviction strategies to decide on whether to evict blocks or not.
 	//
-	// Returns ErrMustBeAligned if the write must be aligned. No other
-	// errors are returned.
-	PutData(data []byte, position uint64) error
+	// The priority (one of the QUOTA_BLOCK_PRIO_* constants) is used to
+	// request quota for the blocks which are not cached yet: data which
+	// has been read ahead should not evict data which has been read.
+	//
+	// Returns ErrMustBeAligned if the write must be aligned and
+	// ErrCacheFull if the quota does not allow to store the blocks which
+	// are not cached yet. No other errors are returned.
+	PutData(data []byte, position uint64, priority int) error
+
+	// Write data which has been modified locally into the cached file
+	//
+	// This works like PutData, but the blocks are marked dirty: they hold
+	// data which the source does not have yet. Blocks stay dirty until
+	// MarkClean is called for them. Locally modified data takes
+	// precedence over read data when the quota is exhausted.
+	WriteData(data []byte, position uint64) error
+
+	// Return the indices of the dirty blocks, in ascending order
+	DirtyBlocks() []uint64
+
+	// Clear the dirty flag of the given blocks
+	MarkClean(blocks []uint64)
+
+	// Set the dirty flag of the given blocks again, e.g. after writing them
+	// back has failed
+	MarkDirty(blocks []uint64)
+
+	// Return the indices of the dirty blocks, like DirtyBlocks, and
+	// remember them as being written back to the source
+	//
+	// Blocks which are written to before FinishWriteBack is called are
+	// forgotten again, as the source does not have their new data.
+	StartWriteBack() []uint64
+
+	// Clear the dirty flag of the blocks returned by StartWriteBack which
+	// have not been written to since, if written is true
+	FinishWriteBack(written bool)
 
 	// Fetch data from the cache
 	//
@@ -157,6 +213,10 @@ func (m *dummyCache) PutLink(path string, dest string) {
 func (m *dummyCache) PutNonExistant(path string) {
 }
 
+func (m *dummyCache) Move(oldpath string, newpath string) layer.Error {
+	return layer.WrapError(syscall.EIO)
+}
+
 func (m *dummyCache) FetchLink(path string) (dest string, err layer.Error) {
 	return "", layer.WrapError(syscall.EIO)
 }
@@ -169,6 +229,13 @@ func (m *dummyCache) FetchAttr(path string) (layer.FileStat, layer.Error) {
 	return nil, layer.WrapError(syscall.EIO)
 }
 
+func (m *dummyCache) PutXattrs(path string, xattrs map[string][]byte) {
+}
+
+func (m *dummyCache) FetchXattrs(path string) (map[string][]byte, layer.Error) {
+	return nil, layer.WrapError(syscall.EIO)
+}
+
 func (m *dummyCache) BlockSize() int64 {
 	return 1
 }
@@ -183,10 +250,31 @@ func NewDummyCachedFile() CachedFile {
 	return &dummyCachedFile{}
 }
 
-func (m *dummyCachedFile) PutData(data []byte, position uint64) error {
+func (m *dummyCachedFile) PutData(data []byte, position uint64, priority int) error {
+	return nil
+}
+
+func (m *dummyCachedFile) WriteData(data []byte, position uint64) error {
+	return layer.WrapError(syscall.EIO)
+}
+
+func (m *dummyCachedFile) DirtyBlocks() []uint64 {
 	return nil
 }
 
+func (m *dummyCachedFile) MarkClean(blocks []uint64) {
+}
+
+func (m *dummyCachedFile) MarkDirty(blocks []uint64) {
+}
+
+func (m *dummyCachedFile) StartWriteBack() []uint64 {
+	return nil
+}
+
+func (m *dummyCachedFile) FinishWriteBack(written bool) {
+}
+
 func (m *dummyCachedFile) FetchData(data []byte, position uint64) (int, layer.Error) {
 	return 0, layer.WrapError(syscall.EIO)
 }
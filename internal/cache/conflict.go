@@ -0,0 +1,521 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// Conflicts
+//
+// An offline modification conflicts with the source if the object was changed
+// on the source after it was last seen by the cache. To detect that, WRITE and
+// UNLINK entries carry the version of the object the modification is based
+// on: the attributes which were cached when the object was first modified
+// offline. On replay, the base version is compared with the attributes on the
+// source; if they differ, the conflict policy decides what happens.
+//
+// The base version is kept in the journal rather than in the cached inode: the
+// cached attributes are changed by the offline modifications themselves, the
+// inode of an unlinked object is gone, and the entry has to name the version
+// until it is replayed, also across renames.
+//
+// Replaying an entry changes the object on the source, so the attributes seen
+// after replaying an entry are remembered and accepted as base version, too.
+//
+// A file created offline conflicts with a file which has been created at the
+// same path on the source.
+
+type ConflictPolicy int
+
+const (
+	// Write the cached version next to the version on the source, as
+	// NAME.conflict-HOST-DATE; the version on the source is kept at NAME.
+	CONFLICT_KEEP_BOTH ConflictPolicy = iota
+	// Apply the offline modification anyway. Only the blocks modified
+	// offline are written, so modifications of other blocks on the source
+	// are kept.
+	CONFLICT_CACHE_WINS
+	// Drop the offline modification and the cached data.
+	CONFLICT_SOURCE_WINS
+	// Stop the replay and leave the entry queued until the conflict is
+	// resolved with ResolveConflict.
+	CONFLICT_REFUSE
+)
+
+var (
+	errConflictRefused = layer.NewBackendError(
+		"replay: conflict left queued",
+		syscall.EBUSY,
+	)
+)
+
+func (m ConflictPolicy) String() string {
+	switch m {
+	case CONFLICT_KEEP_BOTH:
+		return "keep-both"
+	case CONFLICT_CACHE_WINS:
+		return "cache-wins"
+	case CONFLICT_SOURCE_WINS:
+		return "source-wins"
+	case CONFLICT_REFUSE:
+		return "refuse"
+	}
+	return "unknown"
+}
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for _, policy := range []ConflictPolicy{
+		CONFLICT_KEEP_BOTH,
+		CONFLICT_CACHE_WINS,
+		CONFLICT_SOURCE_WINS,
+		CONFLICT_REFUSE,
+	} {
+		if policy.String() == s {
+			return policy, nil
+		}
+	}
+	return CONFLICT_KEEP_BOTH, fmt.Errorf("unknown conflict policy: %s", s)
+}
+
+// The version of an object an offline modification is based on.
+type BaseVersion struct {
+	Mtime     uint64
+	Ctime     uint64
+	Size      uint64
+	MtimeNsec uint32
+	CtimeNsec uint32
+	// Set for base versions read from records which were written before
+	// the nanoseconds were recorded; only whole seconds are compared then
+	seconds_only bool
+}
+
+func baseVersionOf(stat layer.FileStat) *BaseVersion {
+	return &BaseVersion{
+		Mtime:     stat.Mtime(),
+		Ctime:     stat.Ctime(),
+		Size:      stat.Size(),
+		MtimeNsec: stat.MtimeNsec(),
+		CtimeNsec: stat.CtimeNsec(),
+	}
+}
+
+func (m *BaseVersion) Matches(stat layer.FileStat) bool {
+	if m.Mtime != stat.Mtime() || m.Ctime != stat.Ctime() || m.Size != stat.Size() {
+		return false
+	}
+	return m.seconds_only || (m.MtimeNsec == stat.MtimeNsec() && m.CtimeNsec == stat.CtimeNsec())
+}
+
+// A conflict which has been detected during replay.
+type Conflict struct {
+	Path string
+	Op   JournalOp
+	Time time.Time
+	// The policy which has been applied
+	Policy ConflictPolicy
+	// The path of the cached version on the source, for KEEP_BOTH
+	Copy string
+	// Whether the entry is still queued (for REFUSE)
+	Queued bool
+	// The error which kept the entry from being applied, for entries which
+	// failed rather than conflicted
+	Error string
+}
+
+const (
+	// Number of resolved conflicts which are remembered
+	conflict_MAX_HISTORY = 256
+)
+
+func (m *CacheLayer) SetConflictPolicy(policy ConflictPolicy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.conflictPolicy = policy
+}
+
+// Return the conflicts detected since startup, oldest first.
+func (m *CacheLayer) Conflicts() []Conflict {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	result := make([]Conflict, len(m.conflicts))
+	copy(result, m.conflicts)
+	return result
+}
+
+// Resolve a conflict which has been left queued with policy and restart the
+// replay.
+//
+// Returns ENOENT if there is no queued conflict for path.
+func (m *CacheLayer) ResolveConflict(path string, policy ConflictPolicy) layer.Error {
+	m.lock.Lock()
+	found := false
+	for _, conflict := range m.conflicts {
+		if conflict.Queued && conflict.Path == path {
+			found = true
+		}
+	}
+	if found {
+		m.resolutions[path] = policy
+		m.blocked = false
+	}
+	m.lock.Unlock()
+
+	if !found {
+		return layer.WrapError(syscall.ENOENT)
+	}
+	go m.Replay()
+	return nil
+}
+
+// Add a conflict to the list, replacing a queued conflict for the same path.
+func (m *CacheLayer) reportConflict(conflict Conflict) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	log.Printf("replay: conflict on %s %s, applying %s",
+		conflict.Op, conflict.Path, conflict.Policy)
+
+	for i, existing := range m.conflicts {
+		if existing.Queued && existing.Path == conflict.Path {
+			m.conflicts = append(m.conflicts[:i], m.conflicts[i+1:]...)
+			break
+		}
+	}
+	m.conflicts = append(m.conflicts, conflict)
+	if len(m.conflicts) > conflict_MAX_HISTORY {
+		m.conflicts = m.conflicts[len(m.conflicts)-conflict_MAX_HISTORY:]
+	}
+	if conflict.Queued {
+		m.blocked = true
+	}
+}
+
+// Return the policy for a conflict on path.
+func (m *CacheLayer) policyFor(path string) ConflictPolicy {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if policy, ok := m.resolutions[path]; ok {
+		delete(m.resolutions, path)
+		return policy
+	}
+	return m.conflictPolicy
+}
+
+// Return whether path or one of its parents has been created offline and not
+// replayed yet. Such objects do not have a version on the source.
+func (m *CacheLayer) createdOffline(path string) bool {
+	entries := m.journal.Pending()
+	for i, entry := range entries {
+		switch entry.Op {
+		case JOURNAL_CREATE, JOURNAL_MKDIR, JOURNAL_SYMLINK:
+			created, ok := resolvePath(entry.Path, entries[i+1:])
+			if ok && hasPathPrefix(path, created) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return the base version for an offline modification of path.
+//
+// Offline modifications change the cached attributes, so that those only
+// describe the version on the source as long as no modification of path is
+// pending; otherwise, the base version of the first pending modification is
+// used.
+func (m *CacheLayer) baseOf(path string) *BaseVersion {
+	if m.createdOffline(path) {
+		return nil
+	}
+	entries := m.journal.Pending()
+	for i, entry := range entries {
+		if entry.Base == nil {
+			continue
+		}
+		if current, ok := resolvePath(entry.Path, entries[i+1:]); ok && current == path {
+			return entry.Base
+		}
+	}
+	stat, err := m.cache.FetchAttr(path)
+	if err != nil {
+		return nil
+	}
+	return baseVersionOf(stat)
+}
+
+// Compare the base version of an entry with the source.
+//
+// Returns the attributes on the source, which are nil if the object does not
+// exist anymore, and whether there is a conflict. Entries without a base
+// version never conflict; the source is not accessed for them.
+func (m *CacheLayer) checkConflict(entry *JournalEntry) (layer.FileStat, bool, layer.Error) {
+	if entry.Base == nil {
+		return nil, false, nil
+	}
+
+	stat, err := m.fs.Lstat(entry.Path)
+	if err != nil && err.Errno() != uintptr(syscall.ENOENT) {
+		return nil, false, err
+	}
+	if err != nil {
+		return nil, true, nil
+	}
+	if entry.Base.Matches(stat) {
+		return stat, false, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	replayed, ok := m.replayed[entry.Path]
+	return stat, !ok || !replayed.Matches(stat), nil
+}
+
+// Remember the attributes of path on the source after an entry has been
+// replayed.
+//
+// If no other pending entry refers to path, the cached attributes are updated,
+// so that later offline modifications are based on the version on the source.
+func (m *CacheLayer) noteReplayed(path string) {
+	stat, err := m.fs.Lstat(path)
+	if err != nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.replayed[path] = baseVersionOf(stat)
+
+	pending := m.journal.Pending()
+	if len(pending) > 0 {
+		pending = pending[1:]
+	}
+	for _, entry := range pending {
+		if refersTo(entry, path) {
+			return
+		}
+	}
+	if _, dirty := m.pendingWrites[path]; dirty {
+		return
+	}
+	m.cache.PutAttr(path, stat)
+}
+
+func refersTo(entry *JournalEntry, path string) bool {
+	if hasPathPrefix(entry.Path, path) || hasPathPrefix(path, entry.Path) {
+		return true
+	}
+	if entry.Op != JOURNAL_RENAME {
+		return false
+	}
+	return hasPathPrefix(entry.Target, path) || hasPathPrefix(path, entry.Target)
+}
+
+// Drop the cached version of a file in favour of the version on the source.
+func (m *CacheLayer) discardCached(cachef CachedFile, cache_path string, stat layer.FileStat) {
+	cachef.MarkClean(cachef.DirtyBlocks())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.cache.PutNonExistant(cache_path)
+	if stat != nil {
+		m.cache.PutAttr(cache_path, stat)
+	}
+}
+
+func conflictCopyPath(path string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s.conflict-%s-%s",
+		path, host, time.Now().Format("20060102-150405"))
+}
+
+// Write the complete cached version of a file to a new file on the source.
+//
+// Blocks which are not in the cache are left as holes.
+func (m *CacheLayer) writeCopy(cachef CachedFile, path string, mode uint32, size uint64) layer.Error {
+	f, err := m.fs.Create(path, os.O_WRONLY|os.O_EXCL, mode&07777)
+	if err != nil {
+		return err
+	}
+	defer f.Release()
+
+	blocksize := uint64(m.cache.BlockSize())
+	chunk := blocksize * replay_MAX_WRITE_BLOCKS
+	for position := uint64(0); position < size; position += chunk {
+		if err := writeBack(cachef, f, position, chunk, size); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// Handle a conflict on a WRITE entry.
+//
+// Returns true if the dirty blocks should be written back as usual.
+func (m *CacheLayer) resolveWriteConflict(entry *JournalEntry, cachef CachedFile, cache_path string, stat layer.FileStat) (bool, layer.Error) {
+	conflict := Conflict{
+		Path:   entry.Path,
+		Op:     entry.Op,
+		Time:   time.Now(),
+		Policy: m.policyFor(entry.Path),
+	}
+
+	switch conflict.Policy {
+	case CONFLICT_REFUSE:
+		conflict.Queued = true
+		m.reportConflict(conflict)
+		// the entry stays queued, so writes need not be recorded again
+		m.lock.Lock()
+		m.pendingWrites[cache_path] = true
+		m.lock.Unlock()
+		return false, errConflictRefused
+	case CONFLICT_SOURCE_WINS:
+		m.reportConflict(conflict)
+		m.discardCached(cachef, cache_path, stat)
+		return false, nil
+	case CONFLICT_KEEP_BOTH:
+		cached, err := cachef.FetchAttr()
+		if err != nil {
+			return false, err
+		}
+		conflict.Copy = conflictCopyPath(entry.Path)
+		if err := m.writeCopy(cachef, conflict.Copy, cached.Mode(), cached.Size()); err != nil {
+			return false, err
+		}
+		m.reportConflict(conflict)
+		m.discardCached(cachef, cache_path, stat)
+		return false, nil
+	}
+
+	m.reportConflict(conflict)
+	if stat == nil {
+		// the file is gone on the source; bring back all of it
+		cached, err := cachef.FetchAttr()
+		if err != nil {
+			return false, err
+		}
+		if err := m.writeCopy(cachef, entry.Path, cached.Mode(), cached.Size()); err != nil {
+			return false, err
+		}
+		cachef.MarkClean(cachef.DirtyBlocks())
+		return false, nil
+	}
+	return true, nil
+}
+
+// Report an entry which could not be applied as a conflict, so that the
+// modification is not lost without notice.
+//
+// With CONFLICT_REFUSE, the entry is left queued and errConflictRefused is
+// returned; otherwise the entry is dropped. The blocks a dropped WRITE entry
+// did not write back stay dirty and are written back along with the next
+// modification of the file.
+func (m *CacheLayer) reportFailure(entry *JournalEntry, err layer.Error) layer.Error {
+	conflict := Conflict{
+		Path:   entry.Path,
+		Op:     entry.Op,
+		Time:   time.Now(),
+		Policy: m.policyFor(entry.Path),
+		Error:  err.Error(),
+	}
+	log.Printf("replay: %s %s failed: %s", entry.Op, entry.Path, err)
+
+	if conflict.Policy != CONFLICT_REFUSE {
+		m.reportConflict(conflict)
+		return nil
+	}
+
+	conflict.Queued = true
+	m.reportConflict(conflict)
+	if entry.Op == JOURNAL_WRITE {
+		// the entry stays queued, so writes need not be recorded again
+		m.lock.Lock()
+		if cache_path, ok := resolvePath(entry.Path, m.journal.Pending()[1:]); ok {
+			m.pendingWrites[cache_path] = true
+		}
+		m.lock.Unlock()
+	}
+	return errConflictRefused
+}
+
+// Handle a conflict on a CREATE entry.
+//
+// Returns true if the file on the source should be replaced.
+func (m *CacheLayer) resolveCreateConflict(entry *JournalEntry, stat layer.FileStat) (bool, layer.Error) {
+	conflict := Conflict{
+		Path:   entry.Path,
+		Op:     entry.Op,
+		Time:   time.Now(),
+		Policy: m.policyFor(entry.Path),
+	}
+
+	switch conflict.Policy {
+	case CONFLICT_REFUSE:
+		conflict.Queued = true
+		m.reportConflict(conflict)
+		return false, errConflictRefused
+	case CONFLICT_CACHE_WINS:
+		m.reportConflict(conflict)
+		return true, nil
+	}
+
+	cachef, cache_path, ok := m.openCached(entry)
+	if !ok {
+		// nothing of the cached version is left
+		m.reportConflict(conflict)
+		return false, nil
+	}
+	defer cachef.Close()
+
+	if conflict.Policy == CONFLICT_KEEP_BOTH {
+		cached, err := cachef.FetchAttr()
+		if err != nil {
+			return false, err
+		}
+		conflict.Copy = conflictCopyPath(entry.Path)
+		if err := m.writeCopy(cachef, conflict.Copy, cached.Mode(), cached.Size()); err != nil {
+			return false, err
+		}
+	}
+	m.reportConflict(conflict)
+	m.discardCached(cachef, cache_path, stat)
+	return false, nil
+}
+
+// Handle a conflict on an UNLINK entry.
+//
+// Returns true if the object should be unlinked anyway.
+func (m *CacheLayer) resolveUnlinkConflict(entry *JournalEntry) (bool, layer.Error) {
+	conflict := Conflict{
+		Path:   entry.Path,
+		Op:     entry.Op,
+		Time:   time.Now(),
+		Policy: m.policyFor(entry.Path),
+	}
+
+	switch conflict.Policy {
+	case CONFLICT_REFUSE:
+		conflict.Queued = true
+		m.reportConflict(conflict)
+		return false, errConflictRefused
+	case CONFLICT_CACHE_WINS:
+		m.reportConflict(conflict)
+		return true, nil
+	}
+
+	// there is nothing of the cached version to keep
+	m.reportConflict(conflict)
+	return false, nil
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := ParseConflictPolicy("source-wins")
+	assert.Nil(t, err)
+	assert.Equal(t, CONFLICT_SOURCE_WINS, policy)
+
+	_, err = ParseConflictPolicy("mine")
+	assert.NotNil(t, err)
+}
+
+func TestBaseVersionMatches(t *testing.T) {
+	base := &BaseVersion{Mtime: 1, Ctime: 2, Size: 3}
+	assert.True(t, base.Matches(&cachedStat{mtime: 1, ctime: 2, size: 3}))
+	assert.False(t, base.Matches(&cachedStat{mtime: 1, ctime: 4, size: 3}))
+	assert.False(t, base.Matches(&cachedStat{mtime: 1, ctime: 2, size: 4}))
+	assert.False(t, base.Matches(&cachedStat{mtime: 1, ctime: 2, size: 3, mtime_nsec: 5}))
+	assert.False(t, base.Matches(&cachedStat{mtime: 1, ctime: 2, size: 3, ctime_nsec: 5}))
+
+	base = &BaseVersion{Mtime: 1, Ctime: 2, Size: 3, seconds_only: true}
+	assert.True(t, base.Matches(&cachedStat{mtime: 1, ctime: 2, size: 3, mtime_nsec: 5}))
+}
+
+func prepConflict(t *testing.T, policy ConflictPolicy) (string, *Journal, *CacheLayer, *mockFileSystem) {
+	dir, journal := prepJournal(t)
+	cache_layer, _, fs := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+	cache_layer.SetConflictPolicy(policy)
+
+	journal.Append(&JournalEntry{
+		Op:   JOURNAL_UNLINK,
+		Path: "/foo",
+		Base: &BaseVersion{Mtime: 1, Ctime: 1, Size: 10},
+	})
+	fs.On("Lstat", "/foo").Return(&cachedStat{mtime: 2, ctime: 2, size: 10}, nil)
+	fs.On("Unlink", "/foo").Return(nil)
+	return dir, journal, cache_layer, fs
+}
+
+func TestUnlinkWithoutConflictIsReplayed(t *testing.T) {
+	dir, journal, cache_layer, fs := prepConflict(t, CONFLICT_SOURCE_WINS)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	journal.Append(&JournalEntry{
+		Op:   JOURNAL_UNLINK,
+		Path: "/bar",
+		Base: &BaseVersion{Mtime: 1, Ctime: 1, Size: 10},
+	})
+	fs.On("Lstat", "/bar").Return(&cachedStat{mtime: 1, ctime: 1, size: 10}, nil)
+	fs.On("Unlink", "/bar").Return(nil)
+
+	assert.Nil(t, cache_layer.Replay())
+	fs.AssertCalled(t, "Unlink", "/bar")
+	assert.Equal(t, 1, len(cache_layer.Conflicts()))
+}
+
+func TestConflictingUnlinkSourceWins(t *testing.T) {
+	dir, journal, cache_layer, fs := prepConflict(t, CONFLICT_SOURCE_WINS)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	assert.Nil(t, cache_layer.Replay())
+	assert.True(t, journal.IsEmpty())
+	fs.AssertNotCalled(t, "Unlink", "/foo")
+
+	conflicts := cache_layer.Conflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, "/foo", conflicts[0].Path)
+	assert.Equal(t, JOURNAL_UNLINK, conflicts[0].Op)
+	assert.Equal(t, CONFLICT_SOURCE_WINS, conflicts[0].Policy)
+	assert.False(t, conflicts[0].Queued)
+}
+
+func TestConflictingUnlinkCacheWins(t *testing.T) {
+	dir, journal, cache_layer, fs := prepConflict(t, CONFLICT_CACHE_WINS)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	assert.Nil(t, cache_layer.Replay())
+	fs.AssertCalled(t, "Unlink", "/foo")
+}
+
+func TestConflictingUnlinkOfRemovedFileIsIgnored(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	cache_layer, _, fs := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+	journal.Append(&JournalEntry{
+		Op:   JOURNAL_UNLINK,
+		Path: "/foo",
+		Base: &BaseVersion{},
+	})
+	fs.On("Lstat", "/foo").Return(nil, layer.WrapError(syscall.ENOENT))
+
+	assert.Nil(t, cache_layer.Replay())
+	assert.True(t, journal.IsEmpty())
+	assert.Equal(t, 0, len(cache_layer.Conflicts()))
+}
+
+func TestRefusedConflictStaysQueued(t *testing.T) {
+	dir, journal, cache_layer, fs := prepConflict(t, CONFLICT_REFUSE)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	assert.Equal(t, errConflictRefused, cache_layer.Replay())
+	assert.Equal(t, 1, len(journal.Pending()))
+	fs.AssertNotCalled(t, "Unlink", "/foo")
+	assert.True(t, cache_layer.Conflicts()[0].Queued)
+
+	// blocked until resolved
+	assert.Nil(t, cache_layer.Replay())
+	assert.Equal(t, 1, len(journal.Pending()))
+
+	assert.Equal(t, uintptr(syscall.ENOENT), cache_layer.ResolveConflict("/bar", CONFLICT_CACHE_WINS).Errno())
+	assert.Nil(t, cache_layer.ResolveConflict("/foo", CONFLICT_CACHE_WINS))
+	for i := 0; i < 100 && !journal.IsEmpty(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, journal.IsEmpty())
+	fs.AssertCalled(t, "Unlink", "/foo")
+
+	conflicts := cache_layer.Conflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, CONFLICT_CACHE_WINS, conflicts[0].Policy)
+	assert.False(t, conflicts[0].Queued)
+}
+
+func TestBaseVersionIsKeptAcrossOfflineAttributeChanges(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+	cache_layer, cache, _ := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+
+	cache.On("FetchAttr", "/foo").Return(&cachedStat{mtime: 1, ctime: 1, size: 10}, nil).Twice()
+	cache.On("PutAttr", "/foo", mock.Anything).Return()
+	mtime := time.Unix(5, 0)
+	assert.Nil(t, cache_layer.offlineUtimens("/foo", nil, &mtime))
+
+	cache.On("FetchAttr", "/foo").Return(&cachedStat{mtime: 5, ctime: 1, size: 10}, nil)
+	assert.Equal(t, &BaseVersion{Mtime: 1, Ctime: 1, Size: 10}, cache_layer.baseOf("/foo"))
+}
+
+func TestCreateOfFileCreatedOnTheSourceIsAConflict(t *testing.T) {
+	dir, journal, cache_layer, cache, _ := prepReplay(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	tree := filepath.Join(dir, "tree")
+	ioutil.WriteFile(filepath.Join(tree, "a"), []byte("theirs"), 0600)
+	cached, _ := cache.OpenFile("/a")
+	cached.WriteData([]byte("mine"), 0)
+	journal.Append(&JournalEntry{Op: JOURNAL_CREATE, Path: "/a", Mode: 0600})
+
+	assert.Nil(t, cache_layer.Replay())
+	assert.True(t, journal.IsEmpty())
+	conflicts := cache_layer.Conflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, JOURNAL_CREATE, conflicts[0].Op)
+
+	data, _ := ioutil.ReadFile(filepath.Join(tree, "a"))
+	assert.Equal(t, "theirs", string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(tree, conflicts[0].Copy))
+	assert.Equal(t, "mine", string(data))
+}
+
+func TestCreateReplacesFileCreatedOnTheSourceIfCacheWins(t *testing.T) {
+	dir, journal, cache_layer, _, _ := prepReplay(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+	cache_layer.SetConflictPolicy(CONFLICT_CACHE_WINS)
+
+	tree := filepath.Join(dir, "tree")
+	ioutil.WriteFile(filepath.Join(tree, "a"), []byte("theirs"), 0600)
+	journal.Append(&JournalEntry{Op: JOURNAL_CREATE, Path: "/a", Mode: 0600})
+
+	assert.Nil(t, cache_layer.Replay())
+	assert.Equal(t, 1, len(cache_layer.Conflicts()))
+	data, _ := ioutil.ReadFile(filepath.Join(tree, "a"))
+	assert.Equal(t, "", string(data))
+}
@@ -1,11 +1,9 @@
 package cache
 
 import (
-	"syscall"
-
 	"github.com/horazont/dragonstash/internal/layer"
 )
 
 func IsUnavailableError(error layer.Error) bool {
-	return error.Errno() == uintptr(syscall.EIO)
+	return layer.IsUnavailableError(error)
 }
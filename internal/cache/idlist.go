@@ -1,6 +1,10 @@
 package cache
 
-import "errors"
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
 
 type idSegment struct {
 	start uint64
@@ -117,3 +121,50 @@ func (m *IDList) Release(id uint64) {
 		panic(err.Error())
 	}
 }
+
+// Write the free segments to writer, as a uint32 segment count followed by
+// the uint64 start and end of each segment, in little endian.
+func (m *IDList) Write(writer io.Writer) error {
+	nsegments := uint32(len(m.segments))
+	if err := binary.Write(writer, binary.LittleEndian, &nsegments); err != nil {
+		return err
+	}
+
+	for _, segment := range m.segments {
+		if err := binary.Write(writer, binary.LittleEndian, &segment.start); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, &segment.end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read an IDList written with Write.
+func ReadIDList(reader io.Reader) (*IDList, error) {
+	var nsegments uint32
+	if err := binary.Read(reader, binary.LittleEndian, &nsegments); err != nil {
+		return nil, err
+	}
+
+	result := NewEmptyIDList()
+	for i := uint32(0); i < nsegments; i++ {
+		var start, end uint64
+		if err := binary.Read(reader, binary.LittleEndian, &start); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &end); err != nil {
+			return nil, err
+		}
+		if start > end {
+			return nil, errors.New("invalid segment")
+		}
+		if err := result.AddBlock(start, end); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -314,3 +315,17 @@ func TestAddBlockAround(t *testing.T) {
 	assert.Equal(t, list.segments[2].start, uint64(400))
 	assert.Equal(t, list.segments[2].end, uint64(499))
 }
+
+func TestWriteAndReadIDList(t *testing.T) {
+	list := NewEmptyIDList()
+	list.AddBlock(0, 99)
+	list.AddBlock(200, 299)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, list.Write(buf))
+
+	read, err := ReadIDList(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, list.segments, read.segments)
+	assert.Equal(t, list.Count(), read.Count())
+}
@@ -0,0 +1,475 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJournalMagicMismatch = errors.New("journal: magic number mismatch")
+)
+
+var (
+	journal_MAGIC = [3]byte{0x6a, 0x6e, 0x6c}
+)
+
+const (
+	journal_VERSION = 1
+	// magic, version, padding and the replay position
+	journal_HEADER_SIZE      = 16
+	journal_POSITION_OFFSET  = 8
+	journal_RECORD_HEAD_SIZE = 8
+	journal_MAX_RECORD_SIZE  = 1 << 20
+	// value of the present flag of base versions with nanoseconds
+	journal_BASE_NSEC = 2
+)
+
+type JournalOp uint8
+
+const (
+	JOURNAL_CREATE JournalOp = iota + 1
+	JOURNAL_MKDIR
+	JOURNAL_SYMLINK
+	JOURNAL_UNLINK
+	JOURNAL_RMDIR
+	JOURNAL_RENAME
+	JOURNAL_CHMOD
+	JOURNAL_CHOWN
+	JOURNAL_UTIMENS
+	JOURNAL_WRITE
+	JOURNAL_SETXATTR
+	JOURNAL_REMOVEXATTR
+)
+
+func (m JournalOp) String() string {
+	switch m {
+	case JOURNAL_CREATE:
+		return "create"
+	case JOURNAL_MKDIR:
+		return "mkdir"
+	case JOURNAL_SYMLINK:
+		return "symlink"
+	case JOURNAL_UNLINK:
+		return "unlink"
+	case JOURNAL_RMDIR:
+		return "rmdir"
+	case JOURNAL_RENAME:
+		return "rename"
+	case JOURNAL_CHMOD:
+		return "chmod"
+	case JOURNAL_CHOWN:
+		return "chown"
+	case JOURNAL_UTIMENS:
+		return "utimens"
+	case JOURNAL_WRITE:
+		return "write"
+	case JOURNAL_SETXATTR:
+		return "setxattr"
+	case JOURNAL_REMOVEXATTR:
+		return "removexattr"
+	}
+	return "unknown"
+}
+
+// A modification which has been applied to the cache, but not to the source.
+//
+// Which fields are used depends on Op:
+//
+// - CREATE, MKDIR, CHMOD: Path, Mode
+// - SYMLINK: Path, Target (the link destination)
+// - UNLINK, RMDIR: Path
+// - RENAME: Path, Target (the new path)
+// - CHOWN: Path, UID, GID
+// - UTIMENS: Path, Atime, Mtime (nil if unchanged)
+// - WRITE: Path
+// - SETXATTR: Path, Target (the attribute name), Value
+// - REMOVEXATTR: Path, Target (the attribute name)
+//
+// WRITE entries do not carry data. They record that the file has dirty blocks
+// in the cache, which are written back to the source on replay.
+//
+// WRITE and UNLINK entries carry the version of the object they are based on
+// in Base, unless the object has been created offline. CHMOD, CHOWN and
+// UTIMENS entries carry it as well, as they change the cached attributes which
+// later entries would otherwise be based on; they are not checked for
+// conflicts.
+type JournalEntry struct {
+	Op     JournalOp
+	Path   string
+	Target string
+	Mode   uint32
+	UID    uint32
+	GID    uint32
+	Atime  *time.Time
+	Mtime  *time.Time
+	Base   *BaseVersion
+	Value  []byte
+
+	// Offset of the end of the record in the journal file
+	end int64
+}
+
+// An ordered, durable log of modifications made while the source was
+// unavailable.
+//
+// Entries are appended to a file and synced to disk before Append returns.
+// The file header holds the position up to which entries have been replayed;
+// it is advanced with Commit. Once all entries have been committed, the file
+// is truncated.
+//
+// A record which has not been written completely (e.g. because of a crash)
+// is detected by its checksum and discarded, together with everything after
+// it, when the journal is opened.
+type Journal struct {
+	lock    *sync.Mutex
+	file    *os.File
+	size    int64
+	pending []*JournalEntry
+}
+
+// Open the journal at path, creating it if needed.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Journal{
+		lock: new(sync.Mutex),
+		file: file,
+	}
+	if err := result.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *Journal) writeHeader(position int64) error {
+	header := make([]byte, journal_HEADER_SIZE)
+	copy(header, journal_MAGIC[:])
+	header[3] = journal_VERSION
+	binary.LittleEndian.PutUint64(header[journal_POSITION_OFFSET:], uint64(position))
+	if _, err := m.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *Journal) writePosition(position int64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(position))
+	if _, err := m.file.WriteAt(buf, journal_POSITION_OFFSET); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *Journal) load() error {
+	stat, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		m.size = journal_HEADER_SIZE
+		return m.writeHeader(journal_HEADER_SIZE)
+	}
+
+	header := make([]byte, journal_HEADER_SIZE)
+	if _, err := m.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if !checkJournalMagic(header) {
+		return ErrJournalMagicMismatch
+	}
+	if header[3] != journal_VERSION {
+		return fmt.Errorf("journal: unsupported version: %d", header[3])
+	}
+	position := int64(binary.LittleEndian.Uint64(header[journal_POSITION_OFFSET:]))
+	if position < journal_HEADER_SIZE || position > stat.Size() {
+		// the journal was truncated after the last commit, but the
+		// position was not reset
+		position = journal_HEADER_SIZE
+	}
+
+	reader := io.NewSectionReader(m.file, position, stat.Size()-position)
+	offset := position
+	for {
+		entry, n, err := readJournalRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("journal: discarding incomplete record at %d: %s",
+				offset, err)
+			break
+		}
+		offset += n
+		entry.end = offset
+		m.pending = append(m.pending, entry)
+	}
+
+	if offset != stat.Size() {
+		if err := m.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	m.size = offset
+
+	if len(m.pending) == 0 {
+		return m.reset()
+	}
+	return m.writePosition(position)
+}
+
+func checkJournalMagic(header []byte) bool {
+	return bytes.Equal(header[:len(journal_MAGIC)], journal_MAGIC[:])
+}
+
+// Must be called with the lock held
+func (m *Journal) reset() error {
+	if err := m.file.Truncate(journal_HEADER_SIZE); err != nil {
+		return err
+	}
+	m.size = journal_HEADER_SIZE
+	return m.writePosition(journal_HEADER_SIZE)
+}
+
+// Append an entry and sync it to disk.
+func (m *Journal) Append(entry *JournalEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	record := encodeJournalRecord(entry)
+	if _, err := m.file.WriteAt(record, m.size); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+
+	copied := *entry
+	m.size += int64(len(record))
+	copied.end = m.size
+	m.pending = append(m.pending, &copied)
+	return nil
+}
+
+// Return the entries which have not been committed yet, oldest first.
+func (m *Journal) Pending() []*JournalEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	result := make([]*JournalEntry, len(m.pending))
+	copy(result, m.pending)
+	return result
+}
+
+// Return whether there are entries which have not been committed yet.
+func (m *Journal) IsEmpty() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.pending) == 0
+}
+
+// Mark the oldest pending entry as replayed.
+//
+// entry must be the first entry returned by Pending.
+func (m *Journal) Commit(entry *JournalEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.pending) == 0 || m.pending[0].end != entry.end {
+		return errors.New("journal: commit out of order")
+	}
+	m.pending = m.pending[1:]
+
+	if len(m.pending) == 0 {
+		return m.reset()
+	}
+	return m.writePosition(entry.end)
+}
+
+func (m *Journal) Close() error {
+	return m.file.Close()
+}
+
+func putJournalString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func putJournalTime(buf *bytes.Buffer, t *time.Time) {
+	if t == nil {
+		buf.WriteByte(0)
+		return
+	}
+	buf.WriteByte(1)
+	binary.Write(buf, binary.LittleEndian, t.UnixNano())
+}
+
+func putJournalBase(buf *bytes.Buffer, base *BaseVersion) {
+	if base == nil {
+		buf.WriteByte(0)
+		return
+	}
+	buf.WriteByte(journal_BASE_NSEC)
+	binary.Write(buf, binary.LittleEndian, base.Mtime)
+	binary.Write(buf, binary.LittleEndian, base.Ctime)
+	binary.Write(buf, binary.LittleEndian, base.Size)
+	binary.Write(buf, binary.LittleEndian, base.MtimeNsec)
+	binary.Write(buf, binary.LittleEndian, base.CtimeNsec)
+}
+
+// Encode an entry as a record: uint32 payload length, uint32 CRC32 of the
+// payload, payload.
+func encodeJournalRecord(entry *JournalEntry) []byte {
+	payload := &bytes.Buffer{}
+	payload.WriteByte(byte(entry.Op))
+	putJournalString(payload, entry.Path)
+	putJournalString(payload, entry.Target)
+	binary.Write(payload, binary.LittleEndian, entry.Mode)
+	binary.Write(payload, binary.LittleEndian, entry.UID)
+	binary.Write(payload, binary.LittleEndian, entry.GID)
+	putJournalTime(payload, entry.Atime)
+	putJournalTime(payload, entry.Mtime)
+	putJournalBase(payload, entry.Base)
+	binary.Write(payload, binary.LittleEndian, uint32(len(entry.Value)))
+	payload.Write(entry.Value)
+
+	record := make([]byte, journal_RECORD_HEAD_SIZE, journal_RECORD_HEAD_SIZE+payload.Len())
+	binary.LittleEndian.PutUint32(record, uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(record, payload.Bytes()...)
+}
+
+func readJournalString(reader io.Reader) (string, error) {
+	var slen uint32
+	if err := binary.Read(reader, binary.LittleEndian, &slen); err != nil {
+		return "", err
+	}
+	buf := make([]byte, slen)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func readJournalTime(reader io.Reader) (*time.Time, error) {
+	var present uint8
+	if err := binary.Read(reader, binary.LittleEndian, &present); err != nil {
+		return nil, err
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	var nsec int64
+	if err := binary.Read(reader, binary.LittleEndian, &nsec); err != nil {
+		return nil, err
+	}
+	t := time.Unix(0, nsec)
+	return &t, nil
+}
+
+func readJournalBase(reader *bytes.Reader) (*BaseVersion, error) {
+	if reader.Len() == 0 {
+		// records written before base versions were introduced
+		return nil, nil
+	}
+	present, err := reader.ReadByte()
+	if err != nil || present == 0 {
+		return nil, err
+	}
+	base := &BaseVersion{}
+	fields := []interface{}{&base.Mtime, &base.Ctime, &base.Size}
+	if present == journal_BASE_NSEC {
+		fields = append(fields, &base.MtimeNsec, &base.CtimeNsec)
+	} else {
+		base.seconds_only = true
+	}
+	for _, field := range fields {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	return base, nil
+}
+
+func readJournalValue(reader *bytes.Reader) ([]byte, error) {
+	if reader.Len() == 0 {
+		// records written before values were introduced
+		return nil, nil
+	}
+	var vlen uint32
+	if err := binary.Read(reader, binary.LittleEndian, &vlen); err != nil || vlen == 0 {
+		return nil, err
+	}
+	value := make([]byte, vlen)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Read a record; returns io.EOF only if there is no data left at all.
+func readJournalRecord(reader io.Reader) (entry *JournalEntry, n int64, err error) {
+	head := make([]byte, journal_RECORD_HEAD_SIZE)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(head)
+	checksum := binary.LittleEndian.Uint32(head[4:])
+	if length > journal_MAX_RECORD_SIZE {
+		return nil, 0, errors.New("record too long")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	entry = &JournalEntry{}
+	payload_reader := bytes.NewReader(payload)
+	var op uint8
+	if err := binary.Read(payload_reader, binary.LittleEndian, &op); err != nil {
+		return nil, 0, err
+	}
+	entry.Op = JournalOp(op)
+	if entry.Path, err = readJournalString(payload_reader); err != nil {
+		return nil, 0, err
+	}
+	if entry.Target, err = readJournalString(payload_reader); err != nil {
+		return nil, 0, err
+	}
+	for _, field := range []*uint32{&entry.Mode, &entry.UID, &entry.GID} {
+		if err := binary.Read(payload_reader, binary.LittleEndian, field); err != nil {
+			return nil, 0, err
+		}
+	}
+	if entry.Atime, err = readJournalTime(payload_reader); err != nil {
+		return nil, 0, err
+	}
+	if entry.Mtime, err = readJournalTime(payload_reader); err != nil {
+		return nil, 0, err
+	}
+	if entry.Base, err = readJournalBase(payload_reader); err != nil {
+		return nil, 0, err
+	}
+	if entry.Value, err = readJournalValue(payload_reader); err != nil {
+		return nil, 0, err
+	}
+
+	return entry, int64(journal_RECORD_HEAD_SIZE + length), nil
+}
@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prepJournal(t *testing.T) (string, *Journal) {
+	dir, err := ioutil.TempDir("", "dragonstash-journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal, err := OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, journal
+}
+
+func TestJournalAppendAndReopen(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1234, 5678)
+	assert.Nil(t, journal.Append(&JournalEntry{Op: JOURNAL_MKDIR, Path: "dir", Mode: 0755}))
+	assert.Nil(t, journal.Append(&JournalEntry{Op: JOURNAL_RENAME, Path: "a", Target: "dir/b"}))
+	assert.Nil(t, journal.Append(&JournalEntry{Op: JOURNAL_UTIMENS, Path: "dir/b", Mtime: &mtime}))
+	journal.Close()
+
+	journal, err := OpenJournal(filepath.Join(dir, "journal"))
+	assert.Nil(t, err)
+	defer journal.Close()
+
+	entries := journal.Pending()
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, JOURNAL_MKDIR, entries[0].Op)
+	assert.Equal(t, "dir", entries[0].Path)
+	assert.Equal(t, uint32(0755), entries[0].Mode)
+	assert.Equal(t, "dir/b", entries[1].Target)
+	assert.Nil(t, entries[2].Atime)
+	assert.Equal(t, mtime.UnixNano(), entries[2].Mtime.UnixNano())
+}
+
+func TestJournalCommitSurvivesReopen(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "a"})
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "b"})
+	assert.Nil(t, journal.Commit(journal.Pending()[0]))
+	journal.Close()
+
+	journal, err := OpenJournal(filepath.Join(dir, "journal"))
+	assert.Nil(t, err)
+	defer journal.Close()
+
+	entries := journal.Pending()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "b", entries[0].Path)
+}
+
+func TestJournalCommitOutOfOrderFails(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "a"})
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "b"})
+	assert.NotNil(t, journal.Commit(journal.Pending()[1]))
+	assert.Equal(t, 2, len(journal.Pending()))
+}
+
+func TestJournalTruncatesWhenEmpty(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "a"})
+	assert.False(t, journal.IsEmpty())
+	assert.Nil(t, journal.Commit(journal.Pending()[0]))
+	assert.True(t, journal.IsEmpty())
+
+	stat, err := os.Stat(filepath.Join(dir, "journal"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(journal_HEADER_SIZE), stat.Size())
+}
+
+func TestJournalDiscardsTornRecord(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "a"})
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "b"})
+	journal.Close()
+
+	path := filepath.Join(dir, "journal")
+	stat, _ := os.Stat(path)
+	os.Truncate(path, stat.Size()-1)
+
+	journal, err := OpenJournal(path)
+	assert.Nil(t, err)
+	entries := journal.Pending()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "a", entries[0].Path)
+
+	// appending after the discarded record must work
+	assert.Nil(t, journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "c"}))
+	journal.Close()
+
+	journal, err = OpenJournal(path)
+	assert.Nil(t, err)
+	defer journal.Close()
+	assert.Equal(t, 2, len(journal.Pending()))
+}
+
+func TestJournalRejectsForeignFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dragonstash-journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	ioutil.WriteFile(path, []byte("this is not a journal"), 0600)
+	_, err = OpenJournal(path)
+	assert.Equal(t, ErrJournalMagicMismatch, err)
+}
+
+func TestJournalStoresBaseVersion(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+
+	base := &BaseVersion{Mtime: 1, Ctime: 2, Size: 3, MtimeNsec: 4, CtimeNsec: 5}
+	journal.Append(&JournalEntry{Op: JOURNAL_WRITE, Path: "a", Base: base})
+	journal.Append(&JournalEntry{Op: JOURNAL_WRITE, Path: "b"})
+	journal.Close()
+
+	journal, err := OpenJournal(filepath.Join(dir, "journal"))
+	assert.Nil(t, err)
+	defer journal.Close()
+
+	entries := journal.Pending()
+	assert.Equal(t, base, entries[0].Base)
+	assert.Nil(t, entries[1].Base)
+}
+
+func TestJournalReadsBaseVersionWithoutNsec(t *testing.T) {
+	record := &bytes.Buffer{}
+	record.WriteByte(1)
+	for _, value := range []uint64{1, 2, 3} {
+		binary.Write(record, binary.LittleEndian, value)
+	}
+
+	base, err := readJournalBase(bytes.NewReader(record.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, &BaseVersion{Mtime: 1, Ctime: 2, Size: 3, seconds_only: true}, base)
+}
+
+func TestJournalStoresXattrValue(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+
+	journal.Append(&JournalEntry{
+		Op:     JOURNAL_SETXATTR,
+		Path:   "a",
+		Target: "user.foo",
+		Value:  []byte("bar\x00baz"),
+	})
+	journal.Append(&JournalEntry{Op: JOURNAL_REMOVEXATTR, Path: "a", Target: "user.foo"})
+	journal.Close()
+
+	journal, err := OpenJournal(filepath.Join(dir, "journal"))
+	assert.Nil(t, err)
+	defer journal.Close()
+
+	entries := journal.Pending()
+	assert.Equal(t, JOURNAL_SETXATTR, entries[0].Op)
+	assert.Equal(t, "user.foo", entries[0].Target)
+	assert.Equal(t, []byte("bar\x00baz"), entries[0].Value)
+	assert.Equal(t, JOURNAL_REMOVEXATTR, entries[1].Op)
+	assert.Nil(t, entries[1].Value)
+}
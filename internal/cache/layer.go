@@ -2,23 +2,96 @@ package cache
 
 import (
 	"log"
+	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/horazont/dragonstash/internal/layer"
 )
 
+// CacheLayer combines a source file system with a cache.
+//
+// Whether the source or the cache is asked first depends on fs.IsReady(),
+// which is called for every operation. fs should thus be a health.Monitor (or
+// something equally cheap) instead of a raw backend.
+//
+// Modifying operations are written through to the source and then applied to
+// the cache. While the source is not ready, they are applied to the cache only
+// and recorded in the journal (see SetJournal), which is replayed when the
+// source is back. Without a journal, they fail with EROFS instead.
+//
+// As long as the journal is not empty, the source is behind the cache and all
+// operations are served from the cache, even if the source is ready.
 type CacheLayer struct {
-	cache Cache
-	fs    layer.FileSystem
+	cache   Cache
+	fs      layer.FileSystem
+	journal *Journal
+
+	lock *sync.Mutex
+	// Paths which have a WRITE entry in the journal which has not been
+	// replayed yet
+	pendingWrites map[string]bool
+	// Open files, whose paths have to be updated on offline renames
+	files     map[*CacheLayerFile]bool
+	replaying bool
+
+	conflictPolicy ConflictPolicy
+	conflicts      []Conflict
+	// Policies for queued conflicts, by path
+	resolutions map[string]ConflictPolicy
+	// Whether the replay is stopped at a queued conflict
+	blocked bool
+	// Attributes on the source after replaying an entry, by path
+	replayed map[string]*BaseVersion
+
+	locks          *lockTable
+	offlineLocking bool
+
+	readAhead ReadAheadStrategy
 }
 
 func NewCacheLayer(cache Cache, fs layer.FileSystem) *CacheLayer {
 	return &CacheLayer{
-		cache: cache,
-		fs:    fs,
+		cache:         cache,
+		fs:            fs,
+		lock:          new(sync.Mutex),
+		pendingWrites: make(map[string]bool),
+		files:         make(map[*CacheLayerFile]bool),
+		resolutions:   make(map[string]ConflictPolicy),
+		replayed:      make(map[string]*BaseVersion),
+		locks:         newLockTable(),
 	}
 }
 
+// Enable offline modifications, which are recorded in journal.
+//
+// Must be called before the CacheLayer is used.
+func (m *CacheLayer) SetJournal(journal *Journal) {
+	m.journal = journal
+}
+
+// Return whether operations go to the source.
+//
+// If the source is ready, but there are journal entries left, a replay is
+// started in the background. Once the journal is empty, emulated locks are
+// re-acquired on the source in the background.
+func (m *CacheLayer) online() bool {
+	if !m.fs.IsReady() {
+		return false
+	}
+	if m.journal == nil || m.journal.IsEmpty() {
+		if m.locks.needsReacquire() {
+			go m.reacquireLocks()
+		}
+		return true
+	}
+	if m.canStartReplay() {
+		go m.Replay()
+	}
+	return false
+}
+
 func (m *CacheLayer) IsReady() bool {
 	return true
 }
@@ -29,57 +102,106 @@ func (m *CacheLayer) Join(elems ...string) string {
 
 func (m *CacheLayer) Lstat(path string) (layer.FileStat, layer.Error) {
 	log.Printf("Lstat(%s)", path)
-	if !m.fs.IsReady() {
+	if !m.online() {
 		return m.cache.FetchAttr(path)
 	}
-	stat, err := m.fs.Lstat(path)
+	stat, err := m.refresh(path)
 	if err == nil {
-		m.cache.PutAttr(path, stat)
-	} else {
-		// FIXME: check for connectivity errors and fall back to cache
-		// instead of deleting it
-		m.cache.PutNonExistant(path)
+		return m.withCachedIno(path, stat), nil
+	}
+
+	if layer.IsUnavailableError(err) {
+		log.Printf("Lstat(%s): source unavailable (%s), using cache",
+			path, err)
+		return m.cache.FetchAttr(path)
 	}
-	return stat, err
+	return nil, err
+}
+
+// Attributes from the source with the inode number from the cache
+type cachedInoStat struct {
+	layer.FileStat
+	ino uint64
+}
+
+func (m *cachedInoStat) Ino() uint64 {
+	return m.ino
+}
+
+// Replace the inode number of attributes from the source with the one the
+// cache has assigned, so that inode numbers are the same whether the source is
+// available or not. The inode number is zero if the path is not in the cache.
+func (m *CacheLayer) withCachedIno(path string, stat layer.FileStat) layer.FileStat {
+	var ino uint64
+	if cached, err := m.cache.FetchAttr(path); err == nil {
+		ino = cached.Ino()
+	}
+	return &cachedInoStat{stat, ino}
 }
 
 func (m *CacheLayer) OpenDir(path string) ([]layer.DirEntry, layer.Error) {
-	if !m.fs.IsReady() {
+	if !m.online() {
 		return m.cache.FetchDir(path)
-	} else {
-		entries, err := m.fs.OpenDir(path)
-		// we don’t cache errors, for now
-		// FIXME: check for connectivity errors
-		if err != nil {
-			m.cache.PutNonExistant(path)
-			return entries, err
-		}
+	}
 
+	entries, err := m.fs.OpenDir(path)
+	if err == nil {
 		m.cache.PutDir(path, entries)
-		return entries, err
+		return entries, nil
+	}
+
+	switch layer.ClassifyError(err) {
+	case layer.ERRCLASS_NOT_FOUND:
+		m.cache.PutNonExistant(path)
+	case layer.ERRCLASS_UNAVAILABLE:
+		log.Printf("OpenDir(%s): source unavailable (%s), using cache",
+			path, err)
+		return m.cache.FetchDir(path)
 	}
+	return nil, err
 }
 
 func (m *CacheLayer) Readlink(path string) (string, layer.Error) {
-	if !m.fs.IsReady() {
+	if !m.online() {
 		return m.cache.FetchLink(path)
-	} else {
-		dest, err := m.fs.Readlink(path)
-		if err == nil {
-			m.cache.PutLink(path, dest)
-		} else {
-			// FIXME: check for connectivity errors and fall back to
-			// cache
-			m.cache.PutNonExistant(path)
-		}
-		return dest, err
 	}
+
+	dest, err := m.fs.Readlink(path)
+	if err == nil {
+		m.cache.PutLink(path, dest)
+		return dest, nil
+	}
+
+	switch layer.ClassifyError(err) {
+	case layer.ERRCLASS_NOT_FOUND:
+		m.cache.PutNonExistant(path)
+	case layer.ERRCLASS_UNAVAILABLE:
+		log.Printf("Readlink(%s): source unavailable (%s), using cache",
+			path, err)
+		return m.cache.FetchLink(path)
+	}
+	return "", err
 }
 
 func (m *CacheLayer) OpenFile(path string, flags int) (layer.File, layer.Error) {
-	f, err := m.fs.OpenFile(path, flags)
-	if err != nil && !IsUnavailableError(err) {
-		return f, err
+	online := m.online()
+	if !online && isWriteOpen(flags) && m.journal == nil {
+		return nil, layer.WrapError(syscall.EROFS)
+	}
+
+	var f layer.File
+	if online {
+		var err layer.Error
+		f, err = m.fs.OpenFile(path, flags)
+		if err != nil && !IsUnavailableError(err) {
+			if layer.IsNotFoundError(err) {
+				m.cache.PutNonExistant(path)
+			}
+			return nil, err
+		}
+		if err == nil && flags&os.O_TRUNC != 0 {
+			m.refresh(path)
+		}
 	}
 
 	// stat, err := f.Stat()
@@ -103,16 +225,224 @@ func (m *CacheLayer) OpenFile(path string, flags int) (layer.File, layer.Error)
 		return nil, layer.WrapError(syscall.EIO)
 	}
 
-	return wrapFile(cachef, f, m.cache.BlockSize()), nil
+	result := m.wrapFile(path, cachef, f)
+	if f == nil && flags&os.O_TRUNC != 0 {
+		if err := result.Truncate(0); err != nil {
+			result.Release()
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func isWriteOpen(flags int) bool {
+	return flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0
+}
+
+// Update the cached attributes of a path from the source.
+//
+// This is also used for paths which have been modified: the attributes are
+// fetched from the source instead of being derived from the operation, so
+// that the cache sees exactly what the source did (e.g. with respect to ctime
+// or the umask).
+func (m *CacheLayer) refresh(path string) (layer.FileStat, layer.Error) {
+	stat, err := m.fs.Lstat(path)
+	if err != nil {
+		if layer.IsNotFoundError(err) {
+			m.cache.PutNonExistant(path)
+		}
+		return nil, err
+	}
+	m.cache.PutAttr(path, stat)
+	return stat, nil
+}
+
+func (m *CacheLayer) Create(path string, flags int, mode uint32) (layer.File, layer.Error) {
+	if !m.online() {
+		return m.offlineCreate(path, flags, mode)
+	}
+
+	f, err := m.fs.Create(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	m.refresh(path)
+
+	cachef, err := m.cache.OpenFile(path)
+	if err != nil {
+		log.Printf("failed to open cache store for %#v: %s",
+			path,
+			err,
+		)
+	}
+
+	return m.wrapFile(path, cachef, f), nil
+}
+
+func (m *CacheLayer) Mkdir(path string, mode uint32) layer.Error {
+	if !m.online() {
+		return m.offlineMkdir(path, mode)
+	}
+
+	if err := m.fs.Mkdir(path, mode); err != nil {
+		return err
+	}
+	m.refresh(path)
+	return nil
+}
+
+func (m *CacheLayer) Unlink(path string) layer.Error {
+	if !m.online() {
+		return m.offlineUnlink(path)
+	}
+
+	if err := m.fs.Unlink(path); err != nil {
+		return err
+	}
+	m.cache.PutNonExistant(path)
+	return nil
+}
+
+func (m *CacheLayer) Rmdir(path string) layer.Error {
+	if !m.online() {
+		return m.offlineRmdir(path)
+	}
+
+	if err := m.fs.Rmdir(path); err != nil {
+		return err
+	}
+	m.cache.PutNonExistant(path)
+	return nil
+}
+
+// Rename a path on the source.
+//
+// The cached data moves along, so that open files keep their cached data, and
+// the attributes of the target are fetched anew. If the old path is not
+// cached, the replaced target is dropped from the cache.
+func (m *CacheLayer) Rename(oldpath string, newpath string) layer.Error {
+	if !m.online() {
+		return m.offlineRename(oldpath, newpath)
+	}
+
+	if err := m.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	if err := m.cache.Move(oldpath, newpath); err != nil {
+		m.cache.PutNonExistant(oldpath)
+		m.cache.PutNonExistant(newpath)
+	}
+	m.renameOpenFiles(oldpath, newpath)
+	m.lock.Unlock()
+
+	m.refresh(newpath)
+	return nil
+}
+
+// Make the open files and the pending offline writes at and below oldpath
+// follow a rename to newpath.
+//
+// Must be called with the lock held.
+func (m *CacheLayer) renameOpenFiles(oldpath string, newpath string) {
+	for f := range m.files {
+		if hasPathPrefix(f.path, oldpath) {
+			f.path = newpath + f.path[len(oldpath):]
+		}
+	}
+	for path := range m.pendingWrites {
+		if hasPathPrefix(path, oldpath) {
+			delete(m.pendingWrites, path)
+			m.pendingWrites[newpath+path[len(oldpath):]] = true
+		}
+	}
+}
+
+func (m *CacheLayer) Symlink(target string, path string) layer.Error {
+	if !m.online() {
+		return m.offlineSymlink(target, path)
+	}
+
+	if err := m.fs.Symlink(target, path); err != nil {
+		return err
+	}
+	m.refresh(path)
+	m.cache.PutLink(path, target)
+	return nil
+}
+
+func (m *CacheLayer) Chmod(path string, mode uint32) layer.Error {
+	if !m.online() {
+		return m.offlineChmod(path, mode)
+	}
+
+	if err := m.fs.Chmod(path, mode); err != nil {
+		return err
+	}
+	m.refresh(path)
+	return nil
+}
+
+func (m *CacheLayer) Chown(path string, uid uint32, gid uint32) layer.Error {
+	if !m.online() {
+		return m.offlineChown(path, uid, gid)
+	}
+
+	if err := m.fs.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	m.refresh(path)
+	return nil
+}
+
+func (m *CacheLayer) Truncate(path string, size uint64) layer.Error {
+	if !m.online() {
+		return m.offlineTruncate(path, size)
+	}
+
+	if err := m.fs.Truncate(path, size); err != nil {
+		return err
+	}
+	m.refresh(path)
+	return nil
+}
+
+func (m *CacheLayer) Utimens(path string, atime *time.Time, mtime *time.Time) layer.Error {
+	if !m.online() {
+		return m.offlineUtimens(path, atime, mtime)
+	}
+
+	if err := m.fs.Utimens(path, atime, mtime); err != nil {
+		return err
+	}
+	m.refresh(path)
+	return nil
 }
 
 type CacheLayerFile struct {
 	blocksize int64
 	cacheside CachedFile
-	fsside    layer.File
+
+	// Protects fsside, which is dropped when the source goes away during
+	// a write
+	lock   sync.Mutex
+	fsside layer.File
+
+	// The layer and path are needed to record offline modifications;
+	// the path is protected by the lock of the layer.
+	layer *CacheLayer
+	path  string
+	// Whether data has been written to the source
+	written bool
+	// The file on the source which holds the locks if there is no fsside;
+	// protected by the lock of the lock table of the layer
+	lockside layer.File
+	// Reading ahead of sequential reads, if enabled and both sides exist
+	ahead *readAhead
 }
 
-func wrapFile(cacheside CachedFile, fsside layer.File, blocksize int64) layer.File {
+func wrapFile(cacheside CachedFile, fsside layer.File, blocksize int64) *CacheLayerFile {
 	return &CacheLayerFile{
 		blocksize: blocksize,
 		cacheside: cacheside,
@@ -120,6 +450,28 @@ func wrapFile(cacheside CachedFile, fsside layer.File, blocksize int64) layer.Fi
 	}
 }
 
+func (m *CacheLayer) wrapFile(path string, cacheside CachedFile, fsside layer.File) *CacheLayerFile {
+	result := wrapFile(cacheside, fsside, m.cache.BlockSize())
+	result.layer = m
+	result.path = path
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.files[result] = true
+	if m.readAhead != nil && cacheside != nil && fsside != nil {
+		result.ahead = newReadAhead(m.readAhead)
+	}
+	return result
+}
+
+// Return the number of files which are currently open through the layer.
+func (m *CacheLayer) OpenFiles() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.files)
+}
+
 func alignRead(
 	position int64,
 	length int64,
@@ -140,14 +492,22 @@ func alignRead(
 }
 
 func (m *CacheLayerFile) Read(dest []byte, position int64) (int, layer.Error) {
+	fsside := m.source()
 	if m.cacheside == nil {
-		return m.fsside.Read(dest, position)
+		return fsside.Read(dest, position)
 	}
 
-	if m.fsside == nil {
+	if fsside == nil {
 		return m.cacheside.FetchData(dest, uint64(position))
 	}
 
+	if m.ahead != nil {
+		if n, ok := m.readAheadData(dest, position); ok {
+			m.observeRead(position, n)
+			return n, nil
+		}
+	}
+
 	new_position, new_length, offset := alignRead(
 		position,
 		int64(len(dest)),
@@ -160,7 +520,7 @@ func (m *CacheLayerFile) Read(dest []byte, position int64) (int, layer.Error) {
 		buffer = make([]byte, new_length)
 	}
 
-	n, err := m.fsside.Read(buffer, new_position)
+	n, err := fsside.Read(buffer, new_position)
 	if err != nil {
 		if IsUnavailableError(err) {
 			// read data from cache instead
@@ -171,7 +531,7 @@ func (m *CacheLayerFile) Read(dest []byte, position int64) (int, layer.Error) {
 			return n, err
 		}
 	}
-	m.cacheside.PutData(buffer[:n], uint64(new_position))
+	m.cacheside.PutData(buffer[:n], uint64(new_position), QUOTA_BLOCK_PRIO_READ)
 
 	start := offset
 	end := offset + int64(len(dest))
@@ -186,19 +546,270 @@ func (m *CacheLayerFile) Read(dest []byte, position int64) (int, layer.Error) {
 
 	copy(dest, buffer[start:end])
 
+	if m.ahead != nil {
+		m.observeRead(position, n)
+	}
+	return n, err
+}
+
+func (m *CacheLayerFile) Write(data []byte, position int64) (int, layer.Error) {
+	if m.ahead != nil {
+		m.ahead.reset()
+	}
+	fsside := m.source()
+	if fsside == nil {
+		return m.writeOffline(data, position)
+	}
+
+	n, err := fsside.Write(data, position)
+	if err != nil && IsUnavailableError(err) && m.canJournal() {
+		log.Printf("Write(): source unavailable (%s), writing to cache", err)
+		// reading from the source would return the data from before
+		// the offline writes
+		m.detachSource()
+		return m.writeOffline(data, position)
+	}
+	if n > 0 {
+		m.written = true
+	}
+	if n > 0 && m.cacheside != nil {
+		m.putWritten(data[:n], position)
+	}
 	return n, err
 }
 
+// Return the file on the source, or nil if the file is served from the cache
+// only.
+func (m *CacheLayerFile) source() layer.File {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.fsside
+}
+
+// Serve the file from the cache only from now on, so that data written
+// offline is not overwritten by the stale data of the source.
+//
+// The file on the source is kept open until the file is released, as it
+// holds the locks of the file.
+func (m *CacheLayerFile) detachSource() {
+	if m.layer != nil {
+		m.layer.locks.lock.Lock()
+		defer m.layer.locks.lock.Unlock()
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.fsside == nil {
+		return
+	}
+	if m.lockside == nil {
+		m.lockside = m.fsside
+	} else {
+		m.fsside.Release()
+	}
+	m.fsside = nil
+}
+
+func (m *CacheLayerFile) canJournal() bool {
+	return m.cacheside != nil && m.layer != nil && m.layer.journal != nil
+}
+
+// Write data into the cache only and record that in the journal.
+func (m *CacheLayerFile) writeOffline(data []byte, position int64) (int, layer.Error) {
+	if !m.canJournal() {
+		return 0, layer.WrapError(syscall.EROFS)
+	}
+
+	if err := m.layer.recordWrite(m); err != nil {
+		return 0, err
+	}
+	if err := m.cacheside.WriteData(data, uint64(position)); err != nil {
+		log.Printf("Write(): cannot write to cache: %s", err)
+		if err == ErrCacheFull {
+			return 0, layer.WrapError(syscall.ENOSPC)
+		}
+		// the rest of a partially written block is not in the cache
+		return 0, layer.WrapError(syscall.EIO)
+	}
+	return len(data), nil
+}
+
+// Store data which has been written to the source in the cache.
+//
+// The cache rejects partial blocks unless the rest of the block is cached
+// already. The data is thus split at block boundaries, so that the full
+// blocks are stored in any case and a rejected partial block does not keep
+// the neighbouring blocks from being updated.
+func (m *CacheLayerFile) putWritten(data []byte, position int64) {
+	end := position + int64(len(data))
+	head_end := (position + m.blocksize - 1) / m.blocksize * m.blocksize
+	if head_end > end {
+		head_end = end
+	}
+	tail_start := end / m.blocksize * m.blocksize
+	if tail_start < head_end {
+		tail_start = head_end
+	}
+
+	for _, piece := range [][2]int64{
+		{position, head_end},
+		{head_end, tail_start},
+		{tail_start, end},
+	} {
+		if piece[0] == piece[1] {
+			continue
+		}
+		err := m.cacheside.PutData(
+			data[piece[0]-position:piece[1]-position],
+			uint64(piece[0]),
+			QUOTA_BLOCK_PRIO_READ,
+		)
+		if err != nil && err != ErrMustBeAligned && err != ErrCacheFull {
+			log.Printf("failed to put written data into cache: %s", err)
+		}
+	}
+}
+
+func (m *CacheLayerFile) Truncate(size uint64) layer.Error {
+	fsside := m.source()
+	if m.ahead != nil {
+		m.ahead.reset()
+	}
+	if fsside == nil {
+		if !m.canJournal() {
+			return layer.WrapError(syscall.EROFS)
+		}
+		if err := m.layer.recordWrite(m); err != nil {
+			return err
+		}
+		return m.cacheside.Truncate(size)
+	}
+
+	if err := fsside.Truncate(size); err != nil {
+		return err
+	}
+	if m.cacheside != nil {
+		m.cacheside.Truncate(size)
+	}
+	return nil
+}
+
+func (m *CacheLayerFile) Chmod(mode uint32) layer.Error {
+	fsside := m.source()
+	if fsside == nil {
+		if !m.canJournal() {
+			return layer.WrapError(syscall.EROFS)
+		}
+		entry := &JournalEntry{Op: JOURNAL_CHMOD, Mode: mode}
+		if err := m.layer.recordFor(m, entry); err != nil {
+			return err
+		}
+		return m.cacheside.Chmod(mode)
+	}
+
+	if err := fsside.Chmod(mode); err != nil {
+		return err
+	}
+	if m.cacheside != nil {
+		m.cacheside.Chmod(mode)
+	}
+	return nil
+}
+
+func (m *CacheLayerFile) Chown(uid uint32, gid uint32) layer.Error {
+	fsside := m.source()
+	if fsside == nil {
+		if !m.canJournal() {
+			return layer.WrapError(syscall.EROFS)
+		}
+		entry := &JournalEntry{Op: JOURNAL_CHOWN, UID: uid, GID: gid}
+		if err := m.layer.recordFor(m, entry); err != nil {
+			return err
+		}
+		return m.cacheside.Chown(uid, gid)
+	}
+
+	if err := fsside.Chown(uid, gid); err != nil {
+		return err
+	}
+	if m.cacheside != nil {
+		m.cacheside.Chown(uid, gid)
+	}
+	return nil
+}
+
+func (m *CacheLayerFile) Utimens(atime *time.Time, mtime *time.Time) layer.Error {
+	fsside := m.source()
+	if fsside == nil {
+		if !m.canJournal() {
+			return layer.WrapError(syscall.EROFS)
+		}
+		entry := &JournalEntry{Op: JOURNAL_UTIMENS, Atime: atime, Mtime: mtime}
+		if err := m.layer.recordFor(m, entry); err != nil {
+			return err
+		}
+		return m.cacheside.Utimens(atime, mtime)
+	}
+
+	if err := fsside.Utimens(atime, mtime); err != nil {
+		return err
+	}
+	if m.cacheside != nil {
+		m.cacheside.Utimens(atime, mtime)
+	}
+	return nil
+}
+
+func (m *CacheLayerFile) Sync() layer.Error {
+	fsside := m.source()
+	if m.cacheside != nil {
+		m.cacheside.Sync()
+	}
+	if fsside == nil {
+		return nil
+	}
+	return fsside.Sync()
+}
+
 func (m *CacheLayerFile) Release() {
 	log.Printf("releasing cache layer file")
 
+	if m.ahead != nil {
+		m.ahead.stop()
+	}
+
+	if m.layer != nil {
+		if m.cacheside != nil {
+			m.layer.locks.releaseFile(m.cacheside, m)
+		}
+
+		m.layer.lock.Lock()
+		delete(m.layer.files, m)
+		path := m.path
+		m.layer.lock.Unlock()
+
+		// the cached attributes are the base version of offline
+		// modifications and must match the source
+		if m.written && m.layer.online() {
+			m.layer.refresh(path)
+		}
+	}
+
 	if m.cacheside != nil {
 		m.cacheside.Close()
 		m.cacheside = nil
 	}
 
+	m.lock.Lock()
 	if m.fsside != nil {
 		m.fsside.Release()
 		m.fsside = nil
 	}
+	m.lock.Unlock()
+
+	if m.lockside != nil {
+		m.lockside.Release()
+		m.lockside = nil
+	}
 }
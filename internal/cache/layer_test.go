@@ -1,6 +1,17 @@
 package cache
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/horazont/dragonstash/internal/localfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
 
 func assertEqualInt64(t *testing.T, a int64, b int64) {
 	if a != b {
@@ -66,3 +77,447 @@ func TestAlignRead(t *testing.T) {
 		assertEqualInt64(t, offs, 37)
 	})
 }
+
+func prepCacheLayer() (*CacheLayer, *mockCache, *mockFileSystem) {
+	cache := &mockCache{}
+	fs := &mockFileSystem{}
+	fs.On("IsReady").Return(true)
+	return NewCacheLayer(cache, fs), cache, fs
+}
+
+func TestLstatPutsAttrOnSuccess(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	stat := layer.NewDefaultFileStat()
+	fs.On("Lstat", "/foo").Return(stat, nil)
+	cache.On("PutAttr", "/foo", stat).Return()
+	cache.On("FetchAttr", "/foo").Return(stat, nil)
+
+	result, err := cache_layer.Lstat("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, stat.Mode(), result.Mode())
+	cache.AssertExpectations(t)
+}
+
+func TestLstatReportsCachedIno(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	stat := &cachedInoStat{layer.NewDefaultFileStat(), 1234}
+	fs.On("Lstat", "/foo").Return(stat, nil)
+	cache.On("PutAttr", "/foo", stat).Return()
+	cache.On("FetchAttr", "/foo").Return(&cachedInoStat{layer.NewDefaultFileStat(), 42}, nil)
+
+	result, err := cache_layer.Lstat("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), result.Ino())
+}
+
+func TestLstatPutsNonExistantOnENOENT(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Lstat", "/foo").Return(nil, layer.WrapError(syscall.ENOENT))
+	cache.On("PutNonExistant", "/foo").Return()
+
+	result, err := cache_layer.Lstat("/foo")
+	assert.Nil(t, result)
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+	cache.AssertExpectations(t)
+}
+
+func TestLstatFallsBackToCacheOnConnectivityErrors(t *testing.T) {
+	for _, errno := range []syscall.Errno{
+		syscall.EIO,
+		syscall.ENOTCONN,
+		syscall.ETIMEDOUT,
+		syscall.EHOSTUNREACH,
+		syscall.ESTALE,
+	} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			cache_layer, cache, fs := prepCacheLayer()
+			stat := layer.NewDefaultFileStat()
+			fs.On("Lstat", "/foo").Return(nil, layer.WrapError(errno))
+			cache.On("FetchAttr", "/foo").Return(stat, nil)
+
+			result, err := cache_layer.Lstat("/foo")
+			assert.Nil(t, err)
+			assert.Equal(t, stat, result)
+			cache.AssertExpectations(t)
+			cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+		})
+	}
+}
+
+func TestLstatKeepsCacheOnPermissionError(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Lstat", "/foo").Return(nil, layer.WrapError(syscall.EACCES))
+
+	_, err := cache_layer.Lstat("/foo")
+	assert.Equal(t, uintptr(syscall.EACCES), err.Errno())
+	cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+	cache.AssertNotCalled(t, "FetchAttr", "/foo")
+}
+
+func TestOpenDirFallsBackToCacheOnConnectivityErrors(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	entries := []layer.DirEntry{}
+	fs.On("OpenDir", "/foo").Return(nil, layer.WrapError(syscall.ENOTCONN))
+	cache.On("FetchDir", "/foo").Return(entries, nil)
+
+	result, err := cache_layer.OpenDir("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, entries, result)
+	cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+}
+
+func TestOpenDirKeepsCacheOnENOTDIR(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("OpenDir", "/foo").Return(nil, layer.WrapError(syscall.ENOTDIR))
+
+	_, err := cache_layer.OpenDir("/foo")
+	assert.Equal(t, uintptr(syscall.ENOTDIR), err.Errno())
+	cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+}
+
+func TestReadlinkFallsBackToCacheOnConnectivityErrors(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Readlink", "/foo").Return("", layer.WrapError(syscall.ETIMEDOUT))
+	cache.On("FetchLink", "/foo").Return("bar", nil)
+
+	result, err := cache_layer.Readlink("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", result)
+	cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+}
+
+func TestReadlinkKeepsCacheOnEINVAL(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Readlink", "/foo").Return("", layer.WrapError(syscall.EINVAL))
+
+	_, err := cache_layer.Readlink("/foo")
+	assert.Equal(t, uintptr(syscall.EINVAL), err.Errno())
+	cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+}
+
+func TestMkdirRefreshesAttr(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	stat := layer.NewDefaultFileStat()
+	fs.On("Mkdir", "/foo", uint32(0755)).Return(nil)
+	fs.On("Lstat", "/foo").Return(stat, nil)
+	cache.On("PutAttr", "/foo", stat).Return()
+
+	assert.Nil(t, cache_layer.Mkdir("/foo", 0755))
+	fs.AssertExpectations(t)
+	cache.AssertExpectations(t)
+}
+
+func TestUnlinkPutsNonExistant(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Unlink", "/foo").Return(nil)
+	cache.On("PutNonExistant", "/foo").Return()
+
+	assert.Nil(t, cache_layer.Unlink("/foo"))
+	cache.AssertExpectations(t)
+}
+
+func TestUnlinkKeepsCacheOnError(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Unlink", "/foo").Return(layer.WrapError(syscall.EACCES))
+
+	err := cache_layer.Unlink("/foo")
+	assert.Equal(t, uintptr(syscall.EACCES), err.Errno())
+	cache.AssertNotCalled(t, "PutNonExistant", "/foo")
+}
+
+func TestRenameMovesCacheAndRefreshesTarget(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	stat := layer.NewDefaultFileStat()
+	fs.On("Rename", "/foo", "/bar").Return(nil)
+	fs.On("Lstat", "/bar").Return(stat, nil)
+	cache.On("Move", "/foo", "/bar").Return(nil)
+	cache.On("PutAttr", "/bar", stat).Return()
+
+	assert.Nil(t, cache_layer.Rename("/foo", "/bar"))
+	cache.AssertExpectations(t)
+	cache.AssertNotCalled(t, "PutNonExistant", "/bar")
+}
+
+func TestRenameOfUncachedPathDropsTarget(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	stat := layer.NewDefaultFileStat()
+	fs.On("Rename", "/foo", "/bar").Return(nil)
+	fs.On("Lstat", "/bar").Return(stat, nil)
+	cache.On("Move", "/foo", "/bar").Return(layer.WrapError(syscall.ENOENT))
+	cache.On("PutNonExistant", "/foo").Return()
+	cache.On("PutNonExistant", "/bar").Return()
+	cache.On("PutAttr", "/bar", stat).Return()
+
+	assert.Nil(t, cache_layer.Rename("/foo", "/bar"))
+	cache.AssertExpectations(t)
+}
+
+func TestWriteToRenamedOpenFile(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	stat := layer.NewDefaultFileStat()
+	fs.On("Rename", "/foo", "/bar").Return(nil)
+	fs.On("Lstat", "/bar").Return(stat, nil)
+	cache.On("Move", "/foo", "/bar").Return(nil)
+	cache.On("PutAttr", "/bar", stat).Return()
+
+	fsside := &mockFile{}
+	cacheside := &mockCachedFile{}
+	f := cache_layer.wrapFile("/foo", cacheside, fsside)
+	assert.Nil(t, cache_layer.Rename("/foo", "/bar"))
+
+	data := []byte("new!")
+	fsside.On("Write", data, int64(0)).Return(4, nil)
+	cacheside.On("PutData", data, uint64(0), mock.Anything).Return(nil)
+	n, err := f.Write(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	cacheside.AssertExpectations(t)
+
+	// the attributes of the new path are refreshed after the write
+	f.Release()
+	fs.AssertNumberOfCalls(t, "Lstat", 2)
+	fs.AssertNotCalled(t, "Lstat", "/foo")
+}
+
+func TestModificationsFailWhileOffline(t *testing.T) {
+	cache := &mockCache{}
+	fs := &mockFileSystem{}
+	fs.On("IsReady").Return(false)
+	cache_layer := NewCacheLayer(cache, fs)
+
+	err := cache_layer.Mkdir("/foo", 0755)
+	assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+	_, err = cache_layer.OpenFile("/foo", os.O_RDWR)
+	assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+	fs.AssertNotCalled(t, "Mkdir", "/foo", uint32(0755))
+	fs.AssertNotCalled(t, "OpenFile", "/foo", os.O_RDWR)
+}
+
+func TestWriteSplitsCachePutAtBlockBoundaries(t *testing.T) {
+	fsside := &mockFile{}
+	cacheside := &mockCachedFile{}
+	f := wrapFile(cacheside, fsside, 16)
+
+	data := make([]byte, 40)
+	fsside.On("Write", data, int64(4)).Return(40, nil)
+	cacheside.On("PutData", data[:12], uint64(4), QUOTA_BLOCK_PRIO_READ).Return(ErrMustBeAligned)
+	cacheside.On("PutData", data[12:28], uint64(16), QUOTA_BLOCK_PRIO_READ).Return(nil)
+	cacheside.On("PutData", data[28:], uint64(32), QUOTA_BLOCK_PRIO_READ).Return(nil)
+
+	n, err := f.Write(data, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 40, n)
+	cacheside.AssertExpectations(t)
+}
+
+func TestWriteWithinBlockPutsOnce(t *testing.T) {
+	fsside := &mockFile{}
+	cacheside := &mockCachedFile{}
+	f := wrapFile(cacheside, fsside, 16)
+
+	data := make([]byte, 4)
+	fsside.On("Write", data, int64(18)).Return(4, nil)
+	cacheside.On("PutData", data, uint64(18), QUOTA_BLOCK_PRIO_READ).Return(nil)
+
+	_, err := f.Write(data, 18)
+	assert.Nil(t, err)
+	cacheside.AssertExpectations(t)
+	assert.Equal(t, 1, len(cacheside.Calls))
+}
+
+func TestWriteDoesNotCacheFailedWrite(t *testing.T) {
+	fsside := &mockFile{}
+	cacheside := &mockCachedFile{}
+	f := wrapFile(cacheside, fsside, 16)
+
+	data := make([]byte, 4)
+	fsside.On("Write", data, int64(0)).Return(0, layer.WrapError(syscall.ENOSPC))
+
+	_, err := f.Write(data, 0)
+	assert.Equal(t, uintptr(syscall.ENOSPC), err.Errno())
+	assert.Equal(t, 0, len(cacheside.Calls))
+}
+
+func TestWriteKeepsToCacheAfterSourceWentAway(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+	cache_layer, cache, _ := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+	cache.On("FetchAttr", "/foo").Return(&cachedStat{size: 4}, nil)
+
+	fsside := &mockFile{}
+	cacheside := &memCachedFile{priorities: make(map[int]bool)}
+	f := cache_layer.wrapFile("/foo", cacheside, fsside)
+	defer f.Release()
+
+	data := []byte("new!")
+	fsside.On("Write", data, int64(0)).Return(0, layer.WrapError(syscall.ENOTCONN))
+	n, err := f.Write(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, JOURNAL_WRITE, journal.Pending()[0].Op)
+
+	// the source would return the data from before the write
+	fsside.On("Read", mock.Anything, mock.Anything).Return(4, nil)
+	dest := make([]byte, 4)
+	n, err = f.Read(dest, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data, dest[:n])
+	fsside.AssertNotCalled(t, "Read", mock.Anything, mock.Anything)
+
+	n, err = f.Write(data, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	fsside.AssertNumberOfCalls(t, "Write", 1)
+}
+
+func TestOfflineRemovalDropsPendingWrites(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+	cache_layer, cache, _ := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+	cache.On("FetchAttr", "/foo").Return(&cachedStat{mode: syscall.S_IFREG}, nil)
+	cache.On("FetchDir", "/dir").Return([]layer.DirEntry{}, nil)
+	cache.On("PutNonExistant", mock.Anything).Return()
+
+	cache_layer.pendingWrites["/foo"] = true
+	cache_layer.pendingWrites["/dir/bar"] = true
+	cache_layer.pendingWrites["/dirt"] = true
+
+	assert.Nil(t, cache_layer.offlineUnlink("/foo"))
+	assert.Nil(t, cache_layer.offlineRmdir("/dir"))
+	assert.Equal(t, map[string]bool{"/dirt": true}, cache_layer.pendingWrites)
+}
+
+func TestResolvePathFollowsRenames(t *testing.T) {
+	later := []*JournalEntry{
+		&JournalEntry{Op: JOURNAL_RENAME, Path: "dir", Target: "other"},
+		&JournalEntry{Op: JOURNAL_RENAME, Path: "other/file", Target: "file"},
+	}
+
+	path, ok := resolvePath("dir/file", later)
+	assert.True(t, ok)
+	assert.Equal(t, "file", path)
+
+	path, ok = resolvePath("dir/file2", later)
+	assert.True(t, ok)
+	assert.Equal(t, "other/file2", path)
+
+	path, ok = resolvePath("directory", later)
+	assert.True(t, ok)
+	assert.Equal(t, "directory", path)
+}
+
+func TestResolvePathDetectsRemoval(t *testing.T) {
+	_, ok := resolvePath("dir/file", []*JournalEntry{
+		&JournalEntry{Op: JOURNAL_RMDIR, Path: "dir"},
+	})
+	assert.False(t, ok)
+
+	_, ok = resolvePath("file", []*JournalEntry{
+		&JournalEntry{Op: JOURNAL_RENAME, Path: "other", Target: "file"},
+	})
+	assert.False(t, ok)
+}
+
+func TestReplayIgnoresAlreadyAppliedEntries(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	cache_layer, _, fs := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+	journal.Append(&JournalEntry{Op: JOURNAL_MKDIR, Path: "/foo", Mode: 0755})
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "/bar"})
+	fs.On("Mkdir", "/foo", uint32(0755)).Return(layer.WrapError(syscall.EEXIST))
+	fs.On("Unlink", "/bar").Return(layer.WrapError(syscall.ENOENT))
+
+	assert.Nil(t, cache_layer.Replay())
+	assert.True(t, journal.IsEmpty())
+	fs.AssertCalled(t, "Mkdir", "/foo", uint32(0755))
+	fs.AssertCalled(t, "Unlink", "/bar")
+}
+
+func TestReplayStopsWhenSourceIsUnavailable(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	cache_layer, _, fs := prepCacheLayer()
+	cache_layer.SetJournal(journal)
+	journal.Append(&JournalEntry{Op: JOURNAL_MKDIR, Path: "/foo", Mode: 0755})
+	journal.Append(&JournalEntry{Op: JOURNAL_UNLINK, Path: "/bar"})
+	fs.On("Mkdir", "/foo", uint32(0755)).Return(layer.WrapError(syscall.EIO))
+
+	assert.NotNil(t, cache_layer.Replay())
+	assert.Equal(t, 2, len(journal.Pending()))
+	fs.AssertNotCalled(t, "Unlink", "/bar")
+}
+
+// Prepare a layer with a journal, a cache in memory and a source directory
+// below the returned temporary directory.
+func prepReplay(t *testing.T) (string, *Journal, *CacheLayer, *memCache, *switchedFileSystem) {
+	dir, journal := prepJournal(t)
+	tree := filepath.Join(dir, "tree")
+	os.Mkdir(tree, 0700)
+
+	cache := newMemCache()
+	fs := &switchedFileSystem{FileSystem: localfs.NewLocalFileSystem(tree)}
+	cache_layer := NewCacheLayer(cache, fs)
+	cache_layer.SetJournal(journal)
+	return dir, journal, cache_layer, cache, fs
+}
+
+func TestReplayedWriteStaysDirtyUntilTheSourceHasIt(t *testing.T) {
+	dir, journal, cache_layer, cache, fs := prepReplay(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	ioutil.WriteFile(filepath.Join(dir, "tree", "a"), []byte("old"), 0600)
+	cached, _ := cache.OpenFile("/a")
+	cached.WriteData([]byte("new data"), 0)
+	journal.Append(&JournalEntry{Op: JOURNAL_WRITE, Path: "/a"})
+
+	fs.truncate_err = layer.WrapError(syscall.ENOTCONN)
+	assert.NotNil(t, cache_layer.Replay())
+	assert.Equal(t, []uint64{0}, cached.DirtyBlocks())
+
+	fs.truncate_err = nil
+	assert.Nil(t, cache_layer.Replay())
+	assert.Equal(t, 0, len(cached.DirtyBlocks()))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "tree", "a"))
+	assert.Equal(t, "new data", string(data))
+}
+
+func TestReplayReportsFailedEntries(t *testing.T) {
+	dir, journal, cache_layer, _, _ := prepReplay(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	journal.Append(&JournalEntry{Op: JOURNAL_CHMOD, Path: "/missing", Mode: 0600})
+	journal.Append(&JournalEntry{Op: JOURNAL_MKDIR, Path: "/foo", Mode: 0700})
+
+	assert.Nil(t, cache_layer.Replay())
+	assert.True(t, journal.IsEmpty())
+	conflicts := cache_layer.Conflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, JOURNAL_CHMOD, conflicts[0].Op)
+	assert.NotEqual(t, "", conflicts[0].Error)
+	assert.False(t, conflicts[0].Queued)
+}
+
+func TestReplayKeepsFailedEntriesQueuedIfRefused(t *testing.T) {
+	dir, journal, cache_layer, _, _ := prepReplay(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+	cache_layer.SetConflictPolicy(CONFLICT_REFUSE)
+
+	journal.Append(&JournalEntry{Op: JOURNAL_CHMOD, Path: "/missing", Mode: 0600})
+	journal.Append(&JournalEntry{Op: JOURNAL_MKDIR, Path: "/foo", Mode: 0700})
+
+	assert.Equal(t, errConflictRefused, cache_layer.Replay())
+	assert.Equal(t, 2, len(journal.Pending()))
+	assert.True(t, cache_layer.Conflicts()[0].Queued)
+}
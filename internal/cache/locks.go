@@ -0,0 +1,507 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// Locks
+//
+// While the source is available, locks are passed to the source. Files which
+// have been opened while the source was unavailable have no handle on the
+// source; one is opened for locking when needed.
+//
+// While the source is unavailable, locks are emulated locally if enabled with
+// SetOfflineLocking. This is unsafe: other clients of the source do not see
+// emulated locks. Emulated locks are re-acquired on the source once it is back
+// and the journal has been replayed. Locks which cannot be re-acquired are
+// logged and listed by LockFailures; they are still held locally.
+//
+// Like the locks of the sources, emulated locks are held by the open file:
+// locks acquired through the same file never conflict with each other.
+
+type emulatedLock struct {
+	file *CacheLayerFile
+	// BSD lock instead of a POSIX record lock; start and end are unused
+	flock bool
+	typ   uint32
+	start uint64
+	end   uint64
+	// Whether re-acquiring the lock on the source has failed
+	failed bool
+}
+
+func (m *emulatedLock) conflicts(other *emulatedLock) bool {
+	if m.flock != other.flock || m.file == other.file {
+		return false
+	}
+	if m.typ != syscall.F_WRLCK && other.typ != syscall.F_WRLCK {
+		return false
+	}
+	return m.flock || (m.start <= other.end && other.start <= m.end)
+}
+
+func (m *emulatedLock) toLock() *layer.Lock {
+	return &layer.Lock{
+		Type:  m.typ,
+		Start: m.start,
+		End:   m.end,
+		Pid:   uint32(os.Getpid()),
+	}
+}
+
+// A lock which could not be re-acquired on the source.
+type LockFailure struct {
+	Path string
+	// Whether the lock is a BSD lock; Start and End of Lock are unused then
+	Flock bool
+	Lock  layer.Lock
+	Error string
+}
+
+type lockTable struct {
+	lock *sync.Mutex
+	// Signalled when locks are released
+	cond *sync.Cond
+	// Emulated locks by cached file
+	locks       map[CachedFile][]*emulatedLock
+	failures    []LockFailure
+	reacquiring bool
+}
+
+func newLockTable() *lockTable {
+	lock := new(sync.Mutex)
+	return &lockTable{
+		lock:  lock,
+		cond:  sync.NewCond(lock),
+		locks: make(map[CachedFile][]*emulatedLock),
+	}
+}
+
+// Must be called with the lock held
+func (m *lockTable) findConflict(key CachedFile, req *emulatedLock) *emulatedLock {
+	for _, held := range m.locks[key] {
+		if held.conflicts(req) {
+			return held
+		}
+	}
+	return nil
+}
+
+// Return a lock of another file which conflicts with req, or nil.
+func (m *lockTable) conflict(key CachedFile, req *emulatedLock) *emulatedLock {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.findConflict(key, req)
+}
+
+// Wait until req does not conflict with an emulated lock; without wait, fail
+// with EAGAIN instead.
+//
+// Must be called with the lock held
+func (m *lockTable) await(key CachedFile, req *emulatedLock, wait bool) layer.Error {
+	for m.findConflict(key, req) != nil {
+		if !wait {
+			return layer.WrapError(syscall.EAGAIN)
+		}
+		m.cond.Wait()
+	}
+	return nil
+}
+
+// Wait until req does not conflict with an emulated lock, without acquiring
+// it.
+func (m *lockTable) wait(key CachedFile, req *emulatedLock, wait bool) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.await(key, req, wait)
+}
+
+// Acquire req as emulated lock.
+func (m *lockTable) acquire(key CachedFile, req *emulatedLock, wait bool) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.await(key, req, wait); err != nil {
+		return err
+	}
+	m.set(key, req)
+	return nil
+}
+
+// Release the emulated locks of the file of req in the range of req.
+func (m *lockTable) release(key CachedFile, req *emulatedLock) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	unlock := *req
+	unlock.typ = syscall.F_UNLCK
+	m.set(key, &unlock)
+}
+
+// Replace the locks of the file of req in the range of req with req.
+//
+// Must be called with the lock held
+func (m *lockTable) set(key CachedFile, req *emulatedLock) {
+	var result []*emulatedLock
+	for _, held := range m.locks[key] {
+		if held.file != req.file || held.flock != req.flock {
+			result = append(result, held)
+			continue
+		}
+		if req.flock || held.end < req.start || held.start > req.end {
+			// BSD locks are replaced entirely
+			if !req.flock {
+				result = append(result, held)
+			}
+			continue
+		}
+		// keep the parts outside of the range of req
+		if held.start < req.start {
+			left := *held
+			left.end = req.start - 1
+			result = append(result, &left)
+		}
+		if held.end > req.end {
+			right := *held
+			right.start = req.end + 1
+			result = append(result, &right)
+		}
+	}
+	if req.typ != syscall.F_UNLCK {
+		result = append(result, req)
+	}
+
+	if len(result) == 0 {
+		delete(m.locks, key)
+	} else {
+		m.locks[key] = result
+	}
+	m.cond.Broadcast()
+}
+
+// Drop all emulated locks of a file.
+func (m *lockTable) releaseFile(key CachedFile, file *CacheLayerFile) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result []*emulatedLock
+	for _, held := range m.locks[key] {
+		if held.file != file {
+			result = append(result, held)
+		}
+	}
+	if len(result) == 0 {
+		delete(m.locks, key)
+	} else {
+		m.locks[key] = result
+	}
+	m.cond.Broadcast()
+}
+
+// Return whether there are emulated locks which have to be re-acquired.
+func (m *lockTable) needsReacquire() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.reacquiring {
+		return false
+	}
+	for _, locks := range m.locks {
+		for _, held := range locks {
+			if !held.failed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return the emulated locks which have to be re-acquired and mark the table
+// as re-acquiring; returns nil if that is already happening.
+func (m *lockTable) startReacquire() []*emulatedLock {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.reacquiring {
+		return nil
+	}
+	var result []*emulatedLock
+	for _, locks := range m.locks {
+		for _, held := range locks {
+			if !held.failed {
+				result = append(result, held)
+			}
+		}
+	}
+	m.reacquiring = len(result) > 0
+	return result
+}
+
+// Record the outcome of re-acquiring an emulated lock on the source: on
+// success, the lock is not emulated anymore.
+func (m *lockTable) reacquired(key CachedFile, held *emulatedLock, path string, err layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err != nil {
+		held.failed = true
+		failure := LockFailure{
+			Path:  path,
+			Flock: held.flock,
+			Lock:  *held.toLock(),
+			Error: err.Error(),
+		}
+		log.Printf("locks: failed to re-acquire lock on %s: %s", path, err)
+		m.failures = append(m.failures, failure)
+		return
+	}
+
+	var result []*emulatedLock
+	for _, other := range m.locks[key] {
+		if other != held {
+			result = append(result, other)
+		}
+	}
+	if len(result) == 0 {
+		delete(m.locks, key)
+	} else {
+		m.locks[key] = result
+	}
+}
+
+func (m *lockTable) doneReacquire() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.reacquiring = false
+}
+
+// Enable emulation of locks while the source is unavailable.
+func (m *CacheLayer) SetOfflineLocking(enabled bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.offlineLocking = enabled
+}
+
+func (m *CacheLayer) canEmulateLocks() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.offlineLocking
+}
+
+// Return the locks which could not be re-acquired on the source.
+func (m *CacheLayer) LockFailures() []LockFailure {
+	m.locks.lock.Lock()
+	defer m.locks.lock.Unlock()
+
+	result := make([]LockFailure, len(m.locks.failures))
+	copy(result, m.locks.failures)
+	return result
+}
+
+// Re-acquire the emulated locks on the source.
+func (m *CacheLayer) reacquireLocks() {
+	locks := m.locks.startReacquire()
+	if locks == nil {
+		return
+	}
+	defer m.locks.doneReacquire()
+
+	for _, held := range locks {
+		file := held.file
+		src, err := file.lockHandle()
+		if err == nil {
+			if held.flock {
+				err = src.Flock(flockHow(held.typ) | syscall.LOCK_NB)
+			} else {
+				err = src.SetLk(0, held.toLock(), false)
+			}
+		}
+		if err != nil && IsUnavailableError(err) {
+			// try again when the source is back
+			log.Printf("locks: source unavailable while re-acquiring locks: %s", err)
+			return
+		}
+
+		m.lock.Lock()
+		path := file.path
+		m.lock.Unlock()
+		m.locks.reacquired(file.cacheside, held, path, err)
+	}
+}
+
+func flockType(how int) uint32 {
+	switch how &^ syscall.LOCK_NB {
+	case syscall.LOCK_SH:
+		return syscall.F_RDLCK
+	case syscall.LOCK_EX:
+		return syscall.F_WRLCK
+	}
+	return syscall.F_UNLCK
+}
+
+func flockHow(typ uint32) int {
+	switch typ {
+	case syscall.F_RDLCK:
+		return syscall.LOCK_SH
+	case syscall.F_WRLCK:
+		return syscall.LOCK_EX
+	}
+	return syscall.LOCK_UN
+}
+
+// Return the file on the source which holds the locks of m.
+//
+// For files opened while the source was unavailable, a file is opened on the
+// source; it is kept open until m is released.
+func (m *CacheLayerFile) lockHandle() (layer.File, layer.Error) {
+	if fsside := m.source(); fsside != nil {
+		return fsside, nil
+	}
+
+	locks := m.layer.locks
+	locks.lock.Lock()
+	lockside := m.lockside
+	locks.lock.Unlock()
+	if lockside != nil {
+		return lockside, nil
+	}
+
+	m.layer.lock.Lock()
+	path := m.path
+	m.layer.lock.Unlock()
+
+	// opening the file may take long, so the lock table stays unlocked
+	// meanwhile; write locks need a file which is open for writing
+	f, err := m.layer.fs.OpenFile(path, os.O_RDWR)
+	if err != nil && !IsUnavailableError(err) {
+		f, err = m.layer.fs.OpenFile(path, os.O_RDONLY)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	locks.lock.Lock()
+	lockside = m.lockside
+	if lockside == nil {
+		m.lockside = f
+	}
+	locks.lock.Unlock()
+
+	if lockside != nil {
+		// another lock operation was quicker
+		f.Release()
+		return lockside, nil
+	}
+	return f, nil
+}
+
+// Return the file on the source for a lock operation, or nil if the lock has
+// to be emulated.
+func (m *CacheLayerFile) lockSource() (layer.File, layer.Error) {
+	if m.layer == nil {
+		fsside := m.source()
+		if fsside == nil {
+			return nil, layer.WrapError(syscall.ENOLCK)
+		}
+		return fsside, nil
+	}
+
+	if m.layer.online() {
+		src, err := m.lockHandle()
+		if err == nil || !IsUnavailableError(err) {
+			return src, err
+		}
+	}
+
+	if m.cacheside == nil || !m.layer.canEmulateLocks() {
+		return nil, layer.WrapError(syscall.ENOLCK)
+	}
+	return nil, nil
+}
+
+func (m *CacheLayerFile) newLock(lk *layer.Lock) *emulatedLock {
+	return &emulatedLock{
+		file:  m,
+		typ:   lk.Type,
+		start: lk.Start,
+		end:   lk.End,
+	}
+}
+
+func (m *CacheLayerFile) GetLk(owner uint64, lk *layer.Lock) (*layer.Lock, layer.Error) {
+	src, err := m.lockSource()
+	if err != nil {
+		return nil, err
+	}
+
+	if m.layer != nil && m.cacheside != nil {
+		if held := m.layer.locks.conflict(m.cacheside, m.newLock(lk)); held != nil {
+			return held.toLock(), nil
+		}
+	}
+	if src == nil {
+		return &layer.Lock{Type: syscall.F_UNLCK}, nil
+	}
+	return src.GetLk(owner, lk)
+}
+
+func (m *CacheLayerFile) SetLk(owner uint64, lk *layer.Lock, wait bool) layer.Error {
+	return m.setLock(m.newLock(lk), func(src layer.File) layer.Error {
+		return src.SetLk(owner, lk, wait)
+	}, wait)
+}
+
+func (m *CacheLayerFile) Flock(how int) layer.Error {
+	req := &emulatedLock{
+		file:  m,
+		flock: true,
+		typ:   flockType(how),
+	}
+	return m.setLock(req, func(src layer.File) layer.Error {
+		return src.Flock(how)
+	}, how&syscall.LOCK_NB == 0)
+}
+
+func (m *CacheLayerFile) setLock(req *emulatedLock, forward func(src layer.File) layer.Error, wait bool) layer.Error {
+	src, err := m.lockSource()
+	if err != nil {
+		return err
+	}
+	if m.layer == nil {
+		return forward(src)
+	}
+
+	locks := m.layer.locks
+	if req.typ == syscall.F_UNLCK {
+		if m.cacheside != nil {
+			locks.release(m.cacheside, req)
+		}
+		if src == nil {
+			return nil
+		}
+		return forward(src)
+	}
+
+	if src != nil {
+		// emulated locks of other files are not known to the source
+		if m.cacheside != nil {
+			if err := locks.wait(m.cacheside, req, wait); err != nil {
+				return err
+			}
+		}
+		return forward(src)
+	}
+
+	log.Printf("locks: source unavailable, emulating lock on %s", m.path)
+	return locks.acquire(m.cacheside, req, wait)
+}
@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func prepOfflineLocks(emulate bool) (*CacheLayer, *CacheLayerFile, *CacheLayerFile) {
+	fs := &mockFileSystem{}
+	fs.On("IsReady").Return(false)
+	cache_layer := NewCacheLayer(&mockCache{}, fs)
+	cache_layer.SetOfflineLocking(emulate)
+
+	// both files are opened from the same cached file
+	cachef := NewDummyCachedFile()
+	return cache_layer,
+		cache_layer.wrapFile("/foo", cachef, nil),
+		cache_layer.wrapFile("/foo", cachef, nil)
+}
+
+func writeLock(start uint64, end uint64) *layer.Lock {
+	return &layer.Lock{Type: syscall.F_WRLCK, Start: start, End: end}
+}
+
+func TestOfflineLocksFailWithoutEmulation(t *testing.T) {
+	_, f, _ := prepOfflineLocks(false)
+
+	err := f.SetLk(1, writeLock(0, 9), false)
+	assert.Equal(t, uintptr(syscall.ENOLCK), err.Errno())
+	err = f.Flock(syscall.LOCK_EX)
+	assert.Equal(t, uintptr(syscall.ENOLCK), err.Errno())
+}
+
+func TestOfflineLocksAreEmulated(t *testing.T) {
+	_, f1, f2 := prepOfflineLocks(true)
+
+	assert.Nil(t, f1.SetLk(1, writeLock(0, 9), false))
+	// locks are held by the open file, not by the owner
+	assert.Nil(t, f1.SetLk(2, writeLock(5, 14), false))
+
+	err := f2.SetLk(1, writeLock(12, 12), false)
+	assert.Equal(t, uintptr(syscall.EAGAIN), err.Errno())
+	held, err := f2.GetLk(1, writeLock(12, 12))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.F_WRLCK), held.Type)
+	assert.Nil(t, f2.SetLk(1, writeLock(15, layer.LOCK_EOF), false))
+
+	f1.Release()
+	assert.Nil(t, f2.SetLk(1, writeLock(0, 9), false))
+}
+
+func TestOfflineReadLocksDoNotConflict(t *testing.T) {
+	_, f1, f2 := prepOfflineLocks(true)
+
+	read := &layer.Lock{Type: syscall.F_RDLCK, Start: 0, End: layer.LOCK_EOF}
+	assert.Nil(t, f1.SetLk(1, read, false))
+	assert.Nil(t, f2.SetLk(1, read, false))
+	held, _ := f2.GetLk(1, read)
+	assert.Equal(t, uint32(syscall.F_UNLCK), held.Type)
+}
+
+func TestOfflineUnlockSplitsLock(t *testing.T) {
+	_, f1, f2 := prepOfflineLocks(true)
+
+	assert.Nil(t, f1.SetLk(1, writeLock(0, 29), false))
+	unlock := &layer.Lock{Type: syscall.F_UNLCK, Start: 10, End: 19}
+	assert.Nil(t, f1.SetLk(1, unlock, false))
+
+	assert.Nil(t, f2.SetLk(1, writeLock(10, 19), false))
+	err := f2.SetLk(1, writeLock(5, 5), false)
+	assert.Equal(t, uintptr(syscall.EAGAIN), err.Errno())
+	err = f2.SetLk(1, writeLock(25, 25), false)
+	assert.Equal(t, uintptr(syscall.EAGAIN), err.Errno())
+}
+
+func TestOfflineFlockIsEmulated(t *testing.T) {
+	_, f1, f2 := prepOfflineLocks(true)
+
+	assert.Nil(t, f1.Flock(syscall.LOCK_SH))
+	assert.Nil(t, f2.Flock(syscall.LOCK_SH|syscall.LOCK_NB))
+	err := f2.Flock(syscall.LOCK_EX | syscall.LOCK_NB)
+	assert.Equal(t, uintptr(syscall.EAGAIN), err.Errno())
+
+	// BSD locks and record locks do not conflict
+	assert.Nil(t, f2.SetLk(1, writeLock(0, layer.LOCK_EOF), false))
+
+	assert.Nil(t, f1.Flock(syscall.LOCK_UN))
+	assert.Nil(t, f2.Flock(syscall.LOCK_EX|syscall.LOCK_NB))
+}
+
+func TestReacquireRecordsFailures(t *testing.T) {
+	cache_layer, _, _ := prepCacheLayer()
+	cache_layer.SetOfflineLocking(true)
+
+	cachef := NewDummyCachedFile()
+	fsside := &mockFile{}
+	f := cache_layer.wrapFile("/foo", cachef, fsside)
+	cache_layer.locks.acquire(cachef, f.newLock(writeLock(0, 9)), false)
+	cache_layer.locks.acquire(cachef, f.newLock(writeLock(20, 29)), false)
+
+	fsside.On("SetLk", uint64(0), mock.MatchedBy(func(lk *layer.Lock) bool {
+		return lk.Start == 0
+	}), false).Return(nil)
+	fsside.On("SetLk", uint64(0), mock.MatchedBy(func(lk *layer.Lock) bool {
+		return lk.Start == 20
+	}), false).Return(layer.WrapError(syscall.EAGAIN))
+
+	cache_layer.reacquireLocks()
+
+	failures := cache_layer.LockFailures()
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, "/foo", failures[0].Path)
+	assert.Equal(t, uint64(20), failures[0].Lock.Start)
+	assert.False(t, cache_layer.locks.needsReacquire())
+	// the failed lock is still held locally
+	assert.Equal(t, 1, len(cache_layer.locks.locks[cachef]))
+}
+
+func TestLockHandleIsOpenedWithoutLockingTheTable(t *testing.T) {
+	cache_layer, _, fs := prepCacheLayer()
+	f := cache_layer.wrapFile("/foo", NewDummyCachedFile(), nil)
+
+	lockside := &mockFile{}
+	fs.On("OpenFile", "/foo", os.O_RDWR).Run(func(args mock.Arguments) {
+		done := make(chan struct{})
+		go func() {
+			cache_layer.LockFailures()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("lock table is locked while the file is opened")
+		}
+	}).Return(lockside, nil)
+
+	src, err := f.lockHandle()
+	assert.Nil(t, err)
+	assert.Equal(t, lockside, src)
+
+	// the handle is kept for later lock operations
+	src, err = f.lockHandle()
+	assert.Nil(t, err)
+	assert.Equal(t, lockside, src)
+	fs.AssertNumberOfCalls(t, "OpenFile", 1)
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/mock"
+)
+
+func toFileStat(v interface{}) layer.FileStat {
+	if v == nil {
+		return nil
+	}
+	return v.(layer.FileStat)
+}
+
+func toDirEntries(v interface{}) []layer.DirEntry {
+	if v == nil {
+		return nil
+	}
+	return v.([]layer.DirEntry)
+}
+
+func toError(v interface{}) layer.Error {
+	if v == nil {
+		return nil
+	}
+	return v.(layer.Error)
+}
+
+type mockFileSystem struct {
+	layer.ReadOnlyFileSystem
+	mock.Mock
+}
+
+func (m *mockFileSystem) Lstat(path string) (layer.FileStat, layer.Error) {
+	args := m.Called(path)
+	return toFileStat(args.Get(0)), toError(args.Get(1))
+}
+
+func (m *mockFileSystem) OpenDir(path string) ([]layer.DirEntry, layer.Error) {
+	args := m.Called(path)
+	return toDirEntries(args.Get(0)), toError(args.Get(1))
+}
+
+func (m *mockFileSystem) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	args := m.Called(path, flags)
+	var f layer.File
+	if v := args.Get(0); v != nil {
+		f = v.(layer.File)
+	}
+	return f, toError(args.Get(1))
+}
+
+func (m *mockFileSystem) Readlink(path string) (string, layer.Error) {
+	args := m.Called(path)
+	return args.String(0), toError(args.Get(1))
+}
+
+func (m *mockFileSystem) Mkdir(path string, mode uint32) layer.Error {
+	return toError(m.Called(path, mode).Get(0))
+}
+
+func (m *mockFileSystem) Unlink(path string) layer.Error {
+	return toError(m.Called(path).Get(0))
+}
+
+func (m *mockFileSystem) Rename(oldpath string, newpath string) layer.Error {
+	return toError(m.Called(oldpath, newpath).Get(0))
+}
+
+func (m *mockFileSystem) Getxattr(path string, name string) ([]byte, layer.Error) {
+	args := m.Called(path, name)
+	value, _ := args.Get(0).([]byte)
+	return value, toError(args.Get(1))
+}
+
+func (m *mockFileSystem) Join(elems ...string) string {
+	return layer.NewDefaultFileSystem().Join(elems...)
+}
+
+func (m *mockFileSystem) IsReady() bool {
+	return m.Called().Bool(0)
+}
+
+type mockCache struct {
+	dummyCache
+	mock.Mock
+}
+
+func (m *mockCache) PutDir(path string, entries []layer.DirEntry) {
+	m.Called(path, entries)
+}
+
+func (m *mockCache) PutAttr(path string, stat layer.FileStat) {
+	m.Called(path, stat)
+}
+
+func (m *mockCache) PutLink(path string, dest string) {
+	m.Called(path, dest)
+}
+
+func (m *mockCache) PutNonExistant(path string) {
+	m.Called(path)
+}
+
+func (m *mockCache) Move(oldpath string, newpath string) layer.Error {
+	return toError(m.Called(oldpath, newpath).Get(0))
+}
+
+func (m *mockCache) FetchLink(path string) (string, layer.Error) {
+	args := m.Called(path)
+	return args.String(0), toError(args.Get(1))
+}
+
+func (m *mockCache) FetchDir(path string) ([]layer.DirEntry, layer.Error) {
+	args := m.Called(path)
+	return toDirEntries(args.Get(0)), toError(args.Get(1))
+}
+
+func (m *mockCache) FetchAttr(path string) (layer.FileStat, layer.Error) {
+	args := m.Called(path)
+	return toFileStat(args.Get(0)), toError(args.Get(1))
+}
+
+func (m *mockCache) PutXattrs(path string, xattrs map[string][]byte) {
+	m.Called(path, xattrs)
+}
+
+func (m *mockCache) FetchXattrs(path string) (map[string][]byte, layer.Error) {
+	args := m.Called(path)
+	xattrs, _ := args.Get(0).(map[string][]byte)
+	return xattrs, toError(args.Get(1))
+}
+
+type mockFile struct {
+	layer.File
+	mock.Mock
+}
+
+func (m *mockFile) Write(data []byte, position int64) (int, layer.Error) {
+	args := m.Called(data, position)
+	return args.Int(0), toError(args.Get(1))
+}
+
+func (m *mockFile) Read(dest []byte, position int64) (int, layer.Error) {
+	args := m.Called(dest, position)
+	return args.Int(0), toError(args.Get(1))
+}
+
+func (m *mockFile) SetLk(owner uint64, lk *layer.Lock, wait bool) layer.Error {
+	args := m.Called(owner, lk, wait)
+	return toError(args.Get(0))
+}
+
+func (m *mockFile) Release() {
+}
+
+type mockCachedFile struct {
+	dummyCachedFile
+	mock.Mock
+}
+
+func (m *mockCachedFile) PutData(data []byte, position uint64, priority int) error {
+	args := m.Called(data, position, priority)
+	return args.Error(0)
+}
@@ -0,0 +1,433 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// Offline modifications
+//
+// While the source is unavailable, modifications are validated against the
+// cache, recorded in the journal and then applied to the cache. Recording
+// comes first: a journal entry for a modification which then fails to apply
+// to the cache is harmless on replay, while a modification which is only in
+// the cache would be lost.
+
+// The attributes of an object which is created or modified offline.
+type cachedStat struct {
+	mode       uint32
+	uid        uint32
+	gid        uint32
+	size       uint64
+	mtime      uint64
+	atime      uint64
+	ctime      uint64
+	mtime_nsec uint32
+	atime_nsec uint32
+	ctime_nsec uint32
+	nlink      uint32
+	rdev       uint64
+}
+
+// Attributes for a new object owned by us.
+func newCachedStat(mode uint32) *cachedStat {
+	now := time.Now()
+	secs := uint64(now.Unix())
+	nsecs := uint32(now.Nanosecond())
+	return &cachedStat{
+		mode:       mode,
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+		mtime:      secs,
+		atime:      secs,
+		ctime:      secs,
+		mtime_nsec: nsecs,
+		atime_nsec: nsecs,
+		ctime_nsec: nsecs,
+		nlink:      1,
+	}
+}
+
+func copyStat(stat layer.FileStat) *cachedStat {
+	return &cachedStat{
+		mode:       stat.Mode(),
+		uid:        stat.OwnerUID(),
+		gid:        stat.OwnerGID(),
+		size:       stat.Size(),
+		mtime:      stat.Mtime(),
+		atime:      stat.Atime(),
+		ctime:      stat.Ctime(),
+		mtime_nsec: stat.MtimeNsec(),
+		atime_nsec: stat.AtimeNsec(),
+		ctime_nsec: stat.CtimeNsec(),
+		nlink:      stat.Nlink(),
+		rdev:       stat.Rdev(),
+	}
+}
+
+func (m *cachedStat) Mode() uint32 {
+	return m.mode
+}
+
+func (m *cachedStat) OwnerUID() uint32 {
+	return m.uid
+}
+
+func (m *cachedStat) OwnerGID() uint32 {
+	return m.gid
+}
+
+func (m *cachedStat) Size() uint64 {
+	return m.size
+}
+
+func (m *cachedStat) Blocks() uint64 {
+	return 0
+}
+
+func (m *cachedStat) Mtime() uint64 {
+	return m.mtime
+}
+
+func (m *cachedStat) Atime() uint64 {
+	return m.atime
+}
+
+func (m *cachedStat) Ctime() uint64 {
+	return m.ctime
+}
+
+func (m *cachedStat) MtimeNsec() uint32 {
+	return m.mtime_nsec
+}
+
+func (m *cachedStat) AtimeNsec() uint32 {
+	return m.atime_nsec
+}
+
+func (m *cachedStat) CtimeNsec() uint32 {
+	return m.ctime_nsec
+}
+
+// The inode number is left to the cache; the inode number of attributes
+// fetched from the cache is not the one of the source.
+func (m *cachedStat) Ino() uint64 {
+	return 0
+}
+
+func (m *cachedStat) Nlink() uint32 {
+	return m.nlink
+}
+
+func (m *cachedStat) Rdev() uint64 {
+	return m.rdev
+}
+
+func parentPath(path string) string {
+	idx := strings.LastIndex(path, "/")
+	if idx < 0 {
+		return ""
+	}
+	return path[:idx]
+}
+
+// Return whether path is base or inside of base.
+func hasPathPrefix(path string, base string) bool {
+	return path == base || strings.HasPrefix(path, base+"/")
+}
+
+func (m *CacheLayer) canStartReplay() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return !m.replaying && !m.blocked
+}
+
+// Append an entry to the journal; fails with EROFS if there is no journal.
+func (m *CacheLayer) record(entry *JournalEntry) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+	if err := m.journal.Append(entry); err != nil {
+		log.Printf("failed to append %s %s to journal: %s",
+			entry.Op, entry.Path, err)
+		return layer.WrapError(syscall.EIO)
+	}
+	return nil
+}
+
+// Append an entry for an operation on an open file.
+func (m *CacheLayer) recordFor(f *CacheLayerFile, entry *JournalEntry) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.Path = f.path
+	entry.Base = m.baseOf(f.path)
+	return m.record(entry)
+}
+
+// Record that the data of an open file is modified, unless that has been
+// recorded already and has not been replayed yet.
+func (m *CacheLayer) recordWrite(f *CacheLayerFile) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.pendingWrites[f.path] {
+		return nil
+	}
+	entry := &JournalEntry{Op: JOURNAL_WRITE, Path: f.path, Base: m.baseOf(f.path)}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	m.pendingWrites[f.path] = true
+	return nil
+}
+
+// Check that the parent of path is a directory in the cache.
+func (m *CacheLayer) checkParent(path string) layer.Error {
+	stat, err := m.cache.FetchAttr(parentPath(path))
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&syscall.S_IFMT != syscall.S_IFDIR {
+		return layer.WrapError(syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// Check that path can be created: its parent must exist and it must not.
+func (m *CacheLayer) checkCreate(path string) layer.Error {
+	if err := m.checkParent(path); err != nil {
+		return err
+	}
+	if _, err := m.cache.FetchAttr(path); err == nil {
+		return layer.WrapError(syscall.EEXIST)
+	}
+	return nil
+}
+
+func (m *CacheLayer) offlineCreate(path string, flags int, mode uint32) (layer.File, layer.Error) {
+	if m.journal == nil {
+		return nil, layer.WrapError(syscall.EROFS)
+	}
+
+	err := m.checkCreate(path)
+	if err != nil && err.Errno() == uintptr(syscall.EEXIST) && flags&os.O_EXCL == 0 {
+		return m.OpenFile(path, flags)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &JournalEntry{Op: JOURNAL_CREATE, Path: path, Mode: mode}
+	if err := m.record(entry); err != nil {
+		return nil, err
+	}
+	m.cache.PutAttr(path, newCachedStat(syscall.S_IFREG|mode&07777))
+
+	cachef, err := m.cache.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return m.wrapFile(path, cachef, nil), nil
+}
+
+func (m *CacheLayer) offlineMkdir(path string, mode uint32) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	if err := m.checkCreate(path); err != nil {
+		return err
+	}
+
+	entry := &JournalEntry{Op: JOURNAL_MKDIR, Path: path, Mode: mode}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	m.cache.PutDir(path, nil)
+	m.cache.PutAttr(path, newCachedStat(syscall.S_IFDIR|mode&07777))
+	return nil
+}
+
+func (m *CacheLayer) offlineSymlink(target string, path string) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	if err := m.checkCreate(path); err != nil {
+		return err
+	}
+
+	entry := &JournalEntry{Op: JOURNAL_SYMLINK, Path: path, Target: target}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	stat := newCachedStat(syscall.S_IFLNK | 0777)
+	stat.size = uint64(len(target))
+	m.cache.PutAttr(path, stat)
+	m.cache.PutLink(path, target)
+	return nil
+}
+
+func (m *CacheLayer) offlineUnlink(path string) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	stat, err := m.cache.FetchAttr(path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&syscall.S_IFMT == syscall.S_IFDIR {
+		return layer.WrapError(syscall.EISDIR)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := &JournalEntry{Op: JOURNAL_UNLINK, Path: path, Base: m.baseOf(path)}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	m.cache.PutNonExistant(path)
+	m.dropPendingWrites(path)
+	return nil
+}
+
+func (m *CacheLayer) offlineRmdir(path string) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	entries, err := m.cache.FetchDir(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return layer.WrapError(syscall.ENOTEMPTY)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.record(&JournalEntry{Op: JOURNAL_RMDIR, Path: path}); err != nil {
+		return err
+	}
+	m.cache.PutNonExistant(path)
+	m.dropPendingWrites(path)
+	return nil
+}
+
+// Forget the pending writes at and below a path which has been removed, so
+// that writes to an object created at the same path later are recorded.
+//
+// Must be called with the lock held.
+func (m *CacheLayer) dropPendingWrites(path string) {
+	for pending := range m.pendingWrites {
+		if hasPathPrefix(pending, path) {
+			delete(m.pendingWrites, pending)
+		}
+	}
+}
+
+func (m *CacheLayer) offlineRename(oldpath string, newpath string) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	if _, err := m.cache.FetchAttr(oldpath); err != nil {
+		return err
+	}
+	if err := m.checkParent(newpath); err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return layer.WrapError(syscall.EINVAL)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := &JournalEntry{Op: JOURNAL_RENAME, Path: oldpath, Target: newpath}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	if err := m.cache.Move(oldpath, newpath); err != nil {
+		return err
+	}
+
+	m.renameOpenFiles(oldpath, newpath)
+	return nil
+}
+
+// Apply a change of attributes to the cache only.
+func (m *CacheLayer) offlineSetAttr(entry *JournalEntry, update func(stat *cachedStat)) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	stat, err := m.cache.FetchAttr(entry.Path)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.Base = m.baseOf(entry.Path)
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	updated := copyStat(stat)
+	update(updated)
+	m.cache.PutAttr(entry.Path, updated)
+	return nil
+}
+
+func (m *CacheLayer) offlineChmod(path string, mode uint32) layer.Error {
+	entry := &JournalEntry{Op: JOURNAL_CHMOD, Path: path, Mode: mode}
+	return m.offlineSetAttr(entry, func(stat *cachedStat) {
+		stat.mode = stat.mode&syscall.S_IFMT | mode&07777
+	})
+}
+
+func (m *CacheLayer) offlineChown(path string, uid uint32, gid uint32) layer.Error {
+	entry := &JournalEntry{Op: JOURNAL_CHOWN, Path: path, UID: uid, GID: gid}
+	return m.offlineSetAttr(entry, func(stat *cachedStat) {
+		stat.uid = uid
+		stat.gid = gid
+	})
+}
+
+func (m *CacheLayer) offlineUtimens(path string, atime *time.Time, mtime *time.Time) layer.Error {
+	entry := &JournalEntry{Op: JOURNAL_UTIMENS, Path: path, Atime: atime, Mtime: mtime}
+	return m.offlineSetAttr(entry, func(stat *cachedStat) {
+		if atime != nil {
+			stat.atime = uint64(atime.Unix())
+			stat.atime_nsec = uint32(atime.Nanosecond())
+		}
+		if mtime != nil {
+			stat.mtime = uint64(mtime.Unix())
+			stat.mtime_nsec = uint32(mtime.Nanosecond())
+		}
+	})
+}
+
+func (m *CacheLayer) offlineTruncate(path string, size uint64) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	f, err := m.OpenFile(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Release()
+	return f.Truncate(size)
+}
@@ -0,0 +1,518 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	// Number of blocks read from the source at once
+	prefetch_CHUNK_BLOCKS = 32
+)
+
+var (
+	errPrefetchCancelled = errors.New("prefetch cancelled")
+
+	// Interval at which a prefetch which waits for the source checks
+	// whether the source is back
+	prefetchRetryInterval = 5 * time.Second
+)
+
+// The progress of a prefetch of a subtree
+//
+// The totals grow while the subtree is scanned. Objects which cannot be
+// fetched are counted in Failed; failed files stay in the totals, so that the
+// remaining counts show what is missing once the prefetch is finished.
+type PrefetchProgress struct {
+	Path       string
+	Running    bool
+	Scanning   bool
+	Cancelled  bool
+	FilesDone  uint64
+	FilesTotal uint64
+	BytesDone  uint64
+	BytesTotal uint64
+	Failed     uint64
+}
+
+func (m PrefetchProgress) FilesRemaining() uint64 {
+	return m.FilesTotal - m.FilesDone
+}
+
+func (m PrefetchProgress) BytesRemaining() uint64 {
+	return m.BytesTotal - m.BytesDone
+}
+
+type prefetchFile struct {
+	path string
+	size uint64
+}
+
+type prefetchJob struct {
+	lock     sync.Mutex
+	progress PrefetchProgress
+	// Whether the job is to be resumed after a restart
+	pending bool
+
+	cancel    chan struct{}
+	done      chan struct{}
+	stop_once sync.Once
+}
+
+func (m *prefetchJob) stop() {
+	m.stop_once.Do(func() {
+		close(m.cancel)
+	})
+}
+
+func (m *prefetchJob) isStopped() bool {
+	select {
+	case <-m.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *prefetchJob) update(fn func(progress *PrefetchProgress)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fn(&m.progress)
+}
+
+// A Prefetcher fetches subtrees of the source into the cache in the
+// background.
+//
+// Directories, links and attributes are stored in the cache as the subtree is
+// scanned; the contents of files are stored afterwards, with the quota
+// requested at QUOTA_BLOCK_PRIO_READAHEAD, so that prefetching never evicts
+// other data. While the source is unavailable, prefetches wait for it.
+//
+// The paths of unfinished prefetches are kept in a state file, so that they
+// can be resumed after a restart. Data which is in the cache already is not
+// fetched again.
+type Prefetcher struct {
+	layer      *CacheLayer
+	state_path string
+	// Limits the number of files which are fetched at the same time
+	slots chan struct{}
+
+	lock   sync.Mutex
+	jobs   map[string]*prefetchJob
+	closed bool
+}
+
+func NewPrefetcher(layer *CacheLayer, state_path string, concurrency int) *Prefetcher {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Prefetcher{
+		layer:      layer,
+		state_path: state_path,
+		slots:      make(chan struct{}, concurrency),
+		jobs:       make(map[string]*prefetchJob),
+	}
+}
+
+// Start the unfinished prefetches from the state file.
+func (m *Prefetcher) Resume() error {
+	data, err := ioutil.ReadFile(m.state_path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, path := range strings.Split(string(data), "\x00") {
+		if path == "" {
+			continue
+		}
+		log.Printf("prefetch(%s): resuming", path)
+		if err := m.Start(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start prefetching path and everything below it in the background.
+//
+// Nothing happens if a prefetch of path is running already.
+func (m *Prefetcher) Start(path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return errPrefetchCancelled
+	}
+	if job, ok := m.jobs[path]; ok && !job.isStopped() {
+		select {
+		case <-job.done:
+		default:
+			return nil
+		}
+	}
+
+	job := &prefetchJob{
+		progress: PrefetchProgress{
+			Path:     path,
+			Running:  true,
+			Scanning: true,
+		},
+		pending: true,
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	m.jobs[path] = job
+	if err := m.saveState(); err != nil {
+		delete(m.jobs, path)
+		return err
+	}
+
+	go m.run(job)
+	return nil
+}
+
+// Stop the prefetch of path, and return whether it was running.
+func (m *Prefetcher) Cancel(path string) bool {
+	m.lock.Lock()
+	job, ok := m.jobs[path]
+	if !ok || job.isStopped() {
+		m.lock.Unlock()
+		return false
+	}
+	job.pending = false
+	job.update(func(progress *PrefetchProgress) {
+		progress.Cancelled = progress.Running
+	})
+	job.stop()
+	if err := m.saveState(); err != nil {
+		log.Printf("prefetch: cannot save state: %s", err)
+	}
+	m.lock.Unlock()
+
+	<-job.done
+	return true
+}
+
+// Return the progress of all prefetches since the start, ordered by path.
+func (m *Prefetcher) Progress() []PrefetchProgress {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	result := make([]PrefetchProgress, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		job.lock.Lock()
+		result = append(result, job.progress)
+		job.lock.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+// Stop all prefetches. Unfinished prefetches are resumed by the next Resume.
+func (m *Prefetcher) Close() {
+	m.lock.Lock()
+	m.closed = true
+	jobs := make([]*prefetchJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		job.stop()
+		jobs = append(jobs, job)
+	}
+	m.lock.Unlock()
+
+	for _, job := range jobs {
+		<-job.done
+	}
+}
+
+// Write the paths of the pending prefetches to the state file.
+//
+// Must be called with the lock held.
+func (m *Prefetcher) saveState() error {
+	var paths []string
+	for path, job := range m.jobs {
+		if job.pending {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	// paths may contain anything but NUL
+	data := ""
+	for _, path := range paths {
+		data += path + "\x00"
+	}
+
+	tmp_path := m.state_path + ".new"
+	if err := ioutil.WriteFile(tmp_path, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, m.state_path)
+}
+
+func (m *Prefetcher) finish(job *prefetchJob) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job.update(func(progress *PrefetchProgress) {
+		progress.Running = false
+		progress.Scanning = false
+	})
+	if m.closed || !job.pending {
+		return
+	}
+	job.pending = false
+	if err := m.saveState(); err != nil {
+		log.Printf("prefetch: cannot save state: %s", err)
+	}
+}
+
+func (m *Prefetcher) run(job *prefetchJob) {
+	defer close(job.done)
+	path := job.progress.Path
+
+	var files []prefetchFile
+	if err := m.walk(job, path, &files); err == errPrefetchCancelled {
+		m.finish(job)
+		return
+	}
+	job.update(func(progress *PrefetchProgress) {
+		progress.Scanning = false
+	})
+
+	var wg sync.WaitGroup
+	for _, file := range files {
+		if !m.acquireSlot(job) {
+			break
+		}
+
+		wg.Add(1)
+		go func(file prefetchFile) {
+			defer wg.Done()
+			defer func() { <-m.slots }()
+
+			err := m.fetchFile(job, file)
+			if err != nil && err != errPrefetchCancelled {
+				log.Printf("prefetch(%s): cannot fetch %s: %s",
+					path, file.path, err)
+				job.update(func(progress *PrefetchProgress) {
+					progress.Failed += 1
+				})
+			}
+		}(file)
+	}
+	wg.Wait()
+
+	m.finish(job)
+	job.lock.Lock()
+	log.Printf("prefetch(%s): fetched %d of %d files, %d of %d bytes, %d failed",
+		path,
+		job.progress.FilesDone, job.progress.FilesTotal,
+		job.progress.BytesDone, job.progress.BytesTotal,
+		job.progress.Failed)
+	job.lock.Unlock()
+}
+
+// Wait until another file may be fetched; returns false if the job is stopped
+// instead.
+func (m *Prefetcher) acquireSlot(job *prefetchJob) bool {
+	select {
+	case m.slots <- struct{}{}:
+	case <-job.cancel:
+		return false
+	}
+	if job.isStopped() {
+		<-m.slots
+		return false
+	}
+	return true
+}
+
+// Call fn until it does not fail because the source is unavailable, waiting
+// for the source to come back in between.
+//
+// Returns errPrefetchCancelled if the job is stopped while waiting.
+func (m *Prefetcher) retry(job *prefetchJob, fn func() layer.Error) error {
+	for {
+		for !m.layer.online() {
+			select {
+			case <-job.cancel:
+				return errPrefetchCancelled
+			case <-time.After(prefetchRetryInterval):
+			}
+		}
+		if job.isStopped() {
+			return errPrefetchCancelled
+		}
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !IsUnavailableError(err) {
+			return err
+		}
+	}
+}
+
+// Store the attributes of path and everything below it in the cache, and
+// collect the regular files.
+func (m *Prefetcher) walk(job *prefetchJob, path string, files *[]prefetchFile) error {
+	var stat layer.FileStat
+	err := m.retry(job, func() (err layer.Error) {
+		stat, err = m.layer.fs.Lstat(path)
+		return err
+	})
+	if err == errPrefetchCancelled {
+		return err
+	}
+	if err != nil {
+		m.walkFailed(job, path, err)
+		return nil
+	}
+	m.layer.cache.PutAttr(path, stat)
+
+	switch stat.Mode() & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		var entries []layer.DirEntry
+		err := m.retry(job, func() (err layer.Error) {
+			entries, err = m.layer.fs.OpenDir(path)
+			return err
+		})
+		if err == errPrefetchCancelled {
+			return err
+		}
+		if err != nil {
+			m.walkFailed(job, path, err)
+			return nil
+		}
+		m.layer.cache.PutDir(path, entries)
+		for _, entry := range entries {
+			child := m.layer.fs.Join(path, entry.Name())
+			if err := m.walk(job, child, files); err != nil {
+				return err
+			}
+		}
+	case syscall.S_IFLNK:
+		var dest string
+		err := m.retry(job, func() (err layer.Error) {
+			dest, err = m.layer.fs.Readlink(path)
+			return err
+		})
+		if err == errPrefetchCancelled {
+			return err
+		}
+		if err != nil {
+			m.walkFailed(job, path, err)
+			return nil
+		}
+		m.layer.cache.PutLink(path, dest)
+	case syscall.S_IFREG:
+		*files = append(*files, prefetchFile{path, stat.Size()})
+		job.update(func(progress *PrefetchProgress) {
+			progress.FilesTotal += 1
+			progress.BytesTotal += stat.Size()
+		})
+	}
+	return nil
+}
+
+func (m *Prefetcher) walkFailed(job *prefetchJob, path string, err error) {
+	log.Printf("prefetch(%s): cannot fetch %s: %s",
+		job.progress.Path, path, err)
+	if layer_err, ok := err.(layer.Error); ok && layer.IsNotFoundError(layer_err) {
+		m.layer.cache.PutNonExistant(path)
+	}
+	job.update(func(progress *PrefetchProgress) {
+		progress.Failed += 1
+	})
+}
+
+// Stream the contents of a file from the source into the cache, skipping the
+// parts which are cached already.
+func (m *Prefetcher) fetchFile(job *prefetchJob, file prefetchFile) error {
+	var src layer.File
+	err := m.retry(job, func() (err layer.Error) {
+		src, err = m.layer.fs.OpenFile(file.path, os.O_RDONLY)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer src.Release()
+
+	dst, layer_err := m.layer.cache.OpenFile(file.path)
+	if layer_err != nil {
+		return layer_err
+	}
+	defer dst.Close()
+
+	block_size := int(m.layer.cache.BlockSize())
+	chunk_size := uint64(block_size) * prefetch_CHUNK_BLOCKS
+	buf := make([]byte, chunk_size)
+	position := uint64(0)
+	for position < file.size {
+		if job.isStopped() {
+			return errPrefetchCancelled
+		}
+
+		want := chunk_size
+		if file.size-position < want {
+			want = file.size - position
+		}
+		if n, _ := dst.FetchData(buf[:want], position); uint64(n) == want {
+			position += want
+			job.update(func(progress *PrefetchProgress) {
+				progress.BytesDone += want
+			})
+			continue
+		}
+
+		var n int
+		err := m.retry(job, func() (err layer.Error) {
+			n, err = src.Read(buf[:want], int64(position))
+			if n > 0 {
+				// keep what has been read
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// the file has become shorter
+			break
+		}
+		if end := position + uint64(n); end < file.size && n > block_size {
+			// the next put must start at a block boundary
+			n -= n % block_size
+		}
+
+		if err := dst.PutData(buf[:n], position, QUOTA_BLOCK_PRIO_READAHEAD); err != nil {
+			return err
+		}
+		position += uint64(n)
+		job.update(func(progress *PrefetchProgress) {
+			progress.BytesDone += uint64(n)
+		})
+	}
+
+	job.update(func(progress *PrefetchProgress) {
+		progress.FilesDone += 1
+	})
+	return nil
+}
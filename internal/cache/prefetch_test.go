@@ -0,0 +1,421 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/horazont/dragonstash/internal/localfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// A cache which keeps file contents and dirty blocks in memory and records the
+// other puts
+type memCache struct {
+	dummyCache
+	lock  sync.Mutex
+	puts  map[string]string
+	files map[string]*memCachedFile
+}
+
+func newMemCache() *memCache {
+	return &memCache{
+		puts:  make(map[string]string),
+		files: make(map[string]*memCachedFile),
+	}
+}
+
+func (m *memCache) PutAttr(path string, stat layer.FileStat) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.puts[path]; !ok {
+		m.puts[path] = "attr"
+	}
+}
+
+func (m *memCache) PutDir(path string, entries []layer.DirEntry) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.puts[path] = "dir"
+}
+
+func (m *memCache) PutLink(path string, dest string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.puts[path] = "link " + dest
+}
+
+func (m *memCache) OpenFile(path string) (CachedFile, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	file, ok := m.files[path]
+	if !ok {
+		file = &memCachedFile{priorities: make(map[int]bool)}
+		m.files[path] = file
+	}
+	return file, nil
+}
+
+func (m *memCache) BlockSize() int64 {
+	return 4096
+}
+
+type memCachedFile struct {
+	dummyCachedFile
+	lock       sync.Mutex
+	data       []byte
+	puts       int
+	priorities map[int]bool
+	dirty      map[uint64]bool
+	writeback  map[uint64]bool
+}
+
+func (m *memCachedFile) PutData(data []byte, position uint64, priority int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if end := int(position) + len(data); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	copy(m.data[position:], data)
+	m.puts += 1
+	m.priorities[priority] = true
+	return nil
+}
+
+func (m *memCachedFile) WriteData(data []byte, position uint64) error {
+	m.PutData(data, position, QUOTA_BLOCK_PRIO_WRITTEN)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.dirty == nil {
+		m.dirty = make(map[uint64]bool)
+	}
+	end := position + uint64(len(data))
+	for block := position / 4096; block < (end+4095)/4096; block++ {
+		m.dirty[block] = true
+		delete(m.writeback, block)
+	}
+	return nil
+}
+
+func (m *memCachedFile) DirtyBlocks() []uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var result []uint64
+	for block := range m.dirty {
+		result = append(result, block)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func (m *memCachedFile) MarkClean(blocks []uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, block := range blocks {
+		delete(m.dirty, block)
+	}
+}
+
+func (m *memCachedFile) StartWriteBack() []uint64 {
+	blocks := m.DirtyBlocks()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.writeback = make(map[uint64]bool)
+	for _, block := range blocks {
+		m.writeback[block] = true
+	}
+	return blocks
+}
+
+func (m *memCachedFile) FinishWriteBack(written bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if written {
+		for block := range m.writeback {
+			delete(m.dirty, block)
+		}
+	}
+	m.writeback = nil
+}
+
+func (m *memCachedFile) FetchAttr() (layer.FileStat, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return &cachedStat{mode: syscall.S_IFREG | 0600, size: uint64(len(m.data))}, nil
+}
+
+func (m *memCachedFile) FetchData(data []byte, position uint64) (int, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if position >= uint64(len(m.data)) {
+		return 0, nil
+	}
+	return copy(data, m.data[position:]), nil
+}
+
+// A source which can be switched off and counts the files open at the same
+// time; truncating files fails with truncate_err if it is set and reads return
+// at most max_read bytes if it is set
+type switchedFileSystem struct {
+	layer.FileSystem
+	lock         sync.Mutex
+	offline      bool
+	open         int
+	max_open     int
+	reads        int
+	max_read     int
+	truncate_err layer.Error
+}
+
+func (m *switchedFileSystem) IsReady() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return !m.offline
+}
+
+func (m *switchedFileSystem) setOffline(offline bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.offline = offline
+}
+
+func (m *switchedFileSystem) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	f, err := m.FileSystem.OpenFile(path, flags)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.open += 1
+	if m.open > m.max_open {
+		m.max_open = m.open
+	}
+	return &countedFile{f, m}, nil
+}
+
+type countedFile struct {
+	layer.File
+	fs *switchedFileSystem
+}
+
+func (m *countedFile) Read(dest []byte, position int64) (int, layer.Error) {
+	m.fs.lock.Lock()
+	m.fs.reads += 1
+	if m.fs.max_read > 0 && len(dest) > m.fs.max_read {
+		dest = dest[:m.fs.max_read]
+	}
+	m.fs.lock.Unlock()
+	// give other files the chance to be opened meanwhile
+	time.Sleep(time.Millisecond)
+	return m.File.Read(dest, position)
+}
+
+func (m *countedFile) Truncate(size uint64) layer.Error {
+	m.fs.lock.Lock()
+	err := m.fs.truncate_err
+	m.fs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.File.Truncate(size)
+}
+
+func (m *countedFile) Release() {
+	m.fs.lock.Lock()
+	m.fs.open -= 1
+	m.fs.lock.Unlock()
+	m.File.Release()
+}
+
+type prefetchSetup struct {
+	dir        string
+	tree       string
+	cache      *memCache
+	fs         *switchedFileSystem
+	prefetcher *Prefetcher
+}
+
+func setUpPrefetch(t *testing.T, concurrency int) *prefetchSetup {
+	prefetchRetryInterval = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "dragonstash-prefetch")
+	assert.Nil(t, err)
+	tree := filepath.Join(dir, "tree")
+	os.MkdirAll(filepath.Join(tree, "music", "jazz"), 0700)
+
+	result := &prefetchSetup{
+		dir:   dir,
+		tree:  tree,
+		cache: newMemCache(),
+		fs: &switchedFileSystem{
+			FileSystem: localfs.NewLocalFileSystem(tree),
+		},
+	}
+	result.prefetcher = NewPrefetcher(
+		NewCacheLayer(result.cache, result.fs),
+		filepath.Join(dir, "prefetch"),
+		concurrency,
+	)
+	return result
+}
+
+func (m *prefetchSetup) tearDown() {
+	m.prefetcher.Close()
+	os.RemoveAll(m.dir)
+}
+
+func (m *prefetchSetup) wait(path string) {
+	m.prefetcher.lock.Lock()
+	job := m.prefetcher.jobs[path]
+	m.prefetcher.lock.Unlock()
+	<-job.done
+}
+
+func (m *prefetchSetup) state() string {
+	data, _ := ioutil.ReadFile(filepath.Join(m.dir, "prefetch"))
+	return string(data)
+}
+
+func TestPrefetchStoresSubtree(t *testing.T) {
+	setup := setUpPrefetch(t, 2)
+	defer setup.tearDown()
+
+	jazz := filepath.Join(setup.tree, "music", "jazz")
+	data := genTestData(200000)
+	ioutil.WriteFile(filepath.Join(jazz, "a"), data, 0600)
+	ioutil.WriteFile(filepath.Join(jazz, "b"), []byte("b"), 0600)
+	os.Symlink("a", filepath.Join(jazz, "link"))
+
+	assert.Nil(t, setup.prefetcher.Start("/music/jazz"))
+	setup.wait("/music/jazz")
+
+	assert.Equal(t, "dir", setup.cache.puts["/music/jazz"])
+	assert.Equal(t, "attr", setup.cache.puts["/music/jazz/a"])
+	assert.Equal(t, "link a", setup.cache.puts["/music/jazz/link"])
+	assert.Equal(t, data, setup.cache.files["/music/jazz/a"].data)
+	assert.Equal(t, []byte("b"), setup.cache.files["/music/jazz/b"].data)
+	assert.Equal(
+		t,
+		map[int]bool{QUOTA_BLOCK_PRIO_READAHEAD: true},
+		setup.cache.files["/music/jazz/a"].priorities,
+	)
+
+	assert.Equal(t, []PrefetchProgress{
+		{
+			Path:       "/music/jazz",
+			FilesDone:  2,
+			FilesTotal: 2,
+			BytesDone:  200001,
+			BytesTotal: 200001,
+		},
+	}, setup.prefetcher.Progress())
+	assert.Equal(t, "", setup.state())
+}
+
+func TestPrefetchSkipsCachedData(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+
+	data := genTestData(10000)
+	ioutil.WriteFile(filepath.Join(setup.tree, "music", "a"), data, 0600)
+	cached, _ := setup.cache.OpenFile("/music/a")
+	cached.PutData(data, 0, QUOTA_BLOCK_PRIO_READ)
+
+	assert.Nil(t, setup.prefetcher.Start("/music"))
+	setup.wait("/music")
+
+	assert.Equal(t, 1, setup.cache.files["/music/a"].puts)
+	progress := setup.prefetcher.Progress()[0]
+	assert.Equal(t, uint64(10000), progress.BytesDone)
+	assert.Equal(t, uint64(0), progress.BytesRemaining())
+}
+
+func TestPrefetchLimitsConcurrency(t *testing.T) {
+	setup := setUpPrefetch(t, 2)
+	defer setup.tearDown()
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		ioutil.WriteFile(
+			filepath.Join(setup.tree, "music", name),
+			genTestData(4096*prefetch_CHUNK_BLOCKS*2),
+			0600,
+		)
+	}
+
+	assert.Nil(t, setup.prefetcher.Start("/music"))
+	setup.wait("/music")
+
+	assert.Equal(t, uint64(6), setup.prefetcher.Progress()[0].FilesDone)
+	assert.Equal(t, 2, setup.fs.max_open)
+}
+
+func TestPrefetchCountsMissingPathAsFailed(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+
+	assert.Nil(t, setup.prefetcher.Start("/missing"))
+	setup.wait("/missing")
+
+	progress := setup.prefetcher.Progress()[0]
+	assert.Equal(t, uint64(1), progress.Failed)
+	assert.False(t, progress.Running)
+}
+
+func TestPrefetchWaitsForSourceAndCanBeCancelled(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+
+	setup.fs.setOffline(true)
+	assert.Nil(t, setup.prefetcher.Start("/music"))
+	assert.Equal(t, "/music\x00", setup.state())
+
+	time.Sleep(10 * time.Millisecond)
+	progress := setup.prefetcher.Progress()[0]
+	assert.True(t, progress.Running)
+	assert.True(t, progress.Scanning)
+
+	assert.True(t, setup.prefetcher.Cancel("/music"))
+	progress = setup.prefetcher.Progress()[0]
+	assert.False(t, progress.Running)
+	assert.True(t, progress.Cancelled)
+	assert.Equal(t, "", setup.state())
+
+	assert.False(t, setup.prefetcher.Cancel("/music"))
+}
+
+func TestPrefetchResumesAfterRestart(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+
+	data := genTestData(5000)
+	ioutil.WriteFile(filepath.Join(setup.tree, "music", "jazz", "a"), data, 0600)
+
+	setup.fs.setOffline(true)
+	assert.Nil(t, setup.prefetcher.Start("/music/jazz"))
+	setup.prefetcher.Close()
+	assert.Equal(t, "/music/jazz\x00", setup.state())
+
+	setup.fs.setOffline(false)
+	setup.prefetcher = NewPrefetcher(
+		NewCacheLayer(setup.cache, setup.fs),
+		filepath.Join(setup.dir, "prefetch"),
+		1,
+	)
+	assert.Nil(t, setup.prefetcher.Resume())
+	setup.wait("/music/jazz")
+
+	assert.Equal(t, data, setup.cache.files["/music/jazz/a"].data)
+	assert.Equal(t, "", setup.state())
+}
+
+func genTestData(n int) []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), n/16+1)[:n]
+}
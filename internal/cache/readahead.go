@@ -0,0 +1,374 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	READAHEAD_OFF        = "off"
+	READAHEAD_FIXED      = "fixed"
+	READAHEAD_DOUBLING   = "doubling"
+	READAHEAD_WHOLE_FILE = "whole-file"
+
+	// Number of consecutive sequential reads after which reading ahead
+	// starts
+	readahead_MIN_SEQUENTIAL = 2
+	// First window of the doubling strategy
+	readahead_INITIAL_WINDOW = 128 * 1024
+	// Number of blocks read from the source at once
+	readahead_CHUNK_BLOCKS = 32
+)
+
+// A ReadAheadStrategy decides how much of a file is read into the cache ahead
+// of sequential reads.
+type ReadAheadStrategy interface {
+	// Return the number of bytes to read ahead of the current position.
+	//
+	// previous is the window returned before in the same run of
+	// sequential reads, zero for the first window of a run. size is the
+	// size of the file, or -1 if it is not known.
+	Window(previous int64, size int64) int64
+}
+
+// Always read the same amount ahead
+type FixedReadAhead struct {
+	Size int64
+}
+
+func (m *FixedReadAhead) Window(previous int64, size int64) int64 {
+	return m.Size
+}
+
+// Start with a small window and double it for every read ahead of the same
+// run, up to a maximum
+type DoublingReadAhead struct {
+	Initial int64
+	Max     int64
+}
+
+func (m *DoublingReadAhead) Window(previous int64, size int64) int64 {
+	window := previous * 2
+	if window < m.Initial {
+		window = m.Initial
+	}
+	if window > m.Max {
+		window = m.Max
+	}
+	return window
+}
+
+// Read files up to MaxSize completely; larger files and files of unknown size
+// are read ahead according to Fallback, if it is set.
+type WholeFileReadAhead struct {
+	MaxSize  int64
+	Fallback ReadAheadStrategy
+}
+
+func (m *WholeFileReadAhead) Window(previous int64, size int64) int64 {
+	if size >= 0 && size <= m.MaxSize {
+		return size
+	}
+	if m.Fallback == nil {
+		return 0
+	}
+	return m.Fallback.Window(previous, size)
+}
+
+// Create the read ahead strategy called name, with size as the window of the
+// fixed strategy, the maximum window of the doubling strategy and the maximum
+// file size of the whole-file strategy. Large files are read ahead with
+// doubling windows by the whole-file strategy.
+//
+// Returns nil for READAHEAD_OFF.
+func NewReadAheadStrategy(name string, size int64) (ReadAheadStrategy, error) {
+	initial := int64(readahead_INITIAL_WINDOW)
+	if initial > size {
+		initial = size
+	}
+
+	switch name {
+	case READAHEAD_OFF:
+		return nil, nil
+	case READAHEAD_FIXED:
+		return &FixedReadAhead{Size: size}, nil
+	case READAHEAD_DOUBLING:
+		return &DoublingReadAhead{Initial: initial, Max: size}, nil
+	case READAHEAD_WHOLE_FILE:
+		return &WholeFileReadAhead{
+			MaxSize:  size,
+			Fallback: &DoublingReadAhead{Initial: initial, Max: size},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown read ahead strategy: %s", name)
+}
+
+// Read the file through the source ahead of sequential reads, with the given
+// strategy, so that the following reads are served from the cache. nil
+// disables reading ahead.
+//
+// Only files opened afterwards are affected.
+func (m *CacheLayer) SetReadAhead(strategy ReadAheadStrategy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.readAhead = strategy
+}
+
+// The state of reading ahead for an open file
+//
+// The range [start, end) has been read into the cache ahead of the reader
+// while the file is open, so that it can be served from the cache without
+// asking the source. end is the end of the file if eof is set.
+type readAhead struct {
+	strategy ReadAheadStrategy
+
+	lock sync.Mutex
+	// end of the previous read
+	last_end int64
+	// number of consecutive sequential reads
+	sequential int
+	window     int64
+	start      int64
+	end        int64
+	eof        bool
+	running    bool
+	stopped    bool
+	wg         sync.WaitGroup
+}
+
+func newReadAhead(strategy ReadAheadStrategy) *readAhead {
+	return &readAhead{
+		strategy: strategy,
+	}
+}
+
+// Return how many bytes of a read at position can be served from the data
+// which has been read ahead, or false if the read must go to the source.
+func (m *readAhead) covers(position int64, length int64) (int64, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if position < m.start || position > m.end {
+		return 0, false
+	}
+	if position+length <= m.end {
+		return length, true
+	}
+	if m.eof {
+		return m.end - position, true
+	}
+	return 0, false
+}
+
+// Record a read of n bytes at position and return the range to read ahead
+// next, if any.
+//
+// If a range is returned, the caller must read it with startReadAhead, which
+// calls finish once it is done.
+func (m *readAhead) observe(
+	position int64,
+	n int64,
+	blocksize int64,
+	size func() int64,
+) (start int64, length int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if position == m.last_end {
+		m.sequential += 1
+	} else {
+		m.sequential = 1
+		m.window = 0
+	}
+	m.last_end = position + n
+
+	if m.sequential < readahead_MIN_SEQUENTIAL || m.running || m.stopped {
+		return 0, 0
+	}
+
+	contiguous := m.start <= m.last_end && m.last_end <= m.end
+	if contiguous && m.eof {
+		return 0, 0
+	}
+	// keep at least half a window ahead of the reader
+	if contiguous && m.window > 0 && m.end-m.last_end >= m.window/2 {
+		return 0, 0
+	}
+
+	window := m.strategy.Window(m.window, size())
+	if window <= 0 {
+		return 0, 0
+	}
+	m.window = window
+
+	if !contiguous {
+		// the put must start at a block boundary
+		m.start = m.last_end / blocksize * blocksize
+		m.end = m.start
+		m.eof = false
+	}
+	start = m.end
+	length = m.last_end + window - start
+	if length <= 0 {
+		return 0, 0
+	}
+
+	m.running = true
+	m.wg.Add(1)
+	return start, length
+}
+
+// Extend the range which has been read ahead by data at position, which is
+// the end of the file if eof is set. Returns false if reading ahead is to be
+// stopped.
+func (m *readAhead) extend(position int64, n int64, eof bool) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped || position != m.end {
+		return false
+	}
+	m.end = position + n
+	m.eof = eof
+	return true
+}
+
+func (m *readAhead) finish() {
+	m.lock.Lock()
+	m.running = false
+	m.lock.Unlock()
+	m.wg.Done()
+}
+
+// Forget what has been read ahead, e.g. because the file has been written to,
+// after waiting for a running read ahead.
+func (m *readAhead) reset() {
+	m.lock.Lock()
+	m.stopped = true
+	m.lock.Unlock()
+
+	m.wg.Wait()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stopped = false
+	m.sequential = 0
+	m.window = 0
+	m.start = 0
+	m.end = 0
+	m.eof = false
+}
+
+// Stop reading ahead for good and wait for a running read ahead.
+func (m *readAhead) stop() {
+	m.lock.Lock()
+	m.stopped = true
+	m.lock.Unlock()
+
+	m.wg.Wait()
+}
+
+// Return the size of the file on the source, or -1 if it is not known.
+//
+// The size in the cache cannot be used: the data which has been read ahead
+// may extend it.
+func (m *CacheLayerFile) sourceSize() int64 {
+	if m.layer == nil {
+		return -1
+	}
+	m.layer.lock.Lock()
+	path := m.path
+	m.layer.lock.Unlock()
+
+	stat, err := m.layer.fs.Lstat(path)
+	if err != nil {
+		return -1
+	}
+	return int64(stat.Size())
+}
+
+// Serve a read from the data which has been read ahead, if it covers the
+// read.
+func (m *CacheLayerFile) readAheadData(dest []byte, position int64) (int, bool) {
+	length, ok := m.ahead.covers(position, int64(len(dest)))
+	if !ok {
+		return 0, false
+	}
+	n, err := m.cacheside.FetchData(dest[:length], uint64(position))
+	if err != nil || int64(n) != length {
+		// evicted in the meantime
+		return 0, false
+	}
+	return n, true
+}
+
+// Record a read for the detection of sequential reads, and read ahead if
+// the strategy asks for it.
+func (m *CacheLayerFile) observeRead(position int64, n int) {
+	start, length := m.ahead.observe(
+		position,
+		int64(n),
+		m.blocksize,
+		m.sourceSize,
+	)
+	if length > 0 {
+		m.startReadAhead(start, length)
+	}
+}
+
+// Read [start, start+length) from the source into the cache in the
+// background, to serve later reads from the cache.
+func (m *CacheLayerFile) startReadAhead(start int64, length int64) {
+	go func() {
+		defer m.ahead.finish()
+
+		fsside := m.source()
+		if fsside == nil {
+			return
+		}
+
+		size := m.sourceSize()
+		chunk_size := m.blocksize * readahead_CHUNK_BLOCKS
+		buf := make([]byte, chunk_size)
+		end := start + length
+		for position := start; position < end; {
+			want := chunk_size
+			if end-position < want {
+				// whole blocks only, so that the next read ahead
+				// starts at a block boundary
+				want = (end - position + m.blocksize - 1) / m.blocksize * m.blocksize
+			}
+
+			n, err := fsside.Read(buf[:want], position)
+			if err != nil {
+				log.Printf("read ahead at %d failed: %s", position, err)
+				return
+			}
+			if n > 0 {
+				err := m.cacheside.PutData(
+					buf[:n],
+					uint64(position),
+					QUOTA_BLOCK_PRIO_READAHEAD,
+				)
+				if err != nil {
+					// usually ErrCacheFull, as reading ahead
+					// does not evict anything
+					return
+				}
+			}
+			short := int64(n) < want
+			// a short read is not necessarily the end of the
+			// file, and serving it as such would truncate reads
+			eof := short && size >= 0 && position+int64(n) >= size
+			if short && !eof {
+				n -= n % int(m.blocksize)
+			}
+			if !m.ahead.extend(position, int64(n), eof) || short {
+				return
+			}
+			position += int64(n)
+		}
+	}()
+}
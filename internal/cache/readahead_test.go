@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAheadStrategies(t *testing.T) {
+	fixed := &FixedReadAhead{Size: 65536}
+	assert.Equal(t, int64(65536), fixed.Window(0, -1))
+	assert.Equal(t, int64(65536), fixed.Window(65536, 1<<30))
+
+	doubling := &DoublingReadAhead{Initial: 4096, Max: 16384}
+	assert.Equal(t, int64(4096), doubling.Window(0, -1))
+	assert.Equal(t, int64(8192), doubling.Window(4096, -1))
+	assert.Equal(t, int64(16384), doubling.Window(16384, -1))
+
+	whole_file := &WholeFileReadAhead{MaxSize: 1 << 20, Fallback: fixed}
+	assert.Equal(t, int64(1000), whole_file.Window(0, 1000))
+	assert.Equal(t, int64(65536), whole_file.Window(0, 1<<21))
+	assert.Equal(t, int64(65536), whole_file.Window(0, -1))
+	whole_file.Fallback = nil
+	assert.Equal(t, int64(0), whole_file.Window(0, 1<<21))
+}
+
+func TestNewReadAheadStrategy(t *testing.T) {
+	strategy, err := NewReadAheadStrategy(READAHEAD_OFF, 1<<20)
+	assert.Nil(t, err)
+	assert.Nil(t, strategy)
+
+	strategy, err = NewReadAheadStrategy(READAHEAD_DOUBLING, 1<<20)
+	assert.Nil(t, err)
+	assert.Equal(t, &DoublingReadAhead{Initial: readahead_INITIAL_WINDOW, Max: 1 << 20}, strategy)
+
+	_, err = NewReadAheadStrategy("sideways", 1<<20)
+	assert.NotNil(t, err)
+}
+
+func openReadAheadFile(t *testing.T, setup *prefetchSetup, size int) *CacheLayerFile {
+	ioutil.WriteFile(filepath.Join(setup.tree, "music", "a"), genTestData(size), 0600)
+
+	cache_layer := NewCacheLayer(setup.cache, setup.fs)
+	cache_layer.SetReadAhead(&FixedReadAhead{Size: 65536})
+	f, err := cache_layer.OpenFile("/music/a", os.O_RDONLY)
+	assert.Nil(t, err)
+	return f.(*CacheLayerFile)
+}
+
+func TestSequentialReadsAreServedFromReadAhead(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+	f := openReadAheadFile(t, setup, 1<<20)
+	defer f.Release()
+
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		n, err := f.Read(buf, int64(i*4096))
+		assert.Nil(t, err)
+		assert.Equal(t, 4096, n)
+	}
+	f.ahead.wg.Wait()
+
+	cached := setup.cache.files["/music/a"]
+	assert.True(t, cached.priorities[QUOTA_BLOCK_PRIO_READAHEAD])
+	assert.Equal(t, 8192+65536, len(cached.data))
+
+	reads := setup.fs.reads
+	n, err := f.Read(buf, 8192)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, genTestData(8192 + 4096)[8192:], buf)
+	assert.Equal(t, reads, setup.fs.reads)
+}
+
+func TestRandomReadsDoNotReadAhead(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+	f := openReadAheadFile(t, setup, 1<<20)
+	defer f.Release()
+
+	buf := make([]byte, 4096)
+	for _, position := range []int64{0, 65536, 4096, 131072} {
+		_, err := f.Read(buf, position)
+		assert.Nil(t, err)
+	}
+	f.ahead.wg.Wait()
+
+	assert.False(t, setup.cache.files["/music/a"].priorities[QUOTA_BLOCK_PRIO_READAHEAD])
+}
+
+func TestWriteDropsReadAhead(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+	f := openReadAheadFile(t, setup, 1<<20)
+	defer f.Release()
+
+	buf := make([]byte, 4096)
+	f.Read(buf, 0)
+	f.Read(buf, 4096)
+	f.ahead.wg.Wait()
+	_, ok := f.ahead.covers(8192, 4096)
+	assert.True(t, ok)
+
+	f.ahead.reset()
+	_, ok = f.ahead.covers(8192, 4096)
+	assert.False(t, ok)
+}
+
+func TestShortReadsAreNotTheEndOfTheFile(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+	f := openReadAheadFile(t, setup, 1<<20)
+	defer f.Release()
+	setup.fs.max_read = 5000
+
+	buf := make([]byte, 4096)
+	f.Read(buf, 0)
+	f.Read(buf, 4096)
+	f.ahead.wg.Wait()
+	_, ok := f.ahead.covers(12288, 4096)
+	assert.False(t, ok)
+
+	n, err := f.Read(buf, 12288)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, genTestData(12288 + 4096)[12288:], buf)
+}
+
+func TestReadAheadStopsAtTheEndOfTheFile(t *testing.T) {
+	setup := setUpPrefetch(t, 1)
+	defer setup.tearDown()
+	f := openReadAheadFile(t, setup, 10000)
+	defer f.Release()
+
+	buf := make([]byte, 4096)
+	f.Read(buf, 0)
+	f.Read(buf, 4096)
+	f.ahead.wg.Wait()
+
+	reads := setup.fs.reads
+	n, err := f.Read(buf, 8192)
+	assert.Nil(t, err)
+	assert.Equal(t, 10000-8192, n)
+	assert.Equal(t, reads, setup.fs.reads)
+}
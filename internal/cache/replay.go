@@ -0,0 +1,371 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	// Maximum number of consecutive dirty blocks written back at once
+	replay_MAX_WRITE_BLOCKS = 64
+)
+
+// Replay the journal against the source.
+//
+// Entries are applied in order and committed one by one, so that a replay
+// which is interrupted, by the source going away or by a crash, continues with
+// the first entry which has not been committed. As an entry may have been
+// applied without being committed, applying an entry twice must be harmless;
+// errors which indicate that an entry has been applied already (e.g. EEXIST
+// for MKDIR) are thus ignored. CREATE is the exception: a file which exists
+// on the source already may have been created there meanwhile and is handled
+// as a conflict.
+//
+// Entries which fail for other reasons than the source being unavailable are
+// reported as conflicts (see reportFailure). If the source becomes
+// unavailable, the replay stops and the error is returned. The replay also stops at conflicts which are left
+// queued (see CONFLICT_REFUSE); it does not start again until the conflict is
+// resolved.
+//
+// Replay is started automatically when the source is ready and there are
+// entries left. Only one replay runs at a time; if a replay is running
+// already, this returns immediately.
+func (m *CacheLayer) Replay() layer.Error {
+	if m.journal == nil {
+		return nil
+	}
+
+	m.lock.Lock()
+	if m.replaying || m.blocked {
+		m.lock.Unlock()
+		return nil
+	}
+	m.replaying = true
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		m.replaying = false
+		m.lock.Unlock()
+	}()
+
+	for {
+		// entries may be appended while the replay is running
+		entries := m.journal.Pending()
+		if len(entries) == 0 {
+			m.lock.Lock()
+			m.replayed = make(map[string]*BaseVersion)
+			m.lock.Unlock()
+			return nil
+		}
+
+		for _, entry := range entries {
+			if err := m.replayEntry(entry); err != nil {
+				if err == errConflictRefused {
+					log.Printf("replay: stopping at conflict on %s",
+						entry.Path)
+					return err
+				}
+				if IsUnavailableError(err) {
+					log.Printf("replay: source unavailable (%s), stopping",
+						err)
+					return err
+				}
+				if err := m.reportFailure(entry, err); err != nil {
+					log.Printf("replay: stopping at failed %s %s",
+						entry.Op, entry.Path)
+					return err
+				}
+			}
+
+			if err := m.journal.Commit(entry); err != nil {
+				log.Printf("replay: failed to commit %s %s: %s",
+					entry.Op, entry.Path, err)
+				return layer.WrapError(syscall.EIO)
+			}
+		}
+	}
+}
+
+// Return nil if err is nil or one of the errors in applied.
+func ignoreErrors(err layer.Error, applied ...syscall.Errno) layer.Error {
+	if err == nil {
+		return nil
+	}
+	for _, errno := range applied {
+		if err.Errno() == uintptr(errno) {
+			return nil
+		}
+	}
+	return err
+}
+
+func (m *CacheLayer) replayEntry(entry *JournalEntry) layer.Error {
+	log.Printf("replay: %s %s", entry.Op, entry.Path)
+
+	var err layer.Error
+	switch entry.Op {
+	case JOURNAL_CREATE:
+		err = m.replayCreate(entry)
+	case JOURNAL_MKDIR:
+		return ignoreErrors(m.fs.Mkdir(entry.Path, entry.Mode), syscall.EEXIST)
+	case JOURNAL_SYMLINK:
+		return ignoreErrors(m.fs.Symlink(entry.Target, entry.Path), syscall.EEXIST)
+	case JOURNAL_UNLINK:
+		return m.replayUnlink(entry)
+	case JOURNAL_RMDIR:
+		return ignoreErrors(m.fs.Rmdir(entry.Path), syscall.ENOENT)
+	case JOURNAL_RENAME:
+		err = ignoreErrors(m.fs.Rename(entry.Path, entry.Target), syscall.ENOENT)
+		if err == nil {
+			m.moveReplayed(entry.Path, entry.Target)
+		}
+		return err
+	case JOURNAL_CHMOD:
+		err = m.fs.Chmod(entry.Path, entry.Mode)
+	case JOURNAL_CHOWN:
+		err = m.fs.Chown(entry.Path, entry.UID, entry.GID)
+	case JOURNAL_UTIMENS:
+		err = m.fs.Utimens(entry.Path, entry.Atime, entry.Mtime)
+	case JOURNAL_WRITE:
+		err = m.replayWrite(entry)
+	case JOURNAL_SETXATTR:
+		// XATTR_CREATE and XATTR_REPLACE have been checked against the
+		// cache already
+		err = m.fs.Setxattr(entry.Path, entry.Target, entry.Value, 0)
+	case JOURNAL_REMOVEXATTR:
+		err = ignoreErrors(m.fs.Removexattr(entry.Path, entry.Target), syscall.ENODATA)
+	default:
+		log.Printf("replay: unknown journal operation %d", entry.Op)
+		return layer.WrapError(syscall.EINVAL)
+	}
+
+	if err == nil {
+		m.noteReplayed(entry.Path)
+	}
+	return err
+}
+
+// Create a file which has been created offline.
+//
+// A file which has been created on the source meanwhile is not replaced
+// unless the conflict policy says so.
+func (m *CacheLayer) replayCreate(entry *JournalEntry) layer.Error {
+	f, err := m.fs.Create(entry.Path, os.O_WRONLY|os.O_EXCL, entry.Mode)
+	if err == nil {
+		f.Release()
+		return nil
+	}
+	if err.Errno() != uintptr(syscall.EEXIST) {
+		return err
+	}
+
+	stat, err := m.fs.Lstat(entry.Path)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	replayed, ok := m.replayed[entry.Path]
+	m.lock.Unlock()
+	if ok && replayed.Matches(stat) {
+		// created by this replay before it was interrupted
+		return nil
+	}
+
+	create, err := m.resolveCreateConflict(entry, stat)
+	if !create {
+		return err
+	}
+	f, err = m.fs.Create(entry.Path, os.O_WRONLY|os.O_TRUNC, entry.Mode)
+	if err != nil {
+		return err
+	}
+	f.Release()
+	return nil
+}
+
+func (m *CacheLayer) replayUnlink(entry *JournalEntry) layer.Error {
+	stat, conflict, err := m.checkConflict(entry)
+	if err != nil {
+		return err
+	}
+	if conflict && stat == nil {
+		// unlinked on the source already
+		return nil
+	}
+	if conflict {
+		unlink, err := m.resolveUnlinkConflict(entry)
+		if !unlink {
+			return err
+		}
+	}
+	return ignoreErrors(m.fs.Unlink(entry.Path), syscall.ENOENT)
+}
+
+// Move the attributes remembered by noteReplayed along with a rename.
+func (m *CacheLayer) moveReplayed(oldpath string, newpath string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for path, base := range m.replayed {
+		if hasPathPrefix(path, newpath) {
+			delete(m.replayed, path)
+		}
+		if hasPathPrefix(path, oldpath) {
+			delete(m.replayed, path)
+			m.replayed[newpath+path[len(oldpath):]] = base
+		}
+	}
+}
+
+// Determine where the object which was at path when an entry was recorded is
+// in the cache now, by following the entries recorded after it.
+//
+// Returns false if the object does not exist anymore.
+func resolvePath(path string, later []*JournalEntry) (string, bool) {
+	for _, entry := range later {
+		switch entry.Op {
+		case JOURNAL_RENAME:
+			if hasPathPrefix(path, entry.Path) {
+				path = entry.Target + path[len(entry.Path):]
+			} else if hasPathPrefix(path, entry.Target) {
+				// replaced by the renamed object
+				return "", false
+			}
+		case JOURNAL_UNLINK, JOURNAL_RMDIR:
+			if hasPathPrefix(path, entry.Path) {
+				return "", false
+			}
+		}
+	}
+	return path, true
+}
+
+// Open the cached file which holds the data for a CREATE or WRITE entry.
+//
+// The lock is held so that the file cannot be renamed between resolving its
+// path and opening it. For WRITE entries, the writes to the file are recorded
+// again from now on.
+func (m *CacheLayer) openCached(entry *JournalEntry) (CachedFile, string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	pending := m.journal.Pending()
+	cache_path, ok := resolvePath(entry.Path, pending[1:])
+	if !ok {
+		return nil, "", false
+	}
+
+	if entry.Op == JOURNAL_WRITE {
+		delete(m.pendingWrites, cache_path)
+	}
+
+	cachef, err := m.cache.OpenFile(cache_path)
+	if err != nil {
+		log.Printf("replay: cached data for %s (now at %s) is gone: %s",
+			entry.Path, cache_path, err)
+		return nil, "", false
+	}
+	return cachef, cache_path, true
+}
+
+// Write the dirty blocks of a file back to the source and set the size of the
+// file on the source to the cached size.
+func (m *CacheLayer) replayWrite(entry *JournalEntry) layer.Error {
+	cachef, cache_path, ok := m.openCached(entry)
+	if !ok {
+		return nil
+	}
+	defer cachef.Close()
+
+	source_stat, conflict, err := m.checkConflict(entry)
+	if err != nil {
+		return err
+	}
+	if conflict {
+		write, err := m.resolveWriteConflict(entry, cachef, cache_path, source_stat)
+		if !write {
+			return err
+		}
+	}
+
+	stat, err := cachef.FetchAttr()
+	if err != nil {
+		log.Printf("replay: cannot stat cached data for %s: %s",
+			entry.Path, err)
+		return nil
+	}
+	size := stat.Size()
+
+	// the blocks stay dirty until the source has them, so that they are
+	// written back again if the replay is interrupted; blocks which are
+	// written to meanwhile stay dirty anyway
+	written := false
+	blocks := cachef.StartWriteBack()
+	defer func() {
+		cachef.FinishWriteBack(written)
+	}()
+
+	f, err := m.fs.OpenFile(entry.Path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Release()
+
+	blocksize := uint64(m.cache.BlockSize())
+	for i := 0; i < len(blocks); {
+		// collect a run of consecutive blocks
+		n := 1
+		for i+n < len(blocks) && n < replay_MAX_WRITE_BLOCKS &&
+			blocks[i+n] == blocks[i]+uint64(n) {
+			n++
+		}
+
+		if err := writeBack(cachef, f, blocks[i]*blocksize, uint64(n)*blocksize, size); err != nil {
+			return err
+		}
+		i += n
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	written = true
+	return nil
+}
+
+// Copy a range from the cache to the source, stopping at the end of the file.
+//
+// If the range cannot be read from the cache, it is skipped: retrying would
+// not bring the data back.
+func writeBack(cachef CachedFile, f layer.File, position uint64, length uint64, size uint64) layer.Error {
+	if position >= size {
+		return nil
+	}
+	if position+length > size {
+		length = size - position
+	}
+
+	buf := make([]byte, length)
+	n, err := cachef.FetchData(buf, position)
+	if err != nil || uint64(n) != length {
+		log.Printf("replay: lost cached data at %d (read %d of %d: %v)",
+			position, n, length, err)
+		return nil
+	}
+
+	for written := 0; written < n; {
+		w, err := f.Write(buf[written:n], int64(position)+int64(written))
+		if err != nil {
+			return err
+		}
+		if w == 0 {
+			return layer.WrapError(syscall.EIO)
+		}
+		written += w
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"log"
+	"syscall"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// Extended attributes
+//
+// Values read from the source are cached per attribute, and Listxattr caches
+// the complete set. While the source is unavailable, attributes are served
+// from the cache; an attribute which has never been read is thus missing
+// offline, unless the attributes have been listed before.
+
+const (
+	// XATTR_CREATE and XATTR_REPLACE from <sys/xattr.h>, which the syscall
+	// package lacks
+	XATTR_CREATE  = 0x1
+	XATTR_REPLACE = 0x2
+)
+
+// Update a single cached extended attribute.
+func (m *CacheLayer) putXattr(path string, name string, value []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	xattrs, err := m.cache.FetchXattrs(path)
+	if err != nil {
+		return
+	}
+	xattrs[name] = value
+	m.cache.PutXattrs(path, xattrs)
+}
+
+// Remove a single cached extended attribute.
+func (m *CacheLayer) dropXattr(path string, name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	xattrs, err := m.cache.FetchXattrs(path)
+	if err != nil {
+		return
+	}
+	if _, ok := xattrs[name]; !ok {
+		return
+	}
+	delete(xattrs, name)
+	m.cache.PutXattrs(path, xattrs)
+}
+
+func (m *CacheLayer) fetchXattr(path string, name string) ([]byte, layer.Error) {
+	xattrs, err := m.cache.FetchXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := xattrs[name]
+	if !ok {
+		return nil, layer.WrapError(syscall.ENODATA)
+	}
+	return value, nil
+}
+
+func (m *CacheLayer) fetchXattrNames(path string) ([]string, layer.Error) {
+	xattrs, err := m.cache.FetchXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+func (m *CacheLayer) Getxattr(path string, name string) ([]byte, layer.Error) {
+	if !m.online() {
+		return m.fetchXattr(path, name)
+	}
+
+	value, err := m.fs.Getxattr(path, name)
+	if err == nil {
+		m.putXattr(path, name, value)
+		return value, nil
+	}
+
+	switch {
+	case err.Errno() == uintptr(syscall.ENODATA):
+		m.dropXattr(path, name)
+	case layer.IsNotFoundError(err):
+		m.cache.PutNonExistant(path)
+	case layer.IsUnavailableError(err):
+		log.Printf("Getxattr(%s): source unavailable (%s), using cache",
+			path, err)
+		return m.fetchXattr(path, name)
+	}
+	return nil, err
+}
+
+func (m *CacheLayer) Listxattr(path string) ([]string, layer.Error) {
+	if !m.online() {
+		return m.fetchXattrNames(path)
+	}
+
+	names, err := m.fs.Listxattr(path)
+	if err == nil {
+		m.cacheXattrs(path, names)
+		return names, nil
+	}
+
+	switch layer.ClassifyError(err) {
+	case layer.ERRCLASS_NOT_FOUND:
+		m.cache.PutNonExistant(path)
+	case layer.ERRCLASS_UNAVAILABLE:
+		log.Printf("Listxattr(%s): source unavailable (%s), using cache",
+			path, err)
+		return m.fetchXattrNames(path)
+	}
+	return nil, err
+}
+
+// Fetch the values of the listed attributes from the source and cache them as
+// the complete set.
+func (m *CacheLayer) cacheXattrs(path string, names []string) {
+	xattrs := make(map[string][]byte)
+	for _, name := range names {
+		value, err := m.fs.Getxattr(path, name)
+		if err != nil && err.Errno() == uintptr(syscall.ENODATA) {
+			// removed in the meantime
+			continue
+		}
+		if err != nil {
+			log.Printf("Listxattr(%s): failed to fetch %s: %s",
+				path, name, err)
+			return
+		}
+		xattrs[name] = value
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cache.PutXattrs(path, xattrs)
+}
+
+func (m *CacheLayer) Setxattr(path string, name string, value []byte, flags int) layer.Error {
+	if !m.online() {
+		return m.offlineSetxattr(path, name, value, flags)
+	}
+
+	if err := m.fs.Setxattr(path, name, value, flags); err != nil {
+		return err
+	}
+	m.putXattr(path, name, value)
+	m.refresh(path)
+	return nil
+}
+
+func (m *CacheLayer) Removexattr(path string, name string) layer.Error {
+	if !m.online() {
+		return m.offlineRemovexattr(path, name)
+	}
+
+	if err := m.fs.Removexattr(path, name); err != nil {
+		return err
+	}
+	m.dropXattr(path, name)
+	m.refresh(path)
+	return nil
+}
+
+func (m *CacheLayer) offlineSetxattr(path string, name string, value []byte, flags int) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	_, err := m.fetchXattr(path, name)
+	if err != nil && err.Errno() != uintptr(syscall.ENODATA) {
+		return err
+	}
+	if err == nil && flags&XATTR_CREATE != 0 {
+		return layer.WrapError(syscall.EEXIST)
+	}
+	if err != nil && flags&XATTR_REPLACE != 0 {
+		return err
+	}
+
+	entry := &JournalEntry{Op: JOURNAL_SETXATTR, Path: path, Target: name, Value: value}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	m.putXattr(path, name, value)
+	return nil
+}
+
+func (m *CacheLayer) offlineRemovexattr(path string, name string) layer.Error {
+	if m.journal == nil {
+		return layer.WrapError(syscall.EROFS)
+	}
+
+	if _, err := m.fetchXattr(path, name); err != nil {
+		return err
+	}
+
+	entry := &JournalEntry{Op: JOURNAL_REMOVEXATTR, Path: path, Target: name}
+	if err := m.record(entry); err != nil {
+		return err
+	}
+	m.dropXattr(path, name)
+	return nil
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetxattrCachesValue(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Getxattr", "/foo", "user.foo").Return([]byte("bar"), nil)
+	cache.On("FetchXattrs", "/foo").Return(map[string][]byte{
+		"user.other": []byte("baz"),
+	}, nil)
+	cache.On("PutXattrs", "/foo", map[string][]byte{
+		"user.other": []byte("baz"),
+		"user.foo":   []byte("bar"),
+	}).Return()
+
+	value, err := cache_layer.Getxattr("/foo", "user.foo")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	cache.AssertExpectations(t)
+}
+
+func TestGetxattrDropsRemovedValue(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Getxattr", "/foo", "user.foo").Return(nil, layer.WrapError(syscall.ENODATA))
+	cache.On("FetchXattrs", "/foo").Return(map[string][]byte{
+		"user.foo": []byte("bar"),
+	}, nil)
+	cache.On("PutXattrs", "/foo", map[string][]byte{}).Return()
+
+	_, err := cache_layer.Getxattr("/foo", "user.foo")
+	assert.Equal(t, uintptr(syscall.ENODATA), err.Errno())
+	cache.AssertExpectations(t)
+}
+
+func TestGetxattrFallsBackToCacheOnConnectivityErrors(t *testing.T) {
+	cache_layer, cache, fs := prepCacheLayer()
+	fs.On("Getxattr", "/foo", "user.foo").Return(nil, layer.WrapError(syscall.EIO))
+	fs.On("Getxattr", "/foo", "user.other").Return(nil, layer.WrapError(syscall.EIO))
+	cache.On("FetchXattrs", "/foo").Return(map[string][]byte{
+		"user.foo": []byte("bar"),
+	}, nil)
+
+	value, err := cache_layer.Getxattr("/foo", "user.foo")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	_, err = cache_layer.Getxattr("/foo", "user.other")
+	assert.Equal(t, uintptr(syscall.ENODATA), err.Errno())
+}
+
+func TestOfflineSetxattrIsRecorded(t *testing.T) {
+	dir, journal := prepJournal(t)
+	defer os.RemoveAll(dir)
+	defer journal.Close()
+
+	cache := &mockCache{}
+	fs := &mockFileSystem{}
+	fs.On("IsReady").Return(false)
+	cache_layer := NewCacheLayer(cache, fs)
+	cache_layer.SetJournal(journal)
+
+	cache.On("FetchXattrs", "/foo").Return(map[string][]byte{}, nil)
+	cache.On("PutXattrs", "/foo", map[string][]byte{
+		"user.foo": []byte("bar"),
+	}).Return()
+
+	err := cache_layer.Setxattr("/foo", "user.foo", []byte("bar"), XATTR_REPLACE)
+	assert.Equal(t, uintptr(syscall.ENODATA), err.Errno())
+	assert.True(t, journal.IsEmpty())
+
+	assert.Nil(t, cache_layer.Setxattr("/foo", "user.foo", []byte("bar"), XATTR_CREATE))
+	entries := journal.Pending()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, JOURNAL_SETXATTR, entries[0].Op)
+	assert.Equal(t, "user.foo", entries[0].Target)
+	assert.Equal(t, []byte("bar"), entries[0].Value)
+	cache.AssertExpectations(t)
+}
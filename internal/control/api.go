@@ -0,0 +1,287 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/horazont/dragonstash/internal/cache"
+	"github.com/horazont/dragonstash/internal/health"
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	fetch_CHUNK_SIZE = 128 * 1024
+)
+
+// The cache management operations, as implemented by filecache.FileCache
+type Cache interface {
+	Quota() cache.QuotaInfo
+	PinnedUsage() (blocks uint64, inodes uint64)
+	SetBlocksTotal(new_blocks uint64)
+	SetInodesTotal(new_inodes uint64)
+	BlockSize() int64
+	Pin(path string) layer.Error
+	Unpin(path string) layer.Error
+	Evict(path string) (uint64, layer.Error)
+	IsPinned(path string) (bool, layer.Error)
+	Usage(path string) (cached uint64, size uint64, err layer.Error)
+}
+
+// The state of the source, as implemented by health.Monitor
+type Source interface {
+	State() health.State
+	IsForced() bool
+	Force(state health.State)
+	Unforce()
+}
+
+// The background prefetching, as implemented by cache.Prefetcher
+type Prefetcher interface {
+	Start(path string) error
+	Cancel(path string) bool
+	Progress() []cache.PrefetchProgress
+}
+
+// The cached file system, as implemented by cache.CacheLayer
+type Layer interface {
+	layer.FileSystem
+	OpenFiles() int
+}
+
+type Empty struct {
+}
+
+type PathArgs struct {
+	Path string
+}
+
+type FetchReply struct {
+	Files  uint64
+	Bytes  uint64
+	Failed uint64
+}
+
+type EvictReply struct {
+	Blocks uint64
+}
+
+type SourceStateArgs struct {
+	// "online", "offline" or "auto" to follow the actual state again
+	State string
+}
+
+type QuotaReply struct {
+	BlockSize    int64
+	BlocksTotal  uint64
+	BlocksUsed   uint64
+	BlocksPinned uint64
+	InodesTotal  uint64
+	InodesUsed   uint64
+	InodesPinned uint64
+}
+
+// Limits to change; nil leaves a limit as it is, zero removes it.
+type SetQuotaArgs struct {
+	Blocks *uint64
+	Inodes *uint64
+}
+
+type PrefetchReply struct {
+	Prefetches []cache.PrefetchProgress
+}
+
+type StatusReply struct {
+	Version      int
+	SourceState  string
+	SourceForced bool
+	BlocksTotal  uint64
+	BlocksUsed   uint64
+	InodesTotal  uint64
+	InodesUsed   uint64
+	OpenFiles    int
+}
+
+// Version 1 of the control API.
+//
+// Paths are relative to the root of the mount.
+type ControlV1 struct {
+	cache      Cache
+	source     Source
+	fs         Layer
+	prefetcher Prefetcher
+}
+
+func NewControlV1(cache Cache, source Source, fs Layer, prefetcher Prefetcher) *ControlV1 {
+	return &ControlV1{
+		cache:      cache,
+		source:     source,
+		fs:         fs,
+		prefetcher: prefetcher,
+	}
+}
+
+// Convert a layer.Error into an error without keeping a typed nil.
+func rpcError(err layer.Error) error {
+	if err == nil {
+		return nil
+	}
+	return err
+}
+
+// Read the file at path through the cached file system, so that its contents
+// end up in the cache.
+func fetchFile(fs layer.FileSystem, path string) (uint64, layer.Error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Release()
+
+	buf := make([]byte, fetch_CHUNK_SIZE)
+	var total uint64
+	for {
+		n, err := file.Read(buf, int64(total))
+		total += uint64(n)
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+	}
+}
+
+func fetchTree(fs layer.FileSystem, path string, reply *FetchReply) {
+	stat, err := fs.Lstat(path)
+	if err != nil {
+		log.Printf("control: cannot fetch %s: %s", path, err)
+		reply.Failed += 1
+		return
+	}
+
+	switch stat.Mode() & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		entries, err := fs.OpenDir(path)
+		if err != nil {
+			log.Printf("control: cannot fetch %s: %s", path, err)
+			reply.Failed += 1
+			return
+		}
+		for _, entry := range entries {
+			fetchTree(fs, fs.Join(path, entry.Name()), reply)
+		}
+	case syscall.S_IFLNK:
+		if _, err := fs.Readlink(path); err != nil {
+			log.Printf("control: cannot fetch %s: %s", path, err)
+			reply.Failed += 1
+		}
+	case syscall.S_IFREG:
+		n, err := fetchFile(fs, path)
+		reply.Bytes += n
+		if err != nil && err != io.EOF {
+			log.Printf("control: cannot fetch %s: %s", path, err)
+			reply.Failed += 1
+			return
+		}
+		reply.Files += 1
+	}
+}
+
+// Fetch the object at path and, recursively, everything below it into the
+// cache.
+//
+// The call returns once everything has been fetched; objects which cannot be
+// fetched are counted in the reply and skipped.
+func (m *ControlV1) Fetch(args *PathArgs, reply *FetchReply) error {
+	fetchTree(m.fs, args.Path, reply)
+	return nil
+}
+
+// Start fetching the object at path and everything below it into the cache in
+// the background, see cache.Prefetcher.
+func (m *ControlV1) Prefetch(args *PathArgs, reply *Empty) error {
+	return m.prefetcher.Start(args.Path)
+}
+
+func (m *ControlV1) CancelPrefetch(args *PathArgs, reply *Empty) error {
+	if !m.prefetcher.Cancel(args.Path) {
+		return errors.New(fmt.Sprintf("no prefetch of %s is running", args.Path))
+	}
+	return nil
+}
+
+// Return the progress of the prefetches since the start.
+func (m *ControlV1) PrefetchProgress(args *Empty, reply *PrefetchReply) error {
+	reply.Prefetches = m.prefetcher.Progress()
+	return nil
+}
+
+// Drop the cached data below path, see filecache.FileCache.Evict.
+func (m *ControlV1) Evict(args *PathArgs, reply *EvictReply) error {
+	blocks, err := m.cache.Evict(args.Path)
+	reply.Blocks = blocks
+	return rpcError(err)
+}
+
+func (m *ControlV1) Pin(args *PathArgs, reply *Empty) error {
+	return rpcError(m.cache.Pin(args.Path))
+}
+
+func (m *ControlV1) Unpin(args *PathArgs, reply *Empty) error {
+	return rpcError(m.cache.Unpin(args.Path))
+}
+
+// Force the source offline or online, or lift the override.
+func (m *ControlV1) SetSourceState(args *SourceStateArgs, reply *Empty) error {
+	switch args.State {
+	case "online":
+		m.source.Force(health.STATE_ONLINE)
+	case "offline":
+		m.source.Force(health.STATE_OFFLINE)
+	case "auto":
+		m.source.Unforce()
+	default:
+		return errors.New(fmt.Sprintf("unknown source state: %q", args.State))
+	}
+	return nil
+}
+
+// Return the limits and usage of the cache, including the usage of pinned
+// objects, which is expensive to determine.
+func (m *ControlV1) GetQuota(args *Empty, reply *QuotaReply) error {
+	info := m.cache.Quota()
+	reply.BlockSize = m.cache.BlockSize()
+	reply.BlocksTotal = info.BlocksTotal
+	reply.BlocksUsed = info.BlocksUsed
+	reply.InodesTotal = info.InodesTotal
+	reply.InodesUsed = info.InodesUsed
+	reply.BlocksPinned, reply.InodesPinned = m.cache.PinnedUsage()
+	return nil
+}
+
+func (m *ControlV1) SetQuota(args *SetQuotaArgs, reply *Empty) error {
+	if args.Blocks != nil {
+		m.cache.SetBlocksTotal(*args.Blocks)
+	}
+	if args.Inodes != nil {
+		m.cache.SetInodesTotal(*args.Inodes)
+	}
+	return nil
+}
+
+func (m *ControlV1) Status(args *Empty, reply *StatusReply) error {
+	info := m.cache.Quota()
+	reply.Version = 1
+	reply.SourceState = m.source.State().String()
+	reply.SourceForced = m.source.IsForced()
+	reply.BlocksTotal = info.BlocksTotal
+	reply.BlocksUsed = info.BlocksUsed
+	reply.InodesTotal = info.InodesTotal
+	reply.InodesUsed = info.InodesUsed
+	reply.OpenFiles = m.fs.OpenFiles()
+	return nil
+}
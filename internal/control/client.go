@@ -0,0 +1,82 @@
+package control
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+
+	"github.com/horazont/dragonstash/internal/cache"
+)
+
+// A client of version 1 of the control API
+type Client struct {
+	rpc *rpc.Client
+}
+
+func Dial(socket_path string) (*Client, error) {
+	conn, err := net.Dial("unix", socket_path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		rpc: jsonrpc.NewClient(conn),
+	}, nil
+}
+
+func (m *Client) Close() error {
+	return m.rpc.Close()
+}
+
+func (m *Client) call(method string, args interface{}, reply interface{}) error {
+	return m.rpc.Call("ControlV1."+method, args, reply)
+}
+
+func (m *Client) Fetch(path string) (*FetchReply, error) {
+	reply := &FetchReply{}
+	return reply, m.call("Fetch", &PathArgs{path}, reply)
+}
+
+func (m *Client) Prefetch(path string) error {
+	return m.call("Prefetch", &PathArgs{path}, &Empty{})
+}
+
+func (m *Client) CancelPrefetch(path string) error {
+	return m.call("CancelPrefetch", &PathArgs{path}, &Empty{})
+}
+
+func (m *Client) PrefetchProgress() ([]cache.PrefetchProgress, error) {
+	reply := &PrefetchReply{}
+	err := m.call("PrefetchProgress", &Empty{}, reply)
+	return reply.Prefetches, err
+}
+
+func (m *Client) Evict(path string) (*EvictReply, error) {
+	reply := &EvictReply{}
+	return reply, m.call("Evict", &PathArgs{path}, reply)
+}
+
+func (m *Client) Pin(path string) error {
+	return m.call("Pin", &PathArgs{path}, &Empty{})
+}
+
+func (m *Client) Unpin(path string) error {
+	return m.call("Unpin", &PathArgs{path}, &Empty{})
+}
+
+func (m *Client) SetSourceState(state string) error {
+	return m.call("SetSourceState", &SourceStateArgs{state}, &Empty{})
+}
+
+func (m *Client) GetQuota() (*QuotaReply, error) {
+	reply := &QuotaReply{}
+	return reply, m.call("GetQuota", &Empty{}, reply)
+}
+
+func (m *Client) SetQuota(args *SetQuotaArgs) error {
+	return m.call("SetQuota", args, &Empty{})
+}
+
+func (m *Client) Status() (*StatusReply, error) {
+	reply := &StatusReply{}
+	return reply, m.call("Status", &Empty{}, reply)
+}
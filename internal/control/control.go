@@ -0,0 +1,126 @@
+// Package control implements the control socket of a running dragonstash.
+//
+// The socket is a Unix domain socket speaking JSON-RPC 1.0 (as implemented by
+// net/rpc/jsonrpc). The API is versioned by the name of the service: the
+// methods of version 1 are ControlV1.*, see ControlV1. Control.Versions lists
+// the versions supported by the server.
+//
+// Only the user running dragonstash may connect; connections from other users
+// are closed right away.
+package control
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"syscall"
+)
+
+var (
+	ErrNotASocket = errors.New("a file which is not a socket is in the way")
+)
+
+// Lists the API versions
+type Control struct {
+}
+
+// Return the supported API versions.
+func (m *Control) Versions(args *Empty, reply *[]int) error {
+	*reply = []int{1}
+	return nil
+}
+
+type Server struct {
+	listener *net.UnixListener
+	rpc      *rpc.Server
+	uid      uint32
+	stopped  chan struct{}
+}
+
+// Create the control socket at socket_path and serve the API on it in the
+// background.
+//
+// A socket left over at socket_path is replaced.
+func Listen(socket_path string, service *ControlV1) (*Server, error) {
+	if info, err := os.Lstat(socket_path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, ErrNotASocket
+		}
+		os.Remove(socket_path)
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{
+		Name: socket_path,
+		Net:  "unix",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket_path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	server := rpc.NewServer()
+	server.Register(&Control{})
+	server.Register(service)
+
+	result := &Server{
+		listener: listener,
+		rpc:      server,
+		uid:      uint32(os.Getuid()),
+		stopped:  make(chan struct{}),
+	}
+	go result.run()
+	return result, nil
+}
+
+// Return whether the peer of conn runs as the same user as this process.
+func (m *Server) isAuthorized(conn *net.UnixConn) bool {
+	file, err := conn.File()
+	if err != nil {
+		log.Printf("control: cannot check peer: %s", err)
+		return false
+	}
+	defer file.Close()
+
+	cred, err := syscall.GetsockoptUcred(
+		int(file.Fd()),
+		syscall.SOL_SOCKET,
+		syscall.SO_PEERCRED,
+	)
+	if err != nil {
+		log.Printf("control: cannot check peer: %s", err)
+		return false
+	}
+	return cred.Uid == m.uid
+}
+
+func (m *Server) run() {
+	defer close(m.stopped)
+
+	for {
+		conn, err := m.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		if !m.isAuthorized(conn) {
+			log.Printf("control: rejecting connection of another user")
+			conn.Close()
+			continue
+		}
+		go m.rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// Stop accepting connections and remove the socket.
+//
+// Connections which are established already are served until the client
+// closes them.
+func (m *Server) Close() {
+	m.listener.Close()
+	<-m.stopped
+}
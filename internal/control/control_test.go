@@ -0,0 +1,306 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/horazont/dragonstash/internal/cache"
+	"github.com/horazont/dragonstash/internal/health"
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/horazont/dragonstash/internal/localfs"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCache struct {
+	quota  cache.QuotaInfo
+	pinned map[string]bool
+}
+
+func (m *fakeCache) Quota() cache.QuotaInfo {
+	return m.quota
+}
+
+func (m *fakeCache) PinnedUsage() (uint64, uint64) {
+	return 3, uint64(len(m.pinned))
+}
+
+func (m *fakeCache) SetBlocksTotal(new_blocks uint64) {
+	m.quota.BlocksTotal = new_blocks
+}
+
+func (m *fakeCache) SetInodesTotal(new_inodes uint64) {
+	m.quota.InodesTotal = new_inodes
+}
+
+func (m *fakeCache) BlockSize() int64 {
+	return 4096
+}
+
+func (m *fakeCache) Pin(path string) layer.Error {
+	if path == "/missing" {
+		return layer.WrapError(syscall.ENOENT)
+	}
+	m.pinned[path] = true
+	return nil
+}
+
+func (m *fakeCache) Unpin(path string) layer.Error {
+	delete(m.pinned, path)
+	return nil
+}
+
+func (m *fakeCache) Evict(path string) (uint64, layer.Error) {
+	return 7, nil
+}
+
+func (m *fakeCache) IsPinned(path string) (bool, layer.Error) {
+	return m.pinned[path], nil
+}
+
+func (m *fakeCache) Usage(path string) (uint64, uint64, layer.Error) {
+	return 1024, 4096, nil
+}
+
+type fakeSource struct {
+	state  health.State
+	forced bool
+}
+
+func (m *fakeSource) State() health.State {
+	return m.state
+}
+
+func (m *fakeSource) IsForced() bool {
+	return m.forced
+}
+
+func (m *fakeSource) Force(state health.State) {
+	m.state = state
+	m.forced = true
+}
+
+func (m *fakeSource) Unforce() {
+	m.forced = false
+}
+
+type fakePrefetcher struct {
+	started []string
+}
+
+func (m *fakePrefetcher) Start(path string) error {
+	m.started = append(m.started, path)
+	return nil
+}
+
+func (m *fakePrefetcher) Cancel(path string) bool {
+	return path == "/running"
+}
+
+func (m *fakePrefetcher) Progress() []cache.PrefetchProgress {
+	return []cache.PrefetchProgress{
+		{Path: "/running", Running: true, FilesTotal: 3, FilesDone: 1},
+	}
+}
+
+type fakeLayer struct {
+	layer.FileSystem
+}
+
+func (m *fakeLayer) OpenFiles() int {
+	return 2
+}
+
+type testSetup struct {
+	dir        string
+	cache      *fakeCache
+	source     *fakeSource
+	prefetcher *fakePrefetcher
+	server     *Server
+	client     *Client
+}
+
+func setUp(t *testing.T) *testSetup {
+	dir, err := ioutil.TempDir("", "dragonstash-control")
+	assert.Nil(t, err)
+	os.Mkdir(filepath.Join(dir, "tree"), 0700)
+
+	result := &testSetup{
+		dir:        dir,
+		cache:      &fakeCache{pinned: make(map[string]bool)},
+		source:     &fakeSource{state: health.STATE_ONLINE},
+		prefetcher: &fakePrefetcher{},
+	}
+	fs := &fakeLayer{localfs.NewLocalFileSystem(filepath.Join(dir, "tree"))}
+	service := NewControlV1(result.cache, result.source, fs, result.prefetcher)
+
+	socket_path := filepath.Join(dir, "control.sock")
+	result.server, err = Listen(socket_path, service)
+	assert.Nil(t, err)
+	result.client, err = Dial(socket_path)
+	assert.Nil(t, err)
+	return result
+}
+
+func (m *testSetup) tearDown() {
+	m.client.Close()
+	m.server.Close()
+	os.RemoveAll(m.dir)
+}
+
+func TestSocketIsPrivate(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	info, err := os.Stat(filepath.Join(setup.dir, "control.sock"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestListenDoesNotReplaceOtherFiles(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	other_path := filepath.Join(setup.dir, "file")
+	ioutil.WriteFile(other_path, []byte("data"), 0600)
+	_, err := Listen(other_path, NewControlV1(nil, nil, nil, nil))
+	assert.Equal(t, ErrNotASocket, err)
+
+	data, _ := ioutil.ReadFile(other_path)
+	assert.Equal(t, []byte("data"), data)
+}
+
+func TestStatus(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	setup.cache.quota = cache.QuotaInfo{
+		BlocksTotal: 100,
+		BlocksUsed:  10,
+		InodesUsed:  5,
+	}
+
+	status, err := setup.client.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, &StatusReply{
+		Version:     1,
+		SourceState: "online",
+		BlocksTotal: 100,
+		BlocksUsed:  10,
+		InodesUsed:  5,
+		OpenFiles:   2,
+	}, status)
+}
+
+func TestPinAndUnpin(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	assert.Nil(t, setup.client.Pin("/music"))
+	assert.True(t, setup.cache.pinned["/music"])
+
+	assert.NotNil(t, setup.client.Pin("/missing"))
+
+	assert.Nil(t, setup.client.Unpin("/music"))
+	assert.False(t, setup.cache.pinned["/music"])
+}
+
+func TestQuota(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	blocks := uint64(1024)
+	assert.Nil(t, setup.client.SetQuota(&SetQuotaArgs{Blocks: &blocks}))
+	inodes := uint64(64)
+	assert.Nil(t, setup.client.SetQuota(&SetQuotaArgs{Inodes: &inodes}))
+	setup.cache.Pin("/foo")
+
+	quota, err := setup.client.GetQuota()
+	assert.Nil(t, err)
+	assert.Equal(t, &QuotaReply{
+		BlockSize:    4096,
+		BlocksTotal:  1024,
+		BlocksPinned: 3,
+		InodesTotal:  64,
+		InodesPinned: 1,
+	}, quota)
+}
+
+func TestSetSourceState(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	assert.Nil(t, setup.client.SetSourceState("offline"))
+	assert.Equal(t, health.STATE_OFFLINE, setup.source.state)
+	assert.True(t, setup.source.forced)
+
+	assert.Nil(t, setup.client.SetSourceState("auto"))
+	assert.False(t, setup.source.forced)
+
+	assert.NotNil(t, setup.client.SetSourceState("sideways"))
+}
+
+func TestFetchReadsTree(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	tree := filepath.Join(setup.dir, "tree")
+	os.Mkdir(filepath.Join(tree, "dir"), 0700)
+	ioutil.WriteFile(filepath.Join(tree, "dir", "foo"), make([]byte, 200000), 0600)
+	ioutil.WriteFile(filepath.Join(tree, "bar"), []byte("bar"), 0600)
+	os.Symlink("bar", filepath.Join(tree, "link"))
+
+	reply, err := setup.client.Fetch("/")
+	assert.Nil(t, err)
+	assert.Equal(t, &FetchReply{Files: 2, Bytes: 200003}, reply)
+
+	reply, err = setup.client.Fetch("/missing")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), reply.Failed)
+}
+
+func TestEvict(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	reply, err := setup.client.Evict("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), reply.Blocks)
+}
+
+func TestLocalFetchFailsForMissingPaths(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	tree := filepath.Join(setup.dir, "tree")
+	ioutil.WriteFile(filepath.Join(tree, "foo"), []byte("foo"), 0600)
+	local := NewLocal(
+		setup.cache,
+		setup.source,
+		&fakeLayer{localfs.NewLocalFileSystem(tree)},
+	)
+
+	assert.Nil(t, local.Fetch("/foo"))
+	err := local.Fetch("/missing")
+	assert.NotNil(t, err)
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestPrefetch(t *testing.T) {
+	setup := setUp(t)
+	defer setup.tearDown()
+
+	assert.Nil(t, setup.client.Prefetch("/music/jazz"))
+	assert.Equal(t, []string{"/music/jazz"}, setup.prefetcher.started)
+
+	assert.Nil(t, setup.client.CancelPrefetch("/running"))
+	assert.NotNil(t, setup.client.CancelPrefetch("/music"))
+
+	progress, err := setup.client.PrefetchProgress()
+	assert.Nil(t, err)
+	assert.Equal(t, []cache.PrefetchProgress{
+		{Path: "/running", Running: true, FilesTotal: 3, FilesDone: 1},
+	}, progress)
+}
@@ -0,0 +1,64 @@
+package control
+
+import (
+	"syscall"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// The operations of the control API for callers in the same process, such
+// as the extended attributes of the frontend.
+type Local struct {
+	cache  Cache
+	source Source
+	fs     Layer
+}
+
+func NewLocal(cache Cache, source Source, fs Layer) *Local {
+	return &Local{
+		cache:  cache,
+		source: source,
+		fs:     fs,
+	}
+}
+
+// Fetch the object at path and everything below it into the cache.
+//
+// Unlike ControlV1.Fetch, this fails with EIO if anything could not be
+// fetched.
+func (m *Local) Fetch(path string) layer.Error {
+	if _, err := m.fs.Lstat(path); err != nil {
+		return err
+	}
+	reply := &FetchReply{}
+	fetchTree(m.fs, path, reply)
+	if reply.Failed > 0 {
+		return layer.WrapError(syscall.EIO)
+	}
+	return nil
+}
+
+func (m *Local) Evict(path string) layer.Error {
+	_, err := m.cache.Evict(path)
+	return err
+}
+
+func (m *Local) Pin(path string) layer.Error {
+	return m.cache.Pin(path)
+}
+
+func (m *Local) Unpin(path string) layer.Error {
+	return m.cache.Unpin(path)
+}
+
+func (m *Local) IsPinned(path string) (bool, layer.Error) {
+	return m.cache.IsPinned(path)
+}
+
+func (m *Local) Usage(path string) (cached uint64, size uint64, err layer.Error) {
+	return m.cache.Usage(path)
+}
+
+func (m *Local) SourceState() string {
+	return m.source.State().String()
+}
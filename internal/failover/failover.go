@@ -0,0 +1,401 @@
+package failover
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// FailoverFileSystem combines several sources which provide the same tree.
+//
+// Each operation is routed to the source with the highest priority (the
+// lowest index) which reports to be ready. If the operation fails because the
+// source is unavailable, the next source is tried.
+//
+// IsReady() is called on each source for each operation, so the sources should
+// be wrapped in health.Monitor instances.
+type FailoverFileSystem struct {
+	sources []layer.FileSystem
+	lock    *sync.Mutex
+	current int
+}
+
+func NewFailoverFileSystem(sources ...layer.FileSystem) *FailoverFileSystem {
+	if len(sources) == 0 {
+		panic("at least one source is required")
+	}
+
+	return &FailoverFileSystem{
+		sources: sources,
+		lock:    new(sync.Mutex),
+		current: -1,
+	}
+}
+
+func (m *FailoverFileSystem) noteSource(index int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.current != index {
+		log.Printf("failover: using source %d", index)
+		m.current = index
+	}
+}
+
+// Call op on each ready source, in order of priority, until it does not fail
+// with an unavailability error.
+//
+// Sources whose index is in excluded are not used; excluded may be nil.
+func (m *FailoverFileSystem) try(excluded map[int]bool, op func(index int, fs layer.FileSystem) layer.Error) layer.Error {
+	var err layer.Error = layer.NewBackendError(
+		"failover: no source available",
+		syscall.ENOTCONN,
+	)
+
+	for i, fs := range m.sources {
+		if excluded[i] || !fs.IsReady() {
+			continue
+		}
+
+		err = op(i, fs)
+		if err == nil || !layer.IsUnavailableError(err) {
+			m.noteSource(i)
+			return err
+		}
+		log.Printf("failover: source %d failed: %s", i, err)
+	}
+
+	return err
+}
+
+// Return true if any of the sources is ready.
+func (m *FailoverFileSystem) IsReady() bool {
+	for _, fs := range m.sources {
+		if fs.IsReady() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *FailoverFileSystem) Join(elems ...string) string {
+	return m.sources[0].Join(elems...)
+}
+
+func (m *FailoverFileSystem) Lstat(path string) (stat layer.FileStat, err layer.Error) {
+	err = m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		stat, fserr = fs.Lstat(path)
+		return fserr
+	})
+	return stat, err
+}
+
+func (m *FailoverFileSystem) OpenDir(path string) (entries []layer.DirEntry, err layer.Error) {
+	err = m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		entries, fserr = fs.OpenDir(path)
+		return fserr
+	})
+	return entries, err
+}
+
+func (m *FailoverFileSystem) Readlink(path string) (dest string, err layer.Error) {
+	err = m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		dest, fserr = fs.Readlink(path)
+		return fserr
+	})
+	return dest, err
+}
+
+func (m *FailoverFileSystem) openFile(excluded map[int]bool, path string, flags int) (f layer.File, index int, err layer.Error) {
+	err = m.try(excluded, func(i int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		f, fserr = fs.OpenFile(path, flags)
+		index = i
+		return fserr
+	})
+	return f, index, err
+}
+
+func (m *FailoverFileSystem) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	f, index, err := m.openFile(nil, path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFailoverFile(m, path, flags, index, f), nil
+}
+
+func (m *FailoverFileSystem) Create(path string, flags int, mode uint32) (f layer.File, err layer.Error) {
+	var index int
+	err = m.try(nil, func(i int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		f, fserr = fs.Create(path, flags, mode)
+		index = i
+		return fserr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newFailoverFile(m, path, flags, index, f), nil
+}
+
+func (m *FailoverFileSystem) Mkdir(path string, mode uint32) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Mkdir(path, mode)
+	})
+}
+
+func (m *FailoverFileSystem) Unlink(path string) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Unlink(path)
+	})
+}
+
+func (m *FailoverFileSystem) Rmdir(path string) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Rmdir(path)
+	})
+}
+
+func (m *FailoverFileSystem) Rename(oldpath string, newpath string) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Rename(oldpath, newpath)
+	})
+}
+
+func (m *FailoverFileSystem) Symlink(target string, path string) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Symlink(target, path)
+	})
+}
+
+func (m *FailoverFileSystem) Chmod(path string, mode uint32) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Chmod(path, mode)
+	})
+}
+
+func (m *FailoverFileSystem) Chown(path string, uid uint32, gid uint32) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Chown(path, uid, gid)
+	})
+}
+
+func (m *FailoverFileSystem) Truncate(path string, size uint64) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Truncate(path, size)
+	})
+}
+
+func (m *FailoverFileSystem) Utimens(path string, atime *time.Time, mtime *time.Time) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Utimens(path, atime, mtime)
+	})
+}
+
+func (m *FailoverFileSystem) Getxattr(path string, name string) (value []byte, err layer.Error) {
+	err = m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		value, fserr = fs.Getxattr(path, name)
+		return fserr
+	})
+	return value, err
+}
+
+func (m *FailoverFileSystem) Listxattr(path string) (names []string, err layer.Error) {
+	err = m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		var fserr layer.Error
+		names, fserr = fs.Listxattr(path)
+		return fserr
+	})
+	return names, err
+}
+
+func (m *FailoverFileSystem) Setxattr(path string, name string, value []byte, flags int) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Setxattr(path, name, value, flags)
+	})
+}
+
+func (m *FailoverFileSystem) Removexattr(path string, name string) layer.Error {
+	return m.try(nil, func(_ int, fs layer.FileSystem) layer.Error {
+		return fs.Removexattr(path, name)
+	})
+}
+
+// A file opened through a FailoverFileSystem.
+//
+// If an operation fails because the source became unavailable, the file is
+// re-opened on the next available source and the operation is retried there.
+type FailoverFile struct {
+	fs       *FailoverFileSystem
+	path     string
+	flags    int
+	lock     *sync.Mutex
+	index    int
+	backend  layer.File
+	released bool
+}
+
+func newFailoverFile(fs *FailoverFileSystem, path string, flags int, index int, f layer.File) *FailoverFile {
+	return &FailoverFile{
+		fs:   fs,
+		path: path,
+		// re-opening must neither create nor truncate the file
+		flags:   flags &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC),
+		lock:    new(sync.Mutex),
+		index:   index,
+		backend: f,
+	}
+}
+
+// Call op with the backend file, re-opening the file on another source as
+// long as op fails because the source is unavailable.
+func (m *FailoverFile) do(op func(f layer.File) layer.Error) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.released {
+		return layer.WrapError(syscall.EBADF)
+	}
+
+	// sources which failed during this operation
+	excluded := make(map[int]bool)
+	for {
+		if m.backend == nil {
+			f, index, err := m.fs.openFile(excluded, m.path, m.flags)
+			if err != nil {
+				return err
+			}
+			log.Printf("failover: re-opened %s on source %d", m.path, index)
+			m.backend = f
+			m.index = index
+		}
+
+		err := op(m.backend)
+		if err == nil || !layer.IsUnavailableError(err) {
+			return err
+		}
+
+		log.Printf("failover: operation on source %d failed: %s", m.index, err)
+		excluded[m.index] = true
+		m.backend.Release()
+		m.backend = nil
+	}
+}
+
+func (m *FailoverFile) Read(dest []byte, position int64) (n int, err layer.Error) {
+	err = m.do(func(f layer.File) layer.Error {
+		var fserr layer.Error
+		n, fserr = f.Read(dest, position)
+		return fserr
+	})
+	return n, err
+}
+
+func (m *FailoverFile) Write(data []byte, position int64) (n int, err layer.Error) {
+	err = m.do(func(f layer.File) layer.Error {
+		var fserr layer.Error
+		n, fserr = f.Write(data, position)
+		return fserr
+	})
+	return n, err
+}
+
+func (m *FailoverFile) Truncate(size uint64) layer.Error {
+	return m.do(func(f layer.File) layer.Error {
+		return f.Truncate(size)
+	})
+}
+
+func (m *FailoverFile) Chmod(mode uint32) layer.Error {
+	return m.do(func(f layer.File) layer.Error {
+		return f.Chmod(mode)
+	})
+}
+
+func (m *FailoverFile) Chown(uid uint32, gid uint32) layer.Error {
+	return m.do(func(f layer.File) layer.Error {
+		return f.Chown(uid, gid)
+	})
+}
+
+func (m *FailoverFile) Utimens(atime *time.Time, mtime *time.Time) layer.Error {
+	return m.do(func(f layer.File) layer.Error {
+		return f.Utimens(atime, mtime)
+	})
+}
+
+// Sync is not retried on another source: the data to be synced was written
+// to the source which failed.
+func (m *FailoverFile) Sync() layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.released {
+		return layer.WrapError(syscall.EBADF)
+	}
+	if m.backend == nil {
+		return layer.NewBackendError("failover: source lost", syscall.EIO)
+	}
+	return m.backend.Sync()
+}
+
+// Locks are held by the backend file, so lock operations are not retried on
+// another source either; locks are lost when the file fails over.
+func (m *FailoverFile) current() (layer.File, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.released {
+		return nil, layer.WrapError(syscall.EBADF)
+	}
+	if m.backend == nil {
+		return nil, layer.NewBackendError("failover: source lost", syscall.EIO)
+	}
+	return m.backend, nil
+}
+
+func (m *FailoverFile) GetLk(owner uint64, lk *layer.Lock) (*layer.Lock, layer.Error) {
+	f, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+	return f.GetLk(owner, lk)
+}
+
+// The lock of the FailoverFile is not held while waiting for the lock.
+func (m *FailoverFile) SetLk(owner uint64, lk *layer.Lock, wait bool) layer.Error {
+	f, err := m.current()
+	if err != nil {
+		return err
+	}
+	return f.SetLk(owner, lk, wait)
+}
+
+func (m *FailoverFile) Flock(how int) layer.Error {
+	f, err := m.current()
+	if err != nil {
+		return err
+	}
+	return f.Flock(how)
+}
+
+func (m *FailoverFile) Release() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.released = true
+	if m.backend != nil {
+		m.backend.Release()
+		m.backend = nil
+	}
+}
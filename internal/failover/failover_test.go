@@ -0,0 +1,226 @@
+package failover
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStat struct {
+	layer.DefaultFileStat
+	size uint64
+}
+
+func (m *fakeStat) Size() uint64 {
+	return m.size
+}
+
+// A source which serves a single file, "/file", with fixed contents
+type fakeSource struct {
+	layer.DefaultFileSystem
+	ready    bool
+	errno    syscall.Errno
+	contents []byte
+	opened   int
+	flags    int
+}
+
+func (m *fakeSource) IsReady() bool {
+	return m.ready
+}
+
+func (m *fakeSource) fail() layer.Error {
+	if m.errno != 0 {
+		return layer.WrapError(m.errno)
+	}
+	return nil
+}
+
+func (m *fakeSource) Lstat(path string) (layer.FileStat, layer.Error) {
+	if err := m.fail(); err != nil {
+		return nil, err
+	}
+	if path != "/file" {
+		return nil, layer.WrapError(syscall.ENOENT)
+	}
+	return &fakeStat{size: uint64(len(m.contents))}, nil
+}
+
+func (m *fakeSource) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	if err := m.fail(); err != nil {
+		return nil, err
+	}
+	m.opened += 1
+	m.flags = flags
+	return &fakeFile{source: m}, nil
+}
+
+func (m *fakeSource) Create(path string, flags int, mode uint32) (layer.File, layer.Error) {
+	if err := m.fail(); err != nil {
+		return nil, err
+	}
+	m.contents = []byte{}
+	return &fakeFile{source: m}, nil
+}
+
+type fakeFile struct {
+	layer.ReadOnlyFile
+	source *fakeSource
+}
+
+func (m *fakeFile) Read(dest []byte, position int64) (int, layer.Error) {
+	if err := m.source.fail(); err != nil {
+		return 0, err
+	}
+	return copy(dest, m.source.contents[position:]), nil
+}
+
+func (m *fakeFile) Write(data []byte, position int64) (int, layer.Error) {
+	if err := m.source.fail(); err != nil {
+		return 0, err
+	}
+	end := int(position) + len(data)
+	if end > len(m.source.contents) {
+		m.source.contents = append(m.source.contents, make([]byte, end-len(m.source.contents))...)
+	}
+	return copy(m.source.contents[position:], data), nil
+}
+
+func (m *fakeFile) Release() {
+}
+
+func TestUsesHighestPriorityReadySource(t *testing.T) {
+	primary := &fakeSource{ready: true, contents: []byte("primary")}
+	secondary := &fakeSource{ready: true, contents: []byte("secondary!")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), stat.Size())
+}
+
+func TestSkipsSourcesWhichAreNotReady(t *testing.T) {
+	primary := &fakeSource{ready: false, contents: []byte("primary")}
+	secondary := &fakeSource{ready: true, contents: []byte("secondary!")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), stat.Size())
+}
+
+func TestFailsOverOnUnavailableError(t *testing.T) {
+	primary := &fakeSource{ready: true, errno: syscall.ENOTCONN}
+	secondary := &fakeSource{ready: true, contents: []byte("secondary!")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), stat.Size())
+}
+
+func TestDoesNotFailOverOnOtherErrors(t *testing.T) {
+	primary := &fakeSource{ready: true, contents: []byte("primary")}
+	secondary := &fakeSource{ready: true, contents: []byte("secondary!")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	_, err := fs.Lstat("/nonexistant")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestReturnsUnavailableIfNoSourceIsReady(t *testing.T) {
+	primary := &fakeSource{ready: false}
+	secondary := &fakeSource{ready: true, errno: syscall.ETIMEDOUT}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	assert.True(t, fs.IsReady())
+	_, err := fs.Lstat("/file")
+	assert.True(t, layer.IsUnavailableError(err))
+
+	secondary.ready = false
+	assert.False(t, fs.IsReady())
+	_, err = fs.Lstat("/file")
+	assert.True(t, layer.IsUnavailableError(err))
+}
+
+func TestReadReopensOnFallbackSource(t *testing.T) {
+	primary := &fakeSource{ready: true, contents: []byte("0123456789")}
+	secondary := &fakeSource{ready: true, contents: []byte("0123456789")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	f, err := fs.OpenFile("/file", 0)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	buf := make([]byte, 4)
+	n, err := f.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, 0, secondary.opened)
+
+	primary.errno = syscall.ENOTCONN
+	n, err = f.Read(buf, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("4567"), buf)
+	assert.Equal(t, 1, secondary.opened)
+}
+
+func TestReadFailsIfAllSourcesFail(t *testing.T) {
+	primary := &fakeSource{ready: true, contents: []byte("0123456789")}
+	secondary := &fakeSource{ready: true, contents: []byte("0123456789")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	f, err := fs.OpenFile("/file", 0)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	primary.errno = syscall.ENOTCONN
+	secondary.errno = syscall.EHOSTUNREACH
+
+	buf := make([]byte, 4)
+	_, err = f.Read(buf, 0)
+	assert.True(t, layer.IsUnavailableError(err))
+
+	// the next read starts over with all sources
+	primary.errno = 0
+	n, err := f.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+}
+
+func TestReadAfterReleaseFails(t *testing.T) {
+	primary := &fakeSource{ready: true, contents: []byte("0123456789")}
+	fs := NewFailoverFileSystem(primary)
+
+	f, _ := fs.OpenFile("/file", 0)
+	f.Release()
+
+	_, err := f.Read(make([]byte, 4), 0)
+	assert.Equal(t, uintptr(syscall.EBADF), err.Errno())
+}
+
+func TestWriteReopensWithoutTruncating(t *testing.T) {
+	primary := &fakeSource{ready: true}
+	secondary := &fakeSource{ready: true, contents: []byte("0123456789")}
+	fs := NewFailoverFileSystem(primary, secondary)
+
+	f, err := fs.Create("/file", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	n, err := f.Write([]byte("ab"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("ab"), primary.contents)
+
+	primary.errno = syscall.ENOTCONN
+	n, err = f.Write([]byte("cd"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("01cd456789"), secondary.contents)
+	assert.Equal(t, os.O_RDWR, secondary.flags)
+}
@@ -0,0 +1,59 @@
+package filecache
+
+import (
+	"log"
+	"time"
+)
+
+// Halve the access counters of all cached blocks.
+//
+// Without aging, blocks which were used often a long time ago would stay at
+// high counters forever and never be evicted. With regular aging, the counter
+// of a block approximates how often it was used recently.
+func (m *FileCache) AgeBlocks() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cached := m.selectUsage(func(usage *inodeUsage) bool {
+		return usage.blocks > 0
+	})
+	m.forFileInodes(cached, true, func(node *fileInode) bool {
+		node.Age()
+		return true
+	})
+}
+
+// Age the access counters of all cached blocks every interval in the
+// background.
+func (m *FileCache) StartAging(interval time.Duration) {
+	m.aging_stop = make(chan struct{})
+	m.aging_stopped = make(chan struct{})
+	go m.runAging(interval)
+}
+
+// Stop aging the access counters in the background.
+func (m *FileCache) StopAging() {
+	if m.aging_stop == nil {
+		return
+	}
+	close(m.aging_stop)
+	<-m.aging_stopped
+	m.aging_stop = nil
+}
+
+func (m *FileCache) runAging(interval time.Duration) {
+	defer close(m.aging_stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.aging_stop:
+			return
+		case <-ticker.C:
+		}
+
+		log.Printf("aging access counters")
+		m.AgeBlocks()
+	}
+}
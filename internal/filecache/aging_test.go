@@ -0,0 +1,74 @@
+package filecache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readACTRs(file_cache *FileCache, path string) []uint8 {
+	node := file_cache.inodes[path].(*fileInode)
+	node.ensureMapped()
+	result := make([]uint8, node.SizeBlocks())
+	for i := range result {
+		result[i] = node.blockmap[i].readACTR()
+	}
+	return result
+}
+
+func TestAgeBlocksHalvesCounters(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	putBlocks(t, file_cache, "/closed", 2)
+	for i := 0; i < 8; i++ {
+		isCached(t, file_cache, "/closed", 0)
+	}
+
+	putBlocks(t, file_cache, "/open", 1)
+	f, err := file_cache.OpenFile("/open")
+	assert.Nil(t, err)
+	defer f.Close()
+	buf := make([]byte, 4096)
+	for i := 0; i < 4; i++ {
+		f.FetchData(buf, 0)
+	}
+
+	assert.Equal(t, []uint8{9, 1}, readACTRs(file_cache, "/closed"))
+	assert.Equal(t, []uint8{5}, readACTRs(file_cache, "/open"))
+
+	file_cache.AgeBlocks()
+	assert.Equal(t, []uint8{4, 1}, readACTRs(file_cache, "/closed"))
+	assert.Equal(t, []uint8{2}, readACTRs(file_cache, "/open"))
+}
+
+func TestAgedBlocksBecomeEvictable(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+	file_cache.SetBlocksTotal(2)
+
+	// used a lot a long time ago
+	putBlocks(t, file_cache, "/old", 1)
+	for i := 0; i < 6; i++ {
+		isCached(t, file_cache, "/old", 0)
+	}
+	for i := 0; i < 3; i++ {
+		file_cache.AgeBlocks()
+	}
+
+	// used a few times recently
+	putBlocks(t, file_cache, "/recent", 1)
+	for i := 0; i < 2; i++ {
+		isCached(t, file_cache, "/recent", 0)
+	}
+
+	putBlocks(t, file_cache, "/new", 1)
+	assert.False(t, isCached(t, file_cache, "/old", 0))
+	assert.True(t, isCached(t, file_cache, "/recent", 0))
+}
@@ -15,6 +15,12 @@ type fileCachedFile struct {
 	inode  *fileInode
 	refcnt uint64
 	file   *os.File
+	// Dirty blocks which are being written back and have not been written
+	// to since
+	writeback map[uint64]bool
+	// Called with the lock of the inode held when the last reference is
+	// dropped
+	on_close func(inode *fileInode)
 }
 
 func openFileCachedFile(quota cache.QuotaService, inode *fileInode) (*fileCachedFile, layer.Error) {
@@ -51,6 +57,9 @@ func (m *fileCachedFile) decRef() bool {
 	if m.refcnt == 0 {
 		m.close()
 		m.inode.handle = nil
+		if m.on_close != nil {
+			m.on_close(m.inode)
+		}
 		return true
 	}
 	return false
@@ -85,21 +94,24 @@ func (m *fileCachedFile) discard(start_block uint64, end_block uint64) {
 		int64(start_block*BLOCK_SIZE),
 		int64((end_block-start_block)*BLOCK_SIZE),
 	)
-	m.inode.Discard(start_block, end_block)
+	m.quota.ReleaseBlocks(m.inode.Discard(start_block, end_block))
 }
 
 func (m *fileCachedFile) resize(new_size uint64, old_size uint64) {
 	if old_size < 0 {
 		old_size = m.size()
 	}
-	m.inode.Resize(new_size)
+	if new_size > old_size {
+		// the data file may still hold data beyond the old end of the
+		// file, which must read as zeros now
+		m.file.Truncate(int64(old_size))
+	}
+	m.quota.ReleaseBlocks(m.inode.Extend(new_size))
 	m.file.Truncate(int64(new_size))
-	// FIXME: release discarded blocks
-	// FIXME: handle discarding of last block on grow
 	// FIXME: make sure the inode is marked dirty
 }
 
-func (m *fileCachedFile) writeRandom(data []byte, position uint64) error {
+func (m *fileCachedFile) writeRandom(data []byte, position uint64) (uint64, error) {
 	start_block := position / BLOCK_SIZE
 	start_aligned := start_block*BLOCK_SIZE == position
 	end_byte := position + uint64(len(data))
@@ -108,23 +120,20 @@ func (m *fileCachedFile) writeRandom(data []byte, position uint64) error {
 
 	if !start_aligned && !m.inode.IsAvailable(start_block) {
 		// cannot write here because the block is incomplete
-		return cache.ErrMustBeAligned
+		return 0, cache.ErrMustBeAligned
 	}
 
 	if !end_aligned && !m.inode.IsAvailable(end_block-1) {
 		// cannot write here because the block is incomplete
-		return cache.ErrMustBeAligned
+		return 0, cache.ErrMustBeAligned
 	}
 
 	// no resize needed per definition of this operation
-	m.writeAndMarkWritten(data, position)
-
-	return nil
+	return m.writeAndMarkWritten(data, position), nil
 }
 
-func (m *fileCachedFile) writeAndMarkWritten(data []byte, position uint64) {
-	// FIXME: allocate needed blocks
-
+// Return the number of blocks which have been added to the cache.
+func (m *fileCachedFile) writeAndMarkWritten(data []byte, position uint64) uint64 {
 	end_byte := uint64(len(data)) + position
 	end_block := uint64((end_byte + BLOCK_SIZE - 1) / BLOCK_SIZE)
 	n, _ := m.file.WriteAt(data, int64(position))
@@ -136,41 +145,189 @@ func (m *fileCachedFile) writeAndMarkWritten(data []byte, position uint64) {
 		m.discard(end_block, end_block+1)
 	}
 
-	m.inode.SetWritten(
+	return m.inode.SetWritten(
 		position/BLOCK_SIZE,
 		end_block,
 	)
 }
 
-func (m *fileCachedFile) writeAndExtend(data []byte, position uint64, size uint64) error {
+func (m *fileCachedFile) writeAndExtend(data []byte, position uint64, size uint64) (uint64, error) {
 	start_block := position / BLOCK_SIZE
 	start_aligned := start_block*BLOCK_SIZE == position
 	end_byte := position + uint64(len(data))
 
 	if !start_aligned && !m.inode.IsAvailable(start_block) {
-		// cannot write here because the block is incomplete
-		return cache.ErrMustBeAligned
+		if start_block*BLOCK_SIZE < size {
+			// cannot write here because the block is incomplete
+			return 0, cache.ErrMustBeAligned
+		}
+		// the block is entirely beyond the end of the file, so
+		// everything before position is a hole
+		padding := position - start_block*BLOCK_SIZE
+		data = append(make([]byte, padding), data...)
+		position -= padding
 	}
 
 	m.resize(end_byte, size)
 
-	m.writeAndMarkWritten(data, position)
-
-	return nil
+	return m.writeAndMarkWritten(data, position), nil
 
 }
 
-func (m *fileCachedFile) appendToEnd(data []byte, position uint64, size uint64) error {
+func (m *fileCachedFile) appendToEnd(data []byte, position uint64, size uint64) (uint64, error) {
+	start_block := position / BLOCK_SIZE
+	if start_block*BLOCK_SIZE != position && !m.inode.IsAvailable(start_block) {
+		// the beginning of the last block is not known
+		return 0, cache.ErrMustBeAligned
+	}
+
 	m.resize(uint64(len(data))+position, size)
-	m.writeAndMarkWritten(data, position)
+	return m.writeAndMarkWritten(data, position), nil
+}
+
+func (m *fileCachedFile) PutData(data []byte, position uint64, priority int) error {
+	return m.put(data, position, priority, false)
+}
+
+func (m *fileCachedFile) WriteData(data []byte, position uint64) error {
+	return m.put(data, position, cache.QUOTA_BLOCK_PRIO_WRITTEN, true)
+}
+
+// Store data in the cache, requesting quota for the blocks it adds.
+//
+// Quota is requested only for the blocks which are missing, with the inode
+// unlocked, as the quota service may have to evict blocks of other files to
+// grant it. The missing blocks are counted again afterwards, as they may have
+// changed in the meantime; whatever is not needed is released again.
+//
+// Unless the data is marked dirty, it comes from the source and dirty blocks
+// are left alone: they hold modifications which have not been written back.
+func (m *fileCachedFile) put(data []byte, position uint64, priority int, dirty bool) error {
+	start_block := position / BLOCK_SIZE
+	end_block := (position + uint64(len(data)) + BLOCK_SIZE - 1) / BLOCK_SIZE
+
+	m.lock()
+	defer m.unlock()
+
+	// only blocks which are not cached yet need quota, so that reading
+	// cached data again does not evict other data. The lock cannot be held
+	// while requesting quota, so the missing blocks are counted again.
+	var granted uint64
+	for {
+		missing := m.inode.MissingBlocks(start_block, end_block)
+		if missing <= granted {
+			break
+		}
+		m.unlock()
+		more := m.quota.RequestBlocks(missing-granted, priority)
+		m.lock()
+		granted += more
+		if granted < missing {
+			m.quota.ReleaseBlocks(granted)
+			return cache.ErrCacheFull
+		}
+	}
 
+	var used uint64
+	var err error
+	if dirty {
+		used, err = m.putData(data, position)
+	} else {
+		used, err = m.putClean(data, position)
+	}
+	m.quota.ReleaseBlocks(granted - used)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		m.inode.MarkDirty(start_block, end_block)
+		for block := start_block; block < end_block; block++ {
+			delete(m.writeback, block)
+		}
+	}
 	return nil
 }
 
-func (m *fileCachedFile) PutData(data []byte, position uint64) error {
+func (m *fileCachedFile) DirtyBlocks() []uint64 {
+	m.lock()
+	defer m.unlock()
+
+	return m.inode.DirtyBlocks()
+}
+
+func (m *fileCachedFile) MarkClean(blocks []uint64) {
+	m.lock()
+	defer m.unlock()
+
+	for _, block := range blocks {
+		m.inode.MarkClean(block, block+1)
+	}
+}
+
+func (m *fileCachedFile) MarkDirty(blocks []uint64) {
+	m.lock()
+	defer m.unlock()
+
+	for _, block := range blocks {
+		m.inode.MarkDirty(block, block+1)
+	}
+}
+
+func (m *fileCachedFile) StartWriteBack() []uint64 {
 	m.lock()
 	defer m.unlock()
 
+	blocks := m.inode.DirtyBlocks()
+	m.writeback = make(map[uint64]bool, len(blocks))
+	for _, block := range blocks {
+		m.writeback[block] = true
+	}
+	return blocks
+}
+
+func (m *fileCachedFile) FinishWriteBack(written bool) {
+	m.lock()
+	defer m.unlock()
+
+	if written {
+		for block := range m.writeback {
+			m.inode.MarkClean(block, block+1)
+		}
+	}
+	m.writeback = nil
+}
+
+// Store data like putData, skipping the blocks which are dirty.
+func (m *fileCachedFile) putClean(data []byte, position uint64) (uint64, error) {
+	end_byte := position + uint64(len(data))
+	start_block := position / BLOCK_SIZE
+	end_block := (end_byte + BLOCK_SIZE - 1) / BLOCK_SIZE
+
+	used := uint64(0)
+	run_start := position
+	for block := start_block; block <= end_block; block++ {
+		if block < end_block && !m.inode.IsDirty(block) {
+			continue
+		}
+		run_end := block * BLOCK_SIZE
+		if run_end > end_byte {
+			run_end = end_byte
+		}
+		if run_end > run_start {
+			n, err := m.putData(data[run_start-position:run_end-position], run_start)
+			used += n
+			if err != nil {
+				return used, err
+			}
+		}
+		run_start = (block + 1) * BLOCK_SIZE
+	}
+	return used, nil
+}
+
+// Return the number of blocks which have been added to the cache.
+func (m *fileCachedFile) putData(data []byte, position uint64) (uint64, error) {
 	// three cases:
 	//
 	// 1. write somewhere inside the file (writeRandom)
@@ -179,11 +336,15 @@ func (m *fileCachedFile) PutData(data []byte, position uint64) error {
 	//
 	// special things:
 	// (3) should keep the last block valid, also it’ll be unaligned
+	//
+	// The end of the file is the size of the inode, not of the data file:
+	// the data file ends after the last cached block, while the inode has
+	// the size of the whole file.
 
 	// detect which case we have
 	start_byte := position
 	end_byte := uint64(len(data)) + position
-	size := m.size()
+	size := m.inode.Size()
 
 	if start_byte == size {
 		return m.appendToEnd(data, position, size)
@@ -192,8 +353,6 @@ func (m *fileCachedFile) PutData(data []byte, position uint64) error {
 	} else {
 		return m.writeRandom(data, position)
 	}
-
-	return nil
 }
 
 func (m *fileCachedFile) FetchData(data []byte, position uint64) (int, layer.Error) {
@@ -209,6 +368,10 @@ func (m *fileCachedFile) FetchData(data []byte, position uint64) (int, layer.Err
 		to_read)
 
 	n, err := m.file.ReadAt(data[:to_read], int64(position))
+	m.inode.Touch(
+		position/BLOCK_SIZE,
+		(position+uint64(n)+BLOCK_SIZE-1)/BLOCK_SIZE,
+	)
 	if uint64(n) < length {
 		if err != nil {
 			return n, layer.WrapError(err)
@@ -241,11 +404,18 @@ func (m *fileCachedFile) Chown(uid uint32, gid uint32) layer.Error {
 	return nil
 }
 
-func (m *fileCachedFile) Sync() {
+func (m *fileCachedFile) sync() {
 	m.inode.Sync()
 	m.file.Sync()
 }
 
+func (m *fileCachedFile) Sync() {
+	m.lock()
+	defer m.unlock()
+
+	m.sync()
+}
+
 func (m *fileCachedFile) Close() {
 	m.lock()
 	defer m.unlock()
@@ -254,7 +424,7 @@ func (m *fileCachedFile) Close() {
 	if !m.decRef() {
 		// this file wasn’t closed
 		// we do a sync now anyways
-		m.Sync()
+		m.sync()
 	}
 }
 
@@ -263,13 +433,28 @@ func (m *fileCachedFile) Allocate(off uint64, size uint64, mode uint32) layer.Er
 }
 
 func (m *fileCachedFile) Chmod(perms uint32) layer.Error {
-	return layer.WrapError(syscall.EIO)
+	m.lock()
+	defer m.unlock()
+
+	m.inode.Chmod(perms)
+
+	return nil
 }
 
 func (m *fileCachedFile) Truncate(new_size uint64) layer.Error {
-	return layer.WrapError(syscall.EIO)
+	m.lock()
+	defer m.unlock()
+
+	m.resize(new_size, m.inode.Size())
+
+	return nil
 }
 
-func (m *fileCachedFile) Utimens(mtime *time.Time, atime *time.Time) layer.Error {
-	return layer.WrapError(syscall.EIO)
+func (m *fileCachedFile) Utimens(atime *time.Time, mtime *time.Time) layer.Error {
+	m.lock()
+	defer m.unlock()
+
+	m.inode.Utimens(atime, mtime)
+
+	return nil
 }
@@ -4,21 +4,29 @@ import (
 	"crypto/rand"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/horazont/dragonstash/internal/cache"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
 )
 
+// Grants requests up to total blocks (zero for no limit) and keeps track of
+// the blocks in use.
 type mockQuotaService struct {
-	mock.Mock
+	total uint64
+	used  uint64
 }
 
 func (m *mockQuotaService) RequestBlocks(nblocks uint64, priority int) (granted uint64) {
-	return uint64(m.Called(nblocks, priority).Int(0))
+	if m.total != 0 && m.used+nblocks > m.total {
+		nblocks = m.total - m.used
+	}
+	m.used += nblocks
+	return nblocks
 }
 
 func (m *mockQuotaService) ReleaseBlocks(nblocks uint64) {
-	m.Called(nblocks)
+	m.used -= nblocks
 }
 
 func genData(nbytes int) (result []byte) {
@@ -42,7 +50,7 @@ func TestAlignedPutAndFetch(t *testing.T) {
 
 	data := genData(4096)
 
-	err = f.PutData(data, 8192)
+	err = f.PutData(data, 8192, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
 	ref := make([]byte, len(data))
@@ -68,7 +76,7 @@ func TestFetchOutsideWrittenRange(t *testing.T) {
 
 	data := genData(4096)
 
-	err = f.PutData(data, 8192)
+	err = f.PutData(data, 8192, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
 	ref := make([]byte, len(data))
@@ -93,7 +101,7 @@ func TestAlignedPutAndUnalignedRead(t *testing.T) {
 
 	data := genData(4096)
 
-	err = f.PutData(data, 8192)
+	err = f.PutData(data, 8192, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
 	ref := make([]byte, len(data)-23)
@@ -120,13 +128,13 @@ func TestAppendCanWriteWithoutAlignment(t *testing.T) {
 	data_pad := genData(4096 + 1024)
 	data_append := genData(4096)
 
-	err = f.PutData(data_pad, 0)
+	err = f.PutData(data_pad, 0, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
-	err = f.PutData(data_append[:1024], 4096+1024)
+	err = f.PutData(data_append[:1024], 4096+1024, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
-	err = f.PutData(data_append[1024:3072], 4096+2048)
+	err = f.PutData(data_append[1024:3072], 4096+2048, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
 	ref := make([]byte, 8192)
@@ -153,7 +161,7 @@ func TestFetchAtEof(t *testing.T) {
 
 	data := genData(3000)
 
-	err = f.PutData(data, 8192)
+	err = f.PutData(data, 8192, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
 	ref := make([]byte, len(data)+1)
@@ -164,6 +172,46 @@ func TestFetchAtEof(t *testing.T) {
 	assert.Equal(t, data, ref[:len(data)])
 }
 
+func TestPutDataKeepsSizeOfPartiallyCachedFile(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ref := dirCacheEntry{
+		ModeV: syscall.S_IFREG | syscall.S_IRWXU,
+		SizeV: 8192 + 100,
+	}
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createInode(dir+"/file", &ref)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+
+	data := genData(4096)
+	err = f.PutData(data, 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192+100), inode.Size())
+
+	// the data before the start of the last block is not known
+	err = f.PutData(genData(50), 8192+50, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Equal(t, cache.ErrMustBeAligned, err)
+
+	tail := genData(100)
+	err = f.PutData(tail, 8192, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192+100), inode.Size())
+
+	buf := make([]byte, 8192+100)
+	n, err := f.FetchData(buf, 0)
+	assert.Equal(t, 4096, n)
+	assert.NotNil(t, err)
+	n, err = f.FetchData(buf, 8192)
+	assert.Nil(t, err)
+	assert.Equal(t, tail, buf[:n])
+}
+
 func TestFetchAttrUsesInode(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
@@ -234,10 +282,10 @@ func TestFetchAttrReturnsProperBlockCount(t *testing.T) {
 
 	data := genData(4096)
 
-	err = f.PutData(data, 8192)
+	err = f.PutData(data, 8192, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
-	err = f.PutData(data, 0)
+	err = f.PutData(data, 0, cache.QUOTA_BLOCK_PRIO_READ)
 	assert.Nil(t, err)
 
 	attr, err = f.FetchAttr()
@@ -277,3 +325,239 @@ func TestChownModifiesInode(t *testing.T) {
 	assert.Equal(t, uint32(123), inode.OwnerUID())
 	assert.Equal(t, uint32(456), inode.OwnerGID())
 }
+
+func TestChmodModifiesInode(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+	assert.NotNil(t, f)
+
+	err = f.Chmod(0640)
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint32(syscall.S_IFREG|0640), inode.Mode())
+}
+
+func TestUtimensKeepsOmittedTime(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ref := dirCacheEntry{
+		ModeV:  syscall.S_IFREG | syscall.S_IRWXU,
+		MtimeV: 12,
+		AtimeV: 34,
+	}
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createInode(dir+"/file", &ref)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+	assert.NotNil(t, f)
+
+	mtime := time.Unix(56, 0)
+	err = f.Utimens(nil, &mtime)
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint64(34), inode.Atime())
+	assert.Equal(t, uint64(56), inode.Mtime())
+}
+
+func TestTruncateDiscardsBlocks(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+	assert.NotNil(t, f)
+
+	data := genData(4096 * 3)
+	err = f.PutData(data, 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+
+	err = f.Truncate(4096 + 100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4096+100), inode.Size())
+
+	ref := make([]byte, 4096)
+	n, err := f.FetchData(ref, 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, data[4096:4096+100], ref[:n])
+
+	// growing again must not resurrect the discarded blocks
+	err = f.Truncate(4096 * 3)
+	assert.Nil(t, err)
+
+	n, err = f.FetchData(ref, 8192)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, uint64(2), inode.Blocks())
+
+	// the incomplete last block is kept, followed by zeros
+	n, err = f.FetchData(ref, 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, data[4096:4096+100], ref[:100])
+	assert.Equal(t, make([]byte, 4096-100), ref[100:])
+}
+
+func TestWriteDataMarksBlocksDirty(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+
+	err = f.PutData(genData(4096), 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(f.DirtyBlocks()))
+
+	err = f.WriteData(genData(100), 4096+10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4096+110), inode.Size())
+
+	err = f.WriteData(genData(4096), 4096*2)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{1, 2}, f.DirtyBlocks())
+
+	f.MarkClean([]uint64{1})
+	assert.Equal(t, []uint64{2}, f.DirtyBlocks())
+
+	f.MarkDirty([]uint64{0})
+	assert.Equal(t, []uint64{0, 2}, f.DirtyBlocks())
+}
+
+func TestPutDataSkipsDirtyBlocks(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+
+	err = f.PutData(make([]byte, 4096*3), 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+	data := genData(4096)
+	err = f.WriteData(data, 4096)
+	assert.Nil(t, err)
+
+	// stale data from the source must not replace the modification
+	err = f.PutData(make([]byte, 4096*3), 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+
+	ref := make([]byte, 4096*3)
+	n, err := f.FetchData(ref, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096*3, n)
+	assert.Equal(t, make([]byte, 4096), ref[:4096])
+	assert.Equal(t, data, ref[4096:4096*2])
+	assert.Equal(t, []uint64{1}, f.DirtyBlocks())
+}
+
+func TestWriteBackKeepsBlocksWrittenMeanwhileDirty(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	var err error
+
+	quota := &mockQuotaService{}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+
+	err = f.WriteData(genData(4096*2), 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []uint64{0, 1}, f.StartWriteBack())
+	f.FinishWriteBack(false)
+	assert.Equal(t, []uint64{0, 1}, f.DirtyBlocks())
+
+	assert.Equal(t, []uint64{0, 1}, f.StartWriteBack())
+	err = f.WriteData(genData(100), 4096)
+	assert.Nil(t, err)
+	f.FinishWriteBack(true)
+	assert.Equal(t, []uint64{1}, f.DirtyBlocks())
+}
+
+func TestPutDataRespectsQuota(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	var err error
+
+	quota := &mockQuotaService{total: 2}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+
+	err = f.PutData(genData(4096*3), 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Equal(t, cache.ErrCacheFull, err)
+	assert.Equal(t, uint64(0), quota.used)
+	assert.Equal(t, uint64(0), inode.Blocks())
+
+	err = f.PutData(genData(4096*2), 0, cache.QUOTA_BLOCK_PRIO_READ)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), quota.used)
+
+	// overwriting cached blocks needs no additional quota
+	err = f.WriteData(genData(4096), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), quota.used)
+
+	err = f.Truncate(100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), quota.used)
+	assert.Equal(t, uint64(1), inode.Blocks())
+}
+
+func TestSyncWhileWriting(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	quota := &mockQuotaService{}
+	inode, err := createEmptyInode(dir+"/file", syscall.S_IFREG)
+	assert.Nil(t, err)
+
+	f, err := openFileCachedFile(quota, inode.(*fileInode))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			f.Sync()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, f.WriteData(genData(4096), uint64(i)*4096))
+	}
+	<-done
+	assert.Equal(t, uint64(20), inode.Blocks())
+}
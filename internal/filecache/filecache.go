@@ -35,20 +35,46 @@ func normalizePath(path string) string {
 }
 
 type FileCache struct {
-	lock        *sync.Mutex
-	root_dir    string
-	inodes      map[string]inode
-	quota       cache.QuotaInfo
+	lock     *sync.Mutex
+	root_dir string
+	inodes   map[string]inode
+	quota    cache.QuotaInfo
+	// the usage of the inodes by storage path, for the eviction of blocks
+	inode_usage map[string]*inodeUsage
+	// guards quota and inode_usage; taken after the lock of the cache and
+	// of inodes
+	quota_lock  *sync.Mutex
 	dirtyInodes map[inode]bool
+	numbers     *inodeNumbers
+	// the leaves of the last walk for the eviction of inodes, least
+	// recently used first
+	evict_queue []leafInode
+
+	aging_stop    chan struct{}
+	aging_stopped chan struct{}
 }
 
-func NewFileCache(root_dir string) *FileCache {
-	return &FileCache{
+// Open the cache stored in root_dir.
+//
+// Fails if the allocation of inode numbers cannot be loaded: reusing numbers
+// which are still in use would merge unrelated files in the frontend.
+func NewFileCache(root_dir string) (*FileCache, error) {
+	numbers, err := loadInodeNumbers(filepath.Join(root_dir, "inodes"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to load inode numbers: %s", err))
+	}
+
+	result := &FileCache{
 		lock:        new(sync.Mutex),
 		root_dir:    root_dir,
 		inodes:      make(map[string]inode),
+		quota_lock:  new(sync.Mutex),
 		dirtyInodes: make(map[inode]bool),
+		numbers:     numbers,
 	}
+	result.loadUsage()
+	result.quota.BlocksUsed, result.quota.InodesUsed = result.countUsage(false)
+	return result, nil
 }
 
 func (m *FileCache) markInodeDirty(node inode) {
@@ -56,6 +82,12 @@ func (m *FileCache) markInodeDirty(node inode) {
 }
 
 func (m *FileCache) writeback() {
+	// the numbers go first, so that numbers in synced inodes are never
+	// handed out again after a crash
+	if err := m.numbers.save(filepath.Join(m.root_dir, "inodes")); err != nil {
+		log.Printf("failed to save inode numbers: %s", err)
+	}
+
 	for inode := range m.dirtyInodes {
 		func() {
 			inode.Mutex().Lock()
@@ -89,45 +121,216 @@ func (m *FileCache) getInode(path string) (inode, error) {
 		log.Printf("failed to open inode: %s", err)
 		return nil, syscall.EIO
 	}
+	m.inodes[path] = inode
+	if inode.Ino() == 0 {
+		// written before inodes were numbered
+		m.numberInode(inode, inode.SourceIno(), false)
+	}
 	return inode, nil
 }
 
-func (m *FileCache) requireInode(path string, format uint32) inode {
+// Call fn with the inode at path and its lock held, without keeping the inode
+// in memory: an inode which is not loaded is opened for the call only.
+//
+// If fn returns true, it has changed the inode, which is then written to disk
+// and its usage updated.
+//
+// Must be called with the lock held.
+func (m *FileCache) peekInode(path string, fn func(node inode) bool) error {
+	storage_path := m.getStoragePath(path, "")
+	node, loaded := m.inodes[path]
+	if !loaded {
+		var err error
+		if node, err = openInode(storage_path); err != nil {
+			log.Printf("failed to open inode: %s", err)
+			return syscall.EIO
+		}
+	}
+
+	node.Mutex().Lock()
+	defer node.Mutex().Unlock()
+
+	if !fn(node) {
+		if !loaded {
+			releaseInode(node)
+		}
+		return nil
+	}
+
+	m.recordUsage(storage_path, node)
+	var err error
+	if loaded {
+		err = node.Sync()
+	} else {
+		err = node.Close()
+	}
+	if err != nil {
+		log.Printf("failed to sync inode: %s", err)
+	}
+	return nil
+}
+
+// Give an inode its inode number, based on the inode number and link count
+// on the source.
+func (m *FileCache) numberInode(node inode, source_ino uint64, linked bool) {
+	if source_ino == 0 {
+		// the source has no inode numbers, or the attributes do not
+		// come from the source
+		source_ino = node.SourceIno()
+	}
+
+	ino, err := m.numbers.assign(node.Ino(), node.SourceIno(), source_ino, linked)
+	if err != nil {
+		log.Printf("failed to allocate inode number: %s", err)
+	}
+	if ino != node.Ino() || source_ino != node.SourceIno() {
+		node.setIno(ino, source_ino)
+		m.markInodeDirty(node)
+	}
+}
+
+// Whether the object is hard linked on the source
+func isLinked(stat layer.FileStat) bool {
+	return stat.Ino() != 0 &&
+		stat.Nlink() > 1 &&
+		stat.Mode()&syscall.S_IFMT != syscall.S_IFDIR
+}
+
+// Split a normalized path into the path of its parent and its name.
+func splitPath(path string) (parent string, name string) {
+	idx := strings.LastIndex(path, "/")
+	return path[:idx], path[idx+1:]
+}
+
+// Add the name of path to the listing of its parent, if the parent directory
+// is in the cache.
+func (m *FileCache) linkToParent(path string) {
+	if path == "" {
+		return
+	}
+	parent_path, name := splitPath(path)
+	parent, ok := m.lookupDir(parent_path)
+	if !ok {
+		return
+	}
+	for _, child := range parent.children {
+		if child == name {
+			return
+		}
+	}
+	parent.children = append(parent.children, name)
+	m.markInodeDirty(parent)
+}
+
+// Remove the name of path from the listing of its parent, if the parent
+// directory is in the cache.
+func (m *FileCache) unlinkFromParent(path string) {
+	if path == "" {
+		return
+	}
+	parent_path, name := splitPath(path)
+	parent, ok := m.lookupDir(parent_path)
+	if !ok {
+		return
+	}
+	if parent.removeChild(name) {
+		m.markInodeDirty(parent)
+	}
+}
+
+func (m *FileCache) lookupDir(path string) (*dirInode, bool) {
+	inode, err := m.getInode(path)
+	if err != nil {
+		return nil, false
+	}
+	dir_inode, ok := inode.(*dirInode)
+	return dir_inode, ok
+}
+
+func (m *FileCache) requireInode(path string, format uint32) (inode, error) {
 	inode, err := m.getInode(path)
 	if err == nil {
 		if inode.Mode()&syscall.S_IFMT == format {
 			// return existing inode if mode matches
-			return inode
+			return inode, nil
 		} else {
-			// TODO: clean up old inode properly
 			log.Printf("existing inode at %s has mismatching format: %d != %d",
 				path,
 				format,
 				inode.Mode()&syscall.S_IFMT)
+			m.deleteInode(path)
 		}
 	}
 
+	if err := m.reserveInode(path); err != nil {
+		return nil, err
+	}
+
 	storage_path := m.getStoragePath(path, "")
 	os.MkdirAll(filepath.Dir(storage_path), 0700)
 	inode, err = createEmptyInode(storage_path, format)
 	if err != nil {
-		panic(fmt.Sprintf("failed to create empty inode at %s: %s",
+		return nil, errors.New(fmt.Sprintf(
+			"failed to create empty inode of format %d at %s: %s",
+			format,
 			storage_path,
 			err))
 	}
+	m.addInodes(1)
+	if path != "" {
+		parent_path, _ := splitPath(path)
+		if parent, ok := m.lookupDir(parent_path); ok && parent.IsPinned() {
+			inode.SetPinned(true)
+		}
+	}
 	m.inodes[path] = inode
+	m.recordUsage(storage_path, inode)
 	m.markInodeDirty(inode)
-	return inode
+	return inode, nil
 }
 
+// Remove the inode at path from the cache, including the cached data of files
+// and, recursively, the children of directories.
 func (m *FileCache) deleteInode(path string) {
-	if inode, ok := m.inodes[path]; ok {
+	storage_path := m.getStoragePath(path, "")
+	inode, ok := m.inodes[path]
+	if !ok {
+		var err error
+		if inode, err = openInode(storage_path); err != nil {
+			inode = nil
+		}
+	}
+
+	switch node := inode.(type) {
+	case *dirInode:
+		for _, child := range node.children {
+			m.deleteInode(path + "/" + child)
+		}
+	case *fileInode:
+		node.mutex.Lock()
+		if node.handle == nil {
+			m.ReleaseBlocks(node.blocks_used)
+			node.ensureUnmapped()
+			node.file.Close()
+		} else {
+			// files which are still open keep their data, and
+			// their blocks, until they are closed
+			node.deleted = true
+		}
+		node.mutex.Unlock()
+	}
+
+	if inode != nil {
+		m.numbers.release(inode.Ino(), inode.SourceIno())
 		delete(m.inodes, path)
 		delete(m.dirtyInodes, inode)
 	}
-
-	backend_path := m.getStoragePath(path, ".inode")
-	os.Remove(backend_path)
+	m.forgetUsage(storage_path)
+	if err := os.Remove(storage_path); err == nil {
+		m.addInodes(-1)
+	}
+	os.Remove(storage_path + ".data")
+	os.Remove(storage_path + ".xattr")
 }
 
 func (m *FileCache) OpenFile(path string) (cache.CachedFile, layer.Error) {
@@ -147,6 +350,7 @@ func (m *FileCache) OpenFile(path string) (cache.CachedFile, layer.Error) {
 		log.Printf("OpenFile: inode is not a file!")
 		return nil, layer.WrapError(syscall.ENOSYS)
 	}
+	m.touchInode(path)
 
 	finode := inode.(*fileInode)
 	if finode.handle != nil {
@@ -160,22 +364,34 @@ func (m *FileCache) OpenFile(path string) (cache.CachedFile, layer.Error) {
 		return nil, layer.WrapError(err)
 	}
 
+	f.on_close = m.fileClosed
 	finode.handle = f
+	m.markOpen(finode.storage_path)
 	return f, nil
 
 }
 
-func (m *FileCache) RequestBlocks(nblocks uint64, priority int) (granted uint64) {
-	return nblocks
-}
-
-func (m *FileCache) ReleaseBlocks(nblocks uint64) {
-}
-
-func (m *FileCache) putAttr(path string, stat layer.FileStat) {
-	inode := m.requireInode(path, stat.Mode()&syscall.S_IFMT)
-	updateInode(stat, inode)
+func (m *FileCache) putAttr(path string, stat layer.FileStat) error {
+	inode, err := m.requireInode(path, stat.Mode()&syscall.S_IFMT)
+	if err != nil {
+		return err
+	}
+	if finode, ok := inode.(*fileInode); ok {
+		// shrinking the file discards blocks
+		finode.mutex.Lock()
+		blocks_used := finode.blocks_used
+		updateInode(stat, inode)
+		if finode.blocks_used < blocks_used {
+			m.ReleaseBlocks(blocks_used - finode.blocks_used)
+		}
+		m.recordUsage(finode.storage_path, finode)
+		finode.mutex.Unlock()
+	} else {
+		updateInode(stat, inode)
+	}
+	m.numberInode(inode, stat.Ino(), isLinked(stat))
 	m.markInodeDirty(inode)
+	return nil
 }
 
 func (m *FileCache) PutAttr(path string, stat layer.FileStat) {
@@ -185,7 +401,11 @@ func (m *FileCache) PutAttr(path string, stat layer.FileStat) {
 	defer m.lock.Unlock()
 
 	log.Printf("PutAttr(%s, %s)", path, stat)
-	m.putAttr(path, stat)
+	if err := m.putAttr(path, stat); err != nil {
+		log.Printf("PutAttr(%s): %s", path, err)
+		return
+	}
+	m.linkToParent(path)
 }
 
 func (m *FileCache) PutNonExistant(path string) {
@@ -195,6 +415,60 @@ func (m *FileCache) PutNonExistant(path string) {
 	defer m.lock.Unlock()
 
 	m.deleteInode(path)
+	m.unlinkFromParent(path)
+}
+
+// Move the inode at oldpath and, recursively, its children to newpath.
+func (m *FileCache) moveInode(oldpath string, newpath string) {
+	inode, err := m.getInode(oldpath)
+	if err != nil {
+		return
+	}
+
+	if dir_inode, ok := inode.(*dirInode); ok {
+		for _, child := range dir_inode.children {
+			m.moveInode(oldpath+"/"+child, newpath+"/"+child)
+		}
+	}
+
+	old_storage_path := m.getStoragePath(oldpath, "")
+	new_storage_path := m.getStoragePath(newpath, "")
+	os.MkdirAll(filepath.Dir(new_storage_path), 0700)
+	if err := os.Rename(old_storage_path, new_storage_path); err != nil {
+		log.Printf("failed to move inode %s to %s: %s", oldpath, newpath, err)
+	}
+	// the data file only exists for regular files, the xattr file only
+	// if extended attributes have been cached
+	os.Rename(old_storage_path+".data", new_storage_path+".data")
+	os.Rename(old_storage_path+".xattr", new_storage_path+".xattr")
+	inode.setStoragePath(new_storage_path)
+	m.moveUsage(old_storage_path, new_storage_path)
+
+	delete(m.inodes, oldpath)
+	m.inodes[newpath] = inode
+}
+
+func (m *FileCache) Move(oldpath string, newpath string) layer.Error {
+	oldpath = normalizePath(oldpath)
+	newpath = normalizePath(newpath)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.getInode(oldpath); err != nil {
+		return layer.WrapError(err)
+	}
+	if oldpath == newpath {
+		return nil
+	}
+
+	m.deleteInode(newpath)
+	m.moveInode(oldpath, newpath)
+	m.unlinkFromParent(oldpath)
+	m.linkToParent(newpath)
+
+	m.writeback()
+	return nil
 }
 
 func (m *FileCache) fetchAttr(path string) (layer.FileStat, error) {
@@ -208,6 +482,105 @@ func (m *FileCache) fetchAttr(path string) (layer.FileStat, error) {
 	return inode, nil
 }
 
+// Set or clear the pinned flag of the inode at path and, recursively, of its
+// children.
+//
+// Must be called with the lock held.
+func (m *FileCache) setPinned(path string, pinned bool) {
+	var children []string
+	m.peekInode(path, func(node inode) bool {
+		if dir_inode, ok := node.(*dirInode); ok {
+			children = append(children, dir_inode.children...)
+		}
+		node.SetPinned(pinned)
+		return true
+	})
+
+	for _, child := range children {
+		m.setPinned(path+"/"+child, pinned)
+	}
+}
+
+// Pin the object at path, and everything below it, in the cache, so that it
+// is never evicted. Objects which are cached below a pinned directory later
+// are pinned, too.
+//
+// Pinning does not fetch anything into the cache.
+func (m *FileCache) Pin(path string) layer.Error {
+	return m.pin(normalizePath(path), true)
+}
+
+// Allow the object at path, and everything below it, to be evicted again.
+func (m *FileCache) Unpin(path string) layer.Error {
+	return m.pin(normalizePath(path), false)
+}
+
+func (m *FileCache) pin(path string, pinned bool) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.peekInode(path, func(node inode) bool { return false }); err != nil {
+		return layer.WrapError(err)
+	}
+	m.setPinned(path, pinned)
+	return nil
+}
+
+// Return whether the object at path is pinned.
+func (m *FileCache) IsPinned(path string) (bool, layer.Error) {
+	path = normalizePath(path)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	inode, err := m.getInode(path)
+	if err != nil {
+		return false, layer.WrapError(err)
+	}
+	inode.Mutex().Lock()
+	defer inode.Mutex().Unlock()
+	return inode.IsPinned(), nil
+}
+
+// Return how many bytes of the file at path or, recursively, of the files
+// below the directory at path are available in the cache, and their size.
+//
+// Only files which are known to the cache are taken into account.
+func (m *FileCache) Usage(path string) (cached uint64, size uint64, err layer.Error) {
+	path = normalizePath(path)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.peekInode(path, func(node inode) bool { return false }); err != nil {
+		return 0, 0, layer.WrapError(err)
+	}
+	cached, size = m.usage(path)
+	return cached, size, nil
+}
+
+// Must be called with the lock held.
+func (m *FileCache) usage(path string) (cached uint64, size uint64) {
+	var children []string
+	m.peekInode(path, func(node inode) bool {
+		switch node := node.(type) {
+		case *dirInode:
+			children = append(children, node.children...)
+		case *fileInode:
+			cached = node.CachedBytes()
+			size = node.Size()
+		}
+		return false
+	})
+
+	for _, child := range children {
+		child_cached, child_size := m.usage(path + "/" + child)
+		cached += child_cached
+		size += child_size
+	}
+	return cached, size
+}
+
 func (m *FileCache) FetchAttr(path string) (layer.FileStat, layer.Error) {
 	path = normalizePath(path)
 
@@ -217,20 +590,90 @@ func (m *FileCache) FetchAttr(path string) (layer.FileStat, layer.Error) {
 	if err != nil {
 		return nil, layer.WrapError(err)
 	}
+	m.touchInode(path)
 	return stat, nil
 }
 
+// The extended attributes are stored next to the inode, as the block map of
+// file inodes extends to the end of the inode file.
+func (m *FileCache) PutXattrs(path string, xattrs map[string][]byte) {
+	path = normalizePath(path)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.getInode(path); err != nil {
+		return
+	}
+
+	storage_path := m.getStoragePath(path, ".xattr")
+	if len(xattrs) == 0 {
+		os.Remove(storage_path)
+		return
+	}
+
+	file, err := CreateSafe(storage_path)
+	if err != nil {
+		log.Printf("PutXattrs(%s): %s", path, err)
+		return
+	}
+	defer file.Abort()
+
+	if err := writeXattrData(file, xattrs); err != nil {
+		log.Printf("PutXattrs(%s): %s", path, err)
+		return
+	}
+	if err := file.Close(); err != nil {
+		log.Printf("PutXattrs(%s): %s", path, err)
+	}
+}
+
+func (m *FileCache) FetchXattrs(path string) (map[string][]byte, layer.Error) {
+	path = normalizePath(path)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.getInode(path); err != nil {
+		return nil, layer.WrapError(err)
+	}
+
+	file, err := os.Open(m.getStoragePath(path, ".xattr"))
+	if os.IsNotExist(err) {
+		return make(map[string][]byte), nil
+	}
+	if err != nil {
+		return nil, layer.WrapError(err)
+	}
+	defer file.Close()
+
+	xattrs, err := readXattrData(file)
+	if err != nil {
+		log.Printf("FetchXattrs(%s): %s", path, err)
+		return nil, layer.WrapError(syscall.EIO)
+	}
+	return xattrs, nil
+}
+
 func (m *FileCache) PutLink(path string, dest string) {
 	path = normalizePath(path)
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	inode := m.requireInode(path, syscall.S_IFLNK)
+	inode, err := m.requireInode(path, syscall.S_IFLNK)
+	if err != nil {
+		log.Printf("PutLink(%s): %s", path, err)
+		return
+	}
 	// we don’t need a lock here: the inode was just created and we still
 	// hold the lock on the whole cache
 	inode.(*linkInode).dest = dest
+	if inode.Ino() == 0 {
+		m.numberInode(inode, 0, false)
+	}
 	m.markInodeDirty(inode)
+	m.linkToParent(path)
 
 	m.writeback()
 }
@@ -255,6 +698,7 @@ func (m *FileCache) FetchLink(path string) (string, layer.Error) {
 		return "", layer.WrapError(syscall.EINVAL)
 	}
 
+	m.touchInode(path)
 	return inode.(*linkInode).dest, nil
 }
 
@@ -266,20 +710,39 @@ func (m *FileCache) PutDir(path string, entries []layer.DirEntry) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	inode := m.requireInode(path, syscall.S_IFDIR)
+	inode, err := m.requireInode(path, syscall.S_IFDIR)
+	if err != nil {
+		log.Printf("PutDir(%s): %s", path, err)
+		return
+	}
 	log.Printf("PutDir(%s): new inode format: %d",
 		path,
 		inode.Mode()&syscall.S_IFMT)
+	if inode.Ino() == 0 {
+		m.numberInode(inode, 0, false)
+	}
 	dir_inode := inode.(*dirInode)
-	dir_inode.children = make([]string, len(entries))
+	old_children := dir_inode.children
+	dir_inode.children = make([]string, 0, len(entries))
 	log.Printf("PutDir(%s): setting up %d children", path, len(entries))
-	for i, entry := range entries {
+	present := make(map[string]bool)
+	for _, entry := range entries {
 		child_name := entry.Name()
-		dir_inode.children[i] = child_name
 		child_path := path + "/" + child_name
-		m.putAttr(child_path, entry.Stat())
+		if err := m.putAttr(child_path, entry.Stat()); err != nil {
+			log.Printf("PutDir(%s): skipping %s: %s", path, child_name, err)
+			continue
+		}
+		dir_inode.children = append(dir_inode.children, child_name)
+		present[child_name] = true
+	}
+	for _, child_name := range old_children {
+		if !present[child_name] {
+			m.deleteInode(path + "/" + child_name)
+		}
 	}
 	m.markInodeDirty(inode)
+	m.linkToParent(path)
 
 	m.writeback()
 }
@@ -305,6 +768,7 @@ func (m *FileCache) FetchDir(path string) ([]layer.DirEntry, layer.Error) {
 		return nil, layer.WrapError(syscall.ENOTDIR)
 	}
 
+	m.touchInode(path)
 	dir_inode := inode.(*dirInode)
 	result := make([]layer.DirEntry, len(dir_inode.children))
 	for i, name := range dir_inode.children {
@@ -314,15 +778,21 @@ func (m *FileCache) FetchDir(path string) ([]layer.DirEntry, layer.Error) {
 			attr = &dirCacheEntry{}
 		}
 		result[i] = &dirCacheEntry{
-			NameV:   name,
-			ModeV:   attr.Mode(),
-			MtimeV:  attr.Mtime(),
-			AtimeV:  attr.Atime(),
-			CtimeV:  attr.Ctime(),
-			SizeV:   attr.Size(),
-			UidV:    attr.OwnerUID(),
-			GidV:    attr.OwnerGID(),
-			BlocksV: 0,
+			NameV:      name,
+			ModeV:      attr.Mode(),
+			MtimeV:     attr.Mtime(),
+			AtimeV:     attr.Atime(),
+			CtimeV:     attr.Ctime(),
+			MtimeNsecV: attr.MtimeNsec(),
+			AtimeNsecV: attr.AtimeNsec(),
+			CtimeNsecV: attr.CtimeNsec(),
+			InoV:       attr.Ino(),
+			NlinkV:     attr.Nlink(),
+			RdevV:      attr.Rdev(),
+			SizeV:      attr.Size(),
+			UidV:       attr.OwnerUID(),
+			GidV:       attr.OwnerGID(),
+			BlocksV:    0,
 		}
 	}
 
@@ -339,8 +809,51 @@ func (m *FileCache) Close() {
 	m.dirtyInodes = nil
 }
 
+// Set the number of blocks the cache may use; zero means no limit.
+//
+// If more blocks are in use already, blocks are evicted until the cache fits
+// the new limit, as far as possible.
 func (m *FileCache) SetBlocksTotal(new_blocks uint64) {
+	m.quota_lock.Lock()
 	m.quota.BlocksTotal = new_blocks
+	excess := uint64(0)
+	if new_blocks != 0 && m.quota.BlocksUsed > new_blocks {
+		excess = m.quota.BlocksUsed - new_blocks
+	}
+	m.quota_lock.Unlock()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.evictBlocks(excess, excess)
+}
+
+// Set the number of inodes the cache may hold; zero means no limit.
+//
+// If more inodes are in the cache already, the least recently used ones are
+// evicted until the cache fits the new limit, as far as possible.
+func (m *FileCache) SetInodesTotal(new_inodes uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.quota_lock.Lock()
+	m.quota.InodesTotal = new_inodes
+	excess := uint64(0)
+	if new_inodes != 0 && m.quota.InodesUsed > new_inodes {
+		excess = m.quota.InodesUsed - new_inodes
+	}
+	m.quota_lock.Unlock()
+
+	if excess > 0 {
+		m.evictInodes(excess, "")
+	}
+}
+
+// Return the current usage and limits of the cache
+func (m *FileCache) Quota() cache.QuotaInfo {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	return m.quota
 }
 
 func (m *FileCache) BlockSize() int64 {
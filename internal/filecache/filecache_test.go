@@ -8,10 +8,14 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/horazont/dragonstash/internal/cache"
 	"github.com/horazont/dragonstash/internal/layer"
 	"github.com/stretchr/testify/assert"
 )
 
+// The tests in this file call their FileCache "cache"
+const prio_READ = cache.QUOTA_BLOCK_PRIO_READ
+
 type mockDirEntry struct {
 	NameV   string
 	ModeV   uint32
@@ -22,6 +26,9 @@ type mockDirEntry struct {
 	UidV    uint32
 	GidV    uint32
 	BlocksV uint64
+	InoV    uint64
+	NlinkV  uint32
+	RdevV   uint64
 }
 
 func (m *mockDirEntry) Mode() uint32 {
@@ -44,6 +51,30 @@ func (m *mockDirEntry) Mtime() uint64 {
 	return m.MtimeV
 }
 
+func (m *mockDirEntry) MtimeNsec() uint32 {
+	return 0
+}
+
+func (m *mockDirEntry) AtimeNsec() uint32 {
+	return 0
+}
+
+func (m *mockDirEntry) CtimeNsec() uint32 {
+	return 0
+}
+
+func (m *mockDirEntry) Ino() uint64 {
+	return m.InoV
+}
+
+func (m *mockDirEntry) Nlink() uint32 {
+	return m.NlinkV
+}
+
+func (m *mockDirEntry) Rdev() uint64 {
+	return m.RdevV
+}
+
 func (m *mockDirEntry) OwnerGID() uint32 {
 	return m.GidV
 }
@@ -77,11 +108,28 @@ func teardownTempDir(path string) {
 	os.RemoveAll(path)
 }
 
+func openFileCache(path string) *FileCache {
+	result, err := NewFileCache(path)
+	if err != nil {
+		panic(fmt.Sprintf("Error: %s", err))
+	}
+	return result
+}
+
+func TestNewFileCacheFailsOnCorruptInodeNumbers(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(dir+"/inodes", []byte("garbage"), 0600)
+	_, err := NewFileCache(dir)
+	assert.NotNil(t, err)
+}
+
 func TestPutAndFetchAttr(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 	attr1 := mockDirEntry{
 		ModeV:   syscall.S_IFDIR,
 		MtimeV:  1234,
@@ -114,7 +162,7 @@ func TestPutAndFetchAttrPersistency(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache_w := NewFileCache(dir)
+	cache_w := openFileCache(dir)
 	attr1 := mockDirEntry{
 		ModeV:   syscall.S_IFDIR,
 		MtimeV:  1234,
@@ -129,7 +177,7 @@ func TestPutAndFetchAttrPersistency(t *testing.T) {
 	cache_w.PutAttr("/some/arbitrary/path", &attr1)
 	cache_w.Close()
 
-	cache_r := NewFileCache(dir)
+	cache_r := openFileCache(dir)
 	attr2, err := cache_r.FetchAttr("/some/arbitrary/path")
 
 	assert.Nil(t, err)
@@ -149,7 +197,7 @@ func TestPutNonExistantRemovesAttr(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 	attr1 := mockDirEntry{
 		ModeV:   syscall.S_IFDIR,
 		MtimeV:  1234,
@@ -178,7 +226,7 @@ func TestPutLinkBeforePutAttr(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	cache.PutLink("/some/arbitrary/path", "../other/path")
 	dest, err := cache.FetchLink("/some/arbitrary/path")
@@ -193,7 +241,7 @@ func TestPutLinkAfterPutAttrPreservesAttributes(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	attr1 := mockDirEntry{
 		ModeV:   syscall.S_IFLNK,
@@ -229,11 +277,11 @@ func TestPutLinkPersistence(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache_w := NewFileCache(dir)
+	cache_w := openFileCache(dir)
 	cache_w.PutLink("/some/arbitrary/path", "../other/path")
 	cache_w.Close()
 
-	cache_r := NewFileCache(dir)
+	cache_r := openFileCache(dir)
 
 	dest, err := cache_r.FetchLink("/some/arbitrary/path")
 
@@ -247,7 +295,7 @@ func TestPutDirAndFetchDir(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	entries := make([]layer.DirEntry, 3)
 	entries[0] = &mockDirEntry{
@@ -322,7 +370,7 @@ func TestPutDirAndFetchAttr(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	entries := make([]layer.DirEntry, 3)
 	entries[0] = &mockDirEntry{
@@ -381,7 +429,7 @@ func TestPutDirPersistence(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache_w := NewFileCache(dir)
+	cache_w := openFileCache(dir)
 
 	entries := make([]layer.DirEntry, 3)
 	entries[0] = &mockDirEntry{
@@ -426,7 +474,7 @@ func TestPutDirPersistence(t *testing.T) {
 	cache_w.PutDir("/some/dir", entries)
 	cache_w.Close()
 
-	cache_r := NewFileCache(dir)
+	cache_r := openFileCache(dir)
 
 	entries2, err := cache_r.FetchDir("/some/dir")
 
@@ -461,7 +509,7 @@ func TestEmptyStringAndSlashAreEquivalentForFetchAttr(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 	attr1 := mockDirEntry{
 		ModeV:   syscall.S_IFDIR,
 		MtimeV:  1234,
@@ -491,7 +539,7 @@ func TestOpenFile(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	attr1 := mockDirEntry{
 		ModeV: syscall.S_IFREG,
@@ -512,7 +560,7 @@ func TestOpenFilePutDataPersistency(t *testing.T) {
 	var err error
 	size := uint64(4096 + 2048)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	attr1 := mockDirEntry{
 		ModeV: syscall.S_IFREG,
@@ -526,12 +574,12 @@ func TestOpenFilePutDataPersistency(t *testing.T) {
 
 	ref := genData(int(size))
 
-	err = f.PutData(ref, 0)
+	err = f.PutData(ref, 0, prio_READ)
 	assert.Nil(t, err)
 
 	cache.Close()
 
-	cache_r := NewFileCache(dir)
+	cache_r := openFileCache(dir)
 
 	f, err = cache_r.OpenFile("/foo")
 	assert.Nil(t, err)
@@ -552,7 +600,7 @@ func TestOpenFileIdempotent(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	attr1 := mockDirEntry{
 		ModeV: syscall.S_IFREG,
@@ -577,7 +625,7 @@ func TestOpenFileIdempotentWithClose(t *testing.T) {
 	dir := prepTempDir()
 	defer teardownTempDir(dir)
 
-	cache := NewFileCache(dir)
+	cache := openFileCache(dir)
 
 	attr1 := mockDirEntry{
 		ModeV: syscall.S_IFREG,
@@ -605,3 +653,320 @@ func TestOpenFileIdempotentWithClose(t *testing.T) {
 
 	cache.Close()
 }
+
+func fetchDirNames(t *testing.T, cache *FileCache, path string) []string {
+	entries, err := cache.FetchDir(path)
+	assert.Nil(t, err)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names
+}
+
+func TestPutAttrAddsToCachedParent(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+	cache.PutAttr("/dir/bar", &mockDirEntry{ModeV: syscall.S_IFREG})
+	cache.PutAttr("/dir/foo", &mockDirEntry{ModeV: syscall.S_IFREG})
+
+	assert.Equal(t, []string{"foo", "bar"}, fetchDirNames(t, cache, "/dir"))
+}
+
+func TestPutAttrDoesNotCreateParent(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	cache.PutAttr("/dir/bar", &mockDirEntry{ModeV: syscall.S_IFREG})
+
+	_, err := cache.FetchAttr("/dir")
+	assert.NotNil(t, err)
+}
+
+func TestPutNonExistantRemovesFromCachedParent(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+		&mockDirEntry{NameV: "bar", ModeV: syscall.S_IFREG},
+	})
+	cache.PutNonExistant("/dir/foo")
+	cache.Close()
+
+	cache = openFileCache(dir)
+	defer cache.Close()
+	assert.Equal(t, []string{"bar"}, fetchDirNames(t, cache, "/dir"))
+	_, err := cache.FetchAttr("/dir/foo")
+	assert.NotNil(t, err)
+}
+
+func TestPutNonExistantRemovesChildrenRecursively(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "sub", ModeV: syscall.S_IFDIR},
+	})
+	cache.PutDir("/dir/sub", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+	cache.Close()
+
+	cache = openFileCache(dir)
+	defer cache.Close()
+	cache.PutNonExistant("/dir")
+
+	_, err := cache.FetchAttr("/dir/sub")
+	assert.NotNil(t, err)
+	_, err = cache.FetchAttr("/dir/sub/foo")
+	assert.NotNil(t, err)
+}
+
+func TestPutDirRemovesStaleChildren(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+		&mockDirEntry{NameV: "bar", ModeV: syscall.S_IFREG},
+	})
+	cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "bar", ModeV: syscall.S_IFREG},
+	})
+
+	_, err := cache.FetchAttr("/dir/foo")
+	assert.NotNil(t, err)
+	_, err = cache.FetchAttr("/dir/bar")
+	assert.Nil(t, err)
+}
+
+func TestPutAttrReplacesInodeOfDifferentType(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	cache.PutAttr("/foo", &mockDirEntry{ModeV: syscall.S_IFREG, SizeV: 10})
+	cache.PutAttr("/foo", &mockDirEntry{ModeV: syscall.S_IFDIR})
+	cache.PutAttr("/foo", &mockDirEntry{ModeV: syscall.S_IFREG, SizeV: 20})
+
+	attr, err := cache.FetchAttr("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG), attr.Mode())
+	assert.Equal(t, uint64(20), attr.Size())
+}
+
+func TestMoveKeepsDataAndChildren(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "dir", ModeV: syscall.S_IFDIR},
+		&mockDirEntry{NameV: "other", ModeV: syscall.S_IFDIR},
+	})
+	cache.PutDir("/other", nil)
+	cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG, SizeV: 4096},
+	})
+	f, err := cache.OpenFile("/dir/foo")
+	assert.Nil(t, err)
+	data := genData(4096)
+	assert.Nil(t, f.PutData(data, 0, prio_READ))
+	f.Close()
+
+	assert.Nil(t, cache.Move("/dir", "/other"))
+	cache.Close()
+
+	cache = openFileCache(dir)
+	defer cache.Close()
+
+	assert.Equal(t, []string{"other"}, fetchDirNames(t, cache, "/"))
+	_, err = cache.FetchAttr("/dir/foo")
+	assert.NotNil(t, err)
+
+	f, err = cache.OpenFile("/other/foo")
+	assert.Nil(t, err)
+	defer f.Close()
+	ref := make([]byte, 4096)
+	n, err := f.FetchData(ref, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, data, ref)
+}
+
+func TestMoveNonExistantFails(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	// uncached objects are indistinguishable from missing ones
+	err := cache.Move("/foo", "/bar")
+	assert.Equal(t, uintptr(syscall.EIO), err.Errno())
+}
+
+func TestPutXattrsPersistence(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+
+	xattrs, err := cache.FetchXattrs("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(xattrs))
+
+	cache.PutXattrs("/foo", map[string][]byte{
+		"user.foo":   []byte("bar"),
+		"user.empty": []byte{},
+	})
+	cache.Close()
+
+	cache = openFileCache(dir)
+	defer cache.Close()
+
+	xattrs, err = cache.FetchXattrs("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(xattrs))
+	assert.Equal(t, []byte("bar"), xattrs["user.foo"])
+	assert.Equal(t, 0, len(xattrs["user.empty"]))
+}
+
+func TestPutXattrsIgnoresUncachedPath(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	cache.PutXattrs("/foo", map[string][]byte{"user.foo": []byte("bar")})
+	_, err := cache.FetchXattrs("/foo")
+	assert.Equal(t, uintptr(syscall.EIO), err.Errno())
+}
+
+func TestMoveAndPutNonExistantHandleXattrs(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	defer cache.Close()
+
+	cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFDIR},
+	})
+	cache.PutXattrs("/foo", map[string][]byte{"user.foo": []byte("bar")})
+
+	assert.Nil(t, cache.Move("/foo", "/bar"))
+	xattrs, err := cache.FetchXattrs("/bar")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), xattrs["user.foo"])
+
+	cache.PutNonExistant("/bar")
+	cache.PutAttr("/bar", &mockDirEntry{ModeV: syscall.S_IFDIR})
+	xattrs, err = cache.FetchXattrs("/bar")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(xattrs))
+}
+
+func TestInodeNumbersPersistency(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache_w := openFileCache(dir)
+	cache_w.PutAttr("/foo", &mockDirEntry{ModeV: syscall.S_IFDIR, InoV: 100})
+	cache_w.PutAttr("/bar", &mockDirEntry{ModeV: syscall.S_IFDIR, InoV: 200})
+	foo_w, _ := cache_w.FetchAttr("/foo")
+	bar_w, _ := cache_w.FetchAttr("/bar")
+	assert.NotEqual(t, uint64(0), foo_w.Ino())
+	assert.NotEqual(t, foo_w.Ino(), bar_w.Ino())
+	cache_w.Close()
+
+	cache_r := openFileCache(dir)
+	foo_r, err := cache_r.FetchAttr("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, foo_w.Ino(), foo_r.Ino())
+
+	// a new inode must not get a number which is in use
+	cache_r.PutAttr("/baz", &mockDirEntry{ModeV: syscall.S_IFDIR, InoV: 300})
+	baz, _ := cache_r.FetchAttr("/baz")
+	assert.NotEqual(t, foo_w.Ino(), baz.Ino())
+	assert.NotEqual(t, bar_w.Ino(), baz.Ino())
+	cache_r.Close()
+}
+
+func TestHardLinksShareInodeNumber(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache := openFileCache(dir)
+	link := &mockDirEntry{ModeV: syscall.S_IFREG, InoV: 100, NlinkV: 2}
+	cache.PutAttr("/foo", link)
+	cache.PutAttr("/bar", link)
+	cache.PutAttr("/baz", &mockDirEntry{ModeV: syscall.S_IFREG, InoV: 200, NlinkV: 1})
+
+	foo, _ := cache.FetchAttr("/foo")
+	bar, _ := cache.FetchAttr("/bar")
+	baz, _ := cache.FetchAttr("/baz")
+	assert.Equal(t, foo.Ino(), bar.Ino())
+	assert.NotEqual(t, foo.Ino(), baz.Ino())
+	assert.Equal(t, uint32(2), foo.Nlink())
+
+	// the number stays in use as long as one of the links is cached
+	ino := foo.Ino()
+	cache.PutNonExistant("/foo")
+	cache.PutAttr("/other", &mockDirEntry{ModeV: syscall.S_IFREG, InoV: 300})
+	other, _ := cache.FetchAttr("/other")
+	assert.NotEqual(t, ino, other.Ino())
+	cache.Close()
+}
+
+func TestPutDirCachesSpecialFiles(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	cache_w := openFileCache(dir)
+	cache_w.PutDir("/dev", []layer.DirEntry{
+		&mockDirEntry{NameV: "fifo", ModeV: syscall.S_IFIFO | 0644},
+		&mockDirEntry{NameV: "socket", ModeV: syscall.S_IFSOCK | 0755},
+		&mockDirEntry{NameV: "null", ModeV: syscall.S_IFCHR | 0666, RdevV: 0x103},
+		&mockDirEntry{NameV: "sda", ModeV: syscall.S_IFBLK | 0660, RdevV: 0x800},
+	})
+	cache_w.Close()
+
+	cache_r := openFileCache(dir)
+	entries, err := cache_r.FetchDir("/dev")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+
+	null, err := cache_r.FetchAttr("/dev/null")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFCHR|0666), null.Mode())
+	assert.Equal(t, uint64(0x103), null.Rdev())
+
+	fifo, err := cache_r.FetchAttr("/dev/fifo")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFIFO|0644), fifo.Mode())
+	assert.Equal(t, uint64(0), fifo.Rdev())
+	cache_r.Close()
+}
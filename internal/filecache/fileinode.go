@@ -99,6 +99,10 @@ func (m *blockinfo) MarkDirty() {
 	m.writeFlags(m.readFlags() | block_FLAG_DIRTY)
 }
 
+func (m *blockinfo) MarkClean() {
+	m.writeFlags(m.readFlags() &^ block_FLAG_DIRTY)
+}
+
 func (m blockinfo) IsDirty() bool {
 	return m.readFlags()&block_FLAG_DIRTY != 0
 }
@@ -112,8 +116,11 @@ type fileInode struct {
 	blocks_used uint64
 	file        *os.File
 	handle      *fileCachedFile
-	blockmmap   mmap.MMap
-	blockmap    []blockinfo
+	// Set when the inode is removed from the cache while the file is
+	// open
+	deleted   bool
+	blockmmap mmap.MMap
+	blockmap  []blockinfo
 }
 
 func openOrCreateFileInode(storage_path string) (result *fileInode, err error) {
@@ -191,8 +198,10 @@ func (m *fileInode) ensureMapped() {
 			m.backingSize(),
 			err))
 	}
+	// the slice header still counts bytes; cut it down to the entries
+	// which are actually mapped
 	m.blockmap =
-		(*(*[]blockinfo)(unsafe.Pointer(&m.blockmmap)))[fileInode_HEADER_SIZE/fileInode_BLOCK_INFO_SIZE:]
+		(*(*[]blockinfo)(unsafe.Pointer(&m.blockmmap)))[fileInode_HEADER_SIZE/fileInode_BLOCK_INFO_SIZE : len(m.blockmmap)/fileInode_BLOCK_INFO_SIZE]
 }
 
 func (m *fileInode) ensureUnmapped() {
@@ -239,26 +248,159 @@ func (m *fileInode) IsAvailable(block uint64) bool {
 	return m.blockmap[block].IsAvailable()
 }
 
-func (m *fileInode) SetWritten(start uint64, end uint64) {
+func (m *fileInode) IsDirty(block uint64) bool {
+	if block >= m.SizeBlocks() {
+		return false
+	}
+	m.ensureMapped()
+	return m.blockmap[block].IsDirty()
+}
+
+// Return the number of blocks in the range which are not available. Blocks
+// beyond the end of the file count as unavailable.
+func (m *fileInode) MissingBlocks(start uint64, end uint64) uint64 {
+	if end <= start {
+		return 0
+	}
 	nblocks := m.SizeBlocks()
 	if start >= nblocks {
-		return
+		return end - start
+	}
+	missing := uint64(0)
+	if end > nblocks {
+		missing = end - nblocks
+		end = nblocks
+	}
+	m.ensureMapped()
+	for i := start; i < end; i++ {
+		if !m.blockmap[i].IsAvailable() {
+			missing += 1
+		}
+	}
+	return missing
+}
+
+// Return the number of blocks which were not available before
+func (m *fileInode) SetWritten(start uint64, end uint64) (new_blocks uint64) {
+	nblocks := m.SizeBlocks()
+	if start >= nblocks {
+		return 0
 	}
 	if end <= start {
-		return
+		return 0
 	}
 	if end > nblocks {
 		end = nblocks
 	}
 	m.ensureMapped()
-	var new_blocks uint64
+	saturated := false
 	for i := start; i < end; i++ {
-		new, _ := m.blockmap[i].Touch()
+		new, overflow := m.blockmap[i].Touch()
 		if new {
 			new_blocks += 1
 		}
+		saturated = saturated || overflow
 	}
 	m.blocks_used += new_blocks
+	if saturated {
+		m.Age()
+	}
+	return new_blocks
+}
+
+// Increase the access counters of the available blocks in the range, e.g.
+// after they have been read from the cache.
+func (m *fileInode) Touch(start uint64, end uint64) {
+	if end > m.SizeBlocks() {
+		end = m.SizeBlocks()
+	}
+	if start >= end {
+		return
+	}
+	m.ensureMapped()
+	saturated := false
+	for i := start; i < end; i++ {
+		if m.blockmap[i].IsAvailable() {
+			_, overflow := m.blockmap[i].Touch()
+			saturated = saturated || overflow
+		}
+	}
+	if saturated {
+		m.Age()
+	}
+}
+
+// Halve the access counters of all blocks, keeping available blocks
+// available.
+//
+// This happens when a counter saturates, so that the counters keep telling
+// apart the blocks of the file, and periodically for all files, so that
+// blocks which were used a lot long ago become evictable.
+func (m *fileInode) Age() {
+	nblocks := m.SizeBlocks()
+	if nblocks == 0 || m.blocks_used == 0 {
+		return
+	}
+	m.ensureMapped()
+	for i := uint64(0); i < nblocks; i++ {
+		m.blockmap[i].Shift()
+	}
+}
+
+// Count the clean, available blocks by their access counter.
+//
+// Dirty blocks hold the only copy of their data and can never be evicted.
+func (m *fileInode) countEvictable() map[uint8]uint64 {
+	nblocks := m.SizeBlocks()
+	if nblocks == 0 || m.blocks_used == 0 {
+		return nil
+	}
+	m.ensureMapped()
+	var result map[uint8]uint64
+	for i := uint64(0); i < nblocks; i++ {
+		info := m.blockmap[i]
+		if info.IsAvailable() && !info.IsDirty() {
+			if result == nil {
+				result = make(map[uint8]uint64)
+			}
+			result[info.readACTR()] += 1
+		}
+	}
+	return result
+}
+
+// Discard all clean blocks with an access counter below actr and up to
+// *budget clean blocks with an access counter of exactly actr.
+//
+// Return the discarded blocks in ascending order; the budget is reduced by
+// the number of blocks discarded at actr.
+func (m *fileInode) evictColdBlocks(actr uint8, budget *uint64) []uint64 {
+	nblocks := m.SizeBlocks()
+	if nblocks == 0 || m.blocks_used == 0 {
+		return nil
+	}
+	m.ensureMapped()
+	var result []uint64
+	for i := uint64(0); i < nblocks; i++ {
+		info := m.blockmap[i]
+		if !info.IsAvailable() || info.IsDirty() {
+			continue
+		}
+		ctr := info.readACTR()
+		if ctr > actr {
+			continue
+		}
+		if ctr == actr {
+			if *budget == 0 {
+				continue
+			}
+			*budget -= 1
+		}
+		m.blockmap[i].Discard()
+		m.blocks_used -= 1
+		result = append(result, i)
+	}
+	return result
 }
 
 // Return the number of blocks discarded. This may be less than the number of
@@ -281,22 +423,69 @@ func (m *fileInode) Discard(start uint64, end uint64) uint64 {
 	return ctr
 }
 
-func (m *fileInode) SetRead(start uint64, end uint64) {
-	m.SetWritten(start, end)
+// Mark the blocks in the range as modified locally. Unavailable blocks are
+// not marked.
+func (m *fileInode) MarkDirty(start uint64, end uint64) {
+	if end > m.SizeBlocks() {
+		end = m.SizeBlocks()
+	}
+	if start >= end {
+		return
+	}
+	m.ensureMapped()
+	for i := start; i < end; i++ {
+		if m.blockmap[i].IsAvailable() {
+			m.blockmap[i].MarkDirty()
+		}
+	}
 }
 
-func (m *fileInode) getAvailableBlocks(start uint64, end uint64) uint64 {
-	var ctr uint64 = 0
+func (m *fileInode) MarkClean(start uint64, end uint64) {
+	if end > m.SizeBlocks() {
+		end = m.SizeBlocks()
+	}
+	if start >= end {
+		return
+	}
+	m.ensureMapped()
 	for i := start; i < end; i++ {
-		if m.blockmap[i].IsAvailable() {
-			ctr += 1
+		m.blockmap[i].MarkClean()
+	}
+}
+
+// Return the indices of all dirty blocks in ascending order.
+func (m *fileInode) DirtyBlocks() []uint64 {
+	nblocks := m.SizeBlocks()
+	if nblocks == 0 {
+		return nil
+	}
+	m.ensureMapped()
+	var result []uint64
+	for i := uint64(0); i < nblocks; i++ {
+		if m.blockmap[i].IsDirty() {
+			result = append(result, i)
 		}
 	}
-	return ctr
+	return result
+}
+
+func (m *fileInode) SetRead(start uint64, end uint64) {
+	m.SetWritten(start, end)
 }
 
 // Return the number of blocks which were discarded
 func (m *fileInode) Resize(nbytes uint64) (discarded uint64) {
+	return m.resize(nbytes, false)
+}
+
+// Resize after the file itself has been resized, e.g. by a write beyond its
+// end: the range between the old and the new end consists of zeros, so an
+// incomplete last block stays available.
+func (m *fileInode) Extend(nbytes uint64) (discarded uint64) {
+	return m.resize(nbytes, true)
+}
+
+func (m *fileInode) resize(nbytes uint64, zero_filled bool) (discarded uint64) {
 	new_blocks := (nbytes + BLOCK_SIZE - 1) / BLOCK_SIZE
 	old_size := m.Size()
 	old_blocks := m.SizeBlocks()
@@ -306,14 +495,13 @@ func (m *fileInode) Resize(nbytes uint64) (discarded uint64) {
 		nbytes, new_blocks,
 	)
 	if new_blocks < old_blocks {
-		m.ensureMapped()
-		discarded = m.getAvailableBlocks(new_blocks, old_blocks)
-	} else if nbytes > old_size && old_size > 0 && old_size%BLOCK_SIZE != 0 {
-		m.ensureMapped()
+		// the block map is only shrunk to page granularity; the flags
+		// of the blocks beyond the end must be cleared so that they
+		// don’t reappear when the file grows again
+		discarded = m.Discard(new_blocks, old_blocks)
+	} else if !zero_filled && nbytes > old_size && old_size > 0 && old_size%BLOCK_SIZE != 0 {
 		// discard the last block if it was available and file size wasn’t aligned
-		if m.blockmap[old_blocks-1].Discard() {
-			discarded = 1
-		}
+		discarded = m.Discard(old_blocks-1, old_blocks)
 	}
 	m.size = nbytes
 	m.resizeMapToBlocks(new_blocks)
@@ -417,6 +605,20 @@ func (m *fileInode) TruncateRead(position uint64, size uint64) (actual_size uint
 	return actual_size, at_eof
 }
 
+// Return the number of bytes of the file which are available in the cache.
+func (m *fileInode) CachedBytes() uint64 {
+	nblocks := m.SizeBlocks()
+	if nblocks == 0 || m.blocks_used == 0 {
+		return 0
+	}
+	cached := m.blocks_used * BLOCK_SIZE
+	// the last block is only partially used by the file
+	if tail := m.size % BLOCK_SIZE; tail != 0 && m.IsAvailable(nblocks-1) {
+		cached -= BLOCK_SIZE - tail
+	}
+	return cached
+}
+
 func (m *fileInode) Blocks() uint64 {
 	if m.SizeBlocks() == 0 {
 		return 0
@@ -498,3 +498,41 @@ func TestTruncateReadRespectsEOF(t *testing.T) {
 	assert.Equal(t, uint64(2048+1234), new_len)
 	assert.True(t, at_eof)
 }
+
+func TestTouchAgesFileWhenCounterSaturates(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	bm, err := openOrCreateFileInode(dir + "/file")
+	assert.Nil(t, err)
+
+	bm.Resize(4096 * 3)
+	bm.SetWritten(0, 2)
+	for i := 0; i < 200; i++ {
+		bm.Touch(0, 1)
+	}
+	assert.Equal(t, uint8(201), bm.blockmap[0].readACTR())
+
+	for i := 0; i < 54; i++ {
+		bm.Touch(0, 1)
+	}
+	assert.Equal(t, uint8(127), bm.blockmap[0].readACTR())
+	assert.Equal(t, uint8(1), bm.blockmap[1].readACTR())
+	assert.False(t, bm.IsAvailable(2))
+	assert.Equal(t, uint64(2), bm.Blocks())
+}
+
+func TestBlockMapCoversOnlyTheMappedEntries(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	bm, err := openOrCreateFileInode(dir + "/file")
+	assert.Nil(t, err)
+	defer bm.Close()
+
+	bm.Resize(1024)
+	bm.ensureMapped()
+	assert.Equal(t,
+		int(bm.backingSize()-fileInode_HEADER_SIZE)/fileInode_BLOCK_INFO_SIZE,
+		len(bm.blockmap))
+}
@@ -18,15 +18,25 @@ var (
 	ErrMagicMismatch = errors.New("magic number mismatch")
 )
 
+const (
+	// the inode and its data are never evicted
+	inode_FLAG_PINNED = uint8(1 << 0)
+)
+
 var (
 	inode_MAGIC     = [3]byte{0x69, 0x6e, 0x6f}
 	inode_DIR_MAGIC = [3]byte{0x44, 0x49, 0x52}
 	inode_REG_MAGIC = [3]byte{0x52, 0x45, 0x47}
 	inode_LNK_MAGIC = [3]byte{0x4c, 0x4e, 0x4b}
+	inode_XAT_MAGIC = [3]byte{0x58, 0x41, 0x54}
+	inode_SPC_MAGIC = [3]byte{0x53, 0x50, 0x43}
 	// FIXME: set this to 4096 - len(inode)
 	inode_MAX_LINK_DEST_LEN = uint32(2048)
 	inode_MAX_DIR_CHILDREN  = uint32(65535)
 	inode_MAX_DIR_ENTRY     = uint32(1024)
+	inode_MAX_XATTRS        = uint32(1024)
+	inode_MAX_XATTR_NAME    = uint32(255)
+	inode_MAX_XATTR_VALUE   = uint32(65536)
 )
 
 func checkMagic(val []byte, ref []byte) bool {
@@ -104,16 +114,32 @@ type inode interface {
 	SetMtime(new uint64)
 	SetAtime(new uint64)
 	SetCtime(new uint64)
+	SetMtimeNsec(new uint32)
+	SetAtimeNsec(new uint32)
+	SetCtimeNsec(new uint32)
+	SetNlink(new uint32)
 	SetSize(new uint64)
 	SetOwnerUID(new uint32)
 	SetOwnerGID(new uint32)
 	SetMode(new uint32)
 
+	IsPinned() bool
+	SetPinned(pinned bool)
+
 	Mutex() *sync.Mutex
 
+	// Change the path at which the inode is stored; the files must have
+	// been moved already
+	setStoragePath(path string)
+
+	// The inode number of the object on the source; Ino is the number
+	// allocated by the cache
+	SourceIno() uint64
+	setIno(ino uint64, source_ino uint64)
+
 	Chown(uid uint32, gid uint32)
 	Chmod(perms uint32)
-	Utimens(mtime *time.Time, atime *time.Time)
+	Utimens(atime *time.Time, mtime *time.Time)
 
 	// Write pending changes to the backing storage
 	Sync() error
@@ -127,9 +153,16 @@ func updateInode(src layer.FileStat, dest inode) {
 	dest.SetMtime(src.Mtime())
 	dest.SetAtime(src.Atime())
 	dest.SetCtime(src.Ctime())
+	dest.SetMtimeNsec(src.MtimeNsec())
+	dest.SetAtimeNsec(src.AtimeNsec())
+	dest.SetCtimeNsec(src.CtimeNsec())
+	dest.SetNlink(src.Nlink())
 	dest.SetOwnerUID(src.OwnerUID())
 	dest.SetOwnerGID(src.OwnerGID())
 	dest.SetSize(src.Size())
+	if special, ok := dest.(*specialInode); ok {
+		special.rdev = src.Rdev()
+	}
 }
 
 type baseInode struct {
@@ -140,6 +173,13 @@ type baseInode struct {
 	mtime          uint64
 	atime          uint64
 	ctime          uint64
+	mtime_nsec     uint32
+	atime_nsec     uint32
+	ctime_nsec     uint32
+	ino            uint64
+	source_ino     uint64
+	nlink          uint32
+	flags          uint8
 	times_modified bool
 	size           uint64
 	uid            uint32
@@ -151,6 +191,10 @@ func (m *baseInode) Atime() uint64 {
 	return m.atime
 }
 
+func (m *baseInode) AtimeNsec() uint32 {
+	return m.atime_nsec
+}
+
 func (m *baseInode) Blocks() uint64 {
 	return 0
 }
@@ -169,10 +213,36 @@ func (m *baseInode) Chown(uid uint32, gid uint32) {
 	m.gid = gid
 }
 
+func (m *baseInode) setStoragePath(path string) {
+	m.storage_path = path
+}
+
+func (m *baseInode) setIno(ino uint64, source_ino uint64) {
+	m.ino = ino
+	m.source_ino = source_ino
+}
+
 func (m *baseInode) Ctime() uint64 {
 	return m.ctime
 }
 
+func (m *baseInode) CtimeNsec() uint32 {
+	return m.ctime_nsec
+}
+
+func (m *baseInode) Ino() uint64 {
+	return m.ino
+}
+
+func (m *baseInode) Nlink() uint32 {
+	return m.nlink
+}
+
+// Overridden by special file inodes
+func (m *baseInode) Rdev() uint64 {
+	return 0
+}
+
 func (m *baseInode) Mode() uint32 {
 	return m.mode
 }
@@ -181,6 +251,10 @@ func (m *baseInode) Mtime() uint64 {
 	return m.mtime
 }
 
+func (m *baseInode) MtimeNsec() uint32 {
+	return m.mtime_nsec
+}
+
 func (m *baseInode) Mutex() *sync.Mutex {
 	return &m.mutex
 }
@@ -197,10 +271,18 @@ func (m *baseInode) SetAtime(new uint64) {
 	m.atime = new
 }
 
+func (m *baseInode) SetAtimeNsec(new uint32) {
+	m.atime_nsec = new
+}
+
 func (m *baseInode) SetCtime(new uint64) {
 	m.ctime = new
 }
 
+func (m *baseInode) SetCtimeNsec(new uint32) {
+	m.ctime_nsec = new
+}
+
 func (m *baseInode) SetMode(new uint32) {
 	m.Chmod(new)
 }
@@ -209,6 +291,26 @@ func (m *baseInode) SetMtime(new uint64) {
 	m.mtime = new
 }
 
+func (m *baseInode) SetMtimeNsec(new uint32) {
+	m.mtime_nsec = new
+}
+
+func (m *baseInode) SetNlink(new uint32) {
+	m.nlink = new
+}
+
+func (m *baseInode) IsPinned() bool {
+	return m.flags&inode_FLAG_PINNED != 0
+}
+
+func (m *baseInode) SetPinned(pinned bool) {
+	if pinned {
+		m.flags |= inode_FLAG_PINNED
+	} else {
+		m.flags &^= inode_FLAG_PINNED
+	}
+}
+
 func (m *baseInode) SetOwnerGID(new uint32) {
 	m.gid = new
 }
@@ -225,13 +327,24 @@ func (m *baseInode) Size() uint64 {
 	return m.size
 }
 
+func (m *baseInode) SourceIno() uint64 {
+	return m.source_ino
+}
+
 func (m *baseInode) Sync() error {
 	return layer.WrapError(syscall.ENOSYS)
 }
 
-func (m *baseInode) Utimens(mtime *time.Time, atime *time.Time) {
-	m.mtime = uint64(mtime.Unix())
-	m.atime = uint64(atime.Unix())
+// Set the access and modification times; nil times are left unchanged.
+func (m *baseInode) Utimens(atime *time.Time, mtime *time.Time) {
+	if atime != nil {
+		m.atime = uint64(atime.Unix())
+		m.atime_nsec = uint32(atime.Nanosecond())
+	}
+	if mtime != nil {
+		m.mtime = uint64(mtime.Unix())
+		m.mtime_nsec = uint32(mtime.Nanosecond())
+	}
 }
 
 func (m *baseInode) read(reader io.Reader) error {
@@ -240,7 +353,7 @@ func (m *baseInode) read(reader io.Reader) error {
 		return err
 	}
 
-	if ver != 1 {
+	if ver < 1 || ver > 4 {
 		return errors.New(fmt.Sprintf("unsupported version: %d", ver))
 	}
 
@@ -282,11 +395,60 @@ func (m *baseInode) read(reader io.Reader) error {
 		return err
 	}
 
+	if ver < 2 {
+		// version 1 only has whole seconds
+		m.mtime_nsec = 0
+		m.atime_nsec = 0
+		m.ctime_nsec = 0
+		return nil
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.mtime_nsec); err != nil {
+		return err
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.atime_nsec); err != nil {
+		return err
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.ctime_nsec); err != nil {
+		return err
+	}
+
+	if ver < 3 {
+		// the cache numbers the inode when it loads it
+		m.ino = 0
+		m.source_ino = 0
+		m.nlink = 1
+		return nil
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.ino); err != nil {
+		return err
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.source_ino); err != nil {
+		return err
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.nlink); err != nil {
+		return err
+	}
+
+	if ver < 4 {
+		m.flags = 0
+		return nil
+	}
+
+	if err = binary.Read(reader, binary.LittleEndian, &m.flags); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (m *baseInode) write(writer io.Writer) error {
-	if err := writeVerAndMagic(writer, 1, inode_MAGIC[:]); err != nil {
+	if err := writeVerAndMagic(writer, 4, inode_MAGIC[:]); err != nil {
 		return err
 	}
 
@@ -327,6 +489,34 @@ func (m *baseInode) write(writer io.Writer) error {
 		return err
 	}
 
+	if err := binary.Write(writer, binary.LittleEndian, &m.mtime_nsec); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, &m.atime_nsec); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, &m.ctime_nsec); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, &m.ino); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, &m.source_ino); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, &m.nlink); err != nil {
+		return err
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, &m.flags); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -388,6 +578,55 @@ func (m *linkInode) readLinkData(reader io.Reader) error {
 	return nil
 }
 
+// FIFOs, sockets and device nodes, of which only the metadata is cached
+type specialInode struct {
+	baseInode
+	rdev uint64
+}
+
+func (m *specialInode) Rdev() uint64 {
+	return m.rdev
+}
+
+func (m *specialInode) Sync() error {
+	file, err := CreateSafe(m.storage_path)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	if err = m.baseInode.write(file); err != nil {
+		return err
+	}
+
+	if err = writeVerAndMagic(file, 1, inode_SPC_MAGIC[:]); err != nil {
+		return err
+	}
+
+	if err = binary.Write(file, binary.LittleEndian, &m.rdev); err != nil {
+		return err
+	}
+
+	file.Close()
+	return nil
+}
+
+func (m *specialInode) Close() error {
+	return m.Sync()
+}
+
+func (m *specialInode) readSpecialData(reader io.Reader) error {
+	ver, err := readVerAndMagic(reader, inode_SPC_MAGIC[:])
+	if err != nil {
+		return err
+	}
+	if ver != 1 {
+		return errors.New(fmt.Sprintf("unsupported version: %d", ver))
+	}
+
+	return binary.Read(reader, binary.LittleEndian, &m.rdev)
+}
+
 type dirInode struct {
 	baseInode
 	children []string
@@ -438,6 +677,17 @@ func (m *dirInode) Close() error {
 	return nil
 }
 
+// Remove name from the listing and return whether it was listed.
+func (m *dirInode) removeChild(name string) bool {
+	for i, child := range m.children {
+		if child == name {
+			m.children = append(m.children[:i], m.children[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (m *dirInode) readDirData(reader io.Reader) error {
 	ver, err := readVerAndMagic(reader, inode_DIR_MAGIC[:])
 	if err != nil {
@@ -469,6 +719,64 @@ func (m *dirInode) readDirData(reader io.Reader) error {
 	return nil
 }
 
+// Write the extended attribute extension
+func writeXattrData(writer io.Writer, xattrs map[string][]byte) error {
+	if err := writeVerAndMagic(writer, 1, inode_XAT_MAGIC[:]); err != nil {
+		return err
+	}
+
+	nxattrs := uint32(len(xattrs))
+	if err := binary.Write(writer, binary.LittleEndian, &nxattrs); err != nil {
+		return err
+	}
+
+	for name, value := range xattrs {
+		if err := writeLenString(writer, name); err != nil {
+			return err
+		}
+		if err := writeLenString(writer, string(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readXattrData(reader io.Reader) (map[string][]byte, error) {
+	ver, err := readVerAndMagic(reader, inode_XAT_MAGIC[:])
+	if err != nil {
+		return nil, err
+	}
+	if ver != 1 {
+		return nil, errors.New(fmt.Sprintf("unsupported version: %d", ver))
+	}
+
+	var nxattrs uint32
+	if err := binary.Read(reader, binary.LittleEndian, &nxattrs); err != nil {
+		return nil, err
+	}
+
+	if nxattrs > inode_MAX_XATTRS {
+		return nil, errors.New(fmt.Sprintf("too many extended attributes: %d",
+			nxattrs))
+	}
+
+	result := make(map[string][]byte)
+	for i := uint32(0); i < nxattrs; i++ {
+		name, err := readLenString(reader, inode_MAX_XATTR_NAME)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readLenString(reader, inode_MAX_XATTR_VALUE)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = []byte(value)
+	}
+
+	return result, nil
+}
+
 func createInode(storage_path string, ref layer.FileStat) (inode, error) {
 	base := baseInode{
 		storage_path: storage_path,
@@ -476,6 +784,10 @@ func createInode(storage_path string, ref layer.FileStat) (inode, error) {
 		mtime:        ref.Mtime(),
 		atime:        ref.Atime(),
 		ctime:        ref.Ctime(),
+		mtime_nsec:   ref.MtimeNsec(),
+		atime_nsec:   ref.AtimeNsec(),
+		ctime_nsec:   ref.CtimeNsec(),
+		nlink:        ref.Nlink(),
 		size:         ref.Size(),
 		uid:          ref.OwnerUID(),
 		gid:          ref.OwnerGID(),
@@ -494,6 +806,12 @@ func createInode(storage_path string, ref layer.FileStat) (inode, error) {
 			nil,
 		}
 		return result, nil
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
+		result := &specialInode{
+			base,
+			ref.Rdev(),
+		}
+		return result, nil
 	case syscall.S_IFREG:
 		file, err := os.OpenFile(storage_path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
 		if err != nil {
@@ -517,6 +835,7 @@ func createEmptyInode(storage_path string, format uint32) (inode, error) {
 	base := baseInode{
 		storage_path: storage_path,
 		mode:         format,
+		nlink:        1,
 	}
 
 	switch base.mode & syscall.S_IFMT {
@@ -532,6 +851,12 @@ func createEmptyInode(storage_path string, format uint32) (inode, error) {
 			nil,
 		}
 		return result, nil
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
+		result := &specialInode{
+			base,
+			0,
+		}
+		return result, nil
 	case syscall.S_IFREG:
 		file, err := os.OpenFile(storage_path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
 		if err != nil {
@@ -588,6 +913,15 @@ func openInode(storage_path string) (inode, error) {
 			return nil, err
 		}
 		return result, nil
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
+		result := &specialInode{
+			base,
+			0,
+		}
+		if err = result.readSpecialData(file); err != nil {
+			return nil, err
+		}
+		return result, nil
 	case syscall.S_IFREG:
 		result := &fileInode{
 			baseInode: base,
@@ -0,0 +1,212 @@
+package filecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/horazont/dragonstash/internal/cache"
+)
+
+var (
+	inode_NUMBERS_MAGIC = [3]byte{0x69, 0x6e, 0x6e}
+	// 1 is the inode number of the root of the FUSE mount
+	inode_FIRST_NUMBER = uint64(2)
+	inode_LAST_NUMBER  = ^uint64(0) - 1
+)
+
+// A group of hard links on the source, all cached inodes of which share an
+// inode number.
+type hardLink struct {
+	ino  uint64
+	refs uint32
+}
+
+// The allocation of inode numbers, persisted in the cache root
+type inodeNumbers struct {
+	free *cache.IDList
+	// hard link groups by the inode number on the source
+	links map[uint64]*hardLink
+	dirty bool
+}
+
+func newInodeNumbers() *inodeNumbers {
+	free := cache.NewEmptyIDList()
+	free.AddBlock(inode_FIRST_NUMBER, inode_LAST_NUMBER)
+	return &inodeNumbers{
+		free:  free,
+		links: make(map[uint64]*hardLink),
+	}
+}
+
+// Load the inode numbers from path; a fresh allocation is returned if the file
+// does not exist.
+func loadInodeNumbers(path string) (*inodeNumbers, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return newInodeNumbers(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := &inodeNumbers{
+		links: make(map[uint64]*hardLink),
+	}
+	if err := result.read(file); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *inodeNumbers) read(reader io.Reader) error {
+	ver, err := readVerAndMagic(reader, inode_NUMBERS_MAGIC[:])
+	if err != nil {
+		return err
+	}
+	if ver != 1 {
+		return errors.New(fmt.Sprintf("unsupported version: %d", ver))
+	}
+
+	if m.free, err = cache.ReadIDList(reader); err != nil {
+		return err
+	}
+
+	var nlinks uint32
+	if err := binary.Read(reader, binary.LittleEndian, &nlinks); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < nlinks; i++ {
+		var source_ino uint64
+		link := &hardLink{}
+		if err := binary.Read(reader, binary.LittleEndian, &source_ino); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &link.ino); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &link.refs); err != nil {
+			return err
+		}
+		m.links[source_ino] = link
+	}
+
+	return nil
+}
+
+func (m *inodeNumbers) write(writer io.Writer) error {
+	if err := writeVerAndMagic(writer, 1, inode_NUMBERS_MAGIC[:]); err != nil {
+		return err
+	}
+
+	if err := m.free.Write(writer); err != nil {
+		return err
+	}
+
+	nlinks := uint32(len(m.links))
+	if err := binary.Write(writer, binary.LittleEndian, &nlinks); err != nil {
+		return err
+	}
+
+	for source_ino, link := range m.links {
+		if err := binary.Write(writer, binary.LittleEndian, &source_ino); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, &link.ino); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, &link.refs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write the inode numbers to path, if they changed since the last save.
+func (m *inodeNumbers) save(path string) error {
+	if !m.dirty {
+		return nil
+	}
+
+	file, err := CreateSafe(path)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	if err := m.write(file); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	m.dirty = false
+	return nil
+}
+
+// Return the inode number for a cached inode which currently has the numbers
+// ino and old_source_ino and now has the number source_ino on the source.
+//
+// The current number is kept if possible, and released otherwise. Inodes with
+// linked set share the inode number with the other inodes of their hard link
+// group.
+func (m *inodeNumbers) assign(ino uint64, old_source_ino uint64, source_ino uint64, linked bool) (uint64, error) {
+	if ino != 0 && source_ino == old_source_ino {
+		if !linked {
+			return ino, nil
+		}
+		link, ok := m.links[source_ino]
+		if !ok {
+			// the file was not linked yet when it was numbered
+			m.links[source_ino] = &hardLink{ino, 1}
+			m.dirty = true
+			return ino, nil
+		}
+		if link.ino == ino {
+			return ino, nil
+		}
+	}
+
+	m.release(ino, old_source_ino)
+
+	if linked {
+		if link, ok := m.links[source_ino]; ok {
+			link.refs += 1
+			m.dirty = true
+			return link.ino, nil
+		}
+	}
+
+	new_ino, err := m.free.Alloc()
+	if err != nil {
+		return 0, err
+	}
+	if linked {
+		m.links[source_ino] = &hardLink{new_ino, 1}
+	}
+	m.dirty = true
+	return new_ino, nil
+}
+
+// Release the inode number of a cached inode which is removed from the cache.
+func (m *inodeNumbers) release(ino uint64, source_ino uint64) {
+	if ino == 0 {
+		return
+	}
+
+	m.dirty = true
+	if link, ok := m.links[source_ino]; ok && link.ino == ino {
+		link.refs -= 1
+		if link.refs > 0 {
+			return
+		}
+		delete(m.links, source_ino)
+	}
+	m.free.Release(ino)
+}
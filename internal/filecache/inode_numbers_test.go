@@ -0,0 +1,79 @@
+package filecache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignKeepsInodeNumber(t *testing.T) {
+	numbers := newInodeNumbers()
+
+	ino, err := numbers.assign(0, 0, 100, false)
+	assert.Nil(t, err)
+	assert.Equal(t, inode_FIRST_NUMBER, ino)
+
+	same, err := numbers.assign(ino, 100, 100, false)
+	assert.Nil(t, err)
+	assert.Equal(t, ino, same)
+}
+
+func TestAssignReplacesInodeNumberOfReplacedFile(t *testing.T) {
+	numbers := newInodeNumbers()
+
+	ino, _ := numbers.assign(0, 0, 100, false)
+	other, _ := numbers.assign(0, 0, 200, false)
+	replaced, _ := numbers.assign(ino, 100, 101, false)
+	assert.NotEqual(t, other, replaced)
+
+	// the old number has been released and is handed out again
+	assert.Equal(t, ino, replaced)
+}
+
+func TestAssignSharesInodeNumberOfHardLinks(t *testing.T) {
+	numbers := newInodeNumbers()
+
+	ino1, _ := numbers.assign(0, 0, 100, true)
+	ino2, _ := numbers.assign(0, 0, 100, true)
+	assert.Equal(t, ino1, ino2)
+	assert.Equal(t, uint32(2), numbers.links[100].refs)
+
+	numbers.release(ino1, 100)
+	assert.Equal(t, uint32(1), numbers.links[100].refs)
+	numbers.release(ino2, 100)
+	_, ok := numbers.links[100]
+	assert.False(t, ok)
+
+	ino3, _ := numbers.assign(0, 0, 300, false)
+	assert.Equal(t, ino1, ino3)
+}
+
+func TestAssignJoinsHardLinkGroupWhenLinked(t *testing.T) {
+	numbers := newInodeNumbers()
+
+	ino1, _ := numbers.assign(0, 0, 100, false)
+	// the file got a second link on the source
+	linked1, _ := numbers.assign(ino1, 100, 100, true)
+	assert.Equal(t, ino1, linked1)
+
+	ino2, _ := numbers.assign(0, 0, 100, true)
+	assert.Equal(t, ino1, ino2)
+}
+
+func TestInodeNumbersWriteAndRead(t *testing.T) {
+	numbers := newInodeNumbers()
+	ino, _ := numbers.assign(0, 0, 100, true)
+	numbers.assign(0, 0, 200, false)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, numbers.write(buf))
+
+	read := &inodeNumbers{links: make(map[uint64]*hardLink)}
+	assert.Nil(t, read.read(buf))
+	assert.Equal(t, numbers.free.Count(), read.free.Count())
+	assert.Equal(t, &hardLink{ino, 1}, read.links[100])
+
+	next, _ := read.assign(0, 0, 300, false)
+	assert.Equal(t, inode_FIRST_NUMBER+2, next)
+}
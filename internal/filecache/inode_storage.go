@@ -14,6 +14,12 @@ type dirCacheEntry struct {
 	MtimeV     uint64 `toml:"mtime"`
 	CtimeV     uint64 `toml:"ctime"`
 	AtimeV     uint64 `toml:"atime"`
+	MtimeNsecV uint32 `toml:"mtime_nsec"`
+	CtimeNsecV uint32 `toml:"ctime_nsec"`
+	AtimeNsecV uint32 `toml:"atime_nsec"`
+	InoV       uint64 `toml:"ino"`
+	NlinkV     uint32 `toml:"nlink"`
+	RdevV      uint64 `toml:"rdev"`
 	SizeV      uint64 `toml:"size"`
 	UidV       uint32 `toml:"uid"`
 	GidV       uint32 `toml:"gid"`
@@ -39,6 +45,12 @@ func updateStatToCache(stat layer.FileStat, dest *dirCacheEntry) {
 	dest.MtimeV = stat.Mtime()
 	dest.AtimeV = stat.Atime()
 	dest.CtimeV = stat.Ctime()
+	dest.MtimeNsecV = stat.MtimeNsec()
+	dest.AtimeNsecV = stat.AtimeNsec()
+	dest.CtimeNsecV = stat.CtimeNsec()
+	dest.InoV = stat.Ino()
+	dest.NlinkV = stat.Nlink()
+	dest.RdevV = stat.Rdev()
 	dest.SizeV = stat.Size()
 	dest.UidV = stat.OwnerUID()
 	dest.GidV = stat.OwnerGID()
@@ -98,6 +110,30 @@ func (m *dirCacheEntry) Mtime() uint64 {
 	return m.MtimeV
 }
 
+func (m *dirCacheEntry) MtimeNsec() uint32 {
+	return m.MtimeNsecV
+}
+
+func (m *dirCacheEntry) AtimeNsec() uint32 {
+	return m.AtimeNsecV
+}
+
+func (m *dirCacheEntry) CtimeNsec() uint32 {
+	return m.CtimeNsecV
+}
+
+func (m *dirCacheEntry) Ino() uint64 {
+	return m.InoV
+}
+
+func (m *dirCacheEntry) Nlink() uint32 {
+	return m.NlinkV
+}
+
+func (m *dirCacheEntry) Rdev() uint64 {
+	return m.RdevV
+}
+
 func (m *dirCacheEntry) OwnerGID() uint32 {
 	return m.GidV
 }
@@ -1,6 +1,7 @@
 package filecache
 
 import (
+	"os"
 	"syscall"
 	"testing"
 
@@ -215,3 +216,112 @@ func TestCreateAndReopenDirInode(t *testing.T) {
 	assert.Equal(t, "fnord", di.children[1])
 	assert.Equal(t, "quux", di.children[2])
 }
+
+func TestCreateAndReopenInodeKeepsNanoseconds(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+	path := dir + "/file"
+
+	ref := dirCacheEntry{
+		ModeV:      syscall.S_IFDIR | syscall.S_IRWXU,
+		MtimeV:     12,
+		AtimeV:     23,
+		CtimeV:     34,
+		MtimeNsecV: 120,
+		AtimeNsecV: 230,
+		CtimeNsecV: 340,
+	}
+
+	n, err := createInode(path, &ref)
+	assert.Nil(t, err)
+	assert.Nil(t, n.Sync())
+
+	n, err = openInode(path)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ref.MtimeV, n.Mtime())
+	assert.Equal(t, ref.MtimeNsecV, n.MtimeNsec())
+	assert.Equal(t, ref.AtimeNsecV, n.AtimeNsec())
+	assert.Equal(t, ref.CtimeNsecV, n.CtimeNsec())
+}
+
+func TestOpenVersion1Inode(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+	path := dir + "/file"
+
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	file.Write([]byte{
+		0x69, 0x6e, 0x6f, 0x01, // magic and version
+		0xc0, 0x41, 0x00, 0x00, // mode
+		0x4e, 0x00, 0x00, 0x00, // uid
+		0x59, 0x00, 0x00, 0x00, // gid
+		0x00,                                           // perms_modified
+		0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // mtime
+		0x17, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // atime
+		0x22, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ctime
+		0x00,                                           // times_modified
+		0x2d, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // size
+		0x44, 0x49, 0x52, 0x01, // directory magic and version
+		0x00, 0x00, 0x00, 0x00, // no children
+	})
+	file.Close()
+
+	n, err := openInode(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, n)
+
+	assert.Equal(t, uint32(syscall.S_IFDIR|syscall.S_IRWXU), n.Mode())
+	assert.Equal(t, uint32(78), n.OwnerUID())
+	assert.Equal(t, uint32(89), n.OwnerGID())
+	assert.Equal(t, uint64(12), n.Mtime())
+	assert.Equal(t, uint64(23), n.Atime())
+	assert.Equal(t, uint64(34), n.Ctime())
+	assert.Equal(t, uint64(45), n.Size())
+	assert.Equal(t, uint32(0), n.MtimeNsec())
+	assert.Equal(t, uint32(0), n.AtimeNsec())
+	assert.Equal(t, uint32(0), n.CtimeNsec())
+}
+
+func TestCreateAndReopenSpecialInode(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+	path := dir + "/file"
+
+	ref := dirCacheEntry{
+		ModeV: syscall.S_IFBLK | syscall.S_IRUSR | syscall.S_IWUSR,
+		RdevV: 0x801,
+	}
+
+	n, err := createInode(path, &ref)
+	assert.Nil(t, err)
+	_, ok := n.(*specialInode)
+	assert.True(t, ok)
+	assert.Nil(t, n.Sync())
+
+	n, err = openInode(path)
+	assert.Nil(t, err)
+	_, ok = n.(*specialInode)
+	assert.True(t, ok)
+
+	assert.Equal(t, ref.ModeV, n.Mode())
+	assert.Equal(t, ref.RdevV, n.Rdev())
+}
+
+func TestCreateAndReopenPinnedInode(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+	path := dir + "/file"
+
+	n, err := createEmptyInode(path, syscall.S_IFDIR)
+	assert.Nil(t, err)
+	assert.False(t, n.IsPinned())
+
+	n.SetPinned(true)
+	assert.Nil(t, n.Close())
+
+	n, err = openInode(path)
+	assert.Nil(t, err)
+	assert.True(t, n.IsPinned())
+}
@@ -0,0 +1,482 @@
+package filecache
+
+import (
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/cache"
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// Return the blocks and inodes used by pinned objects.
+//
+// Files which are open are counted with the blocks they had when they were
+// opened.
+func (m *FileCache) PinnedUsage() (blocks uint64, inodes uint64) {
+	return m.countUsage(true)
+}
+
+// Log a warning if eviction fell short because pinned objects alone exceed
+// the limit.
+//
+// Must be called with the lock held.
+func (m *FileCache) reportPinnedExcess() {
+	info := m.Quota()
+	blocks, inodes := m.countUsage(true)
+	if info.BlocksTotal != 0 && blocks > info.BlocksTotal {
+		log.Printf("WARNING: pinned files use %d blocks, which exceeds the limit of %d blocks",
+			blocks, info.BlocksTotal)
+	}
+	if info.InodesTotal != 0 && inodes > info.InodesTotal {
+		log.Printf("WARNING: %d inodes are pinned, which exceeds the limit of %d inodes",
+			inodes, info.InodesTotal)
+	}
+}
+
+// Take up to nblocks from the free blocks and return the number taken.
+func (m *FileCache) takeFreeBlocks(nblocks uint64) uint64 {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	if m.quota.BlocksTotal != 0 {
+		free := uint64(0)
+		if m.quota.BlocksUsed < m.quota.BlocksTotal {
+			free = m.quota.BlocksTotal - m.quota.BlocksUsed
+		}
+		if nblocks > free {
+			nblocks = free
+		}
+	}
+	m.quota.BlocksUsed += nblocks
+	return nblocks
+}
+
+// Request blocks for cached data.
+//
+// Blocks are granted from the free blocks first. If those do not suffice,
+// requests for written or read data evict clean blocks of files which are not
+// open, least accessed first. Read-ahead never evicts other data. Requests may
+// be granted partially.
+//
+// Blocks are evicted in batches of a fraction of the limit on top of the
+// shortfall, so that the tree does not have to be walked for every request
+// once the cache is full.
+//
+// Must not be called with the lock of an inode held.
+func (m *FileCache) RequestBlocks(nblocks uint64, priority int) (granted uint64) {
+	granted = m.takeFreeBlocks(nblocks)
+	if granted == nblocks || priority == cache.QUOTA_BLOCK_PRIO_READAHEAD {
+		return granted
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// another request may have evicted enough in the meantime
+	granted += m.takeFreeBlocks(nblocks - granted)
+	if granted == nblocks {
+		return granted
+	}
+
+	shortfall := nblocks - granted
+	m.evictBlocks(shortfall+m.Quota().BlocksTotal/64, shortfall)
+	return granted + m.takeFreeBlocks(shortfall)
+}
+
+func (m *FileCache) ReleaseBlocks(nblocks uint64) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	if nblocks > m.quota.BlocksUsed {
+		log.Printf("ReleaseBlocks: releasing %d blocks, but only %d are in use",
+			nblocks, m.quota.BlocksUsed)
+		nblocks = m.quota.BlocksUsed
+	}
+	m.quota.BlocksUsed -= nblocks
+}
+
+// Call fn with each of the file inodes stored at storage_paths, with its lock
+// held; open files are skipped unless include_open is set.
+//
+// Inodes which are not loaded are opened for the call only. If fn returns
+// true, it has changed the inode, which is then synced to disk and its usage
+// updated.
+//
+// Must be called with the lock held.
+func (m *FileCache) forFileInodes(storage_paths []string, include_open bool, fn func(node *fileInode) bool) {
+	loaded := make(map[string]*fileInode)
+	for _, node := range m.inodes {
+		if finode, ok := node.(*fileInode); ok {
+			loaded[finode.storage_path] = finode
+		}
+	}
+
+	for _, storage_path := range storage_paths {
+		if finode, ok := loaded[storage_path]; ok {
+			func() {
+				finode.mutex.Lock()
+				defer finode.mutex.Unlock()
+				if (include_open || finode.handle == nil) && fn(finode) {
+					if err := finode.Sync(); err != nil {
+						log.Printf("failed to sync inode: %s", err)
+					}
+					m.recordUsage(storage_path, finode)
+				}
+			}()
+			continue
+		}
+
+		node, err := openInode(storage_path)
+		if err != nil {
+			log.Printf("failed to open inode %s: %s", storage_path, err)
+			continue
+		}
+		finode, ok := node.(*fileInode)
+		if !ok {
+			releaseInode(node)
+			continue
+		}
+		if fn(finode) {
+			m.recordUsage(storage_path, finode)
+			if err := finode.Close(); err != nil {
+				log.Printf("failed to close inode: %s", err)
+			}
+			continue
+		}
+		releaseInode(finode)
+	}
+}
+
+// Punch the given blocks out of the data file of an inode.
+func punchBlocks(storage_path string, blocks []uint64) {
+	file, err := os.OpenFile(storage_path+".data", os.O_RDWR, 0600)
+	if err != nil {
+		log.Printf("failed to open data file: %s", err)
+		return
+	}
+	defer file.Close()
+
+	for len(blocks) > 0 {
+		// punch runs of adjacent blocks at once
+		n := 1
+		for n < len(blocks) && blocks[n] == blocks[0]+uint64(n) {
+			n += 1
+		}
+		// FIXME: use proper constants once they are in syscall.
+		syscall.Fallocate(
+			int(file.Fd()),
+			0x2|0x1,
+			int64(blocks[0]*BLOCK_SIZE),
+			int64(n*BLOCK_SIZE),
+		)
+		blocks = blocks[n:]
+	}
+}
+
+// Return the lowest access counter at which at least nblocks blocks are
+// evictable according to hist, and how many of the blocks at that counter
+// need to be evicted on top of all blocks below it.
+func evictionThreshold(hist *[block_ACTR_MAX + 1]uint64, nblocks uint64) (actr uint8, budget uint64) {
+	var below uint64
+	ctr := 0
+	for ; ctr < block_ACTR_MAX; ctr++ {
+		if below+hist[ctr] >= nblocks {
+			break
+		}
+		below += hist[ctr]
+	}
+	return uint8(ctr), nblocks - below
+}
+
+// Evict up to nblocks clean blocks of files which are not open, least
+// accessed first, and release them. Pinned objects are reported if fewer than
+// needed blocks can be evicted.
+//
+// Only the files which have blocks to evict according to the usage index are
+// opened.
+//
+// Must be called with the lock held.
+func (m *FileCache) evictBlocks(nblocks uint64, needed uint64) {
+	if nblocks == 0 {
+		return
+	}
+
+	hist := m.evictableHistogram()
+	actr, budget := evictionThreshold(&hist, nblocks)
+	candidates := m.selectUsage(func(usage *inodeUsage) bool {
+		return usage.hasEvictable(actr)
+	})
+
+	var evicted uint64
+	m.forFileInodes(candidates, false, func(node *fileInode) bool {
+		if node.IsPinned() {
+			return false
+		}
+		blocks := node.evictColdBlocks(actr, &budget)
+		if len(blocks) == 0 {
+			return false
+		}
+		punchBlocks(node.storage_path, blocks)
+		evicted += uint64(len(blocks))
+		return true
+	})
+
+	log.Printf("evicted %d of %d requested blocks", evicted, nblocks)
+	m.ReleaseBlocks(evicted)
+	if evicted < needed {
+		m.reportPinnedExcess()
+	}
+}
+
+// Record that the inode at path has been used, for the eviction of inodes.
+//
+// The modification time of the inode file serves as the time of last use, so
+// that it persists without changing the inode.
+func (m *FileCache) touchInode(path string) {
+	now := time.Now()
+	os.Chtimes(m.getStoragePath(path, ""), now, now)
+}
+
+func (m *FileCache) addInodes(delta int) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	if delta < 0 && uint64(-delta) > m.quota.InodesUsed {
+		m.quota.InodesUsed = 0
+		return
+	}
+	m.quota.InodesUsed = uint64(int64(m.quota.InodesUsed) + int64(delta))
+}
+
+// Make room for a new inode at path, evicting the least recently used inodes
+// if the inode limit has been reached.
+//
+// Inodes are evicted in batches of a fraction of the limit, so that the tree
+// does not have to be walked for every new inode. Returns cache.ErrCacheFull
+// if not enough inodes can be evicted.
+//
+// Must be called with the lock held.
+func (m *FileCache) reserveInode(path string) error {
+	info := m.Quota()
+	if info.InodesTotal == 0 || info.InodesUsed < info.InodesTotal {
+		return nil
+	}
+
+	batch := info.InodesTotal / 64
+	if batch == 0 {
+		batch = 1
+	}
+	m.evictInodes(info.InodesUsed-info.InodesTotal+batch, path)
+
+	info = m.Quota()
+	if info.InodesUsed >= info.InodesTotal {
+		return cache.ErrCacheFull
+	}
+	return nil
+}
+
+// An inode which can be evicted without leaving dangling entries
+type leafInode struct {
+	path      string
+	last_used time.Time
+}
+
+// Release an inode which was opened for inspection only.
+func releaseInode(node inode) {
+	if finode, ok := node.(*fileInode); ok {
+		finode.ensureUnmapped()
+		finode.file.Close()
+	}
+}
+
+// Return whether the data of a file inode may be dropped: it must not be
+// open and must not hold modifications which the source does not have yet.
+//
+// Must be called with the lock of the inode held.
+func isEvictableFile(node *fileInode) bool {
+	return node.handle == nil && len(node.DirtyBlocks()) == 0
+}
+
+// Inspect the inode at path for eviction: return it as a leaf if it is an
+// object which is not a directory or a directory without children, unless it
+// is pinned or in keep. Otherwise, return the children of a directory.
+//
+// Must be called with the lock held.
+func (m *FileCache) inspectLeaf(path string, keep map[string]bool) (leaf leafInode, ok bool, children []string) {
+	err := m.peekInode(path, func(node inode) bool {
+		switch node := node.(type) {
+		case *dirInode:
+			children = append(children, node.children...)
+		case *fileInode:
+			if !isEvictableFile(node) {
+				return false
+			}
+		}
+		ok = len(children) == 0 && !keep[path] && !node.IsPinned()
+		return false
+	})
+	if err != nil || !ok {
+		return leafInode{}, false, children
+	}
+
+	info, err := os.Stat(m.getStoragePath(path, ""))
+	if err != nil {
+		return leafInode{}, false, nil
+	}
+	return leafInode{path, info.ModTime()}, true, nil
+}
+
+// Collect the inodes at and below path which can be evicted: objects which are
+// not directories and directories without children, unless they are pinned.
+// Inodes which are not reachable from the root are not found.
+//
+// Must be called with the lock held.
+func (m *FileCache) collectLeafInodes(path string, keep map[string]bool, result *[]leafInode) {
+	leaf, ok, children := m.inspectLeaf(path, keep)
+	for _, child := range children {
+		m.collectLeafInodes(path+"/"+child, keep, result)
+	}
+	if ok {
+		*result = append(*result, leaf)
+	}
+}
+
+// Take up to ninodes leaves from the queue of the last walk over the tree.
+//
+// Leaves which have been used, removed or have become unevictable since the
+// walk are dropped from the queue.
+//
+// Must be called with the lock held.
+func (m *FileCache) takeQueuedLeaves(ninodes uint64, keep map[string]bool) []leafInode {
+	var result []leafInode
+	for uint64(len(result)) < ninodes && len(m.evict_queue) > 0 {
+		queued := m.evict_queue[0]
+		m.evict_queue = m.evict_queue[1:]
+		leaf, ok, _ := m.inspectLeaf(queued.path, keep)
+		if ok && leaf.last_used.Equal(queued.last_used) {
+			result = append(result, leaf)
+		}
+	}
+	return result
+}
+
+// Evict up to ninodes of the least recently used inodes.
+//
+// Only leaves of the tree are evicted, after being removed from the listing of
+// their parent; directories become leaves once their children are evicted.
+// The inode at keep and its ancestors are never evicted.
+//
+// The leaves found by a walk over the tree are queued by their last use, and
+// later batches continue with the queue; the tree is only walked again once it
+// is used up.
+//
+// Must be called with the lock held.
+func (m *FileCache) evictInodes(ninodes uint64, keep string) {
+	keep_set := map[string]bool{"": true}
+	for path := keep; path != ""; path, _ = splitPath(path) {
+		keep_set[path] = true
+	}
+
+	var evicted uint64
+	walked := false
+	for evicted < ninodes {
+		leaves := m.takeQueuedLeaves(ninodes-evicted, keep_set)
+		if len(leaves) == 0 {
+			if walked {
+				break
+			}
+			var found []leafInode
+			m.collectLeafInodes("", keep_set, &found)
+			sort.Slice(found, func(i, j int) bool {
+				return found[i].last_used.Before(found[j].last_used)
+			})
+			m.evict_queue = found
+			walked = true
+			continue
+		}
+		// evicting leaves may turn their parents into leaves, which
+		// only a new walk finds
+		walked = false
+
+		// the listings must not name inodes which are gone, even
+		// after a crash
+		names := make(map[string][]string)
+		for _, leaf := range leaves {
+			parent_path, name := splitPath(leaf.path)
+			names[parent_path] = append(names[parent_path], name)
+		}
+		for parent_path, parent_names := range names {
+			m.peekInode(parent_path, func(node inode) bool {
+				dir_inode, ok := node.(*dirInode)
+				if !ok {
+					return false
+				}
+				changed := false
+				for _, name := range parent_names {
+					if dir_inode.removeChild(name) {
+						changed = true
+					}
+				}
+				return changed
+			})
+		}
+		for _, leaf := range leaves {
+			m.deleteInode(leaf.path)
+		}
+		evicted += uint64(len(leaves))
+	}
+
+	log.Printf("evicted %d of %d requested inodes", evicted, ninodes)
+	if evicted < ninodes {
+		m.reportPinnedExcess()
+	}
+}
+
+// Drop the cached data of the file at path or, recursively, of the files
+// below the directory at path, and return the number of blocks evicted.
+//
+// Metadata stays cached. Data of files which are open or pinned and data which
+// has not been written back to the source yet is kept.
+func (m *FileCache) Evict(path string) (uint64, layer.Error) {
+	path = normalizePath(path)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.peekInode(path, func(node inode) bool { return false }); err != nil {
+		return 0, layer.WrapError(err)
+	}
+	evicted := m.evictTree(path)
+	m.ReleaseBlocks(evicted)
+	return evicted, nil
+}
+
+// Must be called with the lock held.
+func (m *FileCache) evictTree(path string) (evicted uint64) {
+	var children []string
+	m.peekInode(path, func(node inode) bool {
+		switch node := node.(type) {
+		case *dirInode:
+			children = append(children, node.children...)
+		case *fileInode:
+			if node.handle != nil || node.IsPinned() {
+				return false
+			}
+			all := ^uint64(0)
+			blocks := node.evictColdBlocks(block_ACTR_MAX, &all)
+			if len(blocks) > 0 {
+				punchBlocks(node.storage_path, blocks)
+			}
+			evicted = uint64(len(blocks))
+		}
+		return evicted > 0
+	})
+
+	for _, child := range children {
+		evicted += m.evictTree(path + "/" + child)
+	}
+	return evicted
+}
@@ -0,0 +1,537 @@
+package filecache
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/cache"
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+// Cache nblocks of data at path and close the file again.
+func putBlocks(t *testing.T, file_cache *FileCache, path string, nblocks int) {
+	file_cache.PutAttr(path, &mockDirEntry{ModeV: syscall.S_IFREG})
+	f, err := file_cache.OpenFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, f.PutData(genData(4096*nblocks), 0, cache.QUOTA_BLOCK_PRIO_READ))
+	f.Close()
+}
+
+func isCached(t *testing.T, file_cache *FileCache, path string, block uint64) bool {
+	f, err := file_cache.OpenFile(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	buf := make([]byte, 4096)
+	n, _ := f.FetchData(buf, block*4096)
+	return n == 4096
+}
+
+func TestBlocksUsedIsCountedOnStartup(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	putBlocks(t, file_cache, "/foo", 2)
+	putBlocks(t, file_cache, "/bar", 1)
+	assert.Equal(t, uint64(3), file_cache.Quota().BlocksUsed)
+	file_cache.Close()
+
+	file_cache = openFileCache(dir)
+	assert.Equal(t, uint64(3), file_cache.Quota().BlocksUsed)
+
+	file_cache.PutNonExistant("/foo")
+	assert.Equal(t, uint64(1), file_cache.Quota().BlocksUsed)
+}
+
+func TestBlocksOfOpenFileAreReleasedOnClose(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	file_cache.PutAttr("/foo", &mockDirEntry{ModeV: syscall.S_IFREG})
+	f, err := file_cache.OpenFile("/foo")
+	assert.Nil(t, err)
+	assert.Nil(t, f.PutData(genData(4096*2), 0, cache.QUOTA_BLOCK_PRIO_READ))
+
+	file_cache.PutNonExistant("/foo")
+	assert.Equal(t, uint64(2), file_cache.Quota().BlocksUsed)
+	assert.Nil(t, f.PutData(genData(4096), 4096*2, cache.QUOTA_BLOCK_PRIO_READ))
+	assert.Equal(t, uint64(3), file_cache.Quota().BlocksUsed)
+
+	f.Close()
+	assert.Equal(t, uint64(0), file_cache.Quota().BlocksUsed)
+}
+
+func TestRequestBlocksEvictsColdBlocks(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.SetBlocksTotal(4)
+
+	putBlocks(t, file_cache, "/cold", 2)
+	putBlocks(t, file_cache, "/hot", 2)
+	for i := 0; i < 3; i++ {
+		isCached(t, file_cache, "/hot", 0)
+		isCached(t, file_cache, "/hot", 1)
+	}
+	isCached(t, file_cache, "/cold", 1)
+
+	putBlocks(t, file_cache, "/new", 1)
+	assert.Equal(t, uint64(4), file_cache.Quota().BlocksUsed)
+	assert.False(t, isCached(t, file_cache, "/cold", 0))
+	assert.True(t, isCached(t, file_cache, "/cold", 1))
+	assert.True(t, isCached(t, file_cache, "/hot", 0))
+	assert.True(t, isCached(t, file_cache, "/hot", 1))
+	assert.True(t, isCached(t, file_cache, "/new", 0))
+
+	attr, err := file_cache.FetchAttr("/cold")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), attr.Blocks())
+}
+
+func TestPutOfCachedDataDoesNotEvict(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.SetBlocksTotal(2)
+	putBlocks(t, file_cache, "/other", 1)
+
+	file_cache.PutAttr("/foo", &mockDirEntry{ModeV: syscall.S_IFREG})
+	f, err := file_cache.OpenFile("/foo")
+	assert.Nil(t, err)
+	defer f.Close()
+	data := genData(4096)
+	assert.Nil(t, f.PutData(data, 0, cache.QUOTA_BLOCK_PRIO_READ))
+	assert.Nil(t, f.PutData(data, 0, cache.QUOTA_BLOCK_PRIO_READ))
+
+	assert.Equal(t, uint64(2), file_cache.Quota().BlocksUsed)
+	assert.True(t, isCached(t, file_cache, "/other", 0))
+}
+
+func TestBlocksAreEvictedInBatches(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.SetBlocksTotal(128)
+	putBlocks(t, file_cache, "/foo", 128)
+
+	// one block is needed, two more are evicted as batch
+	putBlocks(t, file_cache, "/new", 1)
+	assert.Equal(t, uint64(126), file_cache.Quota().BlocksUsed)
+
+	assert.Equal(t, uint64(2), file_cache.RequestBlocks(2, cache.QUOTA_BLOCK_PRIO_READAHEAD))
+}
+
+func TestEvictionThresholdEvictsOnlyUnusedCounterFirst(t *testing.T) {
+	var hist [block_ACTR_MAX + 1]uint64
+	hist[0] = 3
+	hist[1] = 2
+
+	actr, budget := evictionThreshold(&hist, 2)
+	assert.Equal(t, uint8(0), actr)
+	assert.Equal(t, uint64(2), budget)
+
+	actr, budget = evictionThreshold(&hist, 4)
+	assert.Equal(t, uint8(1), actr)
+	assert.Equal(t, uint64(1), budget)
+
+	actr, budget = evictionThreshold(&hist, 10)
+	assert.Equal(t, uint8(block_ACTR_MAX), actr)
+	assert.Equal(t, uint64(5), budget)
+}
+
+func TestColdBlocksAreEvictedAfterRestart(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	putBlocks(t, file_cache, "/cold", 1)
+	putBlocks(t, file_cache, "/hot", 1)
+	for i := 0; i < 3; i++ {
+		isCached(t, file_cache, "/hot", 0)
+	}
+	file_cache.Close()
+
+	file_cache = openFileCache(dir)
+	defer file_cache.Close()
+	file_cache.SetBlocksTotal(2)
+	putBlocks(t, file_cache, "/new", 1)
+	assert.Equal(t, uint64(2), file_cache.Quota().BlocksUsed)
+	assert.False(t, isCached(t, file_cache, "/cold", 0))
+	assert.True(t, isCached(t, file_cache, "/hot", 0))
+}
+
+func TestDirtyAndOpenBlocksAreNotEvicted(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.SetBlocksTotal(2)
+
+	file_cache.PutAttr("/dirty", &mockDirEntry{ModeV: syscall.S_IFREG})
+	f, err := file_cache.OpenFile("/dirty")
+	assert.Nil(t, err)
+	assert.Nil(t, f.WriteData(genData(4096), 0))
+	f.Close()
+
+	file_cache.PutAttr("/open", &mockDirEntry{ModeV: syscall.S_IFREG})
+	open, err := file_cache.OpenFile("/open")
+	assert.Nil(t, err)
+	defer open.Close()
+	assert.Nil(t, open.PutData(genData(4096), 0, cache.QUOTA_BLOCK_PRIO_READ))
+
+	file_cache.PutAttr("/new", &mockDirEntry{ModeV: syscall.S_IFREG})
+	f, err = file_cache.OpenFile("/new")
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Equal(t, cache.ErrCacheFull, f.PutData(genData(4096), 0, cache.QUOTA_BLOCK_PRIO_READ))
+	assert.Equal(t, cache.ErrCacheFull, f.WriteData(genData(4096), 0))
+	assert.Equal(t, uint64(2), file_cache.Quota().BlocksUsed)
+
+	assert.True(t, isCached(t, file_cache, "/dirty", 0))
+	assert.True(t, isCached(t, file_cache, "/open", 0))
+}
+
+func TestReadAheadDoesNotEvict(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.SetBlocksTotal(2)
+	putBlocks(t, file_cache, "/foo", 1)
+
+	assert.Equal(t, uint64(1), file_cache.RequestBlocks(2, cache.QUOTA_BLOCK_PRIO_READAHEAD))
+	assert.True(t, isCached(t, file_cache, "/foo", 0))
+	file_cache.ReleaseBlocks(1)
+
+	assert.Equal(t, uint64(2), file_cache.RequestBlocks(2, cache.QUOTA_BLOCK_PRIO_READ))
+	assert.False(t, isCached(t, file_cache, "/foo", 0))
+}
+
+func TestSetBlocksTotalEvictsExcessBlocks(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	putBlocks(t, file_cache, "/foo", 3)
+
+	file_cache.SetBlocksTotal(1)
+	assert.Equal(t, uint64(1), file_cache.Quota().BlocksUsed)
+
+	attr, err := file_cache.FetchAttr("/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), attr.Blocks())
+}
+
+func TestInodesUsedIsCountedOnStartup(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+		&mockDirEntry{NameV: "bar", ModeV: syscall.S_IFDIR},
+	})
+	file_cache.PutLink("/bar/baz", "/foo")
+	assert.Equal(t, uint64(4), file_cache.Quota().InodesUsed)
+	file_cache.Close()
+
+	file_cache = openFileCache(dir)
+	assert.Equal(t, uint64(4), file_cache.Quota().InodesUsed)
+
+	file_cache.PutNonExistant("/bar")
+	assert.Equal(t, uint64(2), file_cache.Quota().InodesUsed)
+}
+
+func TestInodeQuotaEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+	file_cache.SetInodesTotal(3)
+
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+		&mockDirEntry{NameV: "bar", ModeV: syscall.S_IFREG},
+	})
+	past := time.Now().Add(-time.Hour)
+	for _, path := range []string{"", "/foo", "/bar"} {
+		os.Chtimes(file_cache.getStoragePath(path, ""), past, past)
+	}
+	_, err := file_cache.FetchAttr("/foo")
+	assert.Nil(t, err)
+
+	file_cache.PutAttr("/baz", &mockDirEntry{ModeV: syscall.S_IFREG})
+	assert.Equal(t, uint64(3), file_cache.Quota().InodesUsed)
+	assert.Equal(t, []string{"foo", "baz"}, fetchDirNames(t, file_cache, "/"))
+
+	_, err = file_cache.FetchAttr("/bar")
+	assert.NotNil(t, err)
+}
+
+func TestInodeEvictionContinuesWithQueuedLeaves(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	names := []string{"a", "b", "c", "d"}
+	var entries []layer.DirEntry
+	for _, name := range names {
+		entries = append(entries, &mockDirEntry{NameV: name, ModeV: syscall.S_IFREG})
+	}
+	file_cache.PutDir("/", entries)
+	for i, name := range names {
+		past := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(file_cache.getStoragePath("/"+name, ""), past, past)
+	}
+	file_cache.SetInodesTotal(5)
+
+	file_cache.PutAttr("/e", &mockDirEntry{ModeV: syscall.S_IFREG})
+	assert.Equal(t, []string{"b", "c", "d", "e"}, fetchDirNames(t, file_cache, "/"))
+	assert.Equal(t, 3, len(file_cache.evict_queue))
+
+	// a queued leaf which has been used since is left to the next walk
+	_, err := file_cache.FetchAttr("/b")
+	assert.Nil(t, err)
+	file_cache.PutAttr("/f", &mockDirEntry{ModeV: syscall.S_IFREG})
+	assert.Equal(t, []string{"b", "d", "e", "f"}, fetchDirNames(t, file_cache, "/"))
+	assert.Equal(t, 1, len(file_cache.evict_queue))
+}
+
+func TestInodeQuotaKeepsDirtyFiles(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+	file_cache.SetInodesTotal(2)
+
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+	f, err := file_cache.OpenFile("/foo")
+	assert.Nil(t, err)
+	assert.Nil(t, f.WriteData(genData(4096), 0))
+	f.Close()
+
+	file_cache.PutAttr("/bar", &mockDirEntry{ModeV: syscall.S_IFREG})
+	_, err = file_cache.FetchAttr("/bar")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"foo"}, fetchDirNames(t, file_cache, "/"))
+	assert.True(t, isCached(t, file_cache, "/foo", 0))
+}
+
+func TestSetInodesTotalEvictsSubtrees(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "dir", ModeV: syscall.S_IFDIR},
+	})
+	file_cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+	assert.Equal(t, uint64(3), file_cache.Quota().InodesUsed)
+
+	file_cache.SetInodesTotal(1)
+	assert.Equal(t, uint64(1), file_cache.Quota().InodesUsed)
+	assert.Equal(t, []string{}, fetchDirNames(t, file_cache, "/"))
+	file_cache.Close()
+
+	// the listing on disk must not name the evicted directory
+	file_cache = openFileCache(dir)
+	defer file_cache.Close()
+	assert.Equal(t, []string{}, fetchDirNames(t, file_cache, "/"))
+}
+
+func TestPinnedBlocksAreNotEvicted(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+	file_cache.SetBlocksTotal(2)
+
+	putBlocks(t, file_cache, "/pinned", 1)
+	assert.Nil(t, file_cache.Pin("/pinned"))
+	putBlocks(t, file_cache, "/hot", 1)
+	for i := 0; i < 4; i++ {
+		isCached(t, file_cache, "/hot", 0)
+	}
+
+	putBlocks(t, file_cache, "/new", 1)
+	assert.True(t, isCached(t, file_cache, "/pinned", 0))
+	assert.False(t, isCached(t, file_cache, "/hot", 0))
+
+	blocks, inodes := file_cache.PinnedUsage()
+	assert.Equal(t, uint64(1), blocks)
+	assert.Equal(t, uint64(1), inodes)
+}
+
+func TestPinIsInheritedByNewChildren(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "dir", ModeV: syscall.S_IFDIR},
+	})
+	assert.Nil(t, file_cache.Pin("/dir"))
+	file_cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+
+	file_cache.SetInodesTotal(1)
+	assert.Equal(t, uint64(3), file_cache.Quota().InodesUsed)
+	assert.Equal(t, []string{"foo"}, fetchDirNames(t, file_cache, "/dir"))
+
+	assert.Nil(t, file_cache.Unpin("/dir"))
+	file_cache.SetInodesTotal(1)
+	assert.Equal(t, uint64(1), file_cache.Quota().InodesUsed)
+
+	assert.NotNil(t, file_cache.Pin("/dir"))
+}
+
+func TestEvictDropsDataBelowPath(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "dir", ModeV: syscall.S_IFDIR},
+		&mockDirEntry{NameV: "other", ModeV: syscall.S_IFREG},
+	})
+	file_cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+		&mockDirEntry{NameV: "pinned", ModeV: syscall.S_IFREG},
+	})
+	putBlocks(t, file_cache, "/dir/foo", 2)
+	putBlocks(t, file_cache, "/dir/pinned", 1)
+	putBlocks(t, file_cache, "/other", 1)
+	assert.Nil(t, file_cache.Pin("/dir/pinned"))
+
+	evicted, err := file_cache.Evict("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), evicted)
+	assert.Equal(t, uint64(2), file_cache.Quota().BlocksUsed)
+	assert.False(t, isCached(t, file_cache, "/dir/foo", 0))
+	assert.True(t, isCached(t, file_cache, "/dir/pinned", 0))
+	assert.True(t, isCached(t, file_cache, "/other", 0))
+
+	_, err = file_cache.FetchAttr("/dir/foo")
+	assert.Nil(t, err)
+}
+
+func TestUsageCountsCachedBytesBelowPath(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "dir", ModeV: syscall.S_IFDIR},
+	})
+	file_cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+		&mockDirEntry{NameV: "bar", ModeV: syscall.S_IFREG},
+	})
+	putBlocks(t, file_cache, "/dir/foo", 2)
+
+	file_cache.PutAttr("/dir/bar", &mockDirEntry{ModeV: syscall.S_IFREG, SizeV: 10000})
+	f, err := file_cache.OpenFile("/dir/bar")
+	assert.Nil(t, err)
+	assert.Nil(t, f.PutData(genData(10000-8192), 8192, cache.QUOTA_BLOCK_PRIO_READ))
+	f.Close()
+
+	cached, size, err := file_cache.Usage("/dir/bar")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10000-8192), cached)
+	assert.Equal(t, uint64(10000), size)
+
+	cached, size, err = file_cache.Usage("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192+10000-8192), cached)
+	assert.Equal(t, uint64(8192+10000), size)
+
+	_, _, err = file_cache.Usage("/missing")
+	assert.NotNil(t, err)
+}
+
+func TestTreeOperationsDoNotLoadInodes(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "dir", ModeV: syscall.S_IFDIR},
+	})
+	file_cache.PutDir("/dir", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+	putBlocks(t, file_cache, "/dir/foo", 2)
+	file_cache.Close()
+
+	file_cache = openFileCache(dir)
+	cached, _, err := file_cache.Usage("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192), cached)
+	assert.Nil(t, file_cache.Pin("/"))
+	evicted, err := file_cache.Evict("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), evicted)
+	assert.Nil(t, file_cache.Unpin("/"))
+	evicted, err = file_cache.Evict("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), evicted)
+	assert.Equal(t, 0, len(file_cache.inodes))
+	assert.Equal(t, uint64(0), file_cache.Quota().BlocksUsed)
+	file_cache.Close()
+
+	file_cache = openFileCache(dir)
+	defer file_cache.Close()
+	cached, _, err = file_cache.Usage("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), cached)
+}
+
+func TestIsPinned(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	file_cache := openFileCache(dir)
+	defer file_cache.Close()
+
+	file_cache.PutDir("/", []layer.DirEntry{
+		&mockDirEntry{NameV: "foo", ModeV: syscall.S_IFREG},
+	})
+
+	pinned, err := file_cache.IsPinned("/foo")
+	assert.Nil(t, err)
+	assert.False(t, pinned)
+
+	assert.Nil(t, file_cache.Pin("/foo"))
+	pinned, err = file_cache.IsPinned("/foo")
+	assert.Nil(t, err)
+	assert.True(t, pinned)
+
+	_, err = file_cache.IsPinned("/missing")
+	assert.NotNil(t, err)
+}
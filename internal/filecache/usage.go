@@ -0,0 +1,214 @@
+package filecache
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// What the accounting and the eviction of blocks need to know about an inode.
+//
+// The usage of all inodes is kept in memory, indexed by their storage path, so
+// that the cache does not have to be walked whenever blocks are evicted.
+type inodeUsage struct {
+	pinned bool
+	// Open files are never evicted; their usage is updated when the last
+	// handle is closed
+	open   bool
+	blocks uint64
+	// The number of clean, available blocks by their access counter
+	evictable map[uint8]uint64
+}
+
+// Return the usage of an inode; the lock of the inode must be held.
+func usageOf(node inode) *inodeUsage {
+	result := &inodeUsage{pinned: node.IsPinned()}
+	if finode, ok := node.(*fileInode); ok {
+		result.open = finode.handle != nil
+		result.blocks = finode.blocks_used
+		result.evictable = finode.countEvictable()
+	}
+	return result
+}
+
+// Whether blocks of the inode would be evicted at the access counter actr.
+func (m *inodeUsage) hasEvictable(actr uint8) bool {
+	if m.pinned || m.open {
+		return false
+	}
+	for ctr := range m.evictable {
+		if ctr <= actr {
+			return true
+		}
+	}
+	return false
+}
+
+// Call fn for the storage path of every inode in the cache.
+//
+// Inodes are stored two directory levels below the root; files with a suffix
+// (data, extended attributes, temporary files) are skipped.
+func (m *FileCache) walkInodes(fn func(storage_path string)) {
+	filepath.Walk(m.root_dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(m.root_dir, path)
+		if err != nil || strings.Count(rel, string(filepath.Separator)) != 2 {
+			return nil
+		}
+		if strings.Contains(info.Name(), ".") {
+			return nil
+		}
+		fn(path)
+		return nil
+	})
+}
+
+// Read the usage of the inode at storage_path without loading it.
+//
+// Only the header is read, unless the inode is a file with cached blocks.
+func readInodeUsage(storage_path string) (*inodeUsage, error) {
+	file, err := os.Open(storage_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var base baseInode
+	if err := base.read(file); err != nil {
+		return nil, err
+	}
+	if base.mode&syscall.S_IFMT != syscall.S_IFREG {
+		return &inodeUsage{pinned: base.IsPinned()}, nil
+	}
+
+	var header fileInode
+	if err := header.readFileData(file); err != nil {
+		return nil, err
+	}
+	if header.blocks_used == 0 {
+		return &inodeUsage{pinned: base.IsPinned()}, nil
+	}
+
+	node, err := openInode(storage_path)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseInode(node)
+	return usageOf(node), nil
+}
+
+// Build the index of the usage of all inodes by walking the cache.
+//
+// Inodes which cannot be read count as inodes without blocks.
+func (m *FileCache) loadUsage() {
+	m.inode_usage = make(map[string]*inodeUsage)
+	m.walkInodes(func(storage_path string) {
+		usage, err := readInodeUsage(storage_path)
+		if err != nil {
+			log.Printf("failed to read inode %s: %s", storage_path, err)
+			usage = &inodeUsage{}
+		}
+		m.inode_usage[storage_path] = usage
+	})
+}
+
+// Update the usage of the inode stored at storage_path; the lock of the inode
+// must be held.
+func (m *FileCache) recordUsage(storage_path string, node inode) {
+	usage := usageOf(node)
+
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+	m.inode_usage[storage_path] = usage
+}
+
+func (m *FileCache) forgetUsage(storage_path string) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+	delete(m.inode_usage, storage_path)
+}
+
+func (m *FileCache) moveUsage(old_storage_path string, new_storage_path string) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+	if usage, ok := m.inode_usage[old_storage_path]; ok {
+		delete(m.inode_usage, old_storage_path)
+		m.inode_usage[new_storage_path] = usage
+	}
+}
+
+// Mark the file stored at storage_path as open, so that it is not evicted.
+func (m *FileCache) markOpen(storage_path string) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+	if usage, ok := m.inode_usage[storage_path]; ok {
+		usage.open = true
+	}
+}
+
+// Called with the lock of the inode held when the last handle of a file is
+// closed.
+//
+// The blocks of a file which was removed from the cache while it was open are
+// released now.
+func (m *FileCache) fileClosed(node *fileInode) {
+	if node.deleted {
+		m.ReleaseBlocks(node.blocks_used)
+		return
+	}
+	m.recordUsage(node.storage_path, node)
+}
+
+// Return the storage paths of the inodes for which filter returns true.
+func (m *FileCache) selectUsage(filter func(usage *inodeUsage) bool) []string {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	var result []string
+	for storage_path, usage := range m.inode_usage {
+		if filter(usage) {
+			result = append(result, storage_path)
+		}
+	}
+	return result
+}
+
+// Count the inodes in the cache and sum up the blocks used by the file
+// inodes, either of all inodes or of the pinned ones only.
+//
+// Files which are open are counted with the blocks they had when they were
+// opened.
+func (m *FileCache) countUsage(pinned_only bool) (blocks uint64, inodes uint64) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	for _, usage := range m.inode_usage {
+		if pinned_only && !usage.pinned {
+			continue
+		}
+		inodes += 1
+		blocks += usage.blocks
+	}
+	return blocks, inodes
+}
+
+// Sum up the evictable blocks of the files which are neither pinned nor open,
+// by their access counter.
+func (m *FileCache) evictableHistogram() (hist [block_ACTR_MAX + 1]uint64) {
+	m.quota_lock.Lock()
+	defer m.quota_lock.Unlock()
+
+	for _, usage := range m.inode_usage {
+		if usage.pinned || usage.open {
+			continue
+		}
+		for ctr, n := range usage.evictable {
+			hist[ctr] += n
+		}
+	}
+	return hist
+}
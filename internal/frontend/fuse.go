@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
@@ -9,7 +11,8 @@ import (
 
 type DragonStashFS struct {
 	pathfs.FileSystem
-	fs layer.FileSystem
+	fs      layer.FileSystem
+	control Control
 }
 
 func NewDragonStashFS(fs layer.FileSystem) *DragonStashFS {
@@ -26,13 +29,19 @@ func (m *DragonStashFS) GetAttr(path string, context *fuse.Context) (*fuse.Attr,
 	}
 
 	return &fuse.Attr{
-		Mode:   stat.Mode(),
-		Blocks: stat.Blocks(),
-		Mtime:  stat.Mtime(),
-		Atime:  stat.Atime(),
-		Ctime:  stat.Ctime(),
-		Owner:  fuse.Owner{stat.OwnerUID(), stat.OwnerGID()},
-		Size:   stat.Size(),
+		Ino:       stat.Ino(),
+		Nlink:     stat.Nlink(),
+		Mode:      stat.Mode(),
+		Blocks:    stat.Blocks(),
+		Mtime:     stat.Mtime(),
+		Atime:     stat.Atime(),
+		Ctime:     stat.Ctime(),
+		Mtimensec: stat.MtimeNsec(),
+		Atimensec: stat.AtimeNsec(),
+		Ctimensec: stat.CtimeNsec(),
+		Owner:     fuse.Owner{stat.OwnerUID(), stat.OwnerGID()},
+		Size:      stat.Size(),
+		Rdev:      uint32(stat.Rdev()),
 	}, fuse.OK
 }
 
@@ -70,6 +79,85 @@ func (m *DragonStashFS) Open(path string, flags uint32, context *fuse.Context) (
 	return wrapFile(result), fuse.OK
 }
 
+func (m *DragonStashFS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	result, err := m.fs.Create(path, int(flags), mode)
+	if err != nil {
+		return nil, fuse.Status(err.Errno())
+	}
+
+	return wrapFile(result), fuse.OK
+}
+
+func (m *DragonStashFS) Mkdir(path string, mode uint32, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Mkdir(path, mode))
+}
+
+func (m *DragonStashFS) Unlink(path string, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Unlink(path))
+}
+
+func (m *DragonStashFS) Rmdir(path string, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Rmdir(path))
+}
+
+func (m *DragonStashFS) Rename(oldpath string, newpath string, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Rename(oldpath, newpath))
+}
+
+func (m *DragonStashFS) Symlink(target string, path string, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Symlink(target, path))
+}
+
+func (m *DragonStashFS) Chmod(path string, mode uint32, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Chmod(path, mode))
+}
+
+func (m *DragonStashFS) Chown(path string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Chown(path, uid, gid))
+}
+
+func (m *DragonStashFS) Truncate(path string, size uint64, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Truncate(path, size))
+}
+
+func (m *DragonStashFS) Utimens(path string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return toStatus(m.fs.Utimens(path, atime, mtime))
+}
+
+func (m *DragonStashFS) GetXAttr(path string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if m.control != nil && isVirtualXattr(attribute) {
+		return m.getVirtualXattr(path, attribute)
+	}
+	value, err := m.fs.Getxattr(path, attribute)
+	return value, toStatus(err)
+}
+
+func (m *DragonStashFS) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Status) {
+	names, err := m.fs.Listxattr(path)
+	return names, toStatus(err)
+}
+
+func (m *DragonStashFS) SetXAttr(path string, attribute string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if m.control != nil && isVirtualXattr(attribute) {
+		return m.setVirtualXattr(path, attribute, data)
+	}
+	return toStatus(m.fs.Setxattr(path, attribute, data, flags))
+}
+
+func (m *DragonStashFS) RemoveXAttr(path string, attribute string, context *fuse.Context) fuse.Status {
+	if m.control != nil && isVirtualXattr(attribute) {
+		return fuse.EPERM
+	}
+	return toStatus(m.fs.Removexattr(path, attribute))
+}
+
+func toStatus(err layer.Error) fuse.Status {
+	if err != nil {
+		return fuse.Status(err.Errno())
+	}
+	return fuse.OK
+}
+
 type DragonStashFile struct {
 	nodefs.File
 	file layer.File
@@ -89,3 +177,39 @@ func (m *DragonStashFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.St
 	}
 	return fuse.ReadResultData(dest[:n]), fuse.OK
 }
+
+func (m *DragonStashFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, err := m.file.Write(data, off)
+	return uint32(n), toStatus(err)
+}
+
+func (m *DragonStashFile) Fsync(flags int) fuse.Status {
+	return toStatus(m.file.Sync())
+}
+
+func (m *DragonStashFile) Truncate(size uint64) fuse.Status {
+	return toStatus(m.file.Truncate(size))
+}
+
+func (m *DragonStashFile) Chmod(mode uint32) fuse.Status {
+	return toStatus(m.file.Chmod(mode))
+}
+
+func (m *DragonStashFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return toStatus(m.file.Chown(uid, gid))
+}
+
+func (m *DragonStashFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return toStatus(m.file.Utimens(atime, mtime))
+}
+
+// BSD locks are passed on. The version of the FUSE library in use has no hooks
+// for POSIX record locks yet, so the kernel handles those locally; the layers
+// pass them on with GetLk and SetLk.
+func (m *DragonStashFile) Flock(flags int) fuse.Status {
+	return toStatus(m.file.Flock(flags))
+}
+
+func (m *DragonStashFile) Release() {
+	m.file.Release()
+}
@@ -0,0 +1,95 @@
+package frontend
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	xattr_PREFIX         = "user.dragonstash."
+	xattr_CACHED_BYTES   = xattr_PREFIX + "cached_bytes"
+	xattr_CACHED_PERCENT = xattr_PREFIX + "cached_percent"
+	xattr_PINNED         = xattr_PREFIX + "pinned"
+	xattr_SOURCE_STATE   = xattr_PREFIX + "source_state"
+	xattr_ACTION         = xattr_PREFIX + "action"
+)
+
+// The cache management behind the user.dragonstash.* extended attributes, as
+// implemented by control.Local
+type Control interface {
+	Fetch(path string) layer.Error
+	Evict(path string) layer.Error
+	Pin(path string) layer.Error
+	Unpin(path string) layer.Error
+	IsPinned(path string) (bool, layer.Error)
+	Usage(path string) (cached uint64, size uint64, err layer.Error)
+	SourceState() string
+}
+
+// Serve the user.dragonstash.* extended attributes from control.
+//
+// The attributes are virtual: they are not listed and are never passed on to
+// the source. user.dragonstash.cached_bytes, cached_percent, pinned and
+// source_state can be read; writing fetch, evict, pin or unpin to
+// user.dragonstash.action runs that operation on the path.
+func (m *DragonStashFS) SetControl(control Control) {
+	m.control = control
+}
+
+func isVirtualXattr(attribute string) bool {
+	return strings.HasPrefix(attribute, xattr_PREFIX)
+}
+
+func (m *DragonStashFS) getVirtualXattr(path string, attribute string) ([]byte, fuse.Status) {
+	var value string
+	switch attribute {
+	case xattr_CACHED_BYTES, xattr_CACHED_PERCENT:
+		cached, size, err := m.control.Usage(path)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if attribute == xattr_CACHED_BYTES {
+			value = fmt.Sprintf("%d", cached)
+		} else if size == 0 {
+			value = "100"
+		} else {
+			value = fmt.Sprintf("%d", cached*100/size)
+		}
+	case xattr_PINNED:
+		pinned, err := m.control.IsPinned(path)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		value = "0"
+		if pinned {
+			value = "1"
+		}
+	case xattr_SOURCE_STATE:
+		value = m.control.SourceState()
+	default:
+		return nil, fuse.Status(syscall.ENODATA)
+	}
+	return []byte(value), fuse.OK
+}
+
+func (m *DragonStashFS) setVirtualXattr(path string, attribute string, data []byte) fuse.Status {
+	if attribute != xattr_ACTION {
+		return fuse.EPERM
+	}
+
+	switch strings.TrimSpace(string(data)) {
+	case "fetch":
+		return toStatus(m.control.Fetch(path))
+	case "evict":
+		return toStatus(m.control.Evict(path))
+	case "pin":
+		return toStatus(m.control.Pin(path))
+	case "unpin":
+		return toStatus(m.control.Unpin(path))
+	}
+	return fuse.EINVAL
+}
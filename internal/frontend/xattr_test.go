@@ -0,0 +1,95 @@
+package frontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeControl struct {
+	actions []string
+	pinned  bool
+}
+
+func (m *fakeControl) Fetch(path string) layer.Error {
+	m.actions = append(m.actions, "fetch "+path)
+	return nil
+}
+
+func (m *fakeControl) Evict(path string) layer.Error {
+	m.actions = append(m.actions, "evict "+path)
+	return nil
+}
+
+func (m *fakeControl) Pin(path string) layer.Error {
+	m.pinned = true
+	return nil
+}
+
+func (m *fakeControl) Unpin(path string) layer.Error {
+	m.pinned = false
+	return nil
+}
+
+func (m *fakeControl) IsPinned(path string) (bool, layer.Error) {
+	if path == "missing" {
+		return false, layer.WrapError(syscall.ENOENT)
+	}
+	return m.pinned, nil
+}
+
+func (m *fakeControl) Usage(path string) (uint64, uint64, layer.Error) {
+	return 1000, 3000, nil
+}
+
+func (m *fakeControl) SourceState() string {
+	return "offline"
+}
+
+func newTestFS() (*DragonStashFS, *fakeControl) {
+	control := &fakeControl{}
+	fs := NewDragonStashFS(layer.NewDefaultFileSystem())
+	fs.SetControl(control)
+	return fs, control
+}
+
+func TestReadVirtualXattrs(t *testing.T) {
+	fs, _ := newTestFS()
+
+	value, status := fs.GetXAttr("foo", "user.dragonstash.cached_bytes", nil)
+	assert.Equal(t, fuse.OK, status)
+	assert.Equal(t, "1000", string(value))
+
+	value, status = fs.GetXAttr("foo", "user.dragonstash.cached_percent", nil)
+	assert.Equal(t, fuse.OK, status)
+	assert.Equal(t, "33", string(value))
+
+	value, status = fs.GetXAttr("foo", "user.dragonstash.source_state", nil)
+	assert.Equal(t, fuse.OK, status)
+	assert.Equal(t, "offline", string(value))
+
+	_, status = fs.GetXAttr("foo", "user.dragonstash.unknown", nil)
+	assert.Equal(t, fuse.Status(syscall.ENODATA), status)
+
+	_, status = fs.GetXAttr("missing", "user.dragonstash.pinned", nil)
+	assert.Equal(t, fuse.Status(syscall.ENOENT), status)
+}
+
+func TestActionXattrRunsOperation(t *testing.T) {
+	fs, control := newTestFS()
+
+	assert.Equal(t, fuse.OK, fs.SetXAttr("foo", "user.dragonstash.action", []byte("pin"), 0, nil))
+	value, _ := fs.GetXAttr("foo", "user.dragonstash.pinned", nil)
+	assert.Equal(t, "1", string(value))
+
+	assert.Equal(t, fuse.OK, fs.SetXAttr("foo", "user.dragonstash.action", []byte("fetch"), 0, nil))
+	assert.Equal(t, fuse.OK, fs.SetXAttr("bar", "user.dragonstash.action", []byte("evict\n"), 0, nil))
+	assert.Equal(t, []string{"fetch foo", "evict bar"}, control.actions)
+
+	assert.Equal(t, fuse.EINVAL, fs.SetXAttr("foo", "user.dragonstash.action", []byte("explode"), 0, nil))
+	assert.Equal(t, fuse.EPERM, fs.SetXAttr("foo", "user.dragonstash.pinned", []byte("0"), 0, nil))
+	assert.Equal(t, fuse.EPERM, fs.RemoveXAttr("foo", "user.dragonstash.action", nil))
+}
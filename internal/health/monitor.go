@@ -0,0 +1,547 @@
+package health
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+type State int
+
+const (
+	STATE_OFFLINE State = iota
+	STATE_ONLINE
+)
+
+func (m State) String() string {
+	switch m {
+	case STATE_OFFLINE:
+		return "offline"
+	case STATE_ONLINE:
+		return "online"
+	}
+	return "unknown"
+}
+
+// A transition of the source state
+type Event struct {
+	State State
+	Time  time.Time
+}
+
+const (
+	event_QUEUE_LENGTH = 8
+)
+
+type Config struct {
+	// Interval between probes while the source is online
+	ProbeInterval time.Duration
+
+	// Initial interval between probes while the source is offline; the
+	// interval is doubled after each failed probe, up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Number of consecutive successes needed to go online
+	RiseThreshold int
+
+	// Number of consecutive failures needed to go offline
+	FallThreshold int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ProbeInterval: 30 * time.Second,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+		RiseThreshold: 2,
+		FallThreshold: 2,
+	}
+}
+
+// A Monitor wraps a layer.FileSystem and tracks whether it is reachable.
+//
+// The state is derived from periodic probes and from the results of the
+// operations passed through the Monitor. A state change requires several
+// consecutive successes or failures, so that a flapping link does not cause
+// the state to flap along with it.
+//
+// IsReady() reports the tracked state and never blocks on the source.
+type Monitor struct {
+	fs     layer.FileSystem
+	config Config
+
+	lock        *sync.Mutex
+	state       State
+	initialized bool
+	// If forced is set, forced_state is reported instead of state
+	forced       bool
+	forced_state State
+	successes    int
+	failures     int
+	backoff      time.Duration
+	subscribers  []chan Event
+
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func NewMonitor(fs layer.FileSystem, config *Config) *Monitor {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	return &Monitor{
+		fs:      fs,
+		config:  *config,
+		lock:    new(sync.Mutex),
+		state:   STATE_OFFLINE,
+		backoff: config.MinBackoff,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Probe the source once to determine the initial state and start probing in
+// the background.
+func (m *Monitor) Start() {
+	m.record(m.probe())
+
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go m.run()
+}
+
+// Stop background probing.
+//
+// The state is frozen at its current value.
+func (m *Monitor) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.stopped
+	m.stop = nil
+}
+
+func (m *Monitor) State() State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.effectiveState()
+}
+
+// Must be called with the lock held
+func (m *Monitor) effectiveState() State {
+	if m.forced {
+		return m.forced_state
+	}
+	return m.state
+}
+
+// Report state instead of the tracked state until Unforce is called.
+//
+// Probing continues in the background, so that the tracked state is up to
+// date when the override is lifted.
+func (m *Monitor) Force(state State) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old := m.effectiveState()
+	m.forced = true
+	m.forced_state = state
+	log.Printf("health: source forced %s", state)
+	m.publishChange(old)
+}
+
+// Report the tracked state again.
+func (m *Monitor) Unforce() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old := m.effectiveState()
+	m.forced = false
+	log.Printf("health: source state no longer forced")
+	m.publishChange(old)
+}
+
+// Return whether the state is forced by Force.
+func (m *Monitor) IsForced() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.forced
+}
+
+// Publish a transition if the reported state differs from old.
+//
+// Must be called with the lock held
+func (m *Monitor) publishChange(old State) {
+	if state := m.effectiveState(); state != old {
+		m.publish(Event{
+			State: state,
+			Time:  time.Now(),
+		})
+	}
+}
+
+// Subscribe to state transitions.
+//
+// If the subscriber falls behind, older events are dropped in favour of newer
+// ones; the most recent transition is always delivered.
+func (m *Monitor) Subscribe() <-chan Event {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ch := make(chan Event, event_QUEUE_LENGTH)
+	m.subscribers = append(m.subscribers, ch)
+	return ch
+}
+
+func (m *Monitor) Unsubscribe(ch <-chan Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, subscriber := range m.subscribers {
+		if subscriber == ch {
+			m.subscribers = append(m.subscribers[:i], m.subscribers[i+1:]...)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+// Must be called with the lock held
+func (m *Monitor) publish(event Event) {
+	for _, ch := range m.subscribers {
+		for {
+			select {
+			case ch <- event:
+			default:
+				// drop the oldest event to make room
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Must be called with the lock held
+func (m *Monitor) setState(state State) {
+	m.successes = 0
+	m.failures = 0
+	m.backoff = m.config.MinBackoff
+
+	if state == m.state {
+		return
+	}
+	log.Printf("health: source is now %s", state)
+	old := m.effectiveState()
+	m.state = state
+	m.publishChange(old)
+}
+
+func (m *Monitor) record(ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.initialized {
+		// the very first result decides directly; there is no
+		// previous state to protect
+		m.initialized = true
+		if ok {
+			m.setState(STATE_ONLINE)
+		} else {
+			m.setState(STATE_OFFLINE)
+		}
+		return
+	}
+
+	if ok {
+		m.failures = 0
+		if m.state == STATE_OFFLINE {
+			m.successes += 1
+			if m.successes >= m.config.RiseThreshold {
+				m.setState(STATE_ONLINE)
+			}
+		}
+		return
+	}
+
+	m.successes = 0
+	if m.state == STATE_ONLINE {
+		m.failures += 1
+		if m.failures >= m.config.FallThreshold {
+			m.setState(STATE_OFFLINE)
+		} else {
+			// confirm the failure quickly
+			m.triggerProbe()
+		}
+		return
+	}
+
+	m.backoff *= 2
+	if m.backoff > m.config.MaxBackoff {
+		m.backoff = m.config.MaxBackoff
+	}
+}
+
+// Feed the result of an operation into the state
+func (m *Monitor) report(err layer.Error) {
+	if err != nil && layer.IsUnavailableError(err) {
+		m.record(false)
+	} else {
+		// any other error is proof that the source is reachable
+		m.record(true)
+	}
+}
+
+func (m *Monitor) triggerProbe() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Monitor) probe() bool {
+	if !m.fs.IsReady() {
+		return false
+	}
+	_, err := m.fs.Lstat("/")
+	return err == nil || !layer.IsUnavailableError(err)
+}
+
+func (m *Monitor) nextInterval() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.state == STATE_ONLINE {
+		if m.failures > 0 {
+			return m.config.MinBackoff
+		}
+		return m.config.ProbeInterval
+	}
+
+	if m.successes > 0 {
+		return m.config.MinBackoff
+	}
+	return m.backoff
+}
+
+func (m *Monitor) run() {
+	defer close(m.stopped)
+
+	for {
+		timer := time.NewTimer(m.nextInterval())
+		select {
+		case <-m.stop:
+			timer.Stop()
+			return
+		case <-m.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		m.record(m.probe())
+	}
+}
+
+// Return true if the source is considered online.
+func (m *Monitor) IsReady() bool {
+	return m.State() == STATE_ONLINE
+}
+
+func (m *Monitor) Join(elems ...string) string {
+	return m.fs.Join(elems...)
+}
+
+func (m *Monitor) Lstat(path string) (layer.FileStat, layer.Error) {
+	stat, err := m.fs.Lstat(path)
+	m.report(err)
+	return stat, err
+}
+
+func (m *Monitor) OpenDir(path string) ([]layer.DirEntry, layer.Error) {
+	entries, err := m.fs.OpenDir(path)
+	m.report(err)
+	return entries, err
+}
+
+func (m *Monitor) Readlink(path string) (string, layer.Error) {
+	dest, err := m.fs.Readlink(path)
+	m.report(err)
+	return dest, err
+}
+
+func (m *Monitor) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	f, err := m.fs.OpenFile(path, flags)
+	m.report(err)
+	if err != nil {
+		return nil, err
+	}
+	return &monitoredFile{
+		File:    f,
+		monitor: m,
+	}, nil
+}
+
+func (m *Monitor) Create(path string, flags int, mode uint32) (layer.File, layer.Error) {
+	f, err := m.fs.Create(path, flags, mode)
+	m.report(err)
+	if err != nil {
+		return nil, err
+	}
+	return &monitoredFile{
+		File:    f,
+		monitor: m,
+	}, nil
+}
+
+func (m *Monitor) Mkdir(path string, mode uint32) layer.Error {
+	err := m.fs.Mkdir(path, mode)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Unlink(path string) layer.Error {
+	err := m.fs.Unlink(path)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Rmdir(path string) layer.Error {
+	err := m.fs.Rmdir(path)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Rename(oldpath string, newpath string) layer.Error {
+	err := m.fs.Rename(oldpath, newpath)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Symlink(target string, path string) layer.Error {
+	err := m.fs.Symlink(target, path)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Chmod(path string, mode uint32) layer.Error {
+	err := m.fs.Chmod(path, mode)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Chown(path string, uid uint32, gid uint32) layer.Error {
+	err := m.fs.Chown(path, uid, gid)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Truncate(path string, size uint64) layer.Error {
+	err := m.fs.Truncate(path, size)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Utimens(path string, atime *time.Time, mtime *time.Time) layer.Error {
+	err := m.fs.Utimens(path, atime, mtime)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Getxattr(path string, name string) ([]byte, layer.Error) {
+	value, err := m.fs.Getxattr(path, name)
+	m.report(err)
+	return value, err
+}
+
+func (m *Monitor) Listxattr(path string) ([]string, layer.Error) {
+	names, err := m.fs.Listxattr(path)
+	m.report(err)
+	return names, err
+}
+
+func (m *Monitor) Setxattr(path string, name string, value []byte, flags int) layer.Error {
+	err := m.fs.Setxattr(path, name, value, flags)
+	m.report(err)
+	return err
+}
+
+func (m *Monitor) Removexattr(path string, name string) layer.Error {
+	err := m.fs.Removexattr(path, name)
+	m.report(err)
+	return err
+}
+
+type monitoredFile struct {
+	layer.File
+	monitor *Monitor
+}
+
+func (m *monitoredFile) Read(dest []byte, position int64) (int, layer.Error) {
+	n, err := m.File.Read(dest, position)
+	m.monitor.report(err)
+	return n, err
+}
+
+func (m *monitoredFile) Write(data []byte, position int64) (int, layer.Error) {
+	n, err := m.File.Write(data, position)
+	m.monitor.report(err)
+	return n, err
+}
+
+func (m *monitoredFile) Truncate(size uint64) layer.Error {
+	err := m.File.Truncate(size)
+	m.monitor.report(err)
+	return err
+}
+
+func (m *monitoredFile) Chmod(mode uint32) layer.Error {
+	err := m.File.Chmod(mode)
+	m.monitor.report(err)
+	return err
+}
+
+func (m *monitoredFile) Chown(uid uint32, gid uint32) layer.Error {
+	err := m.File.Chown(uid, gid)
+	m.monitor.report(err)
+	return err
+}
+
+func (m *monitoredFile) Utimens(atime *time.Time, mtime *time.Time) layer.Error {
+	err := m.File.Utimens(atime, mtime)
+	m.monitor.report(err)
+	return err
+}
+
+func (m *monitoredFile) Sync() layer.Error {
+	err := m.File.Sync()
+	m.monitor.report(err)
+	return err
+}
+
+func (m *monitoredFile) GetLk(owner uint64, lk *layer.Lock) (*layer.Lock, layer.Error) {
+	result, err := m.File.GetLk(owner, lk)
+	m.monitor.report(err)
+	return result, err
+}
+
+func (m *monitoredFile) SetLk(owner uint64, lk *layer.Lock, wait bool) layer.Error {
+	err := m.File.SetLk(owner, lk, wait)
+	m.monitor.report(err)
+	return err
+}
+
+func (m *monitoredFile) Flock(how int) layer.Error {
+	err := m.File.Flock(how)
+	m.monitor.report(err)
+	return err
+}
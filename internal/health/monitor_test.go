@@ -0,0 +1,265 @@
+package health
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeFileSystem struct {
+	layer.DefaultFileSystem
+	lock   sync.Mutex
+	online bool
+	probes int
+}
+
+func (m *fakeFileSystem) setOnline(online bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.online = online
+}
+
+func (m *fakeFileSystem) IsReady() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.probes += 1
+	return m.online
+}
+
+func (m *fakeFileSystem) Lstat(path string) (layer.FileStat, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.online {
+		return nil, layer.WrapError(syscall.ENOTCONN)
+	}
+	if path != "/" {
+		return nil, layer.WrapError(syscall.ENOENT)
+	}
+	return layer.NewDefaultFileStat(), nil
+}
+
+func testConfig() *Config {
+	return &Config{
+		ProbeInterval: time.Hour,
+		MinBackoff:    time.Hour,
+		MaxBackoff:    4 * time.Hour,
+		RiseThreshold: 2,
+		FallThreshold: 3,
+	}
+}
+
+func TestInitialProbeDecidesState(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.Start()
+	defer monitor.Stop()
+
+	assert.Equal(t, STATE_ONLINE, monitor.State())
+	assert.True(t, monitor.IsReady())
+
+	fs = &fakeFileSystem{online: false}
+	monitor = NewMonitor(fs, testConfig())
+	monitor.Start()
+	defer monitor.Stop()
+
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+	assert.False(t, monitor.IsReady())
+}
+
+func TestIsReadyDoesNotQueryBackend(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.Start()
+	defer monitor.Stop()
+
+	probes := fs.probes
+	monitor.IsReady()
+	monitor.IsReady()
+	assert.Equal(t, probes, fs.probes)
+}
+
+func TestFallThreshold(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.record(true)
+
+	monitor.record(false)
+	monitor.record(false)
+	assert.Equal(t, STATE_ONLINE, monitor.State())
+
+	monitor.record(false)
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+}
+
+func TestSuccessResetsFailures(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.record(true)
+
+	monitor.record(false)
+	monitor.record(false)
+	monitor.record(true)
+	monitor.record(false)
+	monitor.record(false)
+	assert.Equal(t, STATE_ONLINE, monitor.State())
+}
+
+func TestRiseThreshold(t *testing.T) {
+	fs := &fakeFileSystem{}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.record(false)
+
+	monitor.record(true)
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+
+	monitor.record(false)
+	monitor.record(true)
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+
+	monitor.record(true)
+	assert.Equal(t, STATE_ONLINE, monitor.State())
+}
+
+func TestNonConnectivityErrorsCountAsSuccess(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.record(true)
+
+	for i := 0; i < 5; i++ {
+		_, err := monitor.Lstat("/nonexistant")
+		assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+	}
+	assert.Equal(t, STATE_ONLINE, monitor.State())
+}
+
+func TestOperationFailuresTakeSourceOffline(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.record(true)
+
+	fs.setOnline(false)
+	for i := 0; i < 3; i++ {
+		monitor.Lstat("/")
+	}
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	fs := &fakeFileSystem{}
+	monitor := NewMonitor(fs, testConfig())
+	monitor.record(false)
+
+	assert.Equal(t, time.Hour, monitor.nextInterval())
+	monitor.record(false)
+	assert.Equal(t, 2*time.Hour, monitor.nextInterval())
+	monitor.record(false)
+	assert.Equal(t, 4*time.Hour, monitor.nextInterval())
+	monitor.record(false)
+	assert.Equal(t, 4*time.Hour, monitor.nextInterval())
+
+	monitor.record(true)
+	monitor.record(true)
+	assert.Equal(t, STATE_ONLINE, monitor.State())
+	assert.Equal(t, time.Hour, monitor.nextInterval())
+}
+
+func TestSubscribersReceiveTransitions(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	events := monitor.Subscribe()
+
+	monitor.record(true)
+	event := <-events
+	assert.Equal(t, STATE_ONLINE, event.State)
+
+	monitor.record(false)
+	monitor.record(false)
+	monitor.record(false)
+	event = <-events
+	assert.Equal(t, STATE_OFFLINE, event.State)
+
+	select {
+	case event = <-events:
+		t.Errorf("unexpected event: %v", event)
+	default:
+	}
+}
+
+func TestSlowSubscribersGetLatestEvent(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	config := testConfig()
+	config.RiseThreshold = 1
+	config.FallThreshold = 1
+	monitor := NewMonitor(fs, config)
+	events := monitor.Subscribe()
+
+	monitor.record(true)
+	for i := 0; i < 2*event_QUEUE_LENGTH; i++ {
+		monitor.record(false)
+		monitor.record(true)
+	}
+	monitor.record(false)
+
+	var last Event
+	for len(events) > 0 {
+		last = <-events
+	}
+	assert.Equal(t, STATE_OFFLINE, last.State)
+}
+
+func TestBackgroundProbesDetectRecovery(t *testing.T) {
+	fs := &fakeFileSystem{}
+	config := &Config{
+		ProbeInterval: time.Millisecond,
+		MinBackoff:    time.Millisecond,
+		MaxBackoff:    time.Millisecond,
+		RiseThreshold: 2,
+		FallThreshold: 2,
+	}
+	monitor := NewMonitor(fs, config)
+	events := monitor.Subscribe()
+	monitor.Start()
+	defer monitor.Stop()
+
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+	fs.setOnline(true)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, STATE_ONLINE, event.State)
+	case <-time.After(5 * time.Second):
+		t.Errorf("monitor did not detect recovery")
+	}
+}
+
+func TestForceOverridesTrackedState(t *testing.T) {
+	fs := &fakeFileSystem{online: true}
+	monitor := NewMonitor(fs, testConfig())
+	events := monitor.Subscribe()
+
+	monitor.record(true)
+	<-events
+
+	monitor.Force(STATE_OFFLINE)
+	assert.True(t, monitor.IsForced())
+	assert.False(t, monitor.IsReady())
+	assert.Equal(t, STATE_OFFLINE, (<-events).State)
+
+	// the tracked state changes silently while forced
+	monitor.record(false)
+	monitor.record(false)
+	monitor.record(false)
+	monitor.record(true)
+	monitor.record(true)
+	assert.Equal(t, 0, len(events))
+	assert.Equal(t, STATE_OFFLINE, monitor.State())
+
+	monitor.Unforce()
+	assert.False(t, monitor.IsForced())
+	assert.True(t, monitor.IsReady())
+	assert.Equal(t, STATE_ONLINE, (<-events).State)
+}
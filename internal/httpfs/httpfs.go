@@ -0,0 +1,439 @@
+package httpfs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	DEFAULT_TIMEOUT = 30 * time.Second
+
+	mode_DIR = syscall.S_IFDIR | 0555
+	mode_REG = syscall.S_IFREG | 0444
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop>
+<resourcetype/><getcontentlength/><getlastmodified/>
+</prop></propfind>`
+
+// HTTPFileSystem is a read-only source served over HTTP.
+//
+// Metadata is obtained with WebDAV PROPFIND requests. Servers which do not
+// support WebDAV are accessed with HEAD requests; listing directories is not
+// possible with those. File contents are read with Range requests.
+type HTTPFileSystem struct {
+	layer.ReadOnlyFileSystem
+	client *http.Client
+	base   *url.URL
+	uid    uint32
+	gid    uint32
+}
+
+// Create a new HTTP file system rooted at base.
+//
+// User information in the URL is used for basic authentication. If client is
+// nil, a client with DEFAULT_TIMEOUT is used.
+func NewHTTPFileSystem(base *url.URL, client *http.Client) *HTTPFileSystem {
+	if client == nil {
+		client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+
+	root := *base
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+	root.RawPath = ""
+
+	return &HTTPFileSystem{
+		client: client,
+		base:   &root,
+		uid:    uint32(os.Getuid()),
+		gid:    uint32(os.Getgid()),
+	}
+}
+
+func (m *HTTPFileSystem) url(p string, dir bool) string {
+	u := *m.base
+	u.User = nil
+	u.Path = path.Join(m.base.Path, path.Clean("/"+p))
+	if dir && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (m *HTTPFileSystem) newRequest(method string, url string, body io.Reader) (*http.Request, layer.Error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, layer.WrapError(syscall.EINVAL)
+	}
+	if m.base.User != nil {
+		password, _ := m.base.User.Password()
+		req.SetBasicAuth(m.base.User.Username(), password)
+	}
+	return req, nil
+}
+
+func (m *HTTPFileSystem) do(req *http.Request) (*http.Response, layer.Error) {
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("httpfs: %s %s: %s", req.Method, req.URL, err)
+		return nil, layer.NewBackendError(err.Error(), syscall.ENOTCONN)
+	}
+	return resp, nil
+}
+
+func statusToError(resp *http.Response) layer.Error {
+	var errno syscall.Errno
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		errno = syscall.ENOENT
+	case http.StatusUnauthorized, http.StatusForbidden:
+		errno = syscall.EACCES
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		errno = syscall.EOPNOTSUPP
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		errno = syscall.ENOTCONN
+	case http.StatusRequestTimeout:
+		errno = syscall.ETIMEDOUT
+	default:
+		errno = syscall.EIO
+	}
+	return layer.NewBackendError(
+		fmt.Sprintf("httpfs: %s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status),
+		errno,
+	)
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+}
+
+func (m *HTTPFileSystem) propfind(url string, depth string) ([]davResponse, layer.Error) {
+	req, err := m.newRequest("PROPFIND", url, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := m.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, statusToError(resp)
+	}
+
+	var result davMultistatus
+	if xmlerr := xml.NewDecoder(resp.Body).Decode(&result); xmlerr != nil {
+		log.Printf("httpfs: malformed PROPFIND response from %s: %s", url, xmlerr)
+		return nil, layer.WrapError(syscall.EIO)
+	}
+	return result.Responses, nil
+}
+
+func (m *davResponse) stat(uid uint32, gid uint32) *HTTPFileStat {
+	result := &HTTPFileStat{
+		mode: mode_REG,
+		uid:  uid,
+		gid:  gid,
+	}
+	for _, propstat := range m.Propstats {
+		if !strings.Contains(propstat.Status, " 200 ") {
+			continue
+		}
+		prop := &propstat.Prop
+		if prop.ResourceType.Collection != nil {
+			result.mode = mode_DIR
+		}
+		if size, err := strconv.ParseUint(prop.ContentLength, 10, 64); err == nil {
+			result.size = size
+		}
+		if mtime, err := http.ParseTime(prop.LastModified); err == nil {
+			result.mtime = uint64(mtime.Unix())
+		}
+	}
+	return result
+}
+
+// Return the unescaped path of a href, without trailing slash
+func hrefPath(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(u.Path, "/")
+}
+
+func (m *HTTPFileSystem) statHead(p string) (layer.FileStat, layer.Error) {
+	req, err := m.newRequest("HEAD", m.url(p, false), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusToError(resp)
+	}
+
+	result := &HTTPFileStat{
+		mode: mode_REG,
+		uid:  m.uid,
+		gid:  m.gid,
+	}
+	// directory indices are usually redirected to the URL with a slash
+	if strings.HasSuffix(resp.Request.URL.Path, "/") {
+		result.mode = mode_DIR
+	}
+	if resp.ContentLength >= 0 {
+		result.size = uint64(resp.ContentLength)
+	}
+	if mtime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		result.mtime = uint64(mtime.Unix())
+	}
+	return result, nil
+}
+
+// Always returns true; HTTP has no sessions whose state could be checked.
+func (m *HTTPFileSystem) IsReady() bool {
+	return true
+}
+
+func (m *HTTPFileSystem) Join(elems ...string) string {
+	return path.Join(elems...)
+}
+
+func (m *HTTPFileSystem) Lstat(p string) (layer.FileStat, layer.Error) {
+	responses, err := m.propfind(m.url(p, false), "0")
+	if err != nil {
+		if err.Errno() == uintptr(syscall.EOPNOTSUPP) {
+			return m.statHead(p)
+		}
+		return nil, err
+	}
+
+	if len(responses) == 0 {
+		return nil, layer.WrapError(syscall.EIO)
+	}
+	return responses[0].stat(m.uid, m.gid), nil
+}
+
+func (m *HTTPFileSystem) OpenDir(p string) ([]layer.DirEntry, layer.Error) {
+	dir_url := m.url(p, true)
+	responses, err := m.propfind(dir_url, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	self := hrefPath(dir_url)
+	entries := make([]layer.DirEntry, 0, len(responses))
+	for i := range responses {
+		response := &responses[i]
+		entry_path := hrefPath(response.Href)
+		if entry_path == self || entry_path == "" {
+			continue
+		}
+		entries = append(entries, &HTTPDirEntry{
+			name: path.Base(entry_path),
+			stat: response.stat(m.uid, m.gid),
+		})
+	}
+
+	return entries, nil
+}
+
+// HTTP has no symlinks; this always fails with EINVAL.
+func (m *HTTPFileSystem) Readlink(p string) (string, layer.Error) {
+	return "", layer.WrapError(syscall.EINVAL)
+}
+
+func (m *HTTPFileSystem) OpenFile(p string, flags int) (layer.File, layer.Error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, layer.WrapError(syscall.EROFS)
+	}
+
+	return &HTTPFile{
+		fs:  m,
+		url: m.url(p, false),
+	}, nil
+}
+
+type HTTPDirEntry struct {
+	name string
+	stat *HTTPFileStat
+}
+
+func (m *HTTPDirEntry) Name() string {
+	return m.name
+}
+
+func (m *HTTPDirEntry) Mode() uint32 {
+	return m.stat.Mode()
+}
+
+func (m *HTTPDirEntry) Stat() layer.FileStat {
+	return m.stat
+}
+
+// HTTP only provides the modification time, in whole seconds; it is used for
+// all timestamps.
+type HTTPFileStat struct {
+	mode  uint32
+	size  uint64
+	mtime uint64
+	uid   uint32
+	gid   uint32
+}
+
+func (m *HTTPFileStat) Mtime() uint64 {
+	return m.mtime
+}
+
+func (m *HTTPFileStat) Atime() uint64 {
+	return m.mtime
+}
+
+func (m *HTTPFileStat) Ctime() uint64 {
+	return m.mtime
+}
+
+func (m *HTTPFileStat) MtimeNsec() uint32 {
+	return 0
+}
+
+func (m *HTTPFileStat) AtimeNsec() uint32 {
+	return 0
+}
+
+func (m *HTTPFileStat) CtimeNsec() uint32 {
+	return 0
+}
+
+func (m *HTTPFileStat) Ino() uint64 {
+	return 0
+}
+
+func (m *HTTPFileStat) Nlink() uint32 {
+	return 1
+}
+
+func (m *HTTPFileStat) Rdev() uint64 {
+	return 0
+}
+
+func (m *HTTPFileStat) Blocks() uint64 {
+	return (m.size + 511) / 512
+}
+
+func (m *HTTPFileStat) Mode() uint32 {
+	return m.mode
+}
+
+func (m *HTTPFileStat) OwnerGID() uint32 {
+	return m.gid
+}
+
+func (m *HTTPFileStat) OwnerUID() uint32 {
+	return m.uid
+}
+
+func (m *HTTPFileStat) Size() uint64 {
+	return m.size
+}
+
+// HTTPFile reads a file with one Range request per Read call.
+type HTTPFile struct {
+	layer.ReadOnlyFile
+	fs  *HTTPFileSystem
+	url string
+}
+
+func (m *HTTPFile) Read(dest []byte, position int64) (int, layer.Error) {
+	if len(dest) == 0 {
+		return 0, nil
+	}
+
+	req, err := m.fs.newRequest("GET", m.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d",
+		position, position+int64(len(dest))-1))
+
+	resp, err := m.fs.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range; skip to the requested
+		// position
+		if _, ioerr := io.CopyN(ioutil.Discard, resp.Body, position); ioerr != nil {
+			if ioerr == io.EOF {
+				return 0, nil
+			}
+			return 0, layer.NewBackendError(ioerr.Error(), syscall.ENOTCONN)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// reading at or beyond the end of file
+		return 0, nil
+	default:
+		return 0, statusToError(resp)
+	}
+
+	n, ioerr := io.ReadFull(resp.Body, dest)
+	if ioerr == io.EOF || ioerr == io.ErrUnexpectedEOF {
+		ioerr = nil
+	}
+	if ioerr != nil {
+		log.Printf("Read(): %s\n", ioerr)
+		return n, layer.NewBackendError(ioerr.Error(), syscall.ENOTCONN)
+	}
+	return n, nil
+}
+
+func (m *HTTPFile) Release() {
+}
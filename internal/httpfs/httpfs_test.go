@@ -0,0 +1,382 @@
+package httpfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMtime = time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// A minimal WebDAV server serving a fixed tree of files.
+//
+// Directories are implied by the paths of the files.
+type fakeServer struct {
+	files  map[string][]byte
+	webdav bool
+
+	lock     sync.Mutex
+	requests map[string]int
+	ranges   []string
+}
+
+func newFakeServer(webdav bool) *fakeServer {
+	return &fakeServer{
+		files: map[string][]byte{
+			"/file":           []byte("0123456789"),
+			"/dir/a":          []byte("a"),
+			"/dir/with space": []byte("spaced"),
+			"/dir/sub/b":      []byte("b"),
+		},
+		webdav:   webdav,
+		requests: make(map[string]int),
+	}
+}
+
+func (m *fakeServer) isDir(p string) bool {
+	if p == "/" {
+		return true
+	}
+	for name := range m.files {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the direct children of a directory, with a trailing slash for
+// directories
+func (m *fakeServer) children(p string) []string {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	seen := make(map[string]bool)
+	result := []string{}
+	for name := range m.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		child := strings.SplitN(name[len(prefix):], "/", 2)
+		entry := prefix + child[0]
+		if len(child) > 1 {
+			entry += "/"
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			result = append(result, entry)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *fakeServer) writeResponse(w *bytes.Buffer, p string) {
+	href := (&url.URL{Path: p}).EscapedPath()
+	fmt.Fprintf(w, "<D:response><D:href>%s</D:href><D:propstat><D:prop>", href)
+	if strings.HasSuffix(p, "/") {
+		w.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		fmt.Fprintf(w, "<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength>",
+			len(m.files[p]))
+	}
+	fmt.Fprintf(w, "<D:getlastmodified>%s</D:getlastmodified>",
+		testMtime.Format(http.TimeFormat))
+	w.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+}
+
+func (m *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	m.requests[r.Method] += 1
+	if r.Method == "GET" {
+		m.ranges = append(m.ranges, r.Header.Get("Range"))
+	}
+	m.lock.Unlock()
+
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	if p == "" {
+		p = "/"
+	}
+	_, is_file := m.files[p]
+	is_dir := m.isDir(p)
+
+	switch r.Method {
+	case "PROPFIND":
+		if !m.webdav {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !is_file && !is_dir {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		buf := &bytes.Buffer{}
+		buf.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		if is_dir {
+			self := strings.TrimSuffix(p, "/") + "/"
+			m.writeResponse(buf, self)
+			if r.Header.Get("Depth") == "1" {
+				for _, child := range m.children(p) {
+					m.writeResponse(buf, child)
+				}
+			}
+		} else {
+			m.writeResponse(buf, p)
+		}
+		buf.WriteString("</D:multistatus>")
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(buf.Bytes())
+	case "GET", "HEAD":
+		if is_dir {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>index</html>"))
+			return
+		}
+		if !is_file {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, p, testMtime, bytes.NewReader(m.files[p]))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func prepServer(webdav bool) (*fakeServer, *httptest.Server, *HTTPFileSystem) {
+	backend := newFakeServer(webdav)
+	server := httptest.NewServer(backend)
+	base, _ := url.Parse(server.URL)
+	return backend, server, NewHTTPFileSystem(base, nil)
+}
+
+func TestLstatFile(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0444), stat.Mode())
+	assert.Equal(t, uint64(10), stat.Size())
+	assert.Equal(t, uint64(testMtime.Unix()), stat.Mtime())
+	assert.Equal(t, uint32(os.Getuid()), stat.OwnerUID())
+}
+
+func TestLstatDirectory(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	stat, err := fs.Lstat("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+
+	stat, err = fs.Lstat("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+}
+
+func TestLstatNonexistant(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	_, err := fs.Lstat("/nonexistant")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestLstatFallsBackToHead(t *testing.T) {
+	backend, server, fs := prepServer(false)
+	defer server.Close()
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0444), stat.Mode())
+	assert.Equal(t, uint64(10), stat.Size())
+	assert.Equal(t, uint64(testMtime.Unix()), stat.Mtime())
+
+	stat, err = fs.Lstat("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+
+	_, err = fs.Lstat("/nonexistant")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+
+	assert.Equal(t, 3, backend.requests["PROPFIND"])
+}
+
+func TestOpenDir(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	entries, err := fs.OpenDir("/dir")
+	assert.Nil(t, err)
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"a", "sub", "with space"}, names)
+	assert.Equal(t, uint32(syscall.S_IFREG|0444), entries[0].Mode())
+	assert.Equal(t, uint64(1), entries[0].Stat().Size())
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), entries[1].Mode())
+}
+
+func TestOpenDirRoot(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	entries, err := fs.OpenDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestOpenDirWithoutWebDAV(t *testing.T) {
+	_, server, fs := prepServer(false)
+	defer server.Close()
+
+	_, err := fs.OpenDir("/dir")
+	assert.Equal(t, uintptr(syscall.EOPNOTSUPP), err.Errno())
+}
+
+func TestSubdirectoryAsRoot(t *testing.T) {
+	backend := newFakeServer(true)
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	base, _ := url.Parse(server.URL + "/dir")
+	fs := NewHTTPFileSystem(base, nil)
+
+	entries, err := fs.OpenDir("/sub")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "b", entries[0].Name())
+
+	stat, err := fs.Lstat("/with space")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), stat.Size())
+}
+
+func TestReadUsesOneRangeRequestPerCall(t *testing.T) {
+	backend, server, fs := prepServer(true)
+	defer server.Close()
+
+	f, err := fs.OpenFile("/file", os.O_RDONLY)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	buf := make([]byte, 4)
+	n, err := f.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("0123"), buf)
+
+	n, err = f.Read(buf, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("4567"), buf)
+
+	// short read at the end of the file
+	n, err = f.Read(buf, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("89"), buf[:n])
+
+	assert.Equal(t, []string{"bytes=0-3", "bytes=4-7", "bytes=8-11"}, backend.ranges)
+}
+
+func TestReadBeyondEndOfFile(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	f, _ := fs.OpenFile("/file", os.O_RDONLY)
+	defer f.Release()
+
+	n, err := f.Read(make([]byte, 4), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestReadWithoutRangeSupport(t *testing.T) {
+	contents := []byte("0123456789")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(contents)
+	}))
+	defer server.Close()
+	base, _ := url.Parse(server.URL)
+	fs := NewHTTPFileSystem(base, nil)
+
+	f, _ := fs.OpenFile("/file", os.O_RDONLY)
+	defer f.Release()
+
+	buf := make([]byte, 4)
+	n, err := f.Read(buf, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("4567"), buf)
+
+	n, err = f.Read(buf, 20)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestOpenFileForWritingFails(t *testing.T) {
+	_, server, fs := prepServer(true)
+	defer server.Close()
+
+	_, err := fs.OpenFile("/file", os.O_RDWR)
+	assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+}
+
+func TestBasicAuth(t *testing.T) {
+	backend := newFakeServer(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	_, err := NewHTTPFileSystem(base, nil).Lstat("/file")
+	assert.Equal(t, uintptr(syscall.EACCES), err.Errno())
+
+	base.User = url.UserPassword("user", "secret")
+	_, err = NewHTTPFileSystem(base, nil).Lstat("/file")
+	assert.Nil(t, err)
+}
+
+func TestServerErrorsAreUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	base, _ := url.Parse(server.URL)
+	fs := NewHTTPFileSystem(base, nil)
+
+	_, err := fs.Lstat("/file")
+	assert.True(t, layer.IsUnavailableError(err))
+
+	server.Close()
+	_, err = fs.Lstat("/file")
+	assert.True(t, layer.IsUnavailableError(err))
+
+	f, _ := fs.OpenFile("/file", os.O_RDONLY)
+	_, err = f.Read(make([]byte, 4), 0)
+	assert.True(t, layer.IsUnavailableError(err))
+}
@@ -1,5 +1,9 @@
 package layer
 
+import (
+	"time"
+)
+
 type FileSystem interface {
 	Lstat(path string) (FileStat, Error)
 	OpenDir(path string) ([]DirEntry, Error)
@@ -7,23 +11,99 @@ type FileSystem interface {
 	Readlink(path string) (string, Error)
 	Join(elems ...string) string
 	IsReady() bool
+
+	// Create and open a regular file
+	//
+	// flags are passed as for OpenFile; O_CREAT is implied.
+	Create(path string, flags int, mode uint32) (File, Error)
+	Mkdir(path string, mode uint32) Error
+	Unlink(path string) Error
+	Rmdir(path string) Error
+	Rename(oldpath string, newpath string) Error
+
+	// Create a symlink at path pointing to target
+	Symlink(target string, path string) Error
+	Chmod(path string, mode uint32) Error
+	Chown(path string, uid uint32, gid uint32) Error
+	Truncate(path string, size uint64) Error
+
+	// Set the access and modification times; nil leaves the time unchanged
+	Utimens(path string, atime *time.Time, mtime *time.Time) Error
+
+	// Return the value of an extended attribute; fails with ENODATA if
+	// the attribute does not exist and ENOTSUP if the source has no
+	// extended attributes
+	Getxattr(path string, name string) ([]byte, Error)
+	Listxattr(path string) ([]string, Error)
+
+	// Set an extended attribute; flags are XATTR_CREATE, XATTR_REPLACE or
+	// zero
+	Setxattr(path string, name string, value []byte, flags int) Error
+	Removexattr(path string, name string) Error
 }
 
 type File interface {
 	Read(dest []byte, position int64) (int, Error)
+	Write(data []byte, position int64) (int, Error)
+	Truncate(size uint64) Error
+	Chmod(mode uint32) Error
+	Chown(uid uint32, gid uint32) Error
+	Utimens(atime *time.Time, mtime *time.Time) Error
+
+	// Flush written data to persistent storage
+	Sync() Error
 	Release()
+
+	// Return a lock which would prevent lk from being acquired by owner,
+	// or a lock of type F_UNLCK if there is none
+	GetLk(owner uint64, lk *Lock) (*Lock, Error)
+
+	// Acquire or release (type F_UNLCK) a POSIX record lock for owner;
+	// without wait, fail with EAGAIN if a conflicting lock is held
+	SetLk(owner uint64, lk *Lock, wait bool) Error
+
+	// Acquire or release a BSD lock; how is LOCK_SH, LOCK_EX or LOCK_UN,
+	// optionally combined with LOCK_NB
+	Flock(how int) Error
 }
 
+// A POSIX record lock
+//
+// Locks are held by the open file through which they were acquired and are
+// released with it.
+type Lock struct {
+	// F_RDLCK, F_WRLCK or F_UNLCK
+	Type  uint32
+	Start uint64
+	// Last byte of the range; LOCK_EOF extends it to the end of the file
+	End uint64
+	Pid uint32
+}
+
+const LOCK_EOF = ^uint64(0)
+
 type DirEntry interface {
 	Name() string
 	Mode() uint32
 	Stat() FileStat
 }
 
+// Times are split into seconds since the epoch and the nanoseconds within the
+// second, as in struct stat.
+//
+// Ino is zero if the file system has no (stable) inode numbers; hard links to
+// the same file share a non-zero Ino. Rdev is the device number of character
+// and block devices and zero for everything else.
 type FileStat interface {
 	Mtime() uint64
 	Atime() uint64
 	Ctime() uint64
+	MtimeNsec() uint32
+	AtimeNsec() uint32
+	CtimeNsec() uint32
+	Ino() uint64
+	Nlink() uint32
+	Rdev() uint64
 	Size() uint64
 	Blocks() uint64
 	OwnerUID() uint32
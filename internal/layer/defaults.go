@@ -3,6 +3,7 @@ package layer
 import (
 	"path"
 	"syscall"
+	"time"
 )
 
 type DefaultFileStat struct {
@@ -24,6 +25,30 @@ func (m *DefaultFileStat) Ctime() uint64 {
 	return 0
 }
 
+func (m *DefaultFileStat) AtimeNsec() uint32 {
+	return 0
+}
+
+func (m *DefaultFileStat) MtimeNsec() uint32 {
+	return 0
+}
+
+func (m *DefaultFileStat) CtimeNsec() uint32 {
+	return 0
+}
+
+func (m *DefaultFileStat) Ino() uint64 {
+	return 0
+}
+
+func (m *DefaultFileStat) Nlink() uint32 {
+	return 1
+}
+
+func (m *DefaultFileStat) Rdev() uint64 {
+	return 0
+}
+
 func (m *DefaultFileStat) Size() uint64 {
 	return 0
 }
@@ -89,3 +114,189 @@ func (m *DefaultFileSystem) Readlink(path string) (string, Error) {
 func (m *DefaultFileSystem) OpenFile(path string, flags int) (File, Error) {
 	return nil, NewBackendError("dummy source", syscall.EIO)
 }
+
+func (m *DefaultFileSystem) Create(path string, flags int, mode uint32) (File, Error) {
+	return nil, NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Mkdir(path string, mode uint32) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Unlink(path string) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Rmdir(path string) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Rename(oldpath string, newpath string) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Symlink(target string, path string) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Chmod(path string, mode uint32) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Chown(path string, uid uint32, gid uint32) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Truncate(path string, size uint64) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Utimens(path string, atime *time.Time, mtime *time.Time) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Getxattr(path string, name string) ([]byte, Error) {
+	return nil, NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Listxattr(path string) ([]string, Error) {
+	return nil, NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Setxattr(path string, name string, value []byte, flags int) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+func (m *DefaultFileSystem) Removexattr(path string, name string) Error {
+	return NewBackendError("dummy source", syscall.EIO)
+}
+
+// NoXattrFileSystem implements the extended attribute operations of
+// FileSystem by failing with ENOTSUP.
+//
+// It is meant to be embedded by sources which have no extended attributes.
+type NoXattrFileSystem struct {
+}
+
+func (m *NoXattrFileSystem) Getxattr(path string, name string) ([]byte, Error) {
+	return nil, WrapError(syscall.ENOTSUP)
+}
+
+func (m *NoXattrFileSystem) Listxattr(path string) ([]string, Error) {
+	return nil, WrapError(syscall.ENOTSUP)
+}
+
+func (m *NoXattrFileSystem) Setxattr(path string, name string, value []byte, flags int) Error {
+	return WrapError(syscall.ENOTSUP)
+}
+
+func (m *NoXattrFileSystem) Removexattr(path string, name string) Error {
+	return WrapError(syscall.ENOTSUP)
+}
+
+// ReadOnlyFileSystem implements the modifying operations of FileSystem by
+// failing with EROFS. Extended attributes are not supported.
+//
+// It is meant to be embedded by sources which cannot be written to.
+type ReadOnlyFileSystem struct {
+	NoXattrFileSystem
+}
+
+func (m *ReadOnlyFileSystem) Create(path string, flags int, mode uint32) (File, Error) {
+	return nil, WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Mkdir(path string, mode uint32) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Unlink(path string) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Rmdir(path string) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Rename(oldpath string, newpath string) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Symlink(target string, path string) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Chmod(path string, mode uint32) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Chown(path string, uid uint32, gid uint32) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Truncate(path string, size uint64) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Utimens(path string, atime *time.Time, mtime *time.Time) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Setxattr(path string, name string, value []byte, flags int) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFileSystem) Removexattr(path string, name string) Error {
+	return WrapError(syscall.EROFS)
+}
+
+// NoLockFile implements the lock operations of File by failing with ENOLCK.
+//
+// It is meant to be embedded by files of sources which have no locking.
+type NoLockFile struct {
+}
+
+func (m *NoLockFile) GetLk(owner uint64, lk *Lock) (*Lock, Error) {
+	return nil, WrapError(syscall.ENOLCK)
+}
+
+func (m *NoLockFile) SetLk(owner uint64, lk *Lock, wait bool) Error {
+	return WrapError(syscall.ENOLCK)
+}
+
+func (m *NoLockFile) Flock(how int) Error {
+	return WrapError(syscall.ENOLCK)
+}
+
+// ReadOnlyFile implements the modifying operations of File by failing with
+// EROFS. Sync succeeds, as there is never anything to flush. Locks are not
+// supported.
+//
+// It is meant to be embedded by files of sources which cannot be written to.
+type ReadOnlyFile struct {
+	NoLockFile
+}
+
+func (m *ReadOnlyFile) Write(data []byte, position int64) (int, Error) {
+	return 0, WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFile) Truncate(size uint64) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFile) Chmod(mode uint32) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFile) Chown(uid uint32, gid uint32) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFile) Utimens(atime *time.Time, mtime *time.Time) Error {
+	return WrapError(syscall.EROFS)
+}
+
+func (m *ReadOnlyFile) Sync() Error {
+	return nil
+}
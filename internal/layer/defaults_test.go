@@ -0,0 +1,27 @@
+package layer
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyFileSystemFailsWithEROFS(t *testing.T) {
+	fs := &ReadOnlyFileSystem{}
+	_, err := fs.Create("/foo", os.O_RDWR, 0644)
+	assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+	assert.Equal(t, uintptr(syscall.EROFS), fs.Mkdir("/foo", 0755).Errno())
+	assert.Equal(t, uintptr(syscall.EROFS), fs.Rename("/foo", "/bar").Errno())
+	assert.Equal(t, uintptr(syscall.EROFS), fs.Setxattr("/foo", "user.foo", nil, 0).Errno())
+	_, err = fs.Getxattr("/foo", "user.foo")
+	assert.Equal(t, uintptr(syscall.ENOTSUP), err.Errno())
+
+	f := &ReadOnlyFile{}
+	_, err = f.Write([]byte("foo"), 0)
+	assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+	assert.Equal(t, uintptr(syscall.EROFS), f.Truncate(0).Errno())
+	assert.Nil(t, f.Sync())
+	assert.Equal(t, uintptr(syscall.ENOLCK), f.Flock(syscall.LOCK_SH).Errno())
+}
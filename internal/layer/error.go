@@ -31,12 +31,18 @@ func WrapError(err error) Error {
 			return newWrappedOSError(err, *syserr)
 		}
 		return WrapError(cast.Err)
+	case *os.LinkError:
+		return newWrappedOSError(err, syscall.Errno(WrapError(cast.Err).Errno()))
+	case *os.SyscallError:
+		return newWrappedOSError(err, syscall.Errno(WrapError(cast.Err).Errno()))
 	case *syscall.Errno:
 		return newWrappedOSError(err, *cast)
 	case syscall.Errno:
 		return newWrappedOSError(err, cast)
 	case *wrappedOSError:
 		return cast
+	case Error:
+		return cast
 	default:
 		return newWrappedOSError(err, syscall.Errno(syscall.EIO))
 	}
@@ -80,3 +86,61 @@ func (m *backendError) Error() string {
 func (m *backendError) Errno() uintptr {
 	return m.errno
 }
+
+// Classes of errors, used to decide how a failed operation on a source
+// affects the cache.
+type ErrorClass int
+
+const (
+	// The error says nothing about the existence of the path or the
+	// availability of the source (e.g. EINVAL, EISDIR)
+	ERRCLASS_FATAL ErrorClass = iota
+
+	// The path does not exist on the source
+	ERRCLASS_NOT_FOUND
+
+	// The path exists, but access is not allowed
+	ERRCLASS_PERMISSION
+
+	// The source cannot be reached right now; the operation may succeed
+	// later
+	ERRCLASS_UNAVAILABLE
+)
+
+func ClassifyError(err Error) ErrorClass {
+	switch syscall.Errno(err.Errno()) {
+	case syscall.ENOENT:
+		return ERRCLASS_NOT_FOUND
+	case syscall.EACCES, syscall.EPERM:
+		return ERRCLASS_PERMISSION
+	case syscall.EIO,
+		syscall.ENOTCONN,
+		syscall.ETIMEDOUT,
+		syscall.EHOSTUNREACH,
+		syscall.EHOSTDOWN,
+		syscall.ENETUNREACH,
+		syscall.ENETDOWN,
+		syscall.ENETRESET,
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.ESHUTDOWN,
+		syscall.EPIPE,
+		syscall.ESTALE,
+		syscall.ENOLINK,
+		syscall.EREMOTEIO:
+		return ERRCLASS_UNAVAILABLE
+	}
+	return ERRCLASS_FATAL
+}
+
+// Return true if the error is evidence that the path does not exist.
+func IsNotFoundError(err Error) bool {
+	return ClassifyError(err) == ERRCLASS_NOT_FOUND
+}
+
+// Return true if the error indicates that the source is (temporarily)
+// unreachable.
+func IsUnavailableError(err Error) bool {
+	return ClassifyError(err) == ERRCLASS_UNAVAILABLE
+}
@@ -0,0 +1,48 @@
+package layer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := map[syscall.Errno]ErrorClass{
+		syscall.ENOENT:       ERRCLASS_NOT_FOUND,
+		syscall.EACCES:       ERRCLASS_PERMISSION,
+		syscall.EPERM:        ERRCLASS_PERMISSION,
+		syscall.EIO:          ERRCLASS_UNAVAILABLE,
+		syscall.ENOTCONN:     ERRCLASS_UNAVAILABLE,
+		syscall.ETIMEDOUT:    ERRCLASS_UNAVAILABLE,
+		syscall.EHOSTUNREACH: ERRCLASS_UNAVAILABLE,
+		syscall.ESTALE:       ERRCLASS_UNAVAILABLE,
+		syscall.ENOTDIR:      ERRCLASS_FATAL,
+		syscall.EINVAL:       ERRCLASS_FATAL,
+	}
+
+	for errno, class := range cases {
+		assert.Equal(t, class, ClassifyError(WrapError(errno)), errno.Error())
+	}
+}
+
+func TestWrapErrorUnwrapsPathError(t *testing.T) {
+	_, err := os.Lstat("/nonexistant/dragonstash/path")
+	assert.Equal(t, uintptr(syscall.ENOENT), WrapError(err).Errno())
+}
+
+func TestWrapErrorUnwrapsLinkError(t *testing.T) {
+	err := os.Rename("/nonexistant/dragonstash/a", "/nonexistant/dragonstash/b")
+	assert.Equal(t, uintptr(syscall.ENOENT), WrapError(err).Errno())
+}
+
+func TestWrapErrorKeepsBackendError(t *testing.T) {
+	err := NewBackendError("foo", syscall.ENOTCONN)
+	assert.Equal(t, err, WrapError(err))
+}
+
+func TestWrapErrorDefaultsToEIO(t *testing.T) {
+	assert.Equal(t, uintptr(syscall.EIO), WrapError(errors.New("foo")).Errno())
+}
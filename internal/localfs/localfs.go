@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/horazont/dragonstash/internal/layer"
 )
@@ -109,6 +111,133 @@ func (m *LocalFileSystem) OpenFile(path string, flags int) (layer.File, layer.Er
 	return newLocalFile(f), nil
 }
 
+func (m *LocalFileSystem) Create(path string, flags int, mode uint32) (layer.File, layer.Error) {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	// os.OpenFile would mangle the setuid/setgid/sticky bits of mode
+	fd, err := syscall.Open(path, flags|syscall.O_CREAT|syscall.O_CLOEXEC, mode)
+	if err != nil {
+		return nil, layer.WrapError(err)
+	}
+
+	return newLocalFile(os.NewFile(uintptr(fd), path)), nil
+}
+
+func (m *LocalFileSystem) Mkdir(path string, mode uint32) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(syscall.Mkdir(path, mode))
+}
+
+func (m *LocalFileSystem) Unlink(path string) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(syscall.Unlink(path))
+}
+
+func (m *LocalFileSystem) Rmdir(path string) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(syscall.Rmdir(path))
+}
+
+func (m *LocalFileSystem) Rename(oldpath string, newpath string) layer.Error {
+	oldpath, fserr := m.fullPath(oldpath)
+	if fserr != nil {
+		return fserr
+	}
+	newpath, fserr = m.fullPath(newpath)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(os.Rename(oldpath, newpath))
+}
+
+func (m *LocalFileSystem) Symlink(target string, path string) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(os.Symlink(target, path))
+}
+
+func (m *LocalFileSystem) Chmod(path string, mode uint32) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(syscall.Chmod(path, mode))
+}
+
+func (m *LocalFileSystem) Chown(path string, uid uint32, gid uint32) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(os.Lchown(path, int(uid), int(gid)))
+}
+
+func (m *LocalFileSystem) Truncate(path string, size uint64) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(os.Truncate(path, int64(size)))
+}
+
+// UTIME_OMIT from <sys/stat.h>, which the syscall package lacks
+const utime_OMIT = (1 << 30) - 2
+
+func toTimespec(t *time.Time) syscall.Timespec {
+	if t == nil {
+		return syscall.Timespec{Nsec: utime_OMIT}
+	}
+	return syscall.NsecToTimespec(t.UnixNano())
+}
+
+// The syscall package has no variant of UtimesNano for file descriptors;
+// utimensat with a NULL path changes the times of the file itself.
+func futimens(fd int, times []syscall.Timespec) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT,
+		uintptr(fd),
+		0,
+		uintptr(unsafe.Pointer(&times[0])),
+		0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (m *LocalFileSystem) Utimens(path string, atime *time.Time, mtime *time.Time) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(syscall.UtimesNano(path, []syscall.Timespec{
+		toTimespec(atime),
+		toTimespec(mtime),
+	}))
+}
+
 type LocalDirEntry struct {
 	name    string
 	wrapped *LocalFileStat
@@ -157,6 +286,30 @@ func (m *LocalFileStat) Ctime() uint64 {
 	return uint64(m.backend.Ctim.Sec)
 }
 
+func (m *LocalFileStat) MtimeNsec() uint32 {
+	return uint32(m.backend.Mtim.Nsec)
+}
+
+func (m *LocalFileStat) AtimeNsec() uint32 {
+	return uint32(m.backend.Atim.Nsec)
+}
+
+func (m *LocalFileStat) CtimeNsec() uint32 {
+	return uint32(m.backend.Ctim.Nsec)
+}
+
+func (m *LocalFileStat) Ino() uint64 {
+	return m.backend.Ino
+}
+
+func (m *LocalFileStat) Nlink() uint32 {
+	return uint32(m.backend.Nlink)
+}
+
+func (m *LocalFileStat) Rdev() uint64 {
+	return m.backend.Rdev
+}
+
 func (m *LocalFileStat) Mode() uint32 {
 	return m.backend.Mode
 }
@@ -200,6 +353,120 @@ func (m *LocalFile) Read(dest []byte, position int64) (int, layer.Error) {
 	return n, layer.WrapError(err)
 }
 
+func (m *LocalFile) Write(data []byte, position int64) (int, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	n, err := m.backend.WriteAt(data, position)
+	if err != nil {
+		log.Printf("Write(): %s\n", err)
+	}
+	return n, layer.WrapError(err)
+}
+
+func (m *LocalFile) Truncate(size uint64) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return layer.WrapError(m.backend.Truncate(int64(size)))
+}
+
+func (m *LocalFile) Chmod(mode uint32) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return layer.WrapError(syscall.Fchmod(int(m.backend.Fd()), mode))
+}
+
+func (m *LocalFile) Chown(uid uint32, gid uint32) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return layer.WrapError(m.backend.Chown(int(uid), int(gid)))
+}
+
+// The syscall package has no futimens, so times which are not to be changed
+// are filled in from the current attributes.
+func (m *LocalFile) Utimens(atime *time.Time, mtime *time.Time) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return layer.WrapError(futimens(int(m.backend.Fd()), []syscall.Timespec{
+		toTimespec(atime),
+		toTimespec(mtime),
+	}))
+}
+
+func (m *LocalFile) Sync() layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return layer.WrapError(m.backend.Sync())
+}
+
+const (
+	// Commands for locks owned by the open file instead of the process
+	// (Linux 3.15+); they are missing from the syscall package.
+	//
+	// All files are opened by the same process, so process-owned locks
+	// would not conflict with each other.
+	f_OFD_GETLK  = 36
+	f_OFD_SETLK  = 37
+	f_OFD_SETLKW = 38
+)
+
+func toFlockT(lk *layer.Lock) *syscall.Flock_t {
+	result := &syscall.Flock_t{
+		Type:   int16(lk.Type),
+		Whence: int16(io.SeekStart),
+		Start:  int64(lk.Start),
+	}
+	if lk.End != layer.LOCK_EOF {
+		result.Len = int64(lk.End-lk.Start) + 1
+	}
+	return result
+}
+
+func fromFlockT(flk *syscall.Flock_t) *layer.Lock {
+	result := &layer.Lock{
+		Type:  uint32(flk.Type),
+		Start: uint64(flk.Start),
+		End:   layer.LOCK_EOF,
+	}
+	if flk.Len > 0 {
+		result.End = uint64(flk.Start+flk.Len) - 1
+	}
+	if flk.Pid > 0 {
+		result.Pid = uint32(flk.Pid)
+	}
+	return result
+}
+
+// The lock operations do not take the lock of the file, as they may block
+// for a long time.
+//
+// Locks are not owned by owner, but by the open file: all owners sharing a
+// file share its locks.
+func (m *LocalFile) GetLk(owner uint64, lk *layer.Lock) (*layer.Lock, layer.Error) {
+	flk := toFlockT(lk)
+	if err := syscall.FcntlFlock(m.backend.Fd(), f_OFD_GETLK, flk); err != nil {
+		return nil, layer.WrapError(err)
+	}
+	return fromFlockT(flk), nil
+}
+
+func (m *LocalFile) SetLk(owner uint64, lk *layer.Lock, wait bool) layer.Error {
+	cmd := f_OFD_SETLK
+	if wait {
+		cmd = f_OFD_SETLKW
+	}
+	return layer.WrapError(syscall.FcntlFlock(m.backend.Fd(), cmd, toFlockT(lk)))
+}
+
+func (m *LocalFile) Flock(how int) layer.Error {
+	return layer.WrapError(syscall.Flock(int(m.backend.Fd()), how))
+}
+
 func (m *LocalFile) Stat() (layer.FileStat, layer.Error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
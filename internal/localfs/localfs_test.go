@@ -0,0 +1,303 @@
+package localfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+func prepFileSystem(t *testing.T) (string, *LocalFileSystem) {
+	dir, err := ioutil.TempDir("", "dragonstash-localfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, NewLocalFileSystem(dir)
+}
+
+func TestCreateAndWrite(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	f, err := fs.Create("/file", os.O_RDWR|os.O_EXCL, 0640)
+	assert.Nil(t, err)
+
+	n, err := f.Write([]byte("world"), 6)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	n, err = f.Write([]byte("hello "), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.Nil(t, f.Sync())
+	f.Release()
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "file"))
+	assert.Equal(t, []byte("hello world"), contents)
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0640), stat.Mode())
+
+	_, err = fs.Create("/file", os.O_RDWR|os.O_EXCL, 0640)
+	assert.Equal(t, uintptr(syscall.EEXIST), err.Errno())
+}
+
+func TestMkdirAndRmdir(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, fs.Mkdir("/dir", 0750))
+	stat, err := fs.Lstat("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0750), stat.Mode())
+
+	assert.Equal(t, uintptr(syscall.EEXIST), fs.Mkdir("/dir", 0750).Errno())
+
+	ioutil.WriteFile(filepath.Join(dir, "dir", "file"), nil, 0644)
+	assert.Equal(t, uintptr(syscall.ENOTEMPTY), fs.Rmdir("/dir").Errno())
+	assert.Equal(t, uintptr(syscall.EISDIR), fs.Unlink("/dir").Errno())
+
+	assert.Nil(t, fs.Unlink("/dir/file"))
+	assert.Nil(t, fs.Rmdir("/dir"))
+	_, err = fs.Lstat("/dir")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestUnlinkNonexistant(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	assert.Equal(t, uintptr(syscall.ENOENT), fs.Unlink("/nonexistant").Errno())
+	assert.Equal(t, uintptr(syscall.ENOENT), fs.Rmdir("/nonexistant").Errno())
+}
+
+func TestRename(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0644)
+
+	assert.Nil(t, fs.Rename("/a", "/b"))
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "b"))
+	assert.Equal(t, []byte("a"), contents)
+
+	assert.Equal(t, uintptr(syscall.ENOENT), fs.Rename("/a", "/c").Errno())
+}
+
+func TestSymlink(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, fs.Symlink("some/target", "/link"))
+	dest, err := fs.Readlink("/link")
+	assert.Nil(t, err)
+	assert.Equal(t, "some/target", dest)
+}
+
+func TestChmodAndTruncate(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644)
+
+	assert.Nil(t, fs.Chmod("/file", 0600|syscall.S_ISGID))
+	assert.Nil(t, fs.Truncate("/file", 4))
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0600|syscall.S_ISGID), stat.Mode())
+	assert.Equal(t, uint64(4), stat.Size())
+
+	assert.Equal(t, uintptr(syscall.ENOENT), fs.Chmod("/nonexistant", 0600).Errno())
+}
+
+func TestChownToSelf(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	assert.Nil(t, fs.Chown("/file", uint32(os.Getuid()), uint32(os.Getgid())))
+}
+
+func TestUtimensKeepsOmittedTime(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	atime := time.Unix(1000, 0)
+	mtime := time.Unix(2000, 0)
+
+	assert.Nil(t, fs.Utimens("/file", &atime, &mtime))
+	stat, _ := fs.Lstat("/file")
+	assert.Equal(t, uint64(1000), stat.Atime())
+	assert.Equal(t, uint64(2000), stat.Mtime())
+
+	mtime = time.Unix(3000, 0)
+	assert.Nil(t, fs.Utimens("/file", nil, &mtime))
+	stat, _ = fs.Lstat("/file")
+	assert.Equal(t, uint64(1000), stat.Atime())
+	assert.Equal(t, uint64(3000), stat.Mtime())
+}
+
+func TestUtimensKeepsNanoseconds(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	atime := time.Unix(1000, 123456789)
+	mtime := time.Unix(2000, 987654321)
+
+	assert.Nil(t, fs.Utimens("/file", &atime, &mtime))
+	stat, _ := fs.Lstat("/file")
+	assert.Equal(t, uint32(123456789), stat.AtimeNsec())
+	assert.Equal(t, uint32(987654321), stat.MtimeNsec())
+}
+
+func TestFileAttributeOperations(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644)
+	f, err := fs.OpenFile("/file", os.O_RDWR)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	atime := time.Unix(1000, 0)
+	assert.Nil(t, f.Truncate(2))
+	assert.Nil(t, f.Chmod(0600))
+	assert.Nil(t, f.Chown(uint32(os.Getuid()), uint32(os.Getgid())))
+	assert.Nil(t, f.Utimens(&atime, nil))
+
+	stat, _ := fs.Lstat("/file")
+	assert.Equal(t, uint64(2), stat.Size())
+	assert.Equal(t, uint32(syscall.S_IFREG|0600), stat.Mode())
+	assert.Equal(t, uint64(1000), stat.Atime())
+}
+
+func TestFileUtimensKeepsNanosecondsAndOmittedTime(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	f, err := fs.OpenFile("/file", os.O_RDWR)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	atime := time.Unix(1000, 123456789)
+	mtime := time.Unix(2000, 987654321)
+	assert.Nil(t, f.Utimens(&atime, &mtime))
+
+	mtime = time.Unix(3000, 5)
+	assert.Nil(t, f.Utimens(nil, &mtime))
+
+	stat, _ := fs.Lstat("/file")
+	assert.Equal(t, uint64(1000), stat.Atime())
+	assert.Equal(t, uint32(123456789), stat.AtimeNsec())
+	assert.Equal(t, uint64(3000), stat.Mtime())
+	assert.Equal(t, uint32(5), stat.MtimeNsec())
+}
+
+func TestWriteToReadOnlyFileFails(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	f, _ := fs.OpenFile("/file", os.O_RDONLY)
+	defer f.Release()
+
+	_, err := f.Write([]byte("foo"), 0)
+	assert.Equal(t, uintptr(syscall.EBADF), err.Errno())
+}
+
+func TestFlockConflictsBetweenFiles(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	f1, _ := fs.OpenFile("/file", os.O_RDONLY)
+	defer f1.Release()
+	f2, _ := fs.OpenFile("/file", os.O_RDONLY)
+	defer f2.Release()
+
+	assert.Nil(t, f1.Flock(syscall.LOCK_EX))
+	err := f2.Flock(syscall.LOCK_SH | syscall.LOCK_NB)
+	assert.Equal(t, uintptr(syscall.EWOULDBLOCK), err.Errno())
+	assert.Nil(t, f1.Flock(syscall.LOCK_UN))
+	assert.Nil(t, f2.Flock(syscall.LOCK_SH|syscall.LOCK_NB))
+}
+
+func TestRecordLocksConflictBetweenFiles(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	f1, _ := fs.OpenFile("/file", os.O_RDWR)
+	defer f1.Release()
+	f2, _ := fs.OpenFile("/file", os.O_RDWR)
+	defer f2.Release()
+
+	lock := &layer.Lock{Type: syscall.F_WRLCK, Start: 10, End: 19}
+	assert.Nil(t, f1.SetLk(1, lock, false))
+
+	held, err := f2.GetLk(1, &layer.Lock{Type: syscall.F_RDLCK, Start: 0, End: layer.LOCK_EOF})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.F_WRLCK), held.Type)
+	assert.Equal(t, uint64(10), held.Start)
+	assert.Equal(t, uint64(19), held.End)
+
+	err = f2.SetLk(1, &layer.Lock{Type: syscall.F_RDLCK, Start: 15, End: 15}, false)
+	assert.Equal(t, uintptr(syscall.EAGAIN), err.Errno())
+	assert.Nil(t, f2.SetLk(1, &layer.Lock{Type: syscall.F_WRLCK, Start: 20, End: layer.LOCK_EOF}, false))
+}
+
+func TestXattrs(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	err := fs.Setxattr("/file", "user.foo", []byte("bar"), 0)
+	if err != nil && err.Errno() == uintptr(syscall.ENOTSUP) {
+		t.Skip("no user xattrs on the temporary directory")
+	}
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Setxattr("/file", "user.empty", nil, 0))
+
+	value, err := fs.Getxattr("/file", "user.foo")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	value, err = fs.Getxattr("/file", "user.empty")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(value))
+
+	names, err := fs.Listxattr("/file")
+	assert.Nil(t, err)
+	assert.Contains(t, names, "user.foo")
+	assert.Contains(t, names, "user.empty")
+
+	err = fs.Setxattr("/file", "user.foo", []byte("baz"), 0x1)
+	assert.Equal(t, uintptr(syscall.EEXIST), err.Errno())
+
+	assert.Nil(t, fs.Removexattr("/file", "user.foo"))
+	_, err = fs.Getxattr("/file", "user.foo")
+	assert.Equal(t, uintptr(syscall.ENODATA), err.Errno())
+}
+
+func TestHardLinksShareIno(t *testing.T) {
+	dir, fs := prepFileSystem(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	os.Link(filepath.Join(dir, "file"), filepath.Join(dir, "link"))
+
+	stat1, _ := fs.Lstat("/file")
+	stat2, _ := fs.Lstat("/link")
+	assert.NotEqual(t, uint64(0), stat1.Ino())
+	assert.Equal(t, stat1.Ino(), stat2.Ino())
+	assert.Equal(t, uint32(2), stat1.Nlink())
+}
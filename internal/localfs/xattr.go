@@ -0,0 +1,178 @@
+package localfs
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+// The syscall package only has the variants of the xattr calls which follow
+// symlinks; like everything else, the source is accessed without following
+// them.
+
+func lgetxattr(path string, name string, dest []byte) (int, error) {
+	path_ptr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	name_ptr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var dest_ptr unsafe.Pointer
+	if len(dest) > 0 {
+		dest_ptr = unsafe.Pointer(&dest[0])
+	}
+	n, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR,
+		uintptr(unsafe.Pointer(path_ptr)),
+		uintptr(unsafe.Pointer(name_ptr)),
+		uintptr(dest_ptr),
+		uintptr(len(dest)),
+		0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func llistxattr(path string, dest []byte) (int, error) {
+	path_ptr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var dest_ptr unsafe.Pointer
+	if len(dest) > 0 {
+		dest_ptr = unsafe.Pointer(&dest[0])
+	}
+	n, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR,
+		uintptr(unsafe.Pointer(path_ptr)),
+		uintptr(dest_ptr),
+		uintptr(len(dest)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func lsetxattr(path string, name string, value []byte, flags int) error {
+	path_ptr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	name_ptr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var value_ptr unsafe.Pointer
+	if len(value) > 0 {
+		value_ptr = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(path_ptr)),
+		uintptr(unsafe.Pointer(name_ptr)),
+		uintptr(value_ptr),
+		uintptr(len(value)),
+		uintptr(flags),
+		0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func lremovexattr(path string, name string) error {
+	path_ptr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	name_ptr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_LREMOVEXATTR,
+		uintptr(unsafe.Pointer(path_ptr)),
+		uintptr(unsafe.Pointer(name_ptr)),
+		0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Call read with a buffer of the size it reports for a nil buffer; the value
+// may grow in between, so this is retried on ERANGE.
+func readSized(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func (m *LocalFileSystem) Getxattr(path string, name string) ([]byte, layer.Error) {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	value, err := readSized(func(dest []byte) (int, error) {
+		return lgetxattr(path, name, dest)
+	})
+	if err != nil {
+		return nil, layer.WrapError(err)
+	}
+	return value, nil
+}
+
+func (m *LocalFileSystem) Listxattr(path string) ([]string, layer.Error) {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	buf, err := readSized(func(dest []byte) (int, error) {
+		return llistxattr(path, dest)
+	})
+	if err != nil {
+		return nil, layer.WrapError(err)
+	}
+
+	// the names are NUL terminated
+	var result []string
+	for _, name := range strings.Split(string(buf), "\x00") {
+		if name != "" {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+func (m *LocalFileSystem) Setxattr(path string, name string, value []byte, flags int) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(lsetxattr(path, name, value, flags))
+}
+
+func (m *LocalFileSystem) Removexattr(path string, name string) layer.Error {
+	path, fserr := m.fullPath(path)
+	if fserr != nil {
+		return fserr
+	}
+
+	return layer.WrapError(lremovexattr(path, name))
+}
@@ -0,0 +1,493 @@
+package s3fs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	DEFAULT_TIMEOUT = 30 * time.Second
+	DEFAULT_REGION  = "us-east-1"
+
+	mode_DIR = syscall.S_IFDIR | 0555
+	mode_REG = syscall.S_IFREG | 0444
+)
+
+type Config struct {
+	// Base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com;
+	// buckets are addressed path-style below it
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Key prefix which is used as root of the file system
+	Prefix string
+
+	// If AccessKey is empty, requests are sent unsigned
+	AccessKey string
+	SecretKey string
+
+	// HTTP client to use; if nil, a client with DEFAULT_TIMEOUT is used
+	Client *http.Client
+}
+
+// S3FileSystem is a read-only source backed by an S3 bucket.
+//
+// Keys are split at slashes into directories. A directory exists if any key
+// starts with its path followed by a slash; directory marker objects (keys
+// ending in a slash) are recognized but not required.
+type S3FileSystem struct {
+	layer.ReadOnlyFileSystem
+	client     *http.Client
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	prefix     string
+	access_key string
+	secret_key string
+	uid        uint32
+	gid        uint32
+}
+
+func NewS3FileSystem(config *Config) (*S3FileSystem, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket given")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint: %s", config.Endpoint)
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+
+	region := config.Region
+	if region == "" {
+		region = DEFAULT_REGION
+	}
+
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3FileSystem{
+		client:     client,
+		endpoint:   endpoint,
+		region:     region,
+		bucket:     config.Bucket,
+		prefix:     prefix,
+		access_key: config.AccessKey,
+		secret_key: config.SecretKey,
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+	}, nil
+}
+
+// Return the object key for a path; the root maps to the prefix
+func (m *S3FileSystem) key(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	return m.prefix + p
+}
+
+// Return the key prefix of the objects inside the directory at a path
+func (m *S3FileSystem) dirPrefix(p string) string {
+	key := m.key(p)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+func (m *S3FileSystem) newRequest(method string, key string, params map[string]string) *http.Request {
+	u := *m.endpoint
+	raw_path := strings.TrimSuffix(u.EscapedPath(), "/") + "/" +
+		uriEncode(m.bucket, false)
+	if key != "" {
+		raw_path += "/" + uriEncode(key, true)
+	}
+	u.Path, _ = url.PathUnescape(raw_path)
+	u.RawPath = raw_path
+	u.RawQuery = canonicalQuery(params)
+
+	req := &http.Request{
+		Method: method,
+		URL:    &u,
+		Header: make(http.Header),
+		Host:   u.Host,
+	}
+	return req
+}
+
+func (m *S3FileSystem) do(req *http.Request) (*http.Response, layer.Error) {
+	if m.access_key != "" {
+		signRequest(req, m.access_key, m.secret_key, m.region, time.Now())
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("s3: %s %s: %s", req.Method, req.URL, err)
+		return nil, layer.NewBackendError(err.Error(), syscall.ENOTCONN)
+	}
+	return resp, nil
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func statusToError(resp *http.Response) layer.Error {
+	var errno syscall.Errno
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		errno = syscall.ENOENT
+	case http.StatusForbidden, http.StatusUnauthorized:
+		errno = syscall.EACCES
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		// S3 asks clients to retry on these, so treat the service as
+		// temporarily unavailable
+		errno = syscall.ENOTCONN
+	case http.StatusRequestTimeout:
+		errno = syscall.ETIMEDOUT
+	default:
+		errno = syscall.EIO
+	}
+
+	message := resp.Status
+	var body s3ErrorResponse
+	if resp.Request.Method != "HEAD" && xml.NewDecoder(resp.Body).Decode(&body) == nil && body.Code != "" {
+		message = fmt.Sprintf("%s: %s", body.Code, body.Message)
+	}
+
+	return layer.NewBackendError(
+		fmt.Sprintf("s3: %s %s: %s", resp.Request.Method, resp.Request.URL.Path, message),
+		errno,
+	)
+}
+
+type listBucketResult struct {
+	IsTruncated           bool `xml:"IsTruncated"`
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified string
+		Size         uint64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// Call fn for each page of the listing of the objects starting with prefix,
+// grouped by the next slash.
+//
+// Listing stops early if fn returns false or once max_keys keys have been
+// requested; max_keys of 0 means no limit.
+func (m *S3FileSystem) list(prefix string, max_keys int, fn func(*listBucketResult) bool) layer.Error {
+	params := map[string]string{
+		"list-type": "2",
+		"delimiter": "/",
+		"prefix":    prefix,
+	}
+	if max_keys > 0 {
+		params["max-keys"] = fmt.Sprintf("%d", max_keys)
+	}
+
+	for {
+		resp, err := m.do(m.newRequest("GET", "", params))
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = statusToError(resp)
+			resp.Body.Close()
+			return err
+		}
+
+		var result listBucketResult
+		xmlerr := xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if xmlerr != nil {
+			log.Printf("s3: malformed listing of %s: %s", prefix, xmlerr)
+			return layer.WrapError(syscall.EIO)
+		}
+
+		if !fn(&result) || !result.IsTruncated || max_keys > 0 {
+			return nil
+		}
+		params["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+func (m *S3FileSystem) dirStat() *S3FileStat {
+	return &S3FileStat{
+		mode: mode_DIR,
+		uid:  m.uid,
+		gid:  m.gid,
+	}
+}
+
+func (m *S3FileSystem) fileStat(size uint64, mtime time.Time) *S3FileStat {
+	return &S3FileStat{
+		mode:       mode_REG,
+		size:       size,
+		mtime:      uint64(mtime.Unix()),
+		mtime_nsec: uint32(mtime.Nanosecond()),
+		uid:        m.uid,
+		gid:        m.gid,
+	}
+}
+
+// Always returns true; S3 has no sessions whose state could be checked.
+func (m *S3FileSystem) IsReady() bool {
+	return true
+}
+
+func (m *S3FileSystem) Join(elems ...string) string {
+	return path.Join(elems...)
+}
+
+func (m *S3FileSystem) Lstat(p string) (layer.FileStat, layer.Error) {
+	if path.Clean("/"+p) == "/" {
+		return m.dirStat(), nil
+	}
+
+	resp, err := m.do(m.newRequest("HEAD", m.key(p), nil))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var size uint64
+		if resp.ContentLength > 0 {
+			size = uint64(resp.ContentLength)
+		}
+		mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return m.fileStat(size, mtime), nil
+	case http.StatusNotFound:
+		// may still be a directory
+	default:
+		return nil, statusToError(resp)
+	}
+
+	found := false
+	err = m.list(m.dirPrefix(p), 1, func(result *listBucketResult) bool {
+		found = len(result.Contents) > 0 || len(result.CommonPrefixes) > 0
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, layer.WrapError(syscall.ENOENT)
+	}
+	return m.dirStat(), nil
+}
+
+func (m *S3FileSystem) OpenDir(p string) ([]layer.DirEntry, layer.Error) {
+	prefix := m.dirPrefix(p)
+	found := false
+	entries := []layer.DirEntry{}
+
+	err := m.list(prefix, 0, func(result *listBucketResult) bool {
+		for _, common := range result.CommonPrefixes {
+			found = true
+			name := strings.TrimSuffix(common.Prefix[len(prefix):], "/")
+			if name == "" {
+				continue
+			}
+			entries = append(entries, &S3DirEntry{
+				name: name,
+				stat: m.dirStat(),
+			})
+		}
+		for _, object := range result.Contents {
+			found = true
+			name := object.Key[len(prefix):]
+			if name == "" {
+				// directory marker
+				continue
+			}
+			mtime, _ := time.Parse(time.RFC3339, object.LastModified)
+			entries = append(entries, &S3DirEntry{
+				name: name,
+				stat: m.fileStat(object.Size, mtime),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found && prefix != m.prefix {
+		return nil, layer.WrapError(syscall.ENOENT)
+	}
+	return entries, nil
+}
+
+// S3 has no symlinks; this always fails with EINVAL.
+func (m *S3FileSystem) Readlink(p string) (string, layer.Error) {
+	return "", layer.WrapError(syscall.EINVAL)
+}
+
+func (m *S3FileSystem) OpenFile(p string, flags int) (layer.File, layer.Error) {
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, layer.WrapError(syscall.EROFS)
+	}
+
+	return &S3File{
+		fs:  m,
+		key: m.key(p),
+	}, nil
+}
+
+type S3DirEntry struct {
+	name string
+	stat *S3FileStat
+}
+
+func (m *S3DirEntry) Name() string {
+	return m.name
+}
+
+func (m *S3DirEntry) Mode() uint32 {
+	return m.stat.Mode()
+}
+
+func (m *S3DirEntry) Stat() layer.FileStat {
+	return m.stat
+}
+
+// S3 only provides the modification time; it is used for all timestamps.
+type S3FileStat struct {
+	mode       uint32
+	size       uint64
+	mtime      uint64
+	mtime_nsec uint32
+	uid        uint32
+	gid        uint32
+}
+
+func (m *S3FileStat) Mtime() uint64 {
+	return m.mtime
+}
+
+func (m *S3FileStat) Atime() uint64 {
+	return m.mtime
+}
+
+func (m *S3FileStat) Ctime() uint64 {
+	return m.mtime
+}
+
+func (m *S3FileStat) MtimeNsec() uint32 {
+	return m.mtime_nsec
+}
+
+func (m *S3FileStat) AtimeNsec() uint32 {
+	return m.mtime_nsec
+}
+
+func (m *S3FileStat) CtimeNsec() uint32 {
+	return m.mtime_nsec
+}
+
+func (m *S3FileStat) Ino() uint64 {
+	return 0
+}
+
+func (m *S3FileStat) Nlink() uint32 {
+	return 1
+}
+
+func (m *S3FileStat) Rdev() uint64 {
+	return 0
+}
+
+func (m *S3FileStat) Blocks() uint64 {
+	return (m.size + 511) / 512
+}
+
+func (m *S3FileStat) Mode() uint32 {
+	return m.mode
+}
+
+func (m *S3FileStat) OwnerGID() uint32 {
+	return m.gid
+}
+
+func (m *S3FileStat) OwnerUID() uint32 {
+	return m.uid
+}
+
+func (m *S3FileStat) Size() uint64 {
+	return m.size
+}
+
+// S3File reads an object with one ranged GET per Read call.
+type S3File struct {
+	layer.ReadOnlyFile
+	fs  *S3FileSystem
+	key string
+}
+
+func (m *S3File) Read(dest []byte, position int64) (int, layer.Error) {
+	if len(dest) == 0 {
+		return 0, nil
+	}
+
+	req := m.fs.newRequest("GET", m.key, nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d",
+		position, position+int64(len(dest))-1))
+
+	resp, err := m.fs.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// reading at or beyond the end of the object
+		return 0, nil
+	default:
+		return 0, statusToError(resp)
+	}
+
+	n, ioerr := io.ReadFull(resp.Body, dest)
+	if ioerr == io.EOF || ioerr == io.ErrUnexpectedEOF {
+		ioerr = nil
+	}
+	if ioerr != nil {
+		log.Printf("Read(): %s\n", ioerr)
+		return n, layer.NewBackendError(ioerr.Error(), syscall.ENOTCONN)
+	}
+	return n, nil
+}
+
+func (m *S3File) Release() {
+}
@@ -0,0 +1,406 @@
+package s3fs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horazont/dragonstash/internal/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMtime = time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC)
+
+const (
+	testBucket    = "media"
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "secret"
+)
+
+// A minimal S3 server serving a single bucket from a fixed set of objects.
+//
+// Listings are paginated with at most pageSize keys per page.
+type fakeServer struct {
+	objects  map[string][]byte
+	pageSize int
+
+	lock   sync.Mutex
+	ranges []string
+	lists  int
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		objects: map[string][]byte{
+			"file":           []byte("0123456789"),
+			"dir/a":          []byte("a"),
+			"dir/with space": []byte("spaced"),
+			"dir/sub/b":      []byte("b"),
+			"dir/sub/c":      []byte("c"),
+			"marked/":        []byte{},
+		},
+		pageSize: 2,
+	}
+}
+
+type fakeObject struct {
+	Key          string
+	LastModified string
+	Size         int
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+type fakeListing struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	IsTruncated           bool
+	NextContinuationToken string       `xml:",omitempty"`
+	Contents              []fakeObject `xml:"Contents"`
+	CommonPrefixes        []fakePrefix `xml:"CommonPrefixes"`
+}
+
+// Return the sorted keys and common prefixes below prefix, grouped by
+// delimiter
+func (m *fakeServer) entries(prefix string, delimiter string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for key := range m.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			result = append(result, entry)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	entries := m.entries(query.Get("prefix"), query.Get("delimiter"))
+
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	limit := m.pageSize
+	if max_keys, err := strconv.Atoi(query.Get("max-keys")); err == nil && max_keys < limit {
+		limit = max_keys
+	}
+
+	result := fakeListing{}
+	end := start + limit
+	if end < len(entries) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(entries)
+	}
+
+	for _, entry := range entries[start:end] {
+		if _, ok := m.objects[entry]; ok {
+			result.Contents = append(result.Contents, fakeObject{
+				Key:          entry,
+				LastModified: testMtime.Format(time.RFC3339),
+				Size:         len(m.objects[entry]),
+			})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakePrefix{entry})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&result)
+}
+
+func (m *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != testBucket {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>"))
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		m.lock.Lock()
+		m.lists += 1
+		m.lock.Unlock()
+		m.list(w, r)
+		return
+	}
+
+	key := parts[1]
+	data, ok := m.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != "HEAD" {
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+		}
+		return
+	}
+
+	if r.Method == "GET" {
+		m.lock.Lock()
+		m.ranges = append(m.ranges, r.Header.Get("Range"))
+		m.lock.Unlock()
+	}
+	http.ServeContent(w, r, key, testMtime, bytes.NewReader(data))
+}
+
+func prepServer(prefix string) (*fakeServer, *httptest.Server, *S3FileSystem) {
+	backend := newFakeServer()
+	server := httptest.NewServer(backend)
+	fs, err := NewS3FileSystem(&Config{
+		Endpoint: server.URL,
+		Bucket:   testBucket,
+		Prefix:   prefix,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return backend, server, fs
+}
+
+func TestNewS3FileSystemValidatesConfig(t *testing.T) {
+	_, err := NewS3FileSystem(&Config{Endpoint: "http://localhost"})
+	assert.NotNil(t, err)
+
+	_, err = NewS3FileSystem(&Config{Endpoint: "localhost", Bucket: "foo"})
+	assert.NotNil(t, err)
+}
+
+func TestLstatObject(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0444), stat.Mode())
+	assert.Equal(t, uint64(10), stat.Size())
+	assert.Equal(t, uint64(testMtime.Unix()), stat.Mtime())
+	assert.Equal(t, uint32(os.Getuid()), stat.OwnerUID())
+}
+
+func TestLstatCommonPrefix(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	stat, err := fs.Lstat("/dir/sub")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+
+	stat, err = fs.Lstat("/marked")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+
+	stat, err = fs.Lstat("/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0555), stat.Mode())
+}
+
+func TestLstatNonexistant(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	_, err := fs.Lstat("/nonexistant")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestOpenDir(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	entries, err := fs.OpenDir("/dir")
+	assert.Nil(t, err)
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"a", "sub", "with space"}, names)
+
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "a":
+			assert.Equal(t, uint32(syscall.S_IFREG|0444), entry.Mode())
+			assert.Equal(t, uint64(1), entry.Stat().Size())
+			assert.Equal(t, uint64(testMtime.Unix()), entry.Stat().Mtime())
+		case "sub":
+			assert.Equal(t, uint32(syscall.S_IFDIR|0555), entry.Mode())
+		}
+	}
+}
+
+func TestOpenDirFollowsPagination(t *testing.T) {
+	backend, server, fs := prepServer("")
+	defer server.Close()
+
+	entries, err := fs.OpenDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, 2, backend.lists)
+}
+
+func TestOpenDirSkipsDirectoryMarker(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	entries, err := fs.OpenDir("/marked")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestOpenDirNonexistant(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	_, err := fs.OpenDir("/nonexistant")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestPrefixAsRoot(t *testing.T) {
+	_, server, fs := prepServer("/dir/")
+	defer server.Close()
+
+	entries, err := fs.OpenDir("/sub")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	stat, err := fs.Lstat("/with space")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), stat.Size())
+
+	entries, err = fs.OpenDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+}
+
+func TestReadUsesOneRangedGetPerCall(t *testing.T) {
+	backend, server, fs := prepServer("")
+	defer server.Close()
+
+	f, err := fs.OpenFile("/file", os.O_RDONLY)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	buf := make([]byte, 4)
+	n, err := f.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("0123"), buf)
+
+	n, err = f.Read(buf, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("4567"), buf)
+
+	// short read at the end of the object
+	n, err = f.Read(buf, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("89"), buf[:n])
+
+	n, err = f.Read(buf, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	assert.Equal(t, []string{"bytes=0-3", "bytes=4-7", "bytes=8-11", "bytes=10-13"}, backend.ranges)
+}
+
+func TestReadKeyWithSpecialCharacters(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	f, _ := fs.OpenFile("/dir/with space", os.O_RDONLY)
+	defer f.Release()
+
+	buf := make([]byte, 16)
+	n, err := f.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("spaced"), buf[:n])
+}
+
+func TestReadNonexistant(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	f, _ := fs.OpenFile("/nonexistant", os.O_RDONLY)
+	defer f.Release()
+
+	_, err := f.Read(make([]byte, 4), 0)
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestOpenFileForWritingFails(t *testing.T) {
+	_, server, fs := prepServer("")
+	defer server.Close()
+
+	_, err := fs.OpenFile("/file", os.O_RDWR)
+	assert.Equal(t, uintptr(syscall.EROFS), err.Errno())
+}
+
+func TestRequestsAreSigned(t *testing.T) {
+	backend := newFakeServer()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+testAccessKey+"/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	config := &Config{
+		Endpoint: server.URL,
+		Bucket:   testBucket,
+	}
+	fs, _ := NewS3FileSystem(config)
+	_, err := fs.Lstat("/file")
+	assert.Equal(t, uintptr(syscall.EACCES), err.Errno())
+
+	config.AccessKey = testAccessKey
+	config.SecretKey = testSecretKey
+	fs, _ = NewS3FileSystem(config)
+	_, err = fs.Lstat("/file")
+	assert.Nil(t, err)
+	_, err = fs.OpenDir("/dir")
+	assert.Nil(t, err)
+}
+
+func TestServerErrorsAreUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	fs, _ := NewS3FileSystem(&Config{
+		Endpoint: server.URL,
+		Bucket:   testBucket,
+	})
+
+	_, err := fs.Lstat("/file")
+	assert.True(t, layer.IsUnavailableError(err))
+
+	server.Close()
+	_, err = fs.OpenDir("/")
+	assert.True(t, layer.IsUnavailableError(err))
+
+	f, _ := fs.OpenFile("/file", os.O_RDONLY)
+	_, err = f.Read(make([]byte, 4), 0)
+	assert.True(t, layer.IsUnavailableError(err))
+}
@@ -0,0 +1,130 @@
+package s3fs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sign_ALGORITHM = "AWS4-HMAC-SHA256"
+	sign_SERVICE   = "s3"
+
+	// SHA-256 of the empty string; all requests we make have no body
+	EMPTY_PAYLOAD_HASH = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Escape a string as required for the canonical request of AWS signature
+// version 4: everything except unreserved characters is percent-encoded.
+//
+// If keep_slash is true, slashes are passed through unchanged.
+func uriEncode(s string, keep_slash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' ||
+			(keep_slash && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// Return the canonical query string for the given parameters
+func canonicalQuery(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = uriEncode(key, false) + "=" + uriEncode(params[key], false)
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign a request with AWS signature version 4.
+//
+// The request must have no body. The URL must use the canonical encoding for
+// its path (RawPath) and query (RawQuery), as produced by uriEncode and
+// canonicalQuery. All headers present on the request are signed.
+func signRequest(req *http.Request, access_key string, secret_key string, region string, now time.Time) {
+	now = now.UTC()
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amz_date)
+	req.Header.Set("X-Amz-Content-Sha256", EMPTY_PAYLOAD_HASH)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical_headers strings.Builder
+	for _, name := range names {
+		canonical_headers.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed_headers := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical_request := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonical_headers.String(),
+		signed_headers,
+		EMPTY_PAYLOAD_HASH,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + sign_SERVICE + "/aws4_request"
+	string_to_sign := strings.Join([]string{
+		sign_ALGORITHM,
+		amz_date,
+		scope,
+		sha256Hex(canonical_request),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret_key), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, sign_SERVICE)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, string_to_sign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sign_ALGORITHM, access_key, scope, signed_headers, signature,
+	))
+}
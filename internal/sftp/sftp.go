@@ -0,0 +1,866 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/horazont/dragonstash/internal/layer"
+)
+
+const (
+	DEFAULT_PORT           = 22
+	DEFAULT_RETRY_INTERVAL = 5 * time.Second
+	DEFAULT_DIAL_TIMEOUT   = 10 * time.Second
+)
+
+var (
+	ErrNoAuthMethods = errors.New("no usable SSH authentication methods")
+)
+
+// SFTP status codes as defined in draft-ietf-secsh-filexfer-13. The client
+// library does not export them.
+const (
+	fx_EOF                 = 1
+	fx_NO_SUCH_FILE        = 2
+	fx_PERMISSION_DENIED   = 3
+	fx_FAILURE             = 4
+	fx_BAD_MESSAGE         = 5
+	fx_NO_CONNECTION       = 6
+	fx_CONNECTION_LOST     = 7
+	fx_OP_UNSUPPORTED      = 8
+	fx_INVALID_HANDLE      = 9
+	fx_NO_SUCH_PATH        = 10
+	fx_FILE_ALREADY_EXISTS = 11
+	fx_WRITE_PROTECT       = 12
+	fx_NO_SPACE            = 14
+	fx_QUOTA_EXCEEDED      = 15
+	fx_LOCK_CONFLICT       = 17
+	fx_DIR_NOT_EMPTY       = 18
+	fx_NOT_A_DIRECTORY     = 19
+	fx_FILE_IS_A_DIRECTORY = 24
+)
+
+// Configuration for an SFTP source.
+type Config struct {
+	// Host name or address of the server
+	Host string
+
+	// TCP port; DEFAULT_PORT is used if zero
+	Port int
+
+	// Name of the remote user
+	User string
+
+	// Remote directory which is used as root of the file system
+	Root string
+
+	// Private key files to use for authentication
+	IdentityFiles []string
+
+	// Use the SSH agent at $SSH_AUTH_SOCK for authentication
+	UseAgent bool
+
+	// known_hosts file used for host key verification; defaults to
+	// ~/.ssh/known_hosts
+	KnownHostsFile string
+
+	// Timeout for establishing the connection
+	DialTimeout time.Duration
+
+	// Minimum time between two reconnection attempts
+	RetryInterval time.Duration
+}
+
+// A single SSH/SFTP session.
+type session struct {
+	client *sftpclient.Client
+	conn   io.Closer
+	done   chan struct{}
+}
+
+func (m *session) isAlive() bool {
+	select {
+	case <-m.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (m *session) close() {
+	m.client.Close()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+type connectFunc func() (*session, error)
+
+// SFTPv3 has no extended attributes.
+type SFTPFileSystem struct {
+	layer.NoXattrFileSystem
+	lock           *sync.Mutex
+	root           string
+	connect        connectFunc
+	session        *session
+	last_attempt   time.Time
+	retry_interval time.Duration
+}
+
+// Create a new SFTP file system.
+//
+// This does not connect to the server yet; the connection is established
+// on first use and re-established after it has been lost. An error is only
+// returned if the configuration is unusable.
+func NewSFTPFileSystem(config *Config) (*SFTPFileSystem, error) {
+	client_config, err := makeClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = DEFAULT_PORT
+	}
+	addr := net.JoinHostPort(config.Host, fmt.Sprintf("%d", port))
+
+	connect := func() (*session, error) {
+		return dialSession(addr, client_config)
+	}
+
+	root := config.Root
+	if root == "" {
+		root = "/"
+	}
+
+	retry_interval := config.RetryInterval
+	if retry_interval == 0 {
+		retry_interval = DEFAULT_RETRY_INTERVAL
+	}
+
+	return newSFTPFileSystem(connect, root, retry_interval), nil
+}
+
+func newSFTPFileSystem(connect connectFunc, root string, retry_interval time.Duration) *SFTPFileSystem {
+	return &SFTPFileSystem{
+		lock:           new(sync.Mutex),
+		root:           root,
+		connect:        connect,
+		retry_interval: retry_interval,
+	}
+}
+
+func makeClientConfig(config *Config) (*ssh.ClientConfig, error) {
+	auth := []ssh.AuthMethod{}
+
+	if config.UseAgent {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				conn, err := net.Dial("unix", sock)
+				if err != nil {
+					return nil, err
+				}
+				defer conn.Close()
+				return agent.NewClient(conn).Signers()
+			}))
+		} else {
+			log.Printf("sftp: SSH_AUTH_SOCK is not set, not using the agent")
+		}
+	}
+
+	signers := []ssh.Signer{}
+	for _, keyfile := range config.IdentityFiles {
+		data, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %s", keyfile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if len(auth) == 0 {
+		return nil, ErrNoAuthMethods
+	}
+
+	known_hosts := config.KnownHostsFile
+	if known_hosts == "" {
+		known_hosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+	host_key_callback, err := knownhosts.New(known_hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := config.DialTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_DIAL_TIMEOUT
+	}
+
+	return &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            auth,
+		HostKeyCallback: host_key_callback,
+		Timeout:         timeout,
+	}, nil
+}
+
+func dialSession(addr string, config *ssh.ClientConfig) (*session, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftpclient.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	result := &session{
+		client: client,
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		conn.Wait()
+		close(result.done)
+	}()
+
+	return result, nil
+}
+
+// Return the current session, connecting if necessary and allowed.
+//
+// Must be called with the lock held.
+func (m *SFTPFileSystem) getSession() *session {
+	if m.session != nil {
+		if m.session.isAlive() {
+			return m.session
+		}
+		log.Printf("sftp: session to %s was lost", m.root)
+		m.session.close()
+		m.session = nil
+	}
+
+	if !m.last_attempt.IsZero() && time.Since(m.last_attempt) < m.retry_interval {
+		return nil
+	}
+	m.last_attempt = time.Now()
+
+	session, err := m.connect()
+	if err != nil {
+		log.Printf("sftp: failed to connect: %s", err)
+		return nil
+	}
+	m.session = session
+	return session
+}
+
+func (m *SFTPFileSystem) client() (*session, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	session := m.getSession()
+	if session == nil {
+		return nil, layer.NewBackendError("sftp: not connected", syscall.ENOTCONN)
+	}
+	return session, nil
+}
+
+// Drop a session after a connection-level error.
+func (m *SFTPFileSystem) dropSession(session *session) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.session == session {
+		session.close()
+		m.session = nil
+	}
+}
+
+// Convert an error from the SFTP client into a layer.Error.
+//
+// Errors which are not SFTP status codes indicate that the session is broken;
+// it is dropped so that the next operation reconnects.
+//
+// The client turns some status codes into errors of the os and io packages;
+// these are no connection errors either.
+func (m *SFTPFileSystem) wrapError(session *session, err error) layer.Error {
+	if err == nil {
+		return nil
+	}
+
+	switch err {
+	case os.ErrNotExist:
+		return layer.WrapError(err)
+	case os.ErrPermission:
+		return layer.NewBackendError(err.Error(), syscall.EACCES)
+	case io.EOF:
+		// reads deal with the end of the file themselves; anywhere
+		// else the server has no data for the request
+		return layer.NewBackendError(err.Error(), syscall.ENODATA)
+	}
+
+	status, ok := err.(*sftpclient.StatusError)
+	if !ok {
+		log.Printf("sftp: dropping session after error: %s", err)
+		m.dropSession(session)
+		return layer.NewBackendError(err.Error(), syscall.ENOTCONN)
+	}
+
+	var errno syscall.Errno
+	switch status.Code {
+	case fx_NO_SUCH_FILE, fx_NO_SUCH_PATH:
+		errno = syscall.ENOENT
+	case fx_PERMISSION_DENIED:
+		errno = syscall.EACCES
+	case fx_BAD_MESSAGE:
+		errno = syscall.EBADMSG
+	case fx_NO_CONNECTION, fx_CONNECTION_LOST:
+		m.dropSession(session)
+		errno = syscall.ENOTCONN
+	case fx_OP_UNSUPPORTED:
+		errno = syscall.EOPNOTSUPP
+	case fx_INVALID_HANDLE:
+		errno = syscall.EBADF
+	case fx_FILE_ALREADY_EXISTS:
+		errno = syscall.EEXIST
+	case fx_WRITE_PROTECT:
+		errno = syscall.EROFS
+	case fx_NO_SPACE:
+		errno = syscall.ENOSPC
+	case fx_QUOTA_EXCEEDED:
+		errno = syscall.EDQUOT
+	case fx_LOCK_CONFLICT:
+		errno = syscall.EAGAIN
+	case fx_DIR_NOT_EMPTY:
+		errno = syscall.ENOTEMPTY
+	case fx_NOT_A_DIRECTORY:
+		errno = syscall.ENOTDIR
+	case fx_FILE_IS_A_DIRECTORY:
+		errno = syscall.EISDIR
+	default:
+		errno = syscall.EIO
+	}
+
+	return layer.NewBackendError(err.Error(), errno)
+}
+
+func (m *SFTPFileSystem) fullPath(p string) string {
+	return path.Join(m.root, path.Clean("/"+p))
+}
+
+// Return whether a session to the server is currently established.
+//
+// If there is no session, a reconnect is attempted, but not more often than
+// once per retry interval.
+func (m *SFTPFileSystem) IsReady() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.getSession() != nil
+}
+
+func (m *SFTPFileSystem) Join(elems ...string) string {
+	return path.Join(elems...)
+}
+
+// Close the current session, if any.
+func (m *SFTPFileSystem) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.session != nil {
+		m.session.close()
+		m.session = nil
+	}
+}
+
+func (m *SFTPFileSystem) Lstat(path string) (layer.FileStat, layer.Error) {
+	session, fserr := m.client()
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	stat, err := session.client.Lstat(m.fullPath(path))
+	if err != nil {
+		return nil, m.wrapError(session, err)
+	}
+
+	return wrapFileInfo(stat), nil
+}
+
+func (m *SFTPFileSystem) OpenDir(path string) ([]layer.DirEntry, layer.Error) {
+	session, fserr := m.client()
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	infos, err := session.client.ReadDir(m.fullPath(path))
+	if err != nil {
+		return nil, m.wrapError(session, err)
+	}
+
+	entries := make([]layer.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = wrapFileInfoIntoDirEntry(info)
+	}
+
+	return entries, nil
+}
+
+func (m *SFTPFileSystem) Readlink(path string) (string, layer.Error) {
+	session, fserr := m.client()
+	if fserr != nil {
+		return "", fserr
+	}
+
+	result, err := session.client.ReadLink(m.fullPath(path))
+	if err != nil {
+		return "", m.wrapError(session, err)
+	}
+
+	return result, nil
+}
+
+func (m *SFTPFileSystem) OpenFile(path string, flags int) (layer.File, layer.Error) {
+	session, fserr := m.client()
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	f, err := session.client.OpenFile(m.fullPath(path), flags)
+	if err != nil {
+		return nil, m.wrapError(session, err)
+	}
+
+	return newSFTPFile(m, session, f), nil
+}
+
+func (m *SFTPFileSystem) Create(path string, flags int, mode uint32) (layer.File, layer.Error) {
+	session, fserr := m.client()
+	if fserr != nil {
+		return nil, fserr
+	}
+
+	full_path := m.fullPath(path)
+	f, err := session.client.OpenFile(full_path, flags|os.O_CREATE|os.O_EXCL)
+	if err != nil && flags&os.O_EXCL == 0 {
+		// servers report existing files with a generic failure, so
+		// check whether the file is there
+		if _, staterr := session.client.Lstat(full_path); staterr == nil {
+			f, err = session.client.OpenFile(full_path, flags|os.O_CREATE)
+			if err != nil {
+				return nil, m.wrapError(session, err)
+			}
+			// like open(2), existing files keep their mode
+			return newSFTPFile(m, session, f), nil
+		}
+	}
+	if err != nil {
+		return nil, m.wrapError(session, err)
+	}
+
+	// the client does not allow passing the mode on open
+	if err := session.client.Chmod(full_path, toFileMode(mode)); err != nil {
+		f.Close()
+		return nil, m.wrapError(session, err)
+	}
+
+	return newSFTPFile(m, session, f), nil
+}
+
+func (m *SFTPFileSystem) Mkdir(path string, mode uint32) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	full_path := m.fullPath(path)
+	if err := session.client.Mkdir(full_path); err != nil {
+		return m.wrapError(session, err)
+	}
+
+	return m.wrapError(session, session.client.Chmod(full_path, toFileMode(mode)))
+}
+
+func (m *SFTPFileSystem) Unlink(path string) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	// Remove would also remove empty directories
+	full_path := m.fullPath(path)
+	stat, err := session.client.Lstat(full_path)
+	if err != nil {
+		return m.wrapError(session, err)
+	}
+	if stat.IsDir() {
+		return layer.WrapError(syscall.EISDIR)
+	}
+
+	return m.wrapError(session, session.client.Remove(full_path))
+}
+
+func (m *SFTPFileSystem) Rmdir(path string) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.wrapError(session, session.client.RemoveDirectory(m.fullPath(path)))
+}
+
+// Uses the posix-rename@openssh.com extension, so that an existing target is
+// replaced like with rename(2).
+func (m *SFTPFileSystem) Rename(oldpath string, newpath string) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.wrapError(session, session.client.PosixRename(
+		m.fullPath(oldpath),
+		m.fullPath(newpath),
+	))
+}
+
+func (m *SFTPFileSystem) Symlink(target string, path string) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.wrapError(session, session.client.Symlink(target, m.fullPath(path)))
+}
+
+func (m *SFTPFileSystem) Chmod(path string, mode uint32) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.wrapError(session, session.client.Chmod(m.fullPath(path), toFileMode(mode)))
+}
+
+func (m *SFTPFileSystem) Chown(path string, uid uint32, gid uint32) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.wrapError(session, session.client.Chown(m.fullPath(path), int(uid), int(gid)))
+}
+
+func (m *SFTPFileSystem) Truncate(path string, size uint64) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.wrapError(session, session.client.Truncate(m.fullPath(path), int64(size)))
+}
+
+func (m *SFTPFileSystem) Utimens(path string, atime *time.Time, mtime *time.Time) layer.Error {
+	session, fserr := m.client()
+	if fserr != nil {
+		return fserr
+	}
+
+	return m.chtimes(session, m.fullPath(path), atime, mtime)
+}
+
+// SFTP version 3 carries the access and modification time in whole seconds
+// and can only set both at once, so this is not a real UTIME_OMIT: a time
+// which is not to be changed is written back as the whole seconds reported by
+// the server, dropping any fraction the server had stored. The nanoseconds of
+// the given times are lost as well.
+func (m *SFTPFileSystem) chtimes(session *session, full_path string, atime *time.Time, mtime *time.Time) layer.Error {
+	if atime == nil || mtime == nil {
+		stat, err := session.client.Stat(full_path)
+		if err != nil {
+			return m.wrapError(session, err)
+		}
+		current := wrapFileInfo(stat)
+		if atime == nil {
+			t := time.Unix(int64(current.Atime()), 0)
+			atime = &t
+		}
+		if mtime == nil {
+			t := time.Unix(int64(current.Mtime()), 0)
+			mtime = &t
+		}
+	}
+
+	return m.wrapError(session, session.client.Chtimes(full_path, *atime, *mtime))
+}
+
+type SFTPDirEntry struct {
+	name    string
+	wrapped *SFTPFileStat
+}
+
+func wrapFileInfoIntoDirEntry(v os.FileInfo) *SFTPDirEntry {
+	return &SFTPDirEntry{
+		name:    v.Name(),
+		wrapped: wrapFileInfo(v),
+	}
+}
+
+func (m *SFTPDirEntry) Name() string {
+	return m.name
+}
+
+func (m *SFTPDirEntry) Mode() uint32 {
+	return m.wrapped.Mode()
+}
+
+func (m *SFTPDirEntry) Stat() layer.FileStat {
+	return m.wrapped
+}
+
+// SFTPv3 does not transfer ctime; Ctime returns the mtime instead. Times are
+// transferred in whole seconds, and inode numbers and link counts not at all.
+type SFTPFileStat struct {
+	backend sftpclient.FileStat
+}
+
+func wrapFileInfo(v os.FileInfo) *SFTPFileStat {
+	if stat, ok := v.Sys().(*sftpclient.FileStat); ok {
+		return &SFTPFileStat{*stat}
+	}
+	return &SFTPFileStat{sftpclient.FileStat{
+		Size:  uint64(v.Size()),
+		Mode:  fromFileMode(v.Mode()),
+		Mtime: uint32(v.ModTime().Unix()),
+		Atime: uint32(v.ModTime().Unix()),
+	}}
+}
+
+// Only the permission bits are passed on; the client library versions differ
+// in how they encode the other mode bits.
+func toFileMode(mode uint32) os.FileMode {
+	result := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		result |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		result |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		result |= os.ModeSticky
+	}
+	return result
+}
+
+func fromFileMode(mode os.FileMode) uint32 {
+	result := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		result |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		result |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		result |= syscall.S_ISVTX
+	}
+	switch {
+	case mode&os.ModeDir != 0:
+		result |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		result |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		result |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		result |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		result |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		result |= syscall.S_IFBLK
+	default:
+		result |= syscall.S_IFREG
+	}
+	return result
+}
+
+func (m *SFTPFileStat) Mtime() uint64 {
+	return uint64(m.backend.Mtime)
+}
+
+func (m *SFTPFileStat) Atime() uint64 {
+	return uint64(m.backend.Atime)
+}
+
+func (m *SFTPFileStat) Ctime() uint64 {
+	return uint64(m.backend.Mtime)
+}
+
+func (m *SFTPFileStat) MtimeNsec() uint32 {
+	return 0
+}
+
+func (m *SFTPFileStat) AtimeNsec() uint32 {
+	return 0
+}
+
+func (m *SFTPFileStat) CtimeNsec() uint32 {
+	return 0
+}
+
+func (m *SFTPFileStat) Ino() uint64 {
+	return 0
+}
+
+func (m *SFTPFileStat) Nlink() uint32 {
+	return 1
+}
+
+func (m *SFTPFileStat) Rdev() uint64 {
+	return 0
+}
+
+func (m *SFTPFileStat) Blocks() uint64 {
+	return (m.backend.Size + 511) / 512
+}
+
+func (m *SFTPFileStat) Mode() uint32 {
+	return m.backend.Mode
+}
+
+func (m *SFTPFileStat) OwnerGID() uint32 {
+	return m.backend.GID
+}
+
+func (m *SFTPFileStat) OwnerUID() uint32 {
+	return m.backend.UID
+}
+
+func (m *SFTPFileStat) Size() uint64 {
+	return m.backend.Size
+}
+
+// SFTPv3 has no locking.
+type SFTPFile struct {
+	layer.NoLockFile
+	fs      *SFTPFileSystem
+	session *session
+	backend *sftpclient.File
+	lock    *sync.Mutex
+}
+
+func newSFTPFile(fs *SFTPFileSystem, session *session, f *sftpclient.File) *SFTPFile {
+	return &SFTPFile{
+		fs:      fs,
+		session: session,
+		backend: f,
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (m *SFTPFile) Read(dest []byte, position int64) (int, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.backend.Seek(position, io.SeekStart); err != nil {
+		return 0, m.fs.wrapError(m.session, err)
+	}
+
+	n, err := io.ReadFull(m.backend, dest)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err != nil {
+		log.Printf("Read(): %s\n", err)
+	}
+	return n, m.fs.wrapError(m.session, err)
+}
+
+func (m *SFTPFile) Write(data []byte, position int64) (int, layer.Error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.backend.Seek(position, io.SeekStart); err != nil {
+		return 0, m.fs.wrapError(m.session, err)
+	}
+
+	n, err := m.backend.Write(data)
+	if err != nil {
+		log.Printf("Write(): %s\n", err)
+	}
+	return n, m.fs.wrapError(m.session, err)
+}
+
+// The attribute changing operations go through the path of the file, as not
+// all versions of the client support them on handles.
+func (m *SFTPFile) Truncate(size uint64) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.fs.wrapError(m.session, m.session.client.Truncate(m.backend.Name(), int64(size)))
+}
+
+func (m *SFTPFile) Chmod(mode uint32) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.fs.wrapError(m.session, m.session.client.Chmod(m.backend.Name(), toFileMode(mode)))
+}
+
+func (m *SFTPFile) Chown(uid uint32, gid uint32) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.fs.wrapError(m.session, m.session.client.Chown(m.backend.Name(), int(uid), int(gid)))
+}
+
+func (m *SFTPFile) Utimens(atime *time.Time, mtime *time.Time) layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.fs.chtimes(m.session, m.backend.Name(), atime, mtime)
+}
+
+// SFTPv3 has no fsync; the server writes data as it receives it.
+// Flushing needs the fsync@openssh.com extension. Without it, there is no
+// way to flush and the data is left to the server, like FUSE does for file
+// systems without fsync.
+func (m *SFTPFile) Sync() layer.Error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err := m.backend.Sync()
+	if status, ok := err.(*sftpclient.StatusError); ok && status.Code == fx_OP_UNSUPPORTED {
+		return nil
+	}
+	return m.fs.wrapError(m.session, err)
+}
+
+func (m *SFTPFile) Release() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.backend.Close()
+}
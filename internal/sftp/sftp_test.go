@@ -0,0 +1,461 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	sftpclient "github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+)
+
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// An in-process SFTP server which serves the local file system.
+type testServer struct {
+	server *sftpclient.Server
+	conn   io.Closer
+}
+
+func (m *testServer) kill() {
+	m.conn.Close()
+}
+
+func startTestSession() (*session, *testServer, error) {
+	client_read, server_write := io.Pipe()
+	server_read, client_write := io.Pipe()
+
+	server, err := sftpclient.NewServer(pipeConn{server_read, server_write})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &session{
+		done: make(chan struct{}),
+	}
+	go func() {
+		server.Serve()
+		server_write.Close()
+		close(result.done)
+	}()
+
+	client, err := sftpclient.NewClientPipe(client_read, client_write)
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	result.client = client
+
+	return result, &testServer{server, server_read}, nil
+}
+
+type testConnector struct {
+	servers  []*testServer
+	failures int
+}
+
+func (m *testConnector) connect() (*session, error) {
+	if m.failures > 0 {
+		m.failures -= 1
+		return nil, errors.New("connection refused")
+	}
+	session, server, err := startTestSession()
+	if err != nil {
+		return nil, err
+	}
+	m.servers = append(m.servers, server)
+	return session, nil
+}
+
+func (m *testConnector) current() *testServer {
+	return m.servers[len(m.servers)-1]
+}
+
+func prepTempDir() string {
+	path, err := ioutil.TempDir("", "dragonstash-test")
+	if err != nil {
+		panic(fmt.Sprintf("Error: %s", err))
+	}
+	log.Printf("using temporary directory: %s", path)
+	return path
+}
+
+func teardownTempDir(path string) {
+	os.RemoveAll(path)
+}
+
+func prepFileSystem(dir string) (*SFTPFileSystem, *testConnector) {
+	connector := &testConnector{}
+	return newSFTPFileSystem(connector.connect, dir, 0), connector
+}
+
+func TestIsReadyConnects(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, connector := prepFileSystem(dir)
+	defer fs.Close()
+
+	assert.True(t, fs.IsReady())
+	assert.Equal(t, 1, len(connector.servers))
+}
+
+func TestIsReadyFalseIfConnectFails(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, connector := prepFileSystem(dir)
+	defer fs.Close()
+	connector.failures = 1
+
+	assert.False(t, fs.IsReady())
+	assert.True(t, fs.IsReady())
+}
+
+func TestIsReadyReconnectsAfterSessionLoss(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, connector := prepFileSystem(dir)
+	defer fs.Close()
+
+	assert.True(t, fs.IsReady())
+	old_session := fs.session
+
+	connector.failures = 1
+	connector.current().kill()
+	<-old_session.done
+
+	assert.False(t, fs.IsReady())
+	assert.True(t, fs.IsReady())
+	assert.Equal(t, 2, len(connector.servers))
+}
+
+func TestRetryIntervalLimitsReconnects(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	connector := &testConnector{failures: 1}
+	fs := newSFTPFileSystem(connector.connect, dir, DEFAULT_RETRY_INTERVAL)
+	defer fs.Close()
+
+	assert.False(t, fs.IsReady())
+	assert.False(t, fs.IsReady())
+	assert.Equal(t, 0, len(connector.servers))
+}
+
+func TestOperationsFailWithENOTCONNWhenOffline(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	connector := &testConnector{failures: 1}
+	fs := newSFTPFileSystem(connector.connect, dir, DEFAULT_RETRY_INTERVAL)
+	defer fs.Close()
+
+	_, err := fs.Lstat("/")
+	assert.NotNil(t, err)
+	assert.Equal(t, uintptr(syscall.ENOTCONN), err.Errno())
+}
+
+func TestErrorsMappedByTheClientKeepTheSession(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, connector := prepFileSystem(dir)
+	defer fs.Close()
+
+	assert.True(t, fs.IsReady())
+	session := fs.session
+
+	err := fs.wrapError(session, os.ErrPermission)
+	assert.Equal(t, uintptr(syscall.EACCES), err.Errno())
+	err = fs.wrapError(session, io.EOF)
+	assert.Equal(t, uintptr(syscall.ENODATA), err.Errno())
+
+	assert.True(t, session == fs.session)
+	assert.True(t, fs.IsReady())
+	assert.Equal(t, 1, len(connector.servers))
+}
+
+func TestLstat(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("foobar"), 0640)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), stat.Size())
+	assert.Equal(t, uint32(syscall.S_IFREG|0640), stat.Mode())
+	assert.Equal(t, uint32(os.Getuid()), stat.OwnerUID())
+}
+
+func TestLstatNonExistant(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	stat, err := fs.Lstat("/nonexistant")
+	assert.Nil(t, stat)
+	assert.NotNil(t, err)
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+	assert.True(t, fs.IsReady())
+}
+
+func TestLstatDoesNotEscapeRoot(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	os.Mkdir(filepath.Join(dir, "root"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "outside"), []byte{}, 0644)
+
+	fs, _ := prepFileSystem(filepath.Join(dir, "root"))
+	defer fs.Close()
+
+	_, err := fs.Lstat("/../outside")
+	assert.NotNil(t, err)
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestOpenDir(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	os.Mkdir(filepath.Join(dir, "subdir"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("foo"), 0644)
+	os.Symlink("file", filepath.Join(dir, "link"))
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	entries, err := fs.OpenDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	modes := make(map[string]uint32)
+	for _, entry := range entries {
+		modes[entry.Name()] = entry.Mode() & syscall.S_IFMT
+	}
+	assert.Equal(t, uint32(syscall.S_IFDIR), modes["subdir"])
+	assert.Equal(t, uint32(syscall.S_IFREG), modes["file"])
+	assert.Equal(t, uint32(syscall.S_IFLNK), modes["link"])
+}
+
+func TestReadlink(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	os.Symlink("../some/where", filepath.Join(dir, "link"))
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	dest, err := fs.Readlink("/link")
+	assert.Nil(t, err)
+	assert.Equal(t, "../some/where", dest)
+}
+
+func TestOpenFileAndRead(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	f, err := fs.OpenFile("/file", os.O_RDONLY)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	buf := make([]byte, 4)
+	n, err := f.Read(buf, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("3456"), buf)
+
+	n, err = f.Read(buf, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("89"), buf[:n])
+}
+
+func TestReadAfterSessionLossReturnsENOTCONN(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644)
+
+	fs, connector := prepFileSystem(dir)
+	defer fs.Close()
+
+	f, err := fs.OpenFile("/file", os.O_RDONLY)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	connector.current().kill()
+
+	buf := make([]byte, 4)
+	_, err = f.Read(buf, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, uintptr(syscall.ENOTCONN), err.Errno())
+}
+
+func TestCreateAndWrite(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	f, err := fs.Create("/file", os.O_RDWR, 0600)
+	assert.Nil(t, err)
+
+	n, err := f.Write([]byte("world"), 6)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	n, err = f.Write([]byte("hello "), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.Nil(t, f.Sync())
+	f.Release()
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "file"))
+	assert.Equal(t, []byte("hello world"), contents)
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0600), stat.Mode())
+}
+
+func TestCreateKeepsModeOfExistingFile(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644)
+	os.Chmod(filepath.Join(dir, "file"), 0644)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	f, err := fs.Create("/file", os.O_RDWR, 0600)
+	assert.Nil(t, err)
+	f.Release()
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0644), stat.Mode())
+	assert.Equal(t, uint64(10), stat.Size())
+
+	_, err = fs.Create("/file", os.O_RDWR|os.O_EXCL, 0600)
+	assert.NotNil(t, err)
+	assert.True(t, fs.IsReady())
+}
+
+func TestSpecialModeBits(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	os.Mkdir(filepath.Join(dir, "dir"), 0755)
+	os.Chmod(filepath.Join(dir, "dir"), os.ModeSticky|os.ModeSetgid|0755)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	stat, err := fs.Lstat("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|syscall.S_ISVTX|syscall.S_ISGID|0755), stat.Mode())
+
+	// the test server drops them on chmod, so only the conversion is
+	// checked
+	assert.Equal(t, os.ModeSetuid|os.ModeSetgid|os.ModeSticky|0755,
+		toFileMode(syscall.S_ISUID|syscall.S_ISGID|syscall.S_ISVTX|0755))
+}
+
+func TestDirectoryOperations(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	assert.Nil(t, fs.Mkdir("/dir", 0750))
+	stat, err := fs.Lstat("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0750), stat.Mode())
+
+	assert.Equal(t, uintptr(syscall.EISDIR), fs.Unlink("/dir").Errno())
+	assert.Nil(t, fs.Rmdir("/dir"))
+
+	_, err = fs.Lstat("/dir")
+	assert.Equal(t, uintptr(syscall.ENOENT), err.Errno())
+}
+
+func TestRenameUnlinkAndSymlink(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0644)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	assert.Nil(t, fs.Rename("/a", "/b"))
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "b"))
+	assert.Equal(t, []byte("a"), contents)
+
+	assert.Nil(t, fs.Symlink("b", "/link"))
+	dest, err := fs.Readlink("/link")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", dest)
+
+	assert.Nil(t, fs.Unlink("/b"))
+	assert.Equal(t, uintptr(syscall.ENOENT), fs.Unlink("/b").Errno())
+}
+
+func TestAttributeOperations(t *testing.T) {
+	dir := prepTempDir()
+	defer teardownTempDir(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0644)
+
+	fs, _ := prepFileSystem(dir)
+	defer fs.Close()
+
+	mtime := time.Unix(2000, 0)
+	assert.Nil(t, fs.Chmod("/file", 0600))
+	assert.Nil(t, fs.Truncate("/file", 4))
+	assert.Nil(t, fs.Utimens("/file", nil, &mtime))
+
+	stat, err := fs.Lstat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(syscall.S_IFREG|0600), stat.Mode())
+	assert.Equal(t, uint64(4), stat.Size())
+	assert.Equal(t, uint64(2000), stat.Mtime())
+
+	f, err := fs.OpenFile("/file", os.O_RDWR)
+	assert.Nil(t, err)
+	defer f.Release()
+
+	assert.Nil(t, f.Truncate(2))
+	assert.Nil(t, f.Chmod(0640))
+	stat, _ = fs.Lstat("/file")
+	assert.Equal(t, uint32(syscall.S_IFREG|0640), stat.Mode())
+	assert.Equal(t, uint64(2), stat.Size())
+}